@@ -25,12 +25,16 @@ import (
 	"github.com/spf13/cobra"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 
+	"github.com/lostromos/lostromos/schema"
 	"github.com/lostromos/lostromos/tmpl"
+	"github.com/lostromos/lostromos/tmplctlr"
 )
 
 var (
-	crFile  string
-	tmplDir string
+	crFile      string
+	tmplDir     string
+	objectsFile string
+	strict      bool
 )
 
 var checkCmd = &cobra.Command{
@@ -49,6 +53,8 @@ func init() {
 	LostromosCmd.AddCommand(checkCmd)
 	checkCmd.Flags().StringVar(&crFile, "cr", "", "absolute path to a yaml file with your CR saved in it")
 	checkCmd.Flags().StringVar(&tmplDir, "templates", "", "absolute path to the directory with your template files")
+	checkCmd.Flags().StringVar(&objectsFile, "objects", "", "absolute path to a yaml file with the cluster objects the lookup function can find")
+	checkCmd.Flags().BoolVar(&strict, "strict", false, "fail when the templates use a missing field or map key, like start does in strict mode")
 }
 
 func check(out io.Writer) error {
@@ -84,6 +90,50 @@ func check(out io.Writer) error {
 	if err != nil {
 		return err
 	}
+	lookup, err := checkLookup()
+	if err != nil {
+		return err
+	}
+	if err := checkSchema(&r); err != nil {
+		return err
+	}
 	cr := &tmpl.CustomResource{Resource: &r}
-	return tmpl.Parse(cr, filepath.Join(tmplDir, "*.tmpl"), out)
+	t, err := tmpl.ParseFiles(filepath.Join(tmplDir, "*.tmpl"))
+	if err != nil {
+		return err
+	}
+	if strict {
+		return t.ExecuteStrict(cr, out, lookup)
+	}
+	return t.Execute(cr, out, lookup)
+}
+
+// checkSchema validates the spec of the CR against the schema next to the
+// templates, if there is one
+func checkSchema(r *unstructured.Unstructured) error {
+	s, err := schema.Load(filepath.Join(tmplDir, tmplctlr.SchemaFile))
+	if err != nil || s == nil {
+		return err
+	}
+	spec, ok := r.Object["spec"]
+	if !ok {
+		spec = map[string]interface{}{}
+	}
+	return s.Validate("spec", spec)
+}
+
+// checkLookup serves the objects of the objects file to the lookup function
+// instead of reading them from a cluster.
+func checkLookup() (*tmpl.FakeLookup, error) {
+	lookup := &tmpl.FakeLookup{}
+	if objectsFile == "" {
+		return lookup, nil
+	}
+	f, err := os.Open(objectsFile)
+	if err != nil {
+		return nil, errors.New("ERROR: your objects file can't be read")
+	}
+	defer f.Close() // nolint: errcheck
+	lookup.Objects, err = tmplctlr.ParseManifest(f)
+	return lookup, err
 }
@@ -17,6 +17,9 @@ package cmd
 import (
 	"bufio"
 	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -58,3 +61,79 @@ func TestCheckCommand(t *testing.T) {
 		}
 	}
 }
+
+func TestCheckCommandServesObjectsToLookup(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lostromos")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	tmpl := `ip: {{ (lookup "v1" "Service" "ocean" "reef").spec.clusterIP }}
+missing: {{ len (lookup "v1" "Service" "ocean" "deep") }}`
+	objects := `apiVersion: v1
+kind: Service
+metadata:
+  name: reef
+  namespace: ocean
+spec:
+  clusterIP: 10.0.0.1`
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, "service.tmpl"), []byte(tmpl), 0644))
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, "objects.yml"), []byte(objects), 0644))
+
+	tmplDir = dir
+	crFile = "../test/data/cr_nemo.yml"
+	objectsFile = filepath.Join(dir, "objects.yml")
+	defer func() { objectsFile = "" }()
+	var b bytes.Buffer
+
+	err = check(&b)
+	assert.Nil(t, err)
+	assert.Equal(t, "ip: 10.0.0.1\nmissing: 0", b.String())
+}
+
+func TestCheckCommandFailsWithoutObjectsFile(t *testing.T) {
+	tmplDir = "../test/data/templates/"
+	crFile = "../test/data/cr_nemo.yml"
+	objectsFile = "/path/not/found"
+	defer func() { objectsFile = "" }()
+	var b bytes.Buffer
+
+	err := check(&b)
+	assert.NotNil(t, err)
+	assert.Equal(t, "ERROR: your objects file can't be read", err.Error())
+}
+
+func TestCheckCommandInStrictMode(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lostromos")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	tmpl := `name: {{ .GetField "spec" "nmae" }}`
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, "typo.tmpl"), []byte(tmpl), 0644))
+
+	tmplDir = dir
+	crFile = "../test/data/cr_nemo.yml"
+	var b bytes.Buffer
+	assert.Nil(t, check(&b))
+	assert.Equal(t, "name: ", b.String())
+
+	strict = true
+	defer func() { strict = false }()
+	b.Reset()
+	err = check(&b)
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "missing field spec.nmae")
+}
+
+func TestCheckCommandValidatesSchema(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lostromos")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, "name.tmpl"), []byte(`name: {{ .Name }}`), 0644))
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, "schema.json"), []byte(`{"required": ["size"]}`), 0644))
+
+	tmplDir = dir
+	crFile = "../test/data/cr_nemo.yml"
+	var b bytes.Buffer
+	err = check(&b)
+	assert.NotNil(t, err)
+	assert.Equal(t, "spec does not match the schema: spec.size: is required", err.Error())
+	assert.Empty(t, b.String())
+}
@@ -22,6 +22,7 @@ import (
 	"github.com/spf13/pflag"
 	"github.com/spf13/viper"
 	"go.uber.org/zap"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
 )
 
 var (
@@ -112,4 +113,8 @@ func setupLogging() {
 		panic(err)
 	}
 	logger = l.Sugar()
+	// Errors the kubernetes client handles itself are logged, once for all watches
+	utilruntime.ErrorHandlers = []func(error){
+		func(err error) { logger.Error(err) },
+	}
 }
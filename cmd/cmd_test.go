@@ -20,6 +20,7 @@ import (
 	"github.com/spf13/viper"
 	"github.com/stretchr/testify/assert"
 	"go.uber.org/zap"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
 )
 
 func TestSetupLogger(t *testing.T) {
@@ -32,4 +33,5 @@ func TestSetupLogger(t *testing.T) {
 	viper.Set("logging.pretty", true)
 	setupLogging()
 	assert.Equal(t, true, logger.Desugar().Core().Enabled(zap.InfoLevel), "debug logging should be false")
+	assert.Len(t, utilruntime.ErrorHandlers, 1, "kubernetes errors should only be logged once")
 }
@@ -0,0 +1,62 @@
+// Copyright 2017 the lostromos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/spf13/viper"
+	"k8s.io/helm/pkg/helm/helmpath"
+
+	"github.com/lostromos/lostromos/helmctlr"
+)
+
+// getChartRepos returns the chart repositories listed under helm.repos, which
+// all watches share. It is nil if there are none, then remote charts come from
+// the repositories already in $HELM_HOME.
+func getChartRepos() (*helmctlr.ChartRepos, error) {
+	var repos []helmctlr.ChartRepo
+	if err := viper.UnmarshalKey("helm.repos", &repos); err != nil {
+		return nil, fmt.Errorf("invalid helm repos: %s", err)
+	}
+	if len(repos) == 0 {
+		return nil, nil
+	}
+	return &helmctlr.ChartRepos{Home: helmHome(), Repos: repos}, nil
+}
+
+// helmHome returns the helm home directory of the chart repositories
+func helmHome() helmpath.Home {
+	if home := viper.GetString("helm.home"); home != "" {
+		return helmpath.Home(home)
+	}
+	if home := os.Getenv("HELM_HOME"); home != "" {
+		return helmpath.Home(home)
+	}
+	return helmpath.Home(filepath.Join(homeDir(), ".helm"))
+}
+
+// addChartRepos adds the chart repositories to the helm home and downloads
+// their indexes
+func addChartRepos() error {
+	repos, err := getChartRepos()
+	if err != nil || repos == nil {
+		return err
+	}
+	logger.Infow("adding chart repositories", "helmHome", repos.Home.String(), "repos", len(repos.Repos))
+	return repos.Add()
+}
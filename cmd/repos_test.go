@@ -0,0 +1,71 @@
+// Copyright 2017 the lostromos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"k8s.io/helm/pkg/helm/helmpath"
+
+	"github.com/lostromos/lostromos/helmctlr"
+)
+
+func TestGetChartRepos(t *testing.T) {
+	repos, err := getChartRepos()
+	assert.Nil(t, err)
+	assert.Nil(t, repos, "without repos the ones of $HELM_HOME are used")
+
+	viper.Set("helm.home", "/var/lib/lostromos/helm")
+	viper.Set("helm.repos", []map[string]interface{}{{
+		"name":         "private",
+		"url":          "https://charts.example.com",
+		"usernameFile": "/etc/charts/username",
+		"passwordFile": "/etc/charts/password",
+		"caFile":       "/etc/charts/ca.pem",
+	}})
+	defer viper.Set("helm.home", "")
+	defer viper.Set("helm.repos", nil)
+
+	repos, err = getChartRepos()
+	assert.Nil(t, err)
+	assert.Equal(t, &helmctlr.ChartRepos{
+		Home: helmpath.Home("/var/lib/lostromos/helm"),
+		Repos: []helmctlr.ChartRepo{{
+			Name:         "private",
+			URL:          "https://charts.example.com",
+			UsernameFile: "/etc/charts/username",
+			PasswordFile: "/etc/charts/password",
+			CAFile:       "/etc/charts/ca.pem",
+		}},
+	}, repos)
+}
+
+func TestAddChartReposFailsOnUnreachableRepo(t *testing.T) {
+	home, err := ioutil.TempDir("", "lostromos-helm-")
+	assert.Nil(t, err)
+	defer os.RemoveAll(home)
+	viper.Set("helm.home", home)
+	viper.Set("helm.repos", []map[string]interface{}{{"name": "private", "url": "http://127.0.0.1:1"}})
+	defer viper.Set("helm.home", "")
+	defer viper.Set("helm.repos", nil)
+
+	err = addChartRepos()
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "chart repository private")
+}
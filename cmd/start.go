@@ -15,9 +15,12 @@
 package cmd
 
 import (
-	"errors"
+	"fmt"
 	"net/http"
+	"os"
 	"path/filepath"
+	"sync"
+	"time"
 
 	homedir "github.com/mitchellh/go-homedir"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
@@ -26,12 +29,15 @@ import (
 	"go.uber.org/zap"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
 	restclient "k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
 
 	"github.com/lostromos/lostromos/crwatcher"
 	"github.com/lostromos/lostromos/helmctlr"
+	"github.com/lostromos/lostromos/leader"
 	"github.com/lostromos/lostromos/printctlr"
+	"github.com/lostromos/lostromos/reload"
 	"github.com/lostromos/lostromos/status"
 	"github.com/lostromos/lostromos/tmplctlr"
 	"github.com/lostromos/lostromos/version"
@@ -55,36 +61,100 @@ func init() {
 	startCmd.Flags().String("crd-version", "v1", "the version of the CRD you want monitored")
 	startCmd.Flags().String("crd-namespace", metav1.NamespaceNone, "(optional) the namespace of the CRD you want monitored, only needed for namespaced CRDs (ex: default)")
 	startCmd.Flags().String("crd-filter", "", "(optional) Annotation key to specify that the custom resource has opted in to watching by Lostromos")
+	startCmd.Flags().Duration("crd-resync", 0, "(optional) How often all custom resources are handed to the controller again, 0 disables resyncs")
+	startCmd.Flags().Bool("crd-finalizer", false, "(optional) Add a finalizer to every custom resource so it is cleaned up even if deleted while Lostromos is down")
 	startCmd.Flags().String("helm-chart", "", "Path for helm chart")
 	startCmd.Flags().String("helm-ns", "default", "Namespace for resources deployed by helm")
 	startCmd.Flags().String("helm-prefix", "lostromos", "Prefix for release names in helm")
+	startCmd.Flags().String("helm-namespace-mode", "fixed", "Where helm releases are installed: fixed into --helm-ns, resource into the namespace of the custom resource, annotation into the namespace named by its lostromos.io/namespace annotation")
+	startCmd.Flags().StringSlice("helm-allowed-namespaces", nil, "Namespaces the resource and annotation namespace modes may install releases into. Empty allows all namespaces in resource mode and only the namespace of the custom resource or --helm-ns in annotation mode")
+	startCmd.Flags().Bool("helm-namespaced-release-names", false, "Include the namespace of the custom resource in helm release names, like <prefix>-<namespace>-<name>")
+	startCmd.Flags().StringSlice("helm-values-files", nil, "Values files merged into the values of every helm release, later files overriding earlier ones")
+	startCmd.Flags().String("helm-values-template", "", "Template file rendering the helm values of a custom resource as YAML, instead of the resource values")
+	startCmd.Flags().String("helm-home", "", "Helm home directory where the chart repositories listed under helm.repos in the config file are added. Defaults to $HELM_HOME or ~/.helm")
+	startCmd.Flags().String("helm-backend", "tiller", "Where helm releases are installed and stored: tiller, or secrets to install without Tiller and keep releases in Secrets")
 	startCmd.Flags().String("helm-tiller", "tiller-deploy:44134", "Address for helm tiller")
+	startCmd.Flags().String("helm-tiller-namespace", "kube-system", "Namespace of the Tiller releases migrated by the secrets helm backend")
 	startCmd.Flags().Bool("helm-wait", false, "Use the helm --wait flag for creating and updating releases")
 	startCmd.Flags().Int64("helm-wait-timeout", 120, "The time in seconds to wait for kubernetes resources to be created when doing a helm install or upgrade")
+	startCmd.Flags().Bool("helm-rollback", false, "Roll a failed helm upgrade back to the last deployed revision, which waits for the resources if --helm-wait is set")
+	startCmd.Flags().Int("helm-max-history", 0, "The number of revisions the secrets helm backend keeps per release. 0 keeps all of them")
 	startCmd.Flags().String("kube-config", filepath.Join(homeDir(), ".kube", "config"), "absolute path to the kubeconfig file. Only required if running outside-of-cluster.")
+	startCmd.Flags().String("kube-client", "kubectl", "How the template controller applies resources, either \"kubectl\" or \"dynamic\" to use the kubernetes API directly")
 	startCmd.Flags().Bool("nop", false, "nop")
+	startCmd.Flags().Bool("leader-elect", false, "Run leader election so only one of several Lostromos replicas manages resources")
+	startCmd.Flags().String("leader-elect-namespace", "default", "Namespace of the ConfigMap used as leader election lock")
+	startCmd.Flags().String("leader-elect-name", "lostromos", "Name of the ConfigMap used as leader election lock")
+	startCmd.Flags().String("leader-elect-id", "", "Unique identity of this replica in the leader election (default is the hostname)")
+	startCmd.Flags().Duration("leader-elect-lease-duration", 15*time.Second, "How long standbys wait before taking over from a leader that stopped renewing")
+	startCmd.Flags().Duration("leader-elect-renew-deadline", 10*time.Second, "How long the leader keeps trying to renew its lease before it stops leading")
+	startCmd.Flags().Duration("leader-elect-retry-period", 2*time.Second, "How often replicas try to acquire or renew the lease")
+	startCmd.Flags().Int("workers", 1, "The number of custom resources that are processed in parallel")
+	startCmd.Flags().Int("max-retries", 5, "The number of times a failed event is retried before it is dropped")
+	startCmd.Flags().Duration("retry-base-delay", 5*time.Millisecond, "The delay before retrying a failed event, doubled after every failure")
+	startCmd.Flags().Duration("retry-max-delay", 5*time.Minute, "The maximum delay between retries of a failed event")
+	startCmd.Flags().Bool("drift-detection", false, "Watch the objects rendered by the templates and apply the templates again when they are changed or deleted")
+	startCmd.Flags().Bool("owner-references", false, "Make the custom resource the owner of the objects rendered by the templates, so they are garbage collected with it")
+	startCmd.Flags().Bool("prune", false, "Delete objects that are no longer rendered by the templates for a custom resource")
+	startCmd.Flags().String("prune-namespace", "default", "Namespace of the ConfigMaps that record the objects of cluster scoped custom resources")
 	startCmd.Flags().String("server-address", ":8080", "The address and port for endpoints such as /metrics and /status")
 	startCmd.Flags().String("metrics-endpoint", "/metrics", "The URI for the metrics endpoint")
 	startCmd.Flags().String("status-endpoint", "/status", "The URI for the status endpoint")
 	startCmd.Flags().String("templates", "", "absolute path to the directory with your template files")
+	startCmd.Flags().Duration("reload-interval", 10*time.Second, "How often the templates or helm chart are checked for changes, which are reloaded without a restart. 0 disables reloading")
+	startCmd.Flags().String("template-set", "", "Subdirectory of the templates directory used for custom resources without a lostromos.io/template annotation")
+	startCmd.Flags().Bool("strict", false, "Fail the reconcile of a custom resource when the templates use a missing field or map key, instead of rendering an empty value")
+	startCmd.Flags().StringSlice("strict-template-sets", nil, "Template sets executed in strict mode, if --strict is not set")
 
 	viperBindFlag("crd.name", startCmd.Flags().Lookup("crd-name"))
 	viperBindFlag("crd.group", startCmd.Flags().Lookup("crd-group"))
 	viperBindFlag("crd.version", startCmd.Flags().Lookup("crd-version"))
 	viperBindFlag("crd.namespace", startCmd.Flags().Lookup("crd-namespace"))
 	viperBindFlag("crd.filter", startCmd.Flags().Lookup("crd-filter"))
+	viperBindFlag("crd.resync", startCmd.Flags().Lookup("crd-resync"))
+	viperBindFlag("crd.finalizer", startCmd.Flags().Lookup("crd-finalizer"))
 	viperBindFlag("helm.chart", startCmd.Flags().Lookup("helm-chart"))
 	viperBindFlag("helm.namespace", startCmd.Flags().Lookup("helm-ns"))
 	viperBindFlag("helm.releasePrefix", startCmd.Flags().Lookup("helm-prefix"))
+	viperBindFlag("helm.namespaceMode", startCmd.Flags().Lookup("helm-namespace-mode"))
+	viperBindFlag("helm.allowedNamespaces", startCmd.Flags().Lookup("helm-allowed-namespaces"))
+	viperBindFlag("helm.namespacedReleaseNames", startCmd.Flags().Lookup("helm-namespaced-release-names"))
+	viperBindFlag("helm.values.files", startCmd.Flags().Lookup("helm-values-files"))
+	viperBindFlag("helm.values.template", startCmd.Flags().Lookup("helm-values-template"))
+	viperBindFlag("helm.home", startCmd.Flags().Lookup("helm-home"))
+	viperBindFlag("helm.backend", startCmd.Flags().Lookup("helm-backend"))
 	viperBindFlag("helm.tiller", startCmd.Flags().Lookup("helm-tiller"))
+	viperBindFlag("helm.tillerNamespace", startCmd.Flags().Lookup("helm-tiller-namespace"))
 	viperBindFlag("helm.wait", startCmd.Flags().Lookup("helm-wait"))
 	viperBindFlag("helm.waitTimeout", startCmd.Flags().Lookup("helm-wait-timeout"))
+	viperBindFlag("helm.rollback", startCmd.Flags().Lookup("helm-rollback"))
+	viperBindFlag("helm.maxHistory", startCmd.Flags().Lookup("helm-max-history"))
 	viperBindFlag("k8s.config", startCmd.Flags().Lookup("kube-config"))
+	viperBindFlag("k8s.client", startCmd.Flags().Lookup("kube-client"))
 	viperBindFlag("nop", startCmd.Flags().Lookup("nop"))
+	viperBindFlag("leaderElection.enabled", startCmd.Flags().Lookup("leader-elect"))
+	viperBindFlag("leaderElection.namespace", startCmd.Flags().Lookup("leader-elect-namespace"))
+	viperBindFlag("leaderElection.name", startCmd.Flags().Lookup("leader-elect-name"))
+	viperBindFlag("leaderElection.identity", startCmd.Flags().Lookup("leader-elect-id"))
+	viperBindFlag("leaderElection.leaseDuration", startCmd.Flags().Lookup("leader-elect-lease-duration"))
+	viperBindFlag("leaderElection.renewDeadline", startCmd.Flags().Lookup("leader-elect-renew-deadline"))
+	viperBindFlag("leaderElection.retryPeriod", startCmd.Flags().Lookup("leader-elect-retry-period"))
+	viperBindFlag("workers", startCmd.Flags().Lookup("workers"))
+	viperBindFlag("retry.max", startCmd.Flags().Lookup("max-retries"))
+	viperBindFlag("retry.baseDelay", startCmd.Flags().Lookup("retry-base-delay"))
+	viperBindFlag("retry.maxDelay", startCmd.Flags().Lookup("retry-max-delay"))
+	viperBindFlag("driftDetection", startCmd.Flags().Lookup("drift-detection"))
+	viperBindFlag("ownerReferences", startCmd.Flags().Lookup("owner-references"))
+	viperBindFlag("prune.enabled", startCmd.Flags().Lookup("prune"))
+	viperBindFlag("prune.namespace", startCmd.Flags().Lookup("prune-namespace"))
 	viperBindFlag("server.address", startCmd.Flags().Lookup("server-address"))
 	viperBindFlag("server.metricsEndpoint", startCmd.Flags().Lookup("metrics-endpoint"))
 	viperBindFlag("server.statusEndpoint", startCmd.Flags().Lookup("status-endpoint"))
 	viperBindFlag("templates", startCmd.Flags().Lookup("templates"))
+	viperBindFlag("templateSet", startCmd.Flags().Lookup("template-set"))
+	viperBindFlag("strict.enabled", startCmd.Flags().Lookup("strict"))
+	viperBindFlag("strict.templateSets", startCmd.Flags().Lookup("strict-template-sets"))
+	viperBindFlag("reload.interval", startCmd.Flags().Lookup("reload-interval"))
 }
 
 func homeDir() string {
@@ -110,47 +180,239 @@ func getKubeClient() (*restclient.Config, error) {
 	return clientcmd.BuildConfigFromFlags("", viper.GetString("k8s.config"))
 }
 
-func buildCRWatcher(cfg *restclient.Config) (*crwatcher.CRWatcher, error) {
+func buildCRWatcher(cfg *restclient.Config, w *watchConfig) (*crwatcher.CRWatcher, error) {
 	cwCfg := &crwatcher.Config{
-		PluralName: viper.GetString("crd.name"),
-		Group:      viper.GetString("crd.group"),
-		Version:    viper.GetString("crd.version"),
-		Namespace:  viper.GetString("crd.namespace"),
-		Filter:     viper.GetString("crd.filter"),
+		PluralName: w.CRD.Name,
+		Group:      w.CRD.Group,
+		Version:    w.CRD.Version,
+		Namespace:  w.CRD.Namespace,
+		Filter:     w.CRD.Filter,
+		Finalizer:  w.CRD.Finalizer,
+		Resync:     w.Resync,
+
+		Workers:        viper.GetInt("workers"),
+		MaxRetries:     viper.GetInt("retry.max"),
+		RetryBaseDelay: viper.GetDuration("retry.baseDelay"),
+		RetryMaxDelay:  viper.GetDuration("retry.maxDelay"),
+	}
+	ctlr, err := getController(cfg, w)
+	if err != nil {
+		return nil, err
+	}
+	l := &crLogger{logger: logger.With("watch", w.Name)}
+	// The CRWatcher points the config at its CRD, so every watch needs a copy
+	kubeCfg := *cfg
+	return crwatcher.NewCRWatcher(cwCfg, &kubeCfg, ctlr, l)
+}
+
+// buildCRWatchers builds a CRWatcher for every configured watch
+func buildCRWatchers(cfg *restclient.Config) ([]*crwatcher.CRWatcher, error) {
+	watches, err := getWatches()
+	if err != nil {
+		return nil, err
+	}
+	watchers := make([]*crwatcher.CRWatcher, 0, len(watches))
+	for _, w := range watches {
+		crw, err := buildCRWatcher(cfg, w)
+		if err != nil {
+			return nil, fmt.Errorf("watch %s: %s", w.Name, err)
+		}
+		watchers = append(watchers, crw)
+	}
+	return watchers, nil
+}
+
+// watchAll runs all CRWatchers until stopCh is closed or one of them fails
+func watchAll(watchers []*crwatcher.CRWatcher, stopCh <-chan struct{}) error {
+	watch := make([]func(<-chan struct{}) error, 0, len(watchers))
+	for _, crw := range watchers {
+		watch = append(watch, crw.Watch)
 	}
-	ctlr := getController()
-	l := &crLogger{logger: logger}
-	return crwatcher.NewCRWatcher(cwCfg, cfg, ctlr, l)
+	return runAll(watch, stopCh)
 }
 
-func getController() crwatcher.ResourceController {
+// runAll runs every function until stopCh is closed or one of them fails,
+// which stops the others. It returns the first error once all of them exited.
+func runAll(run []func(<-chan struct{}) error, stopCh <-chan struct{}) error {
+	runCh := make(chan struct{})
+	var once sync.Once
+	stop := func() { once.Do(func() { close(runCh) }) }
+	defer stop()
+	go func() {
+		select {
+		case <-stopCh:
+			stop()
+		case <-runCh:
+		}
+	}()
+
+	errCh := make(chan error, len(run))
+	for _, f := range run {
+		go func(f func(<-chan struct{}) error) {
+			err := f(runCh)
+			if err != nil {
+				stop()
+			}
+			errCh <- err
+		}(f)
+	}
+	var first error
+	for range run {
+		if err := <-errCh; err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+func buildLeaderConfig() (*leader.Config, error) {
+	id := viper.GetString("leaderElection.identity")
+	if id == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return nil, err
+		}
+		id = hostname
+	}
+	return &leader.Config{
+		Namespace:     viper.GetString("leaderElection.namespace"),
+		Name:          viper.GetString("leaderElection.name"),
+		Identity:      id,
+		LeaseDuration: viper.GetDuration("leaderElection.leaseDuration"),
+		RenewDeadline: viper.GetDuration("leaderElection.renewDeadline"),
+		RetryPeriod:   viper.GetDuration("leaderElection.retryPeriod"),
+	}, nil
+}
+
+func getController(cfg *restclient.Config, w *watchConfig) (crwatcher.ResourceController, error) {
+	logger := logger.With("watch", w.Name)
 	if viper.GetBool("nop") {
 		logger = logger.With("controller", "print")
 		logger.Info("nop specified, using the print controller")
-		return &printctlr.Controller{}
+		return &printctlr.Controller{}, nil
 	}
-	if viper.GetString("helm.chart") != "" {
+	if w.Helm.Chart != "" {
 
-		chrt := viper.GetString("helm.chart")
-		hns := viper.GetString("helm.namespace")
-		hrn := viper.GetString("helm.releasePrefix")
-		ht := viper.GetString("helm.tiller")
-		hw := viper.GetBool("helm.wait")
-		hwto := viper.GetInt64("helm.waitTimeout")
+		chrt := w.Helm.Chart
+		hns := w.Helm.Namespace
+		hrn := w.Helm.ReleasePrefix
+		ht := w.Helm.Tiller
+		hw := w.Helm.Wait
+		hwto := w.Helm.WaitTimeout
 		logger = logger.With("controller", "helm")
 		logger.Infow("using helm controller for deployment",
 			"helmChart", chrt,
 			"helmNamespace", hns,
 			"helmReleasePrefix", hrn,
+			"helmNamespaceMode", w.Helm.NamespaceMode,
+			"helmAllowedNamespaces", w.Helm.AllowedNamespaces,
+			"helmNamespacedReleaseNames", w.Helm.NamespacedReleaseNames,
+			"helmBackend", w.Helm.Backend,
 			"helmTiller", ht,
 			"helmWait", hw,
 			"helmWaitTimeout", hwto,
+			"helmRollback", w.Helm.Rollback,
+			"helmMaxHistory", w.Helm.MaxHistory,
+			"helmValuesFiles", w.Helm.Values.Files,
+			"helmValuesTemplate", w.Helm.Values.Template,
+			"helmValuesFields", len(w.Helm.Values.Fields),
 		)
-		return helmctlr.NewController(chrt, hns, hrn, ht, hw, hwto, logger)
+		ctlr := helmctlr.NewController(chrt, hns, hrn, ht, hw, hwto, logger)
+		ctlr.Reload = reloadWatcher(chrt, logger)
+		ctlr.Rollback = w.Helm.Rollback
+		ctlr.NamespaceMode = w.Helm.NamespaceMode
+		ctlr.AllowedNamespaces = w.Helm.AllowedNamespaces
+		ctlr.NamespacedReleaseNames = w.Helm.NamespacedReleaseNames
+		repos, err := getChartRepos()
+		if err != nil {
+			return nil, err
+		}
+		ctlr.ChartRepos = repos
+		if v := w.Helm.Values; len(v.Files) > 0 || v.Template != "" || len(v.Fields) > 0 {
+			values, err := helmctlr.NewValuesMapping(v.Files, v.Template, v.Fields)
+			if err != nil {
+				return nil, err
+			}
+			ctlr.Values = values
+		}
+		if w.Helm.Backend == helmBackendSecrets {
+			tillerless, err := helmctlr.NewTillerless(cfg, w.Helm.TillerNamespace, logger)
+			if err != nil {
+				return nil, err
+			}
+			tillerless.MaxHistory = w.Helm.MaxHistory
+			ctlr.Tillerless = tillerless
+		}
+		return ctlr, nil
 	}
 	logger = logger.With("controller", "template")
-	logger.Infow("using template controller for deployment", "templateDir", viper.GetString("templates"))
-	return tmplctlr.NewController(viper.GetString("templates"), viper.GetString("k8s.config"), logger)
+	logger.Infow("using template controller for deployment",
+		"templateDir", w.Templates,
+		"templateSet", w.TemplateSet,
+		"strict", w.Strict.Enabled,
+		"strictTemplateSets", w.Strict.TemplateSets,
+		"kubeClient", w.K8s.Client,
+	)
+	ctlr, err := tmplctlr.NewController(w.Templates, viper.GetString("k8s.config"), logger)
+	if err != nil {
+		return nil, err
+	}
+	ctlr.TemplateSet = w.TemplateSet
+	ctlr.Strict = w.Strict.Enabled
+	ctlr.StrictTemplateSets = w.Strict.TemplateSets
+	ctlr.Reload = reloadWatcher(w.Templates, logger)
+	ctlr.OwnerReferences = w.OwnerReferences
+	lookup, err := tmplctlr.NewDynamicLookup(cfg)
+	if err != nil {
+		return nil, err
+	}
+	ctlr.Lookup = lookup
+	if w.K8s.Client == "dynamic" {
+		client, err := tmplctlr.NewDynamicClient(cfg, kubeNamespace())
+		if err != nil {
+			return nil, err
+		}
+		ctlr.Client = client
+	}
+	if w.DriftDetection {
+		drift, err := tmplctlr.NewDriftWatcher(cfg, logger)
+		if err != nil {
+			return nil, err
+		}
+		ctlr.Drift = drift
+	}
+	if w.Prune.Enabled {
+		client, err := kubernetes.NewForConfig(cfg)
+		if err != nil {
+			return nil, err
+		}
+		ctlr.Inventory = &tmplctlr.ConfigMapInventory{
+			Client:    client,
+			Namespace: w.Prune.Namespace,
+		}
+	}
+	return ctlr, nil
+}
+
+// reloadWatcher watches path for changes, it is nil if reloading is disabled
+func reloadWatcher(path string, logger *zap.SugaredLogger) *reload.Watcher {
+	interval := viper.GetDuration("reload.interval")
+	if interval <= 0 {
+		return nil
+	}
+	return reload.NewWatcher(path, interval, logger)
+}
+
+// kubeNamespace returns the namespace of the current kubeconfig context, which
+// is where resources without a namespace end up, as they would with kubectl.
+func kubeNamespace() string {
+	rules := &clientcmd.ClientConfigLoadingRules{ExplicitPath: viper.GetString("k8s.config")}
+	kc := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(rules, &clientcmd.ConfigOverrides{})
+	ns, _, err := kc.Namespace()
+	if err != nil {
+		return metav1.NamespaceDefault
+	}
+	return ns
 }
 
 type crLogger struct {
@@ -162,14 +424,17 @@ func (c crLogger) Error(err error) {
 }
 
 func validateOptions() error {
-	if viper.GetString("crd.name") == "" {
-		return errors.New("crd-name is a required parameter")
-	}
-	if viper.GetString("crd.group") == "" {
-		return errors.New("crd-group is a required parameter")
+	watches, err := getWatches()
+	if err != nil {
+		return err
 	}
-	if viper.GetString("crd.version") == "" {
-		return errors.New("crd-version is a required parameter")
+	for _, w := range watches {
+		if err := w.validate(); err != nil {
+			if viper.IsSet("watches") {
+				return fmt.Errorf("watch %s: %s", w.Name, err)
+			}
+			return err
+		}
 	}
 	return nil
 }
@@ -185,7 +450,10 @@ func startServer() error {
 	if err != nil {
 		return err
 	}
-	crw, err := buildCRWatcher(cfg)
+	if err := addChartRepos(); err != nil {
+		return err
+	}
+	watchers, err := buildCRWatchers(cfg)
 	if err != nil {
 		return err
 	}
@@ -200,5 +468,14 @@ func startServer() error {
 		}
 	}()
 
-	return crw.Watch(wait.NeverStop)
+	if viper.GetBool("leaderElection.enabled") {
+		lcfg, err := buildLeaderConfig()
+		if err != nil {
+			return err
+		}
+		return leader.Run(lcfg, cfg, logger, func(stopCh <-chan struct{}) error {
+			return watchAll(watchers, stopCh)
+		})
+	}
+	return watchAll(watchers, wait.NeverStop)
 }
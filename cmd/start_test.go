@@ -16,8 +16,10 @@ package cmd
 
 import (
 	"fmt"
+	"os"
 	"path"
 	"testing"
+	"time"
 
 	"github.com/spf13/viper"
 	"github.com/stretchr/testify/assert"
@@ -61,9 +63,15 @@ func TestBuildCRWatcherReturnsProperlyConfiguredWatcher(t *testing.T) {
 	viper.Set("crd.namespace", crdNamespace)
 	viper.Set("crd.version", crdVersion)
 	viper.Set("crd.filter", crdFilter)
+	viper.Set("crd.finalizer", true)
+	defer viper.Set("crd.finalizer", false)
+	viper.Set("workers", 4)
+	viper.Set("retry.max", 3)
+	viper.Set("retry.baseDelay", "10ms")
+	viper.Set("templates", "../test/data/templates")
 
 	kubeCfg := &restclient.Config{}
-	crw, err := buildCRWatcher(kubeCfg)
+	crw, err := buildCRWatcher(kubeCfg, defaultWatch())
 	assert.NotNil(t, crw)
 	assert.Nil(t, err)
 	assert.Equal(t, crdGroup, crw.Config.Group)
@@ -71,6 +79,30 @@ func TestBuildCRWatcherReturnsProperlyConfiguredWatcher(t *testing.T) {
 	assert.Equal(t, crdNamespace, crw.Config.Namespace)
 	assert.Equal(t, crdVersion, crw.Config.Version)
 	assert.Equal(t, crdFilter, crw.Config.Filter)
+	assert.True(t, crw.Config.Finalizer)
+	assert.Equal(t, 4, crw.Config.Workers)
+	assert.Equal(t, 3, crw.Config.MaxRetries)
+	assert.Equal(t, 10*time.Millisecond, crw.Config.RetryBaseDelay)
+}
+
+func TestBuildLeaderConfig(t *testing.T) {
+	viper.Set("leaderElection.namespace", "lostromos")
+	viper.Set("leaderElection.name", "lostromos-lock")
+	viper.Set("leaderElection.identity", "")
+	viper.Set("leaderElection.leaseDuration", "15s")
+
+	lcfg, err := buildLeaderConfig()
+	assert.Nil(t, err)
+	hostname, _ := os.Hostname()
+	assert.Equal(t, hostname, lcfg.Identity)
+	assert.Equal(t, "lostromos", lcfg.Namespace)
+	assert.Equal(t, "lostromos-lock", lcfg.Name)
+	assert.Equal(t, 15*time.Second, lcfg.LeaseDuration)
+
+	viper.Set("leaderElection.identity", "lostromos-1")
+	lcfg, err = buildLeaderConfig()
+	assert.Nil(t, err)
+	assert.Equal(t, "lostromos-1", lcfg.Identity)
 }
 
 func TestGetControllerReturnsHelmController(t *testing.T) {
@@ -83,24 +115,109 @@ func TestGetControllerReturnsHelmController(t *testing.T) {
 	viper.Set("helm.releasePrefix", prefix)
 	viper.Set("helm.tiller", tiller)
 
-	ctlr := getController().(*helmctlr.Controller)
+	c, err := getController(nil, defaultWatch())
+	assert.Nil(t, err)
+	ctlr := c.(*helmctlr.Controller)
 
 	assert.NotNil(t, ctlr)
 	assert.Equal(t, ctlr.ChartPath, chart)
 	assert.Equal(t, ctlr.Namespace, ns)
 	assert.Equal(t, ctlr.ReleaseName, prefix)
+	assert.Equal(t, chart, ctlr.Reload.Path)
+}
+
+func TestGetControllerFailsOnInvalidTemplates(t *testing.T) {
+	viper.Set("templates", "/path/not/found")
+	viper.Set("helm.chart", "")
+
+	c, err := getController(&restclient.Config{Host: "http://127.0.0.1:8001"}, defaultWatch())
+	assert.Nil(t, c)
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "/path/not/found")
+}
+
+func TestGetControllerWithoutReload(t *testing.T) {
+	viper.Set("templates", "../test/data/templates")
+	viper.Set("helm.chart", "")
+	viper.Set("reload.interval", 0)
+	defer viper.Set("reload.interval", 10*time.Second)
+
+	c, err := getController(&restclient.Config{Host: "http://127.0.0.1:8001"}, defaultWatch())
+	assert.Nil(t, err)
+	ctlr := c.(*tmplctlr.Controller)
+
+	assert.Nil(t, ctlr.Reload)
 }
 
 func TestGetControllerReturnsTemplateController(t *testing.T) {
-	templates := "/path/templates"
+	templates := "../test/data/templates"
 	kubecfg := "/path/kubeconf"
 	viper.Set("templates", templates)
 	viper.Set("k8s.config", kubecfg)
 	viper.Set("helm.chart", "")
-
-	ctlr := getController().(*tmplctlr.Controller)
+	viper.Set("ownerReferences", true)
+	defer viper.Set("ownerReferences", false)
+	viper.Set("templateSet", "small")
+	defer viper.Set("templateSet", "")
+	viper.Set("strict.templateSets", []string{"large"})
+	defer viper.Set("strict.templateSets", nil)
+
+	c, err := getController(&restclient.Config{Host: "http://127.0.0.1:8001"}, defaultWatch())
+	assert.Nil(t, err)
+	ctlr := c.(*tmplctlr.Controller)
 
 	assert.NotNil(t, ctlr)
+	assert.IsType(t, &tmplctlr.Kubectl{}, ctlr.Client)
+	assert.IsType(t, &tmplctlr.DynamicLookup{}, ctlr.Lookup)
+	assert.True(t, ctlr.OwnerReferences)
+	assert.Equal(t, "small", ctlr.TemplateSet)
+	assert.False(t, ctlr.Strict)
+	assert.Equal(t, []string{"large"}, ctlr.StrictTemplateSets)
+	assert.Equal(t, templates, ctlr.Reload.Path)
+	assert.Equal(t, 10*time.Second, ctlr.Reload.Interval)
+}
+
+func TestGetControllerUsesDynamicClient(t *testing.T) {
+	viper.Set("templates", "../test/data/templates")
+	viper.Set("k8s.config", "")
+	viper.Set("k8s.client", "dynamic")
+	viper.Set("helm.chart", "")
+	defer viper.Set("k8s.client", "kubectl")
+
+	c, err := getController(&restclient.Config{Host: "http://127.0.0.1:8001"}, defaultWatch())
+	assert.Nil(t, err)
+	ctlr := c.(*tmplctlr.Controller)
+
+	assert.IsType(t, &tmplctlr.DynamicClient{}, ctlr.Client)
+}
+
+func TestGetControllerWithDriftDetection(t *testing.T) {
+	viper.Set("templates", "../test/data/templates")
+	viper.Set("helm.chart", "")
+	viper.Set("driftDetection", true)
+	defer viper.Set("driftDetection", false)
+
+	c, err := getController(&restclient.Config{Host: "http://127.0.0.1:8001"}, defaultWatch())
+	assert.Nil(t, err)
+	ctlr := c.(*tmplctlr.Controller)
+
+	assert.NotNil(t, ctlr.Drift)
+}
+
+func TestGetControllerWithPrune(t *testing.T) {
+	viper.Set("templates", "../test/data/templates")
+	viper.Set("helm.chart", "")
+	viper.Set("prune.enabled", true)
+	viper.Set("prune.namespace", "lostromos")
+	defer viper.Set("prune.enabled", false)
+
+	c, err := getController(&restclient.Config{Host: "http://127.0.0.1:8001"}, defaultWatch())
+	assert.Nil(t, err)
+	ctlr := c.(*tmplctlr.Controller)
+
+	inv, ok := ctlr.Inventory.(*tmplctlr.ConfigMapInventory)
+	assert.True(t, ok)
+	assert.Equal(t, "lostromos", inv.Namespace)
 }
 
 func TestValidateOptions(t *testing.T) {
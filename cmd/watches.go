@@ -0,0 +1,300 @@
+// Copyright 2017 the lostromos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/spf13/cast"
+	"github.com/spf13/viper"
+
+	"github.com/lostromos/lostromos/helmctlr"
+)
+
+// watchConfig describes a CRD to watch and the controller that manages its
+// custom resources. Watches are listed under the watches key of the config
+// file, without it a single watch is built from the crd, helm and templates
+// settings.
+type watchConfig struct {
+	Name            string        // Used in logs, defaults to the plural name of the CRD
+	CRD             crdConfig     `mapstructure:"crd"`
+	Resync          time.Duration // How often all custom resources are handed to the controller again
+	Templates       string        // Directory with the go templates, used if no helm chart is set
+	TemplateSet     string        // Subdirectory of Templates for custom resources that don't pick one
+	OwnerReferences bool          // Make the custom resource the owner of the rendered objects
+	DriftDetection  bool          // Reapply the templates when rendered objects change
+	Prune           pruneConfig
+	K8s             k8sConfig
+	Strict          strictConfig
+	Helm            helmConfig
+}
+
+// pruneConfig turns on deleting objects the templates no longer render
+type pruneConfig struct {
+	Enabled   bool
+	Namespace string // Where the inventories of cluster scoped custom resources are kept
+}
+
+// k8sConfig selects how the go template controller talks to kubernetes
+type k8sConfig struct {
+	Client string // kubectl or dynamic
+}
+
+// strictConfig selects the template sets that are executed in strict mode
+type strictConfig struct {
+	Enabled      bool     // All template sets
+	TemplateSets []string // Only these template sets
+}
+
+type crdConfig struct {
+	Name      string
+	Group     string
+	Version   string
+	Namespace string
+	Filter    string
+	Finalizer bool
+}
+
+type helmConfig struct {
+	Chart                  string
+	Namespace              string
+	ReleasePrefix          string
+	NamespaceMode          string   // fixed, resource or annotation, see helmctlr.NamespaceFixed
+	AllowedNamespaces      []string // Namespaces the resource and annotation modes may install into, see helmctlr.Controller
+	NamespacedReleaseNames bool     // Include the namespace of the custom resource in release names
+	Backend                string   // tiller or secrets
+	Tiller                 string
+	TillerNamespace        string // Where Tiller stored the releases to migrate to the secrets backend
+	Wait                   bool
+	WaitTimeout            int64
+	Rollback               bool // Roll failed upgrades back to the last deployed revision
+	MaxHistory             int  // Revisions kept per release by the secrets backend, 0 keeps all
+	Values                 helmValuesConfig
+}
+
+// helmValuesConfig maps custom resources to release values, see
+// helmctlr.ValuesMapping. Unlike other helm settings it belongs to the chart,
+// so watches don't take it from the top level settings.
+type helmValuesConfig struct {
+	Files    []string
+	Template string
+	Fields   []helmctlr.FieldRule
+}
+
+const (
+	helmBackendTiller  = "tiller"
+	helmBackendSecrets = "secrets"
+)
+
+// defaultWatch builds the watch configured by the top level settings
+func defaultWatch() *watchConfig {
+	return &watchConfig{
+		Name: viper.GetString("crd.name"),
+		CRD: crdConfig{
+			Name:      viper.GetString("crd.name"),
+			Group:     viper.GetString("crd.group"),
+			Version:   viper.GetString("crd.version"),
+			Namespace: viper.GetString("crd.namespace"),
+			Filter:    viper.GetString("crd.filter"),
+			Finalizer: viper.GetBool("crd.finalizer"),
+		},
+		Resync:          viper.GetDuration("crd.resync"),
+		Templates:       viper.GetString("templates"),
+		TemplateSet:     viper.GetString("templateSet"),
+		OwnerReferences: viper.GetBool("ownerReferences"),
+		DriftDetection:  viper.GetBool("driftDetection"),
+		Prune: pruneConfig{
+			Enabled:   viper.GetBool("prune.enabled"),
+			Namespace: viper.GetString("prune.namespace"),
+		},
+		K8s: k8sConfig{
+			Client: viper.GetString("k8s.client"),
+		},
+		Strict: strictConfig{
+			Enabled:      viper.GetBool("strict.enabled"),
+			TemplateSets: viper.GetStringSlice("strict.templateSets"),
+		},
+		Helm: helmConfig{
+			Chart:                  viper.GetString("helm.chart"),
+			Namespace:              viper.GetString("helm.namespace"),
+			ReleasePrefix:          viper.GetString("helm.releasePrefix"),
+			NamespaceMode:          viper.GetString("helm.namespaceMode"),
+			AllowedNamespaces:      viper.GetStringSlice("helm.allowedNamespaces"),
+			NamespacedReleaseNames: viper.GetBool("helm.namespacedReleaseNames"),
+			Backend:                viper.GetString("helm.backend"),
+			Tiller:                 viper.GetString("helm.tiller"),
+			TillerNamespace:        viper.GetString("helm.tillerNamespace"),
+			Wait:                   viper.GetBool("helm.wait"),
+			WaitTimeout:            viper.GetInt64("helm.waitTimeout"),
+			Rollback:               viper.GetBool("helm.rollback"),
+			MaxHistory:             viper.GetInt("helm.maxHistory"),
+			Values: helmValuesConfig{
+				Files:    viper.GetStringSlice("helm.values.files"),
+				Template: viper.GetString("helm.values.template"),
+			},
+		},
+	}
+}
+
+// getWatches returns the watches from the config file, or the default watch
+// if there are none. Settings left out of a watch are taken from the top
+// level settings.
+func getWatches() ([]*watchConfig, error) {
+	var watches []*watchConfig
+	if err := viper.UnmarshalKey("watches", &watches); err != nil {
+		return nil, fmt.Errorf("invalid watches: %s", err)
+	}
+	// the raw watches tell settings left out from ones set to false or 0
+	var raw []map[string]interface{}
+	if err := viper.UnmarshalKey("watches", &raw); err != nil {
+		return nil, fmt.Errorf("invalid watches: %s", err)
+	}
+	if len(watches) == 0 {
+		w := defaultWatch()
+		if err := viper.UnmarshalKey("helm.values.fields", &w.Helm.Values.Fields); err != nil {
+			return nil, fmt.Errorf("invalid helm values fields: %s", err)
+		}
+		return []*watchConfig{w}, nil
+	}
+	defaults := defaultWatch()
+	for i, w := range watches {
+		isSet := func(path ...string) bool { return isSetIn(raw[i], path...) }
+		if w.Name == "" {
+			w.Name = w.CRD.Name
+		}
+		if w.CRD.Version == "" {
+			w.CRD.Version = defaults.CRD.Version
+		}
+		if !isSet("crd", "finalizer") {
+			w.CRD.Finalizer = defaults.CRD.Finalizer
+		}
+		if !isSet("resync") {
+			w.Resync = defaults.Resync
+		}
+		if !isSet("ownerReferences") {
+			w.OwnerReferences = defaults.OwnerReferences
+		}
+		if !isSet("driftDetection") {
+			w.DriftDetection = defaults.DriftDetection
+		}
+		if !isSet("prune", "enabled") {
+			w.Prune.Enabled = defaults.Prune.Enabled
+		}
+		if w.Prune.Namespace == "" {
+			w.Prune.Namespace = defaults.Prune.Namespace
+		}
+		if w.K8s.Client == "" {
+			w.K8s.Client = defaults.K8s.Client
+		}
+		if w.Helm.Namespace == "" {
+			w.Helm.Namespace = defaults.Helm.Namespace
+		}
+		if w.Helm.ReleasePrefix == "" {
+			w.Helm.ReleasePrefix = defaults.Helm.ReleasePrefix
+		}
+		if w.Helm.NamespaceMode == "" {
+			w.Helm.NamespaceMode = defaults.Helm.NamespaceMode
+		}
+		if len(w.Helm.AllowedNamespaces) == 0 {
+			w.Helm.AllowedNamespaces = defaults.Helm.AllowedNamespaces
+		}
+		if !isSet("helm", "namespacedReleaseNames") {
+			w.Helm.NamespacedReleaseNames = defaults.Helm.NamespacedReleaseNames
+		}
+		if w.Helm.Backend == "" {
+			w.Helm.Backend = defaults.Helm.Backend
+		}
+		if w.Helm.Tiller == "" {
+			w.Helm.Tiller = defaults.Helm.Tiller
+		}
+		if w.Helm.TillerNamespace == "" {
+			w.Helm.TillerNamespace = defaults.Helm.TillerNamespace
+		}
+		if !isSet("helm", "wait") {
+			w.Helm.Wait = defaults.Helm.Wait
+		}
+		if !isSet("helm", "waitTimeout") {
+			w.Helm.WaitTimeout = defaults.Helm.WaitTimeout
+		}
+		if !isSet("helm", "rollback") {
+			w.Helm.Rollback = defaults.Helm.Rollback
+		}
+		if !isSet("helm", "maxHistory") {
+			w.Helm.MaxHistory = defaults.Helm.MaxHistory
+		}
+		if !isSet("strict") {
+			w.Strict = defaults.Strict
+		}
+	}
+	return watches, nil
+}
+
+// isSetIn reports whether the nested setting is present in a raw watch. Like
+// viper, it ignores the case of the keys.
+func isSetIn(raw map[string]interface{}, path ...string) bool {
+	for _, key := range path {
+		found := false
+		for k, v := range raw {
+			if strings.EqualFold(k, key) {
+				found = true
+				raw = cast.ToStringMap(v)
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// validate checks that the CRD of the watch is fully specified, that the kube
+// client, helm namespace mode and backend are known and that the backend supports waiting
+// and capping the history if they are enabled
+func (w *watchConfig) validate() error {
+	if w.CRD.Name == "" {
+		return errors.New("crd-name is a required parameter")
+	}
+	if w.CRD.Group == "" {
+		return errors.New("crd-group is a required parameter")
+	}
+	if w.CRD.Version == "" {
+		return errors.New("crd-version is a required parameter")
+	}
+	if c := w.K8s.Client; c != "" && c != "kubectl" && c != "dynamic" {
+		return errors.New("kube-client must be either kubectl or dynamic")
+	}
+	switch w.Helm.NamespaceMode {
+	case "", helmctlr.NamespaceFixed, helmctlr.NamespaceResource, helmctlr.NamespaceAnnotation:
+	default:
+		return fmt.Errorf("unknown helm-namespace-mode %q, use %s, %s or %s", w.Helm.NamespaceMode,
+			helmctlr.NamespaceFixed, helmctlr.NamespaceResource, helmctlr.NamespaceAnnotation)
+	}
+	switch w.Helm.Backend {
+	case "", helmBackendTiller, helmBackendSecrets:
+	default:
+		return fmt.Errorf("unknown helm-backend %q, use %s or %s", w.Helm.Backend, helmBackendTiller, helmBackendSecrets)
+	}
+	if w.Helm.Backend == helmBackendSecrets && w.Helm.Wait {
+		return fmt.Errorf("helm-wait is not supported by the %s helm-backend", helmBackendSecrets)
+	}
+	if w.Helm.Backend != helmBackendSecrets && w.Helm.MaxHistory > 0 {
+		return fmt.Errorf("helm-max-history is not supported by the %s helm-backend, start tiller with --history-max instead", helmBackendTiller)
+	}
+	return nil
+}
@@ -0,0 +1,401 @@
+// Copyright 2017 the lostromos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	restclient "k8s.io/client-go/rest"
+
+	"github.com/lostromos/lostromos/crwatcher"
+	"github.com/lostromos/lostromos/helmctlr"
+	"github.com/lostromos/lostromos/tmplctlr"
+)
+
+var testWatches = []map[string]interface{}{
+	{
+		"crd": map[string]interface{}{
+			"name":  "characters",
+			"group": "stable.lostromos",
+		},
+		"resync":    "10m",
+		"templates": "../test/data/templates",
+	},
+	{
+		"name": "movies",
+		"crd": map[string]interface{}{
+			"name":      "films",
+			"group":     "stable.lostromos",
+			"version":   "v2",
+			"namespace": "pixar",
+			"filter":    "lostromos",
+		},
+		"helm": map[string]interface{}{
+			"chart":         "/path/chart",
+			"releasePrefix": "movie",
+			"wait":          true,
+		},
+	},
+}
+
+func setTestWatches() func() {
+	viper.Set("watches", testWatches)
+	viper.Set("crd.version", "v1")
+	viper.Set("helm.namespace", "lostromos")
+	viper.Set("helm.releasePrefix", "lostromos")
+	viper.Set("helm.tiller", "tiller:44134")
+	viper.Set("helm.waitTimeout", 120)
+	return func() { viper.Set("watches", nil) }
+}
+
+func TestGetWatchesDefaultsToTopLevelSettings(t *testing.T) {
+	viper.Set("crd.name", "characters")
+	viper.Set("crd.group", "stable.lostromos")
+	viper.Set("crd.resync", "1m")
+	viper.Set("templates", "../test/data/templates")
+	defer viper.Set("crd.resync", 0)
+
+	watches, err := getWatches()
+	assert.Nil(t, err)
+	assert.Len(t, watches, 1)
+	assert.Equal(t, "characters", watches[0].Name)
+	assert.Equal(t, "stable.lostromos", watches[0].CRD.Group)
+	assert.Equal(t, time.Minute, watches[0].Resync)
+	assert.Equal(t, "../test/data/templates", watches[0].Templates)
+}
+
+func TestGetWatchesFromConfig(t *testing.T) {
+	defer setTestWatches()()
+
+	watches, err := getWatches()
+	assert.Nil(t, err)
+	assert.Len(t, watches, 2)
+
+	assert.Equal(t, "characters", watches[0].Name)
+	assert.Equal(t, "v1", watches[0].CRD.Version)
+	assert.Equal(t, 10*time.Minute, watches[0].Resync)
+	assert.Equal(t, "../test/data/templates", watches[0].Templates)
+	assert.Equal(t, "", watches[0].Helm.Chart)
+
+	assert.Equal(t, "movies", watches[1].Name)
+	assert.Equal(t, crdConfig{Name: "films", Group: "stable.lostromos", Version: "v2", Namespace: "pixar", Filter: "lostromos"}, watches[1].CRD)
+	h := watches[1].Helm
+	assert.Empty(t, h.AllowedNamespaces)
+	h.AllowedNamespaces = nil
+	assert.Equal(t, helmConfig{
+		Chart:           "/path/chart",
+		Namespace:       "lostromos",
+		ReleasePrefix:   "movie",
+		NamespaceMode:   "fixed",
+		Backend:         "tiller",
+		Tiller:          "tiller:44134",
+		TillerNamespace: "kube-system",
+		Wait:            true,
+		WaitTimeout:     120,
+	}, h)
+}
+
+func TestGetWatchesExplicitFalseWins(t *testing.T) {
+	for _, key := range []string{"crd.finalizer", "helm.wait", "helm.rollback", "helm.namespacedReleaseNames"} {
+		viper.Set(key, true)
+		defer viper.Set(key, false)
+	}
+	viper.Set("helm.maxHistory", 5)
+	defer viper.Set("helm.maxHistory", 0)
+	viper.Set("watches", []map[string]interface{}{
+		{"crd": map[string]interface{}{"name": "characters", "finalizer": false}, "helm": map[string]interface{}{
+			"wait": false, "rollback": false, "namespacedReleaseNames": false, "maxHistory": 0,
+		}},
+		{"crd": map[string]interface{}{"name": "films"}},
+	})
+	defer viper.Set("watches", nil)
+
+	watches, err := getWatches()
+	assert.Nil(t, err)
+	assert.Len(t, watches, 2)
+	set, inherited := watches[0], watches[1]
+	assert.False(t, set.CRD.Finalizer)
+	assert.False(t, set.Helm.Wait)
+	assert.False(t, set.Helm.Rollback)
+	assert.False(t, set.Helm.NamespacedReleaseNames)
+	assert.Equal(t, 0, set.Helm.MaxHistory)
+	assert.True(t, inherited.CRD.Finalizer)
+	assert.True(t, inherited.Helm.Wait)
+	assert.True(t, inherited.Helm.Rollback)
+	assert.True(t, inherited.Helm.NamespacedReleaseNames)
+	assert.Equal(t, 5, inherited.Helm.MaxHistory)
+}
+
+func TestGetWatchesInheritsControllerSettings(t *testing.T) {
+	for _, key := range []string{"ownerReferences", "driftDetection", "prune.enabled"} {
+		viper.Set(key, true)
+		defer viper.Set(key, false)
+	}
+	viper.Set("crd.resync", "5m")
+	defer viper.Set("crd.resync", 0)
+	viper.Set("prune.namespace", "lostromos")
+	defer viper.Set("prune.namespace", "default")
+	viper.Set("k8s.client", "dynamic")
+	defer viper.Set("k8s.client", "kubectl")
+	viper.Set("watches", []map[string]interface{}{
+		{"crd": map[string]interface{}{"name": "characters"}, "templates": "../test/data/templates", "resync": "1m", "ownerReferences": false,
+			"driftDetection": false, "prune": map[string]interface{}{"enabled": false}, "k8s": map[string]interface{}{"client": "kubectl"}},
+		{"crd": map[string]interface{}{"name": "films"}},
+	})
+	defer viper.Set("watches", nil)
+
+	watches, err := getWatches()
+	assert.Nil(t, err)
+	assert.Len(t, watches, 2)
+	set, inherited := watches[0], watches[1]
+	assert.Equal(t, time.Minute, set.Resync)
+	assert.False(t, set.OwnerReferences)
+	assert.False(t, set.DriftDetection)
+	assert.Equal(t, pruneConfig{Namespace: "lostromos"}, set.Prune)
+	assert.Equal(t, "kubectl", set.K8s.Client)
+	assert.Equal(t, 5*time.Minute, inherited.Resync)
+	assert.True(t, inherited.OwnerReferences)
+	assert.True(t, inherited.DriftDetection)
+	assert.Equal(t, pruneConfig{Enabled: true, Namespace: "lostromos"}, inherited.Prune)
+	assert.Equal(t, "dynamic", inherited.K8s.Client)
+
+	c, err := getController(&restclient.Config{Host: "http://127.0.0.1:8001"}, set)
+	assert.Nil(t, err)
+	ctlr := c.(*tmplctlr.Controller)
+	assert.False(t, ctlr.OwnerReferences)
+	assert.Nil(t, ctlr.Drift)
+	assert.Nil(t, ctlr.Inventory)
+	assert.IsType(t, &tmplctlr.Kubectl{}, ctlr.Client)
+}
+
+func TestGetWatchesStrictSettings(t *testing.T) {
+	viper.Set("watches", []map[string]interface{}{
+		{"crd": map[string]interface{}{"name": "characters"}},
+		{"crd": map[string]interface{}{"name": "films"}, "strict": map[string]interface{}{"templateSets": []string{"large"}}},
+	})
+	defer viper.Set("watches", nil)
+	viper.Set("strict.enabled", true)
+	defer viper.Set("strict.enabled", false)
+
+	watches, err := getWatches()
+	assert.Nil(t, err)
+	assert.Len(t, watches, 2)
+	assert.True(t, watches[0].Strict.Enabled)
+	assert.Empty(t, watches[0].Strict.TemplateSets)
+	assert.Equal(t, strictConfig{TemplateSets: []string{"large"}}, watches[1].Strict)
+}
+
+func TestValidateOptionsChecksEveryWatch(t *testing.T) {
+	defer setTestWatches()()
+	assert.Nil(t, validateOptions())
+
+	viper.Set("watches", []map[string]interface{}{
+		testWatches[0],
+		{"name": "broken", "crd": map[string]interface{}{"name": "films"}},
+	})
+	err := validateOptions()
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "watch broken")
+}
+
+func TestBuildCRWatchers(t *testing.T) {
+	defer setTestWatches()()
+	viper.Set("helm.chart", "")
+
+	cfg := &restclient.Config{Host: "https://localhost:8443"}
+	watchers, err := buildCRWatchers(cfg)
+	assert.Nil(t, err)
+	assert.Len(t, watchers, 2)
+	assert.Equal(t, "characters", watchers[0].Config.PluralName)
+	assert.Equal(t, 10*time.Minute, watchers[0].Config.Resync)
+	assert.Equal(t, "films", watchers[1].Config.PluralName)
+	assert.Equal(t, "pixar", watchers[1].Config.Namespace)
+	assert.Nil(t, cfg.GroupVersion, "every watch configures its own copy of the config")
+}
+
+func TestGetControllerPerWatch(t *testing.T) {
+	defer setTestWatches()()
+	watches, err := getWatches()
+	assert.Nil(t, err)
+
+	c, err := getController(&restclient.Config{Host: "http://127.0.0.1:8001"}, watches[0])
+	assert.Nil(t, err)
+	assert.IsType(t, &tmplctlr.Controller{}, c)
+
+	c, err = getController(&restclient.Config{Host: "http://127.0.0.1:8001"}, watches[1])
+	assert.Nil(t, err)
+	hc := c.(*helmctlr.Controller)
+	assert.Equal(t, "/path/chart", hc.ChartPath)
+	assert.Equal(t, "movie", hc.ReleaseName)
+	assert.True(t, hc.Wait)
+}
+
+func TestGetControllerWithSecretsBackend(t *testing.T) {
+	w := &watchConfig{Name: "movies", Helm: helmConfig{
+		Chart:           "/path/chart",
+		Backend:         helmBackendSecrets,
+		TillerNamespace: "kube-system",
+		Rollback:        true,
+		MaxHistory:      5,
+	}}
+	c, err := getController(&restclient.Config{Host: "http://127.0.0.1:8001"}, w)
+	assert.Nil(t, err)
+	hc := c.(*helmctlr.Controller)
+	assert.NotNil(t, hc.Tillerless)
+	assert.Equal(t, "kube-system", hc.Tillerless.TillerNamespace)
+	assert.Equal(t, 5, hc.Tillerless.MaxHistory)
+	assert.True(t, hc.Rollback)
+
+	w.Helm.Backend = helmBackendTiller
+	c, err = getController(&restclient.Config{Host: "http://127.0.0.1:8001"}, w)
+	assert.Nil(t, err)
+	assert.Nil(t, c.(*helmctlr.Controller).Tillerless)
+}
+
+func TestValidateHelmBackend(t *testing.T) {
+	w := &watchConfig{CRD: crdConfig{Name: "films", Group: "stable.lostromos", Version: "v1"}}
+	assert.Nil(t, w.validate())
+	w.Helm.Backend = helmBackendSecrets
+	assert.Nil(t, w.validate())
+	w.Helm.Backend = "helm3"
+	err := w.validate()
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "unknown helm-backend")
+}
+
+func TestValidateKubeClient(t *testing.T) {
+	w := &watchConfig{CRD: crdConfig{Name: "films", Group: "stable.lostromos", Version: "v1"}}
+	for _, client := range []string{"", "kubectl", "dynamic"} {
+		w.K8s.Client = client
+		assert.Nil(t, w.validate(), client)
+	}
+	w.K8s.Client = "curl"
+	err := w.validate()
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "kube-client")
+}
+
+func TestValidateRejectsWaitWithSecretsBackend(t *testing.T) {
+	w := &watchConfig{CRD: crdConfig{Name: "films", Group: "stable.lostromos", Version: "v1"}}
+	w.Helm.Wait = true
+	assert.Nil(t, w.validate())
+	w.Helm.Backend = helmBackendSecrets
+	err := w.validate()
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "helm-wait is not supported")
+}
+
+func TestValidateRejectsMaxHistoryWithTillerBackend(t *testing.T) {
+	w := &watchConfig{CRD: crdConfig{Name: "films", Group: "stable.lostromos", Version: "v1"}}
+	w.Helm.MaxHistory = 5
+	w.Helm.Backend = helmBackendSecrets
+	assert.Nil(t, w.validate())
+	for _, backend := range []string{"", helmBackendTiller} {
+		w.Helm.Backend = backend
+		err := w.validate()
+		assert.NotNil(t, err, backend)
+		assert.Contains(t, err.Error(), "helm-max-history is not supported", backend)
+	}
+}
+
+func TestValidateHelmNamespaceMode(t *testing.T) {
+	w := &watchConfig{CRD: crdConfig{Name: "films", Group: "stable.lostromos", Version: "v1"}}
+	w.Helm.NamespaceMode = helmctlr.NamespaceAnnotation
+	assert.Nil(t, w.validate())
+	w.Helm.NamespaceMode = "cluster"
+	err := w.validate()
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "unknown helm-namespace-mode")
+}
+
+func TestGetControllerWithNamespaceMode(t *testing.T) {
+	w := &watchConfig{Name: "movies", Helm: helmConfig{
+		Chart:                  "/path/chart",
+		NamespaceMode:          helmctlr.NamespaceResource,
+		AllowedNamespaces:      []string{"pixar"},
+		NamespacedReleaseNames: true,
+	}}
+	c, err := getController(&restclient.Config{Host: "http://127.0.0.1:8001"}, w)
+	assert.Nil(t, err)
+	hc := c.(*helmctlr.Controller)
+	assert.Equal(t, helmctlr.NamespaceResource, hc.NamespaceMode)
+	assert.Equal(t, []string{"pixar"}, hc.AllowedNamespaces)
+	assert.True(t, hc.NamespacedReleaseNames)
+}
+
+func TestWatchAllReturnsFirstError(t *testing.T) {
+	// Watchers that were not built return an error right away
+	watchers := []*crwatcher.CRWatcher{{}, {}}
+	err := watchAll(watchers, make(chan struct{}))
+	assert.NotNil(t, err)
+}
+
+func TestRunAllStopsTheOthersOnFailure(t *testing.T) {
+	var stopped int32
+	wait := func(stopCh <-chan struct{}) error {
+		<-stopCh
+		time.Sleep(10 * time.Millisecond)
+		atomic.AddInt32(&stopped, 1)
+		return nil
+	}
+	fail := func(stopCh <-chan struct{}) error { return errors.New("watch failed") }
+
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	err := runAll([]func(<-chan struct{}) error{wait, fail, wait}, stopCh)
+	assert.NotNil(t, err)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&stopped), "runAll returned before every function exited")
+}
+
+func TestRunAllStopsWithStopChannel(t *testing.T) {
+	stopCh := make(chan struct{})
+	close(stopCh)
+	wait := func(stopCh <-chan struct{}) error { <-stopCh; return nil }
+	assert.Nil(t, runAll([]func(<-chan struct{}) error{wait, wait}, stopCh))
+}
+
+func TestWatchAllWithoutWatchers(t *testing.T) {
+	assert.Nil(t, watchAll(nil, make(chan struct{})))
+}
+
+func TestGetWatchesDefaultValuesFields(t *testing.T) {
+	viper.Set("helm.values.fields", []map[string]interface{}{{"value": "image.tag", "field": "spec.version"}})
+	defer viper.Set("helm.values.fields", nil)
+
+	watches, err := getWatches()
+	assert.Nil(t, err)
+	assert.Equal(t, []helmctlr.FieldRule{{Value: "image.tag", Field: "spec.version"}}, watches[0].Helm.Values.Fields)
+}
+
+func TestGetControllerWithValuesMapping(t *testing.T) {
+	w := &watchConfig{Name: "movies", Helm: helmConfig{Chart: "/path/chart"}}
+	c, err := getController(&restclient.Config{Host: "http://127.0.0.1:8001"}, w)
+	assert.Nil(t, err)
+	assert.Nil(t, c.(*helmctlr.Controller).Values)
+
+	w.Helm.Values = helmValuesConfig{Files: []string{"../test/data/helm/values/base.yaml"}}
+	c, err = getController(&restclient.Config{Host: "http://127.0.0.1:8001"}, w)
+	assert.Nil(t, err)
+	assert.NotNil(t, c.(*helmctlr.Controller).Values)
+
+	w.Helm.Values.Template = "../test/data/helm/values/missing.tmpl"
+	_, err = getController(&restclient.Config{Host: "http://127.0.0.1:8001"}, w)
+	assert.NotNil(t, err)
+}
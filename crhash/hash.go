@@ -0,0 +1,95 @@
+// Copyright 2017 the lostromos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package crhash remembers a hash of what was last applied successfully for
+// each custom resource, so controllers can skip reconciles that would not
+// change anything.
+package crhash
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"sync"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+// Sum returns the hex encoded sha256 hash of the parts
+func Sum(parts ...[]byte) string {
+	h := sha256.New()
+	for _, p := range parts {
+		// Length prefix each part so different splits of the same bytes differ
+		_, _ = h.Write([]byte{byte(len(p) >> 24), byte(len(p) >> 16), byte(len(p) >> 8), byte(len(p))})
+		_, _ = h.Write(p)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Key returns the namespace/name key of the custom resource
+func Key(r *unstructured.Unstructured) string {
+	if r.GetNamespace() == "" {
+		return r.GetName()
+	}
+	return r.GetNamespace() + "/" + r.GetName()
+}
+
+// IsResync returns true if an update hands over the same version of the custom
+// resource, as the informer does every resync period. Resyncs are applied even
+// if the hash didn't change, so objects changed by hand are set right again.
+func IsResync(oldR, newR *unstructured.Unstructured) bool {
+	return oldR.GetResourceVersion() == newR.GetResourceVersion()
+}
+
+// Store holds the hash of the last successful apply of every custom resource.
+// It is safe for concurrent use, a nil Store never reports a hash unchanged.
+type Store struct {
+	mu     sync.Mutex
+	hashes map[string]string
+}
+
+// NewStore builds an empty Store
+func NewStore() *Store {
+	return &Store{hashes: map[string]string{}}
+}
+
+// Unchanged returns true if sum is the hash of the last successful apply
+func (s *Store) Unchanged(key, sum string) bool {
+	if s == nil {
+		return false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	last, ok := s.hashes[key]
+	return ok && last == sum
+}
+
+// Set records sum as the hash of a successful apply
+func (s *Store) Set(key, sum string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.hashes[key] = sum
+}
+
+// Forget removes the hash, so the next reconcile is applied
+func (s *Store) Forget(key string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.hashes, key)
+}
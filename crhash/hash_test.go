@@ -0,0 +1,68 @@
+// Copyright 2017 the lostromos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package crhash_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+
+	"github.com/lostromos/lostromos/crhash"
+)
+
+func TestSum(t *testing.T) {
+	assert.Equal(t, crhash.Sum([]byte("nemo")), crhash.Sum([]byte("nemo")))
+	assert.NotEqual(t, crhash.Sum([]byte("nemo")), crhash.Sum([]byte("dory")))
+	assert.NotEqual(t, crhash.Sum([]byte("ne"), []byte("mo")), crhash.Sum([]byte("n"), []byte("emo")))
+	assert.Len(t, crhash.Sum(), 64)
+}
+
+func TestKey(t *testing.T) {
+	r := &unstructured.Unstructured{}
+	r.SetName("nemo")
+	assert.Equal(t, "nemo", crhash.Key(r))
+	r.SetNamespace("ocean")
+	assert.Equal(t, "ocean/nemo", crhash.Key(r))
+}
+
+func TestIsResync(t *testing.T) {
+	oldR, newR := &unstructured.Unstructured{}, &unstructured.Unstructured{}
+	oldR.SetResourceVersion("1")
+	newR.SetResourceVersion("1")
+	assert.True(t, crhash.IsResync(oldR, newR))
+	newR.SetResourceVersion("2")
+	assert.False(t, crhash.IsResync(oldR, newR))
+}
+
+func TestStore(t *testing.T) {
+	s := crhash.NewStore()
+	assert.False(t, s.Unchanged("nemo", "a"))
+
+	s.Set("nemo", "a")
+	assert.True(t, s.Unchanged("nemo", "a"))
+	assert.False(t, s.Unchanged("nemo", "b"))
+	assert.False(t, s.Unchanged("dory", "a"))
+
+	s.Forget("nemo")
+	assert.False(t, s.Unchanged("nemo", "a"))
+}
+
+func TestNilStore(t *testing.T) {
+	var s *crhash.Store
+	s.Set("nemo", "a")
+	assert.False(t, s.Unchanged("nemo", "a"))
+	s.Forget("nemo")
+}
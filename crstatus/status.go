@@ -0,0 +1,122 @@
+// Copyright 2017 the lostromos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package crstatus
+
+import (
+	"time"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+
+	"github.com/lostromos/lostromos/schema"
+)
+
+const (
+	// PhaseApplied is the phase of a custom resource that was reconciled successfully
+	PhaseApplied = "Applied"
+	// PhaseFailed is the phase of a custom resource that failed to reconcile
+	PhaseFailed = "Failed"
+)
+
+// Status is the result of a reconcile that is written back to the status of
+// the custom resource.
+type Status struct {
+	Phase             string    // PhaseApplied or PhaseFailed
+	Generation        int64     // generation of the custom resource that was reconciled
+	Message           string    // error message of a failed reconcile
+	Violations        []string  // how the spec does not match the schema, if that failed the reconcile
+	LastReconcileTime time.Time // time of the reconcile
+	Release           *Release  // helm release of the custom resource, if any
+}
+
+// Release describes the helm release managed for a custom resource
+type Release struct {
+	Name      string
+	Namespace string
+	Revision  int32
+	Status    string
+}
+
+// Writer writes a Status to a custom resource
+type Writer interface {
+	WriteStatus(r *unstructured.Unstructured, s *Status) error
+}
+
+// Reporter is implemented by controllers that report the result of each
+// reconcile on the custom resource. The CRWatcher hands them a Writer.
+type Reporter interface {
+	SetStatusWriter(w Writer)
+}
+
+// NopWriter is a Writer that discards every Status
+type NopWriter struct{}
+
+// WriteStatus does nothing
+func (NopWriter) WriteStatus(r *unstructured.Unstructured, s *Status) error {
+	return nil
+}
+
+// New builds the Status for a reconcile of the given custom resource that
+// ended with err.
+func New(r *unstructured.Unstructured, err error) *Status {
+	s := &Status{
+		Phase:             PhaseApplied,
+		Generation:        r.GetGeneration(),
+		LastReconcileTime: time.Now().UTC(),
+	}
+	if err != nil {
+		s.Phase = PhaseFailed
+		s.Message = err.Error()
+		if verr, ok := err.(*schema.ValidationError); ok {
+			s.Violations = verr.Violations
+		}
+	}
+	return s
+}
+
+// Fields returns the status as the unstructured content of the .status field.
+// The last applied generation and time are only set by successful reconciles,
+// so when used in a merge patch a failure keeps the values of the last success.
+func (s *Status) Fields() map[string]interface{} {
+	reconciled := s.LastReconcileTime.Format(time.RFC3339)
+	fields := map[string]interface{}{
+		"phase":             s.Phase,
+		"lastReconcileTime": reconciled,
+	}
+	fields["violations"] = nil
+	if len(s.Violations) > 0 {
+		// Unstructured content only holds untyped lists
+		violations := make([]interface{}, len(s.Violations))
+		for i, v := range s.Violations {
+			violations[i] = v
+		}
+		fields["violations"] = violations
+	}
+	if s.Phase == PhaseFailed {
+		fields["message"] = s.Message
+	} else {
+		fields["message"] = nil
+		fields["lastAppliedGeneration"] = s.Generation
+		fields["lastAppliedTime"] = reconciled
+	}
+	if s.Release != nil {
+		fields["release"] = map[string]interface{}{
+			"name":      s.Release.Name,
+			"namespace": s.Release.Namespace,
+			"revision":  s.Release.Revision,
+			"status":    s.Release.Status,
+		}
+	}
+	return fields
+}
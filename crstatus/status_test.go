@@ -0,0 +1,100 @@
+// Copyright 2017 the lostromos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package crstatus_test
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+
+	"github.com/lostromos/lostromos/crstatus"
+	"github.com/lostromos/lostromos/schema"
+)
+
+var testResource = &unstructured.Unstructured{
+	Object: map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"name":       "dory",
+			"generation": int64(3),
+		},
+	},
+}
+
+func TestNewApplied(t *testing.T) {
+	s := crstatus.New(testResource, nil)
+	assert.Equal(t, crstatus.PhaseApplied, s.Phase)
+	assert.Equal(t, int64(3), s.Generation)
+	assert.Empty(t, s.Message)
+	assert.False(t, s.LastReconcileTime.IsZero())
+}
+
+func TestNewFailed(t *testing.T) {
+	s := crstatus.New(testResource, errors.New("apply failed"))
+	assert.Equal(t, crstatus.PhaseFailed, s.Phase)
+	assert.Equal(t, "apply failed", s.Message)
+}
+
+func TestFieldsApplied(t *testing.T) {
+	ts := time.Date(2018, 1, 2, 3, 4, 5, 0, time.UTC)
+	s := &crstatus.Status{
+		Phase:             crstatus.PhaseApplied,
+		Generation:        3,
+		LastReconcileTime: ts,
+		Release:           &crstatus.Release{Name: "lostromos-dory", Namespace: "pixar", Revision: 2, Status: "DEPLOYED"},
+	}
+	assert.Equal(t, map[string]interface{}{
+		"phase":                 "Applied",
+		"message":               nil,
+		"violations":            nil,
+		"lastAppliedGeneration": int64(3),
+		"lastAppliedTime":       "2018-01-02T03:04:05Z",
+		"lastReconcileTime":     "2018-01-02T03:04:05Z",
+		"release": map[string]interface{}{
+			"name":      "lostromos-dory",
+			"namespace": "pixar",
+			"revision":  int32(2),
+			"status":    "DEPLOYED",
+		},
+	}, s.Fields())
+}
+
+// A failed reconcile must not touch the last applied fields of a previous success
+func TestFieldsFailed(t *testing.T) {
+	ts := time.Date(2018, 1, 2, 3, 4, 5, 0, time.UTC)
+	s := &crstatus.Status{
+		Phase:             crstatus.PhaseFailed,
+		Generation:        3,
+		Message:           "apply failed",
+		LastReconcileTime: ts,
+	}
+	assert.Equal(t, map[string]interface{}{
+		"phase":             "Failed",
+		"message":           "apply failed",
+		"violations":        nil,
+		"lastReconcileTime": "2018-01-02T03:04:05Z",
+	}, s.Fields())
+}
+
+func TestNewFailedValidation(t *testing.T) {
+	err := &schema.ValidationError{Name: "spec", Violations: []string{"spec.size: is required"}}
+	s := crstatus.New(testResource, err)
+	assert.Equal(t, crstatus.PhaseFailed, s.Phase)
+	assert.Equal(t, err.Error(), s.Message)
+	assert.Equal(t, []string{"spec.size: is required"}, s.Violations)
+	assert.Equal(t, []interface{}{"spec.size: is required"}, s.Fields()["violations"])
+}
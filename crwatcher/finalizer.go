@@ -0,0 +1,82 @@
+// Copyright 2017 the lostromos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package crwatcher
+
+import (
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+// Finalizer is added to every custom resource when Config.Finalizer is set. It
+// keeps kubernetes from removing a deleted resource until Lostromos has cleaned
+// up after it.
+const Finalizer = "lostromos.io/cleanup"
+
+func hasFinalizer(r *unstructured.Unstructured) bool {
+	for _, f := range r.GetFinalizers() {
+		if f == Finalizer {
+			return true
+		}
+	}
+	return false
+}
+
+func isDeleting(r *unstructured.Unstructured) bool {
+	return r.GetDeletionTimestamp() != nil
+}
+
+func (cw *CRWatcher) addFinalizer(r *unstructured.Unstructured) error {
+	c := r.DeepCopy()
+	c.SetFinalizers(append(c.GetFinalizers(), Finalizer))
+	_, err := cw.resourceFor(c.GetNamespace()).Update(c)
+	return err
+}
+
+func (cw *CRWatcher) removeFinalizer(r *unstructured.Unstructured) error {
+	c := r.DeepCopy()
+	finalizers := []string{}
+	for _, f := range c.GetFinalizers() {
+		if f != Finalizer {
+			finalizers = append(finalizers, f)
+		}
+	}
+	c.SetFinalizers(finalizers)
+	_, err := cw.resourceFor(c.GetNamespace()).Update(c)
+	return err
+}
+
+// finalize hands a resource that is being deleted, or no longer passes
+// filtering, to ResourceDeleted and removes the finalizer once that succeeded.
+// If only removing the finalizer fails, the retry won't delete again.
+func (cw *CRWatcher) finalize(key string, r, last *unstructured.Unstructured) error {
+	cw.mu.Lock()
+	done := cw.finalized[key]
+	cw.mu.Unlock()
+
+	if !done {
+		final := r
+		if !isDeleting(r) && last != nil {
+			// Like a filtered update, the controller gets the last state that passed filtering
+			final = last
+		}
+		if err := cw.rc.ResourceDeleted(final); err != nil {
+			return err
+		}
+		cw.mu.Lock()
+		cw.finalized[key] = true
+		delete(cw.synced, key)
+		cw.mu.Unlock()
+	}
+	return cw.removeFinalizer(r)
+}
@@ -0,0 +1,170 @@
+// Copyright 2017 the lostromos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package crwatcher
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/client-go/dynamic"
+)
+
+// fakeResource records the updates made to custom resources. Calls to any other
+// method of the interface will panic.
+type fakeResource struct {
+	dynamic.ResourceInterface
+	updated []*unstructured.Unstructured
+	err     error
+}
+
+func (f *fakeResource) Update(obj *unstructured.Unstructured) (*unstructured.Unstructured, error) {
+	f.updated = append(f.updated, obj)
+	return obj, f.err
+}
+
+func newFinalizerTestWatcher(rc ResourceController) (*CRWatcher, *fakeResource) {
+	fr := &fakeResource{}
+	cw := newTestWatcher(&Config{Finalizer: true}, rc)
+	cw.resourceFor = func(namespace string) dynamic.ResourceInterface {
+		return fr
+	}
+	return cw, fr
+}
+
+func deleting(r *unstructured.Unstructured) *unstructured.Unstructured {
+	c := r.DeepCopy()
+	now := metav1.Now()
+	c.SetDeletionTimestamp(&now)
+	return c
+}
+
+func withFinalizer(r *unstructured.Unstructured) *unstructured.Unstructured {
+	c := r.DeepCopy()
+	c.SetFinalizers([]string{"other", Finalizer})
+	return c
+}
+
+func TestFinalizerIsAddedBeforeTheResourceIsHandled(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	mockRC := NewMockResourceController(mockCtrl)
+	cw, fr := newFinalizerTestWatcher(mockRC)
+	r := testResource("Thing1", nil, "a")
+	rFinalizer := withFinalizer(r)
+
+	mockRC.EXPECT().ResourceAdded(rFinalizer)
+
+	addResource(cw, r)
+	processQueue(cw)
+	assert.Len(t, fr.updated, 1)
+	assert.True(t, hasFinalizer(fr.updated[0]))
+
+	updateResource(cw, r, rFinalizer)
+	processQueue(cw)
+	assert.Len(t, fr.updated, 1)
+}
+
+func TestFinalizerCleansUpDeletedResource(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	mockRC := NewMockResourceController(mockCtrl)
+	cw, fr := newFinalizerTestWatcher(mockRC)
+	r := withFinalizer(testResource("Thing1", nil, "a"))
+	rDeleting := deleting(r)
+
+	gomock.InOrder(
+		mockRC.EXPECT().ResourceAdded(r),
+		mockRC.EXPECT().ResourceDeleted(rDeleting),
+	)
+
+	addResource(cw, r)
+	processQueue(cw)
+	updateResource(cw, r, rDeleting)
+	processQueue(cw)
+
+	assert.Len(t, fr.updated, 1)
+	assert.Equal(t, []string{"other"}, fr.updated[0].GetFinalizers())
+	assert.Empty(t, cw.synced)
+
+	// The delete that follows the removal of the finalizer must not clean up again
+	deleteResource(cw, rDeleting)
+	assert.Equal(t, 0, cw.queue.Len())
+	assert.Empty(t, cw.finalized)
+}
+
+func TestFinalizerIsKeptWhenDeleteFails(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	mockRC := NewMockResourceController(mockCtrl)
+	cw, fr := newFinalizerTestWatcher(mockRC)
+	r := deleting(withFinalizer(testResource("Thing1", nil, "a")))
+
+	mockRC.EXPECT().ResourceDeleted(r).Return(errors.New("delete failed"))
+
+	_ = cw.store.Add(r)
+	assert.NotNil(t, cw.sync("Thing1"))
+	assert.Empty(t, fr.updated)
+}
+
+// If the finalizer can't be removed the retry must not call ResourceDeleted again.
+func TestFinalizerRemovalIsRetriedWithoutDeletingAgain(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	mockRC := NewMockResourceController(mockCtrl)
+	cw, fr := newFinalizerTestWatcher(mockRC)
+	r := deleting(withFinalizer(testResource("Thing1", nil, "a")))
+	fr.err = errors.New("conflict")
+
+	mockRC.EXPECT().ResourceDeleted(r).Times(1)
+
+	_ = cw.store.Add(r)
+	assert.NotNil(t, cw.sync("Thing1"))
+	fr.err = nil
+	assert.Nil(t, cw.sync("Thing1"))
+	assert.Len(t, fr.updated, 2)
+}
+
+// A resource that no longer passes filtering is cleaned up with the last state that passed filtering.
+func TestFinalizerCleansUpFilteredResource(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	mockRC := NewMockResourceController(mockCtrl)
+	cw, fr := newFinalizerTestWatcher(mockRC)
+	cw.Config.Filter = "io.nicolerenee.lostromos.filter"
+	rFiltered := withFinalizer(testResource("Thing1", testFilter, "a"))
+	r := withFinalizer(testResource("Thing1", nil, "a"))
+
+	gomock.InOrder(
+		mockRC.EXPECT().ResourceAdded(rFiltered),
+		mockRC.EXPECT().ResourceDeleted(rFiltered),
+	)
+
+	addResource(cw, rFiltered)
+	processQueue(cw)
+	updateResource(cw, rFiltered, r)
+	processQueue(cw)
+
+	assert.Len(t, fr.updated, 1)
+	assert.False(t, hasFinalizer(fr.updated[0]))
+}
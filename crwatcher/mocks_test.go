@@ -34,8 +34,10 @@ func (_m *MockResourceController) EXPECT() *MockResourceControllerMockRecorder {
 }
 
 // ResourceAdded mocks base method
-func (_m *MockResourceController) ResourceAdded(resource *unstructured.Unstructured) {
-	_m.ctrl.Call(_m, "ResourceAdded", resource)
+func (_m *MockResourceController) ResourceAdded(resource *unstructured.Unstructured) error {
+	ret := _m.ctrl.Call(_m, "ResourceAdded", resource)
+	ret0, _ := ret[0].(error)
+	return ret0
 }
 
 // ResourceAdded indicates an expected call of ResourceAdded
@@ -44,8 +46,10 @@ func (_mr *MockResourceControllerMockRecorder) ResourceAdded(arg0 interface{}) *
 }
 
 // ResourceUpdated mocks base method
-func (_m *MockResourceController) ResourceUpdated(oldResource *unstructured.Unstructured, newResource *unstructured.Unstructured) {
-	_m.ctrl.Call(_m, "ResourceUpdated", oldResource, newResource)
+func (_m *MockResourceController) ResourceUpdated(oldResource *unstructured.Unstructured, newResource *unstructured.Unstructured) error {
+	ret := _m.ctrl.Call(_m, "ResourceUpdated", oldResource, newResource)
+	ret0, _ := ret[0].(error)
+	return ret0
 }
 
 // ResourceUpdated indicates an expected call of ResourceUpdated
@@ -54,8 +58,10 @@ func (_mr *MockResourceControllerMockRecorder) ResourceUpdated(arg0, arg1 interf
 }
 
 // ResourceDeleted mocks base method
-func (_m *MockResourceController) ResourceDeleted(resource *unstructured.Unstructured) {
-	_m.ctrl.Call(_m, "ResourceDeleted", resource)
+func (_m *MockResourceController) ResourceDeleted(resource *unstructured.Unstructured) error {
+	ret := _m.ctrl.Call(_m, "ResourceDeleted", resource)
+	ret0, _ := ret[0].(error)
+	return ret0
 }
 
 // ResourceDeleted indicates an expected call of ResourceDeleted
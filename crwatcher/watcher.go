@@ -15,18 +15,34 @@
 package crwatcher
 
 import (
+	"encoding/json"
 	"errors"
+	"fmt"
+	"reflect"
+	"sync"
 	"time"
 
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/apimachinery/pkg/watch"
 	"k8s.io/client-go/dynamic"
 	restclient "k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/workqueue"
+
+	"github.com/lostromos/lostromos/crstatus"
+	"github.com/lostromos/lostromos/metrics"
+)
+
+const (
+	defaultRetryBaseDelay = 5 * time.Millisecond
+	defaultRetryMaxDelay  = 5 * time.Minute
 )
 
 // Config provides config for a CRD Watcher
@@ -37,22 +53,41 @@ type Config struct {
 	PluralName string        // plural name of the CRD
 	Filter     string        // Optional disregard resources that don't have an annotation key matching this filter
 	Resync     time.Duration // How often existing CRs should be resynced (marked as updated)
+	Finalizer  bool          // Optional add a finalizer to every CR so deletes are handled even if they happen while we are down
+
+	Workers        int           // Number of CRs reconciled in parallel, defaults to 1
+	MaxRetries     int           // How many times a failed event is retried before it is dropped
+	RetryBaseDelay time.Duration // Delay before the first retry of a failed event, doubled on every failure
+	RetryMaxDelay  time.Duration // Upper bound for the delay between retries of a failed event
 }
 
 // CRWatcher thing that watches
 type CRWatcher struct {
-	Config     *Config
-	resource   dynamic.ResourceInterface
-	handler    cache.ResourceEventHandlerFuncs
-	store      cache.Store
-	controller cache.Controller
-	logger     ErrorLogger
+	Config      *Config
+	resource    dynamic.ResourceInterface
+	resourceFor func(namespace string) dynamic.ResourceInterface
+	patchStatus func(namespace, name string, patch []byte) error
+	handler     cache.ResourceEventHandlerFuncs
+	store       cache.Store
+	controller  cache.Controller
+	queue       workqueue.RateLimitingInterface
+	rc          ResourceController
+	logger      ErrorLogger
+
+	mu         sync.Mutex
+	synced     map[string]*unstructured.Unstructured // last state of each CR successfully handed to the controller
+	tombstones map[string]*unstructured.Unstructured // final state of deleted CRs that have not been processed yet
+	finalized  map[string]bool                       // CRs already cleaned up by the finalizer
 }
 
 // ResourceController exposes the functionality of a controller that
 // will handle callbacks for events that happen to the Custom Resource being
-// monitored. The events are informational only, so you can't return an
-// error.
+// monitored. Events are delivered from a work queue keyed by namespace/name, so
+// bursts of events for the same resource are collapsed into a single call
+// carrying the latest state. If a callback returns an error the resource is
+// requeued with an exponential backoff until Config.MaxRetries is reached.
+// Up to Config.Workers different resources are handled concurrently, but
+// callbacks for the same resource are never made concurrently or out of order.
 //  * ResourceAdded is called when an object is added.
 //  * ResourceUpdated is called when an object is modified. Note that
 //      oldResource is the last known state of the object-- it is possible that
@@ -61,13 +96,30 @@ type CRWatcher struct {
 //      happens, and it will get called even if nothing changed. This is useful
 //      for periodically evaluating or syncing something.
 //  * ResourceDeleted will get the final state of the item if it is known,
-//      otherwise it will get an object of type DeletedFinalStateUnknown. This
-//      can happen if the watch is closed and misses the delete event and we
-//      don't notice the deletion until the subsequent re-list.
+//      otherwise it will get the last state that was handed to the controller.
+//      This can happen if the watch is closed and misses the delete event and
+//      we don't notice the deletion until the subsequent re-list.
 type ResourceController interface {
-	ResourceAdded(resource *unstructured.Unstructured)
-	ResourceUpdated(oldResource, newResource *unstructured.Unstructured)
-	ResourceDeleted(resource *unstructured.Unstructured)
+	ResourceAdded(resource *unstructured.Unstructured) error
+	ResourceUpdated(oldResource, newResource *unstructured.Unstructured) error
+	ResourceDeleted(resource *unstructured.Unstructured) error
+}
+
+// DependentWatcher is implemented by ResourceControllers that watch the
+// objects they create for the custom resources. WatchDependents is called
+// once the CRWatcher starts, requeue takes the namespace/name key of a custom
+// resource that needs to be reconciled again. The watches must stop when
+// stopCh is closed.
+type DependentWatcher interface {
+	WatchDependents(requeue func(key string), stopCh <-chan struct{})
+}
+
+// Reloader is implemented by ResourceControllers that reload their templates
+// or chart while running. WatchReloads is called once the CRWatcher starts,
+// resync requeues every custom resource so they are reconciled with the
+// reloaded version. Watching must stop when stopCh is closed.
+type Reloader interface {
+	WatchReloads(resync func(), stopCh <-chan struct{})
 }
 
 // ErrorLogger will receive any error messages from the kubernetes client
@@ -93,72 +145,288 @@ func NewCRWatcher(cfg *Config, kubeCfg *restclient.Config, rc ResourceController
 	}
 	dc := dynClient
 	cw.setupResource(dc)
+	if err := cw.setupStatus(kubeCfg); err != nil {
+		return nil, err
+	}
+	cw.setupQueue()
 	cw.setupHandler(rc)
 	cw.setupController()
-	cw.setupRuntimeLogging()
+	if sr, ok := rc.(crstatus.Reporter); ok {
+		sr.SetStatusWriter(cw)
+	}
 	return cw, nil
 }
 
-func (cw *CRWatcher) setupRuntimeLogging() {
-	if cw.logger != nil {
-		utilruntime.ErrorHandlers = []func(error){
-			cw.logKubeError,
-		}
+func (cw *CRWatcher) setupQueue() {
+	base := cw.Config.RetryBaseDelay
+	if base <= 0 {
+		base = defaultRetryBaseDelay
 	}
-}
-
-func (cw *CRWatcher) logKubeError(err error) {
-	cw.logger.Error(err)
+	maxDelay := cw.Config.RetryMaxDelay
+	if maxDelay <= 0 {
+		maxDelay = defaultRetryMaxDelay
+	}
+	cw.queue = workqueue.NewNamedRateLimitingQueue(
+		workqueue.NewItemExponentialFailureRateLimiter(base, maxDelay),
+		cw.Config.PluralName,
+	)
+	cw.synced = map[string]*unstructured.Unstructured{}
+	cw.tombstones = map[string]*unstructured.Unstructured{}
+	cw.finalized = map[string]bool{}
 }
 
 func (cw *CRWatcher) setupHandler(con ResourceController) {
+	cw.rc = con
 	cw.handler = cache.ResourceEventHandlerFuncs{
 		AddFunc: func(obj interface{}) {
 			r := obj.(*unstructured.Unstructured)
 			if cw.passesFiltering(r) {
-				con.ResourceAdded(r)
+				cw.enqueue(r)
 			}
 		},
 		DeleteFunc: func(obj interface{}) {
-			r := obj.(*unstructured.Unstructured)
-			if cw.passesFiltering(r) {
-				con.ResourceDeleted(r)
-			}
+			cw.enqueueDeleted(obj)
 		},
 		UpdateFunc: func(oldObj, newObj interface{}) {
 			oldR := oldObj.(*unstructured.Unstructured)
 			newR := newObj.(*unstructured.Unstructured)
-			cw.update(con, oldR, newR)
+			if onlyStatusChanged(oldR, newR) {
+				return
+			}
+			if cw.passesFiltering(oldR) || cw.passesFiltering(newR) {
+				cw.enqueue(newR)
+			}
 		},
 	}
 }
 
-// update sends an appropriate notification to the controller based on filtering outcomes of the old and new state of a
-// resource.
+// onlyStatusChanged reports whether an update only touched the status of the
+// resource, like the status written back after each reconcile. Resyncs, where
+// the resource version does not change, are never considered status changes.
+func onlyStatusChanged(oldR, newR *unstructured.Unstructured) bool {
+	if oldR.GetResourceVersion() == newR.GetResourceVersion() {
+		return false
+	}
+	return reflect.DeepEqual(withoutStatus(oldR), withoutStatus(newR))
+}
+
+func withoutStatus(r *unstructured.Unstructured) map[string]interface{} {
+	c := r.DeepCopy()
+	delete(c.Object, "status")
+	c.SetResourceVersion("")
+	return c.Object
+}
+
+// enqueue adds the namespace/name key of the resource to the work queue. Keys
+// already waiting in the queue are not added twice.
+func (cw *CRWatcher) enqueue(r *unstructured.Unstructured) {
+	key, err := cache.MetaNamespaceKeyFunc(r)
+	if err != nil {
+		utilruntime.HandleError(err)
+		return
+	}
+	cw.queue.Add(key)
+}
+
+// requeue adds a key to the work queue so the resource is reconciled again
+func (cw *CRWatcher) requeue(key string) {
+	cw.queue.Add(key)
+}
+
+// resyncAll adds every resource in the store to the work queue
+func (cw *CRWatcher) resyncAll() {
+	for _, key := range cw.store.ListKeys() {
+		cw.queue.Add(key)
+	}
+}
+
+// enqueueDeleted records the final known state of a deleted resource so it can
+// be handed to ResourceDeleted once the key is processed.
+func (cw *CRWatcher) enqueueDeleted(obj interface{}) {
+	key, err := cache.DeletionHandlingMetaNamespaceKeyFunc(obj)
+	if err != nil {
+		utilruntime.HandleError(err)
+		return
+	}
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = tombstone.Obj
+	}
+	r, ok := obj.(*unstructured.Unstructured)
+	if !ok || !cw.passesFiltering(r) {
+		return
+	}
+	cw.mu.Lock()
+	defer cw.mu.Unlock()
+	if cw.finalized[key] {
+		// The finalizer already cleaned up after this resource
+		delete(cw.finalized, key)
+		return
+	}
+	cw.tombstones[key] = r
+	cw.queue.Add(key)
+}
+
+func (cw *CRWatcher) runWorker() {
+	for cw.processNextItem() {
+	}
+}
+
+// processNextItem takes the next key off the queue and reconciles it. It
+// returns false once the queue has been shut down.
+func (cw *CRWatcher) processNextItem() bool {
+	key, quit := cw.queue.Get()
+	if quit {
+		return false
+	}
+	defer cw.queue.Done(key)
+
+	err := cw.sync(key.(string))
+	cw.handleErr(err, key.(string))
+	return true
+}
+
+// handleErr forgets keys that were processed successfully and requeues failed
+// keys with a per key exponential backoff until Config.MaxRetries is reached.
+func (cw *CRWatcher) handleErr(err error, key string) {
+	if err == nil {
+		cw.queue.Forget(key)
+		return
+	}
+
+	if cw.queue.NumRequeues(key) < cw.Config.MaxRetries {
+		metrics.EventRetries.Inc()
+		utilruntime.HandleError(fmt.Errorf("failed to process %s, retrying: %s", key, err))
+		cw.queue.AddRateLimited(key)
+		return
+	}
+
+	metrics.DroppedEvents.Inc()
+	utilruntime.HandleError(fmt.Errorf("dropping %s after %d retries: %s", key, cw.queue.NumRequeues(key), err))
+	cw.queue.Forget(key)
+	cw.mu.Lock()
+	delete(cw.tombstones, key)
+	cw.mu.Unlock()
+}
+
+// sync sends an appropriate notification to the controller based on the
+// current state of the resource in the store and the last state that was
+// successfully handed to the controller.
 //
-// If no filter is configured or both states of the resource pass filtering, send an update to the controller.
-// If the new state passes filtering and the old state does not, send an add notification to the controller.
-// If the old state passes filtering and the new state does not, send a delete notification to the controller.
-// If neither state passes filtering, ignore.
+// If the resource exists and passes filtering, send an update to the controller, or an add notification if the
+// controller has not successfully handled the resource before.
+// If the resource was deleted or no longer passes filtering, send a delete notification to the controller if the
+// controller knows about the resource.
+// If finalizers are enabled, resources are only handed to the controller once they carry the finalizer, and a
+// resource that is being deleted or no longer passes filtering is cleaned up before its finalizer is removed.
 //
-func (cw *CRWatcher) update(con ResourceController, oldR *unstructured.Unstructured, newR *unstructured.Unstructured) {
-	if cw.passesFiltering(newR) {
-		if cw.passesFiltering(oldR) {
-			con.ResourceUpdated(oldR, newR)
-			return
+func (cw *CRWatcher) sync(key string) error {
+	obj, exists, err := cw.store.GetByKey(key)
+	if err != nil {
+		return err
+	}
+
+	cw.mu.Lock()
+	last := cw.synced[key]
+	final := cw.tombstones[key]
+	cw.mu.Unlock()
+
+	if exists {
+		r := obj.(*unstructured.Unstructured)
+		if cw.Config.Finalizer && hasFinalizer(r) && (isDeleting(r) || !cw.passesFiltering(r)) {
+			return cw.finalize(key, r, last)
 		}
-		con.ResourceAdded(newR)
-	} else if cw.passesFiltering(oldR) {
-		con.ResourceDeleted(oldR)
+		if cw.passesFiltering(r) {
+			if cw.Config.Finalizer && !hasFinalizer(r) {
+				if isDeleting(r) {
+					// Finalizers can't be added once a resource is being deleted, the delete event will clean up
+					return nil
+				}
+				// Adding the finalizer triggers another update which will be handed to the controller
+				return cw.addFinalizer(r)
+			}
+			if last == nil {
+				err = cw.rc.ResourceAdded(r)
+			} else {
+				err = cw.rc.ResourceUpdated(last, r)
+			}
+			if err != nil {
+				return err
+			}
+			cw.mu.Lock()
+			cw.synced[key] = r
+			delete(cw.tombstones, key)
+			delete(cw.finalized, key)
+			cw.mu.Unlock()
+			return nil
+		}
+	}
+
+	if exists || final == nil {
+		final = last
+	}
+	if final == nil {
+		return nil
 	}
+	if err := cw.rc.ResourceDeleted(final); err != nil {
+		return err
+	}
+	cw.mu.Lock()
+	delete(cw.synced, key)
+	delete(cw.tombstones, key)
+	cw.mu.Unlock()
+	return nil
+}
+
+// WriteStatus patches the .status of the custom resource with the result of a
+// reconcile. The status subresource is patched, since the API server ignores
+// .status in patches of the resource itself if the CRD enables it. CRDs without
+// a status subresource get the .status through the resource.
+func (cw *CRWatcher) WriteStatus(r *unstructured.Unstructured, s *crstatus.Status) error {
+	patch, err := json.Marshal(map[string]interface{}{
+		"status": s.Fields(),
+	})
+	if err != nil {
+		return err
+	}
+	err = cw.patchStatus(r.GetNamespace(), r.GetName(), patch)
+	if apierrors.IsNotFound(err) || apierrors.IsMethodNotSupported(err) {
+		_, err = cw.resourceFor(r.GetNamespace()).Patch(r.GetName(), types.MergePatchType, patch)
+	}
+	return err
 }
 
 func (cw *CRWatcher) setupResource(dc *dynamic.Client) {
-	apiResource := &metav1.APIResource{
-		Name:       cw.Config.PluralName,
-		Namespaced: cw.Config.Namespace != metav1.NamespaceNone,
+	cw.resourceFor = func(namespace string) dynamic.ResourceInterface {
+		apiResource := &metav1.APIResource{
+			Name:       cw.Config.PluralName,
+			Namespaced: namespace != metav1.NamespaceNone,
+		}
+		return dc.Resource(apiResource, namespace)
+	}
+	cw.resource = cw.resourceFor(cw.Config.Namespace)
+}
+
+// setupStatus builds the client for the status subresource, which the dynamic
+// client does not support
+func (cw *CRWatcher) setupStatus(kubeCfg *restclient.Config) error {
+	cfg := *kubeCfg
+	cfg.ContentConfig = dynamic.ContentConfig()
+	cfg.ContentConfig.GroupVersion = kubeCfg.ContentConfig.GroupVersion
+	cl, err := restclient.RESTClientFor(&cfg)
+	if err != nil {
+		return err
+	}
+	cw.patchStatus = func(namespace, name string, patch []byte) error {
+		return cl.Patch(types.MergePatchType).
+			NamespaceIfScoped(namespace, namespace != metav1.NamespaceNone).
+			Resource(cw.Config.PluralName).
+			Name(name).
+			SubResource("status").
+			Body(patch).
+			Do().
+			Error()
 	}
-	cw.resource = dc.Resource(apiResource, cw.Config.Namespace)
+	return nil
 }
 
 func (cw *CRWatcher) setupController() {
@@ -194,11 +462,49 @@ func (cw *CRWatcher) passesFiltering(r *unstructured.Unstructured) bool {
 }
 
 // Watch will be called to begin watching the configured custom resource. All
-// events will be passed back to the ResourceController
+// events will be passed back to the ResourceController. Watch blocks until the
+// stop channel is closed.
 func (cw *CRWatcher) Watch(stopCh <-chan struct{}) error {
 	if cw.controller == nil {
 		return errors.New("the CRWatcher has not been initialized")
 	}
-	cw.controller.Run(stopCh)
+	go cw.controller.Run(stopCh)
+	if !cache.WaitForCacheSync(stopCh, cw.controller.HasSynced) {
+		cw.queue.ShutDown()
+		return errors.New("timed out waiting for the CRWatcher cache to sync")
+	}
+
+	if dw, ok := cw.rc.(DependentWatcher); ok {
+		dw.WatchDependents(cw.requeue, stopCh)
+	}
+	if rl, ok := cw.rc.(Reloader); ok {
+		rl.WatchReloads(cw.resyncAll, stopCh)
+	}
+	workers := cw.startWorkers(stopCh)
+	<-stopCh
+	// Idle workers wait for the queue until it is shut down
+	cw.queue.ShutDown()
+	workers.Wait()
 	return nil
 }
+
+// startWorkers starts Config.Workers goroutines pulling keys off the queue. The
+// queue never hands out a key that is still being processed by another worker,
+// and since every key is reconciled against the latest state in the store the
+// controller always sees the changes of a single resource in order. The
+// returned WaitGroup is done once all workers returned.
+func (cw *CRWatcher) startWorkers(stopCh <-chan struct{}) *sync.WaitGroup {
+	workers := cw.Config.Workers
+	if workers < 1 {
+		workers = 1
+	}
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer wg.Done()
+			wait.Until(cw.runWorker, time.Second, stopCh)
+		}()
+	}
+	return &wg
+}
@@ -15,16 +15,24 @@
 package crwatcher
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/golang/mock/gomock"
 	"github.com/stretchr/testify/assert"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/util/wait"
 	restclient "k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/cache"
 
+	"github.com/lostromos/lostromos/crstatus"
 	"github.com/lostromos/lostromos/printctlr"
 )
 
@@ -52,6 +60,7 @@ func TestNewCRWatcher(t *testing.T) {
 	assert.NotNil(t, cw.handler)
 	assert.NotNil(t, cw.store)
 	assert.NotNil(t, cw.controller)
+	assert.NotNil(t, cw.queue)
 	assert.NotNil(t, cw.logger)
 }
 
@@ -67,39 +76,74 @@ func TestNewCRWatcherReturnsNilOnError(t *testing.T) {
 	assert.Equal(t, "host must be a URL or a host:port pair: \"http:///\"", err.Error())
 }
 
-func TestLogKubeError(t *testing.T) {
-	kubeCfg := &restclient.Config{}
-	cfg := &Config{PluralName: "test"}
-	res := &logResult{}
-	lgr := &testLogger{res: res}
-	cw, err := NewCRWatcher(cfg, kubeCfg, printctlr.Controller{}, lgr)
-	assert.Nil(t, err)
-	assert.NotNil(t, cw.logger)
+// newTestWatcher builds a CRWatcher backed by a local store so events can be
+// driven through the handler and work queue without a kubernetes cluster.
+func newTestWatcher(cfg *Config, rc ResourceController) *CRWatcher {
+	cw := &CRWatcher{
+		Config: cfg,
+		store:  cache.NewStore(cache.MetaNamespaceKeyFunc),
+	}
+	cw.setupQueue()
+	cw.setupHandler(rc)
+	return cw
+}
 
-	cw.logKubeError(errors.New("test"))
-	assert.Equal(t, "error: test", lgr.res.msg)
+// The informer updates its store before calling the handler, these helpers do the same.
+func addResource(cw *CRWatcher, r *unstructured.Unstructured) {
+	_ = cw.store.Add(r)
+	cw.handler.OnAdd(r)
 }
 
-func TestSetupHandlerAddFunc(t *testing.T) {
-	mockCtrl := gomock.NewController(t)
-	defer mockCtrl.Finish()
+func updateResource(cw *CRWatcher, oldR, newR *unstructured.Unstructured) {
+	_ = cw.store.Update(newR)
+	cw.handler.OnUpdate(oldR, newR)
+}
 
-	mockRC := NewMockResourceController(mockCtrl)
-	cw := &CRWatcher{
-		Config: &Config{},
+func deleteResource(cw *CRWatcher, r *unstructured.Unstructured) {
+	_ = cw.store.Delete(r)
+	cw.handler.OnDelete(r)
+}
+
+// processQueue works through every key currently waiting in the queue.
+func processQueue(cw *CRWatcher) {
+	for cw.queue.Len() > 0 {
+		cw.processNextItem()
 	}
-	r := &unstructured.Unstructured{
+}
+
+func testResource(name string, annotations map[string]interface{}, spec string) *unstructured.Unstructured {
+	metadata := map[string]interface{}{
+		"name": name,
+	}
+	if annotations != nil {
+		metadata["annotations"] = annotations
+	}
+	return &unstructured.Unstructured{
 		Object: map[string]interface{}{
-			"metadata": map[string]interface{}{
-				"name": "Thing1",
+			"metadata": metadata,
+			"spec": map[string]interface{}{
+				"value": spec,
 			},
 		},
 	}
-	cw.setupHandler(mockRC)
+}
+
+var testFilter = map[string]interface{}{
+	"io.nicolerenee.lostromos.filter": "true",
+}
+
+func TestSetupHandlerAddFunc(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	mockRC := NewMockResourceController(mockCtrl)
+	cw := newTestWatcher(&Config{}, mockRC)
+	r := testResource("Thing1", nil, "a")
 
 	mockRC.EXPECT().ResourceAdded(r)
 
-	cw.handler.OnAdd(r)
+	addResource(cw, r)
+	processQueue(cw)
 }
 
 // Test to ensure that if we are given filter criteria we only call ResourceAdded for a resource with the specified
@@ -109,35 +153,17 @@ func TestSetupHandlerAddFuncUsesFilter(t *testing.T) {
 	defer mockCtrl.Finish()
 
 	mockRC := NewMockResourceController(mockCtrl)
-	cw := &CRWatcher{
-		Config: &Config{
-			Filter: "io.nicolerenee.lostromos.filter",
-		},
-	}
-	r1 := &unstructured.Unstructured{
-		Object: map[string]interface{}{
-			"metadata": map[string]interface{}{
-				"name": "Thing1",
-			},
-		},
-	}
-	r2 := &unstructured.Unstructured{
-		Object: map[string]interface{}{
-			"metadata": map[string]interface{}{
-				"name": "Thing2",
-				"annotations": map[string]interface{}{
-					"io.nicolerenee.lostromos.filter": "true",
-				},
-			},
-		},
-	}
-	cw.setupHandler(mockRC)
+	cw := newTestWatcher(&Config{Filter: "io.nicolerenee.lostromos.filter"}, mockRC)
+	r1 := testResource("Thing1", nil, "a")
+	r2 := testResource("Thing2", testFilter, "a")
 
 	mockRC.EXPECT().ResourceAdded(r1).MinTimes(0).MaxTimes(0)
 	mockRC.EXPECT().ResourceAdded(r2)
 
-	cw.handler.OnAdd(r1)
-	cw.handler.OnAdd(r2)
+	addResource(cw, r1)
+	addResource(cw, r2)
+	assert.Equal(t, 1, cw.queue.Len())
+	processQueue(cw)
 }
 
 func TestSetupHandlerDeleteFunc(t *testing.T) {
@@ -145,21 +171,13 @@ func TestSetupHandlerDeleteFunc(t *testing.T) {
 	defer mockCtrl.Finish()
 
 	mockRC := NewMockResourceController(mockCtrl)
-	cw := &CRWatcher{
-		Config: &Config{},
-	}
-	r := &unstructured.Unstructured{
-		Object: map[string]interface{}{
-			"metadata": map[string]interface{}{
-				"name": "Thing1",
-			},
-		},
-	}
-	cw.setupHandler(mockRC)
+	cw := newTestWatcher(&Config{}, mockRC)
+	r := testResource("Thing1", nil, "a")
 
 	mockRC.EXPECT().ResourceDeleted(r)
 
-	cw.handler.OnDelete(r)
+	deleteResource(cw, r)
+	processQueue(cw)
 }
 
 // Test to ensure that if we are given filter criteria we only call ResourceDeleted for a resource with the specified
@@ -169,64 +187,60 @@ func TestSetupHandlerDeleteFuncUsesFilter(t *testing.T) {
 	defer mockCtrl.Finish()
 
 	mockRC := NewMockResourceController(mockCtrl)
-	cw := &CRWatcher{
-		Config: &Config{
-			Filter: "io.nicolerenee.lostromos.filter",
-		},
-	}
-	r1 := &unstructured.Unstructured{
-		Object: map[string]interface{}{
-			"metadata": map[string]interface{}{
-				"name": "Thing1",
-			},
-		},
-	}
-	r2 := &unstructured.Unstructured{
-		Object: map[string]interface{}{
-			"metadata": map[string]interface{}{
-				"name": "Thing2",
-				"annotations": map[string]interface{}{
-					"io.nicolerenee.lostromos.filter": "true",
-				},
-			},
-		},
-	}
-	cw.setupHandler(mockRC)
+	cw := newTestWatcher(&Config{Filter: "io.nicolerenee.lostromos.filter"}, mockRC)
+	r1 := testResource("Thing1", nil, "a")
+	r2 := testResource("Thing2", testFilter, "a")
 
 	mockRC.EXPECT().ResourceDeleted(r1).MinTimes(0).MaxTimes(0)
 	mockRC.EXPECT().ResourceDeleted(r2)
 
-	cw.handler.OnDelete(r1)
-	cw.handler.OnDelete(r2)
+	deleteResource(cw, r1)
+	deleteResource(cw, r2)
+	processQueue(cw)
 }
 
-func TestSetupHandlerUpdateFunc(t *testing.T) {
+// Test to ensure a deleted resource gets the final state it had rather than the last state handed to the controller.
+func TestSetupHandlerDeleteFuncUsesFinalState(t *testing.T) {
 	mockCtrl := gomock.NewController(t)
 	defer mockCtrl.Finish()
 
 	mockRC := NewMockResourceController(mockCtrl)
-	cw := &CRWatcher{
-		Config: &Config{},
-	}
-	r1 := &unstructured.Unstructured{
-		Object: map[string]interface{}{
-			"metadata": map[string]interface{}{
-				"name": "Thing1",
-			},
-		},
-	}
-	r2 := &unstructured.Unstructured{
-		Object: map[string]interface{}{
-			"metadata": map[string]interface{}{
-				"name": "Thing2",
-			},
-		},
-	}
-	cw.setupHandler(mockRC)
+	cw := newTestWatcher(&Config{}, mockRC)
+	r1 := testResource("Thing1", nil, "a")
+	r1Updated := testResource("Thing1", nil, "b")
+
+	gomock.InOrder(
+		mockRC.EXPECT().ResourceAdded(r1),
+		mockRC.EXPECT().ResourceDeleted(r1Updated),
+	)
+
+	addResource(cw, r1)
+	processQueue(cw)
+	updateResource(cw, r1, r1Updated)
+	deleteResource(cw, r1Updated)
+	processQueue(cw)
+	assert.Empty(t, cw.synced)
+	assert.Empty(t, cw.tombstones)
+}
 
-	mockRC.EXPECT().ResourceUpdated(r1, r2)
+func TestSetupHandlerUpdateFunc(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
 
-	cw.handler.OnUpdate(r1, r2)
+	mockRC := NewMockResourceController(mockCtrl)
+	cw := newTestWatcher(&Config{}, mockRC)
+	r1 := testResource("Thing1", nil, "a")
+	r2 := testResource("Thing1", nil, "b")
+
+	gomock.InOrder(
+		mockRC.EXPECT().ResourceAdded(r1),
+		mockRC.EXPECT().ResourceUpdated(r1, r2),
+	)
+
+	addResource(cw, r1)
+	processQueue(cw)
+	updateResource(cw, r1, r2)
+	processQueue(cw)
 }
 
 // Test to ensure that if we are given filter criteria we call ResourceUpdated, ResourceDeleted, and ResourceAdded
@@ -236,56 +250,299 @@ func TestSetupHandlerUpdateFuncUsesFilter(t *testing.T) {
 	defer mockCtrl.Finish()
 
 	mockRC := NewMockResourceController(mockCtrl)
-	cw := &CRWatcher{
-		Config: &Config{
-			Filter: "io.nicolerenee.lostromos.filter",
-		},
-	}
-	r1 := &unstructured.Unstructured{
-		Object: map[string]interface{}{
-			"metadata": map[string]interface{}{
-				"name": "Thing1",
-			},
-		},
-	}
-	r1Filtered := &unstructured.Unstructured{
-		Object: map[string]interface{}{
-			"metadata": map[string]interface{}{
-				"name": "Thing1",
-				"annotations": map[string]interface{}{
-					"io.nicolerenee.lostromos.filter": "true",
-				},
-			},
-		},
+	cw := newTestWatcher(&Config{Filter: "io.nicolerenee.lostromos.filter"}, mockRC)
+	r1 := testResource("Thing1", nil, "a")
+	r2 := testResource("Thing1", nil, "b")
+	r1Filtered := testResource("Thing1", testFilter, "a")
+	r2Filtered := testResource("Thing1", testFilter, "b")
+
+	gomock.InOrder(
+		mockRC.EXPECT().ResourceAdded(r1Filtered),
+		mockRC.EXPECT().ResourceUpdated(r1Filtered, r2Filtered),
+		mockRC.EXPECT().ResourceDeleted(r2Filtered),
+	)
+
+	updateResource(cw, r1, r2)
+	assert.Equal(t, 0, cw.queue.Len())
+	updateResource(cw, r2, r1Filtered)
+	processQueue(cw)
+	updateResource(cw, r1Filtered, r2Filtered)
+	processQueue(cw)
+	updateResource(cw, r2Filtered, r1)
+	processQueue(cw)
+}
+
+// Test to ensure a burst of events for the same resource only reaches the controller once with the latest state.
+func TestBurstOfEventsIsDeduplicated(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	mockRC := NewMockResourceController(mockCtrl)
+	cw := newTestWatcher(&Config{}, mockRC)
+	r1 := testResource("Thing1", nil, "a")
+	r2 := testResource("Thing1", nil, "b")
+	r3 := testResource("Thing1", nil, "c")
+
+	mockRC.EXPECT().ResourceAdded(r3)
+
+	addResource(cw, r1)
+	updateResource(cw, r1, r2)
+	updateResource(cw, r2, r3)
+	assert.Equal(t, 1, cw.queue.Len())
+	processQueue(cw)
+}
+
+func TestFailedEventIsRetried(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	mockRC := NewMockResourceController(mockCtrl)
+	cw := newTestWatcher(&Config{MaxRetries: 1, RetryBaseDelay: time.Millisecond}, mockRC)
+	r := testResource("Thing1", nil, "a")
+
+	gomock.InOrder(
+		mockRC.EXPECT().ResourceAdded(r).Return(errors.New("apply failed")),
+		mockRC.EXPECT().ResourceAdded(r).Return(nil),
+	)
+
+	addResource(cw, r)
+	cw.processNextItem()
+	assert.Equal(t, 1, cw.queue.NumRequeues("Thing1"))
+	// Blocks until the rate limited key is added back to the queue
+	cw.processNextItem()
+	assert.Equal(t, 0, cw.queue.NumRequeues("Thing1"))
+	assert.Equal(t, r, cw.synced["Thing1"])
+}
+
+func TestFailedEventIsDroppedAfterMaxRetries(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	mockRC := NewMockResourceController(mockCtrl)
+	cw := newTestWatcher(&Config{MaxRetries: 0}, mockRC)
+	r := testResource("Thing1", nil, "a")
+
+	mockRC.EXPECT().ResourceDeleted(r).Return(errors.New("delete failed"))
+
+	deleteResource(cw, r)
+	processQueue(cw)
+	assert.Equal(t, 0, cw.queue.Len())
+	assert.Equal(t, 0, cw.queue.NumRequeues("Thing1"))
+	assert.Empty(t, cw.tombstones)
+}
+
+// concurrencyController records how many callbacks are running at the same time,
+// both overall and for each resource.
+type concurrencyController struct {
+	mu        sync.Mutex
+	running   map[string]int
+	total     int
+	maxTotal  int
+	maxPerKey int
+	calls     []string
+	release   chan struct{}
+	done      chan string
+}
+
+func newConcurrencyController() *concurrencyController {
+	return &concurrencyController{
+		running: map[string]int{},
+		release: make(chan struct{}),
+		done:    make(chan string, 100),
 	}
-	r2 := &unstructured.Unstructured{
-		Object: map[string]interface{}{
-			"metadata": map[string]interface{}{
-				"name": "Thing2",
-			},
-		},
+}
+
+func (c *concurrencyController) handle(r *unstructured.Unstructured) error {
+	name := r.GetName()
+	c.mu.Lock()
+	c.running[name]++
+	c.total++
+	if c.running[name] > c.maxPerKey {
+		c.maxPerKey = c.running[name]
 	}
-	r2Filtered := &unstructured.Unstructured{
-		Object: map[string]interface{}{
-			"metadata": map[string]interface{}{
-				"name": "Thing2",
-				"annotations": map[string]interface{}{
-					"io.nicolerenee.lostromos.filter": "true",
-				},
-			},
-		},
+	if c.total > c.maxTotal {
+		c.maxTotal = c.total
 	}
-	cw.setupHandler(mockRC)
+	c.calls = append(c.calls, fmt.Sprintf("%s:%s", name, r.Object["spec"].(map[string]interface{})["value"]))
+	c.mu.Unlock()
+
+	<-c.release
+
+	c.mu.Lock()
+	c.running[name]--
+	c.total--
+	c.mu.Unlock()
+	c.done <- name
+	return nil
+}
+
+func (c *concurrencyController) ResourceAdded(r *unstructured.Unstructured) error {
+	return c.handle(r)
+}
+
+func (c *concurrencyController) ResourceUpdated(oldR, newR *unstructured.Unstructured) error {
+	return c.handle(newR)
+}
+
+func (c *concurrencyController) ResourceDeleted(r *unstructured.Unstructured) error {
+	return c.handle(r)
+}
+
+func (c *concurrencyController) waitForRunning(t *testing.T, n int) {
+	err := wait.PollImmediate(time.Millisecond, 5*time.Second, func() (bool, error) {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		return c.total == n, nil
+	})
+	assert.Nil(t, err, "expected %d callbacks to be running", n)
+}
+
+func TestWorkersProcessDifferentResourcesInParallel(t *testing.T) {
+	rc := newConcurrencyController()
+	cw := newTestWatcher(&Config{Workers: 2}, rc)
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	defer cw.queue.ShutDown()
+	cw.startWorkers(stopCh)
+
+	addResource(cw, testResource("Thing1", nil, "a"))
+	addResource(cw, testResource("Thing2", nil, "a"))
+
+	rc.waitForRunning(t, 2)
+	close(rc.release)
+	<-rc.done
+	<-rc.done
+	assert.Equal(t, 2, rc.maxTotal)
+}
+
+func TestWorkersNeverProcessTheSameResourceConcurrently(t *testing.T) {
+	rc := newConcurrencyController()
+	cw := newTestWatcher(&Config{Workers: 4}, rc)
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	defer cw.queue.ShutDown()
+	cw.startWorkers(stopCh)
+
+	r1 := testResource("Thing1", nil, "a")
+	r2 := testResource("Thing1", nil, "b")
+	r3 := testResource("Thing1", nil, "c")
+	addResource(cw, r1)
+	rc.waitForRunning(t, 1)
+
+	// Both updates arrive while the add is still being processed
+	updateResource(cw, r1, r2)
+	updateResource(cw, r2, r3)
+	close(rc.release)
+	<-rc.done
+	<-rc.done
+
+	assert.Equal(t, 1, rc.maxPerKey)
+	assert.Equal(t, []string{"Thing1:a", "Thing1:c"}, rc.calls)
+}
+
+type statusReporter struct {
+	printctlr.Controller
+	writer crstatus.Writer
+}
+
+func (s *statusReporter) SetStatusWriter(w crstatus.Writer) {
+	s.writer = w
+}
+
+func TestNewCRWatcherSetsStatusWriter(t *testing.T) {
+	rc := &statusReporter{}
+	cw, err := NewCRWatcher(&Config{PluralName: "test"}, &restclient.Config{}, rc, testLogger{})
+
+	assert.Nil(t, err)
+	assert.Equal(t, cw, rc.writer)
+}
+
+// statusServer records the PATCH requests it receives. Requests for paths in
+// missing are answered with a 404.
+func statusServer(missing ...string) (*httptest.Server, *[]string, *[]map[string]interface{}) {
+	var (
+		paths  []string
+		bodies []map[string]interface{}
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != "PATCH" || req.Header.Get("Content-Type") != "application/merge-patch+json" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		var body map[string]interface{}
+		_ = json.NewDecoder(req.Body).Decode(&body)
+		paths = append(paths, req.URL.Path)
+		bodies = append(bodies, body)
+		w.Header().Set("Content-Type", "application/json")
+		for _, m := range missing {
+			if req.URL.Path == m {
+				w.WriteHeader(http.StatusNotFound)
+				_, _ = w.Write([]byte(`{"kind": "Status", "apiVersion": "v1", "status": "Failure", "reason": "NotFound", "code": 404}`))
+				return
+			}
+		}
+		_, _ = w.Write([]byte(`{"apiVersion": "stable.lostromos/v1", "kind": "Character", "metadata": {"name": "dory"}}`))
+	}))
+	return srv, &paths, &bodies
+}
+
+func writeTestStatus(t *testing.T, host string) error {
+	cfg := &Config{Group: "stable.lostromos", Version: "v1", PluralName: "characters"}
+	cw, err := NewCRWatcher(cfg, &restclient.Config{Host: host}, printctlr.Controller{}, testLogger{})
+	assert.Nil(t, err)
 
-	mockRC.EXPECT().ResourceUpdated(r1, r2).MinTimes(0).MaxTimes(0)
-	mockRC.EXPECT().ResourceDeleted(r1Filtered)
-	mockRC.EXPECT().ResourceAdded(r2Filtered)
-	mockRC.EXPECT().ResourceUpdated(r1Filtered, r2Filtered)
+	r := testResource("dory", nil, "a")
+	r.SetNamespace("ocean")
+	return cw.WriteStatus(r, crstatus.New(r, errors.New("apply failed")))
+}
+
+func TestWriteStatus(t *testing.T) {
+	srv, paths, bodies := statusServer()
+	defer srv.Close()
 
-	cw.handler.OnUpdate(r1, r2)
-	cw.handler.OnUpdate(r1Filtered, r2)
-	cw.handler.OnUpdate(r1, r2Filtered)
-	cw.handler.OnUpdate(r1Filtered, r2Filtered)
+	assert.Nil(t, writeTestStatus(t, srv.URL))
+	assert.Equal(t, []string{"/apis/stable.lostromos/v1/namespaces/ocean/characters/dory/status"}, *paths)
+	status := (*bodies)[0]["status"].(map[string]interface{})
+	assert.Equal(t, "Failed", status["phase"])
+	assert.Equal(t, "apply failed", status["message"])
+}
+
+// CRDs without the status subresource get the status through the resource
+func TestWriteStatusWithoutStatusSubresource(t *testing.T) {
+	srv, paths, bodies := statusServer("/apis/stable.lostromos/v1/namespaces/ocean/characters/dory/status")
+	defer srv.Close()
+
+	assert.Nil(t, writeTestStatus(t, srv.URL))
+	assert.Equal(t, []string{
+		"/apis/stable.lostromos/v1/namespaces/ocean/characters/dory/status",
+		"/apis/stable.lostromos/v1/namespaces/ocean/characters/dory",
+	}, *paths)
+	status := (*bodies)[1]["status"].(map[string]interface{})
+	assert.Equal(t, "Failed", status["phase"])
+}
+
+// Test to ensure that writing the status back to a resource does not trigger another reconcile, while resyncs and
+// real changes do.
+func TestSetupHandlerUpdateFuncIgnoresStatusChanges(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	mockRC := NewMockResourceController(mockCtrl)
+	cw := newTestWatcher(&Config{}, mockRC)
+	r1 := testResource("Thing1", nil, "a")
+	r1.SetResourceVersion("1")
+	r1WithStatus := r1.DeepCopy()
+	r1WithStatus.SetResourceVersion("2")
+	r1WithStatus.Object["status"] = map[string]interface{}{"phase": "Applied"}
+	r2 := testResource("Thing1", nil, "b")
+	r2.SetResourceVersion("3")
+
+	updateResource(cw, r1, r1WithStatus)
+	assert.Equal(t, 0, cw.queue.Len())
+	updateResource(cw, r1WithStatus, r1WithStatus)
+	assert.Equal(t, 1, cw.queue.Len())
+	updateResource(cw, r1WithStatus, r2)
+	assert.Equal(t, 1, cw.queue.Len())
 }
 
 func TestWatchReturnsErrorIfNotSetup(t *testing.T) {
@@ -294,3 +551,108 @@ func TestWatchReturnsErrorIfNotSetup(t *testing.T) {
 
 	assert.NotNil(t, err)
 }
+
+type syncedController struct{}
+
+func (syncedController) Run(stopCh <-chan struct{})      { <-stopCh }
+func (syncedController) HasSynced() bool                 { return true }
+func (syncedController) LastSyncResourceVersion() string { return "" }
+
+type dependentWatcher struct {
+	added chan string
+}
+
+func (d *dependentWatcher) WatchDependents(requeue func(key string), stopCh <-chan struct{}) {
+	requeue("Thing1")
+}
+
+func (d *dependentWatcher) ResourceAdded(r *unstructured.Unstructured) error {
+	d.added <- r.GetName()
+	return nil
+}
+
+func (d *dependentWatcher) ResourceUpdated(oldR, newR *unstructured.Unstructured) error {
+	return nil
+}
+
+func (d *dependentWatcher) ResourceDeleted(r *unstructured.Unstructured) error {
+	return nil
+}
+
+func TestWatchStartsDependentWatcher(t *testing.T) {
+	rc := &dependentWatcher{added: make(chan string, 1)}
+	cw := newTestWatcher(&Config{}, rc)
+	cw.controller = syncedController{}
+	_ = cw.store.Add(testResource("Thing1", nil, "a"))
+
+	stopCh := make(chan struct{})
+	go func() { _ = cw.Watch(stopCh) }()
+	defer close(stopCh)
+
+	select {
+	case name := <-rc.added:
+		assert.Equal(t, "Thing1", name)
+	case <-time.After(5 * time.Second):
+		t.Fatal("requeued resource was not reconciled")
+	}
+}
+
+func TestWatchWaitsForWorkers(t *testing.T) {
+	rc := newConcurrencyController()
+	cw := newTestWatcher(&Config{}, rc)
+	cw.controller = syncedController{}
+
+	stopCh := make(chan struct{})
+	returned := make(chan struct{})
+	go func() {
+		_ = cw.Watch(stopCh)
+		close(returned)
+	}()
+	addResource(cw, testResource("Thing1", nil, "a"))
+	rc.waitForRunning(t, 1)
+
+	close(stopCh)
+	select {
+	case <-returned:
+		t.Fatal("Watch returned while a worker was still running")
+	case <-time.After(100 * time.Millisecond):
+	}
+	close(rc.release)
+	select {
+	case <-returned:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Watch did not return after the workers finished")
+	}
+}
+
+type reloader struct {
+	dependentWatcher
+}
+
+func (r *reloader) WatchReloads(resync func(), stopCh <-chan struct{}) {
+	resync()
+}
+
+func TestWatchStartsReloader(t *testing.T) {
+	rc := &reloader{dependentWatcher{added: make(chan string, 2)}}
+	cw := newTestWatcher(&Config{}, rc)
+	cw.controller = syncedController{}
+	_ = cw.store.Add(testResource("Thing1", nil, "a"))
+	_ = cw.store.Add(testResource("Thing2", nil, "a"))
+
+	stopCh := make(chan struct{})
+	go func() { _ = cw.Watch(stopCh) }()
+	defer close(stopCh)
+
+	var names []string
+	for len(names) < 2 {
+		select {
+		case name := <-rc.added:
+			names = append(names, name)
+		case <-time.After(5 * time.Second):
+			t.Fatal("resynced resources were not reconciled")
+		}
+	}
+	sort.Strings(names)
+	assert.Equal(t, []string{"Thing1", "Thing2"}, names)
+}
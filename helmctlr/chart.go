@@ -0,0 +1,110 @@
+// Copyright 2017 the lostromos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package helmctlr
+
+import (
+	"fmt"
+	"sync"
+
+	"k8s.io/helm/pkg/chartutil"
+	"k8s.io/helm/pkg/proto/hapi/chart"
+
+	"github.com/lostromos/lostromos/crhash"
+	"github.com/lostromos/lostromos/schema"
+)
+
+// SchemaFile is the name of the JSON Schema in the chart that the spec of
+// custom resources is validated against before installing or upgrading
+const SchemaFile = "values.schema.json"
+
+// chartCache holds the loaded local chart, so the chart in use only changes
+// when it is reloaded successfully
+type chartCache struct {
+	path  string
+	mu    sync.RWMutex
+	chart *chart.Chart
+}
+
+func newChartCache(path string) *chartCache {
+	return &chartCache{path: path}
+}
+
+// get returns the chart if path is the local chart and it can be loaded,
+// otherwise nil
+func (c *chartCache) get(path string) *chart.Chart {
+	if c == nil || path != c.path {
+		return nil
+	}
+	c.mu.RLock()
+	ch := c.chart
+	c.mu.RUnlock()
+	if ch != nil {
+		return ch
+	}
+	if err := c.reload(); err != nil {
+		return nil
+	}
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.chart
+}
+
+// reload loads the chart again, keeping the previous one if it fails to load
+// or has an invalid schema
+func (c *chartCache) reload() error {
+	ch, err := chartutil.Load(c.path)
+	if err != nil {
+		return err
+	}
+	if _, err := chartSchema(ch); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.chart = ch
+	return nil
+}
+
+// chartParts returns the metadata, templates, values and files of the chart
+// and its dependencies, for hashing
+func chartParts(ch *chart.Chart) [][]byte {
+	md := ch.GetMetadata()
+	parts := [][]byte{[]byte(md.GetName()), []byte(md.GetVersion()), []byte(ch.GetValues().GetRaw())}
+	for _, t := range ch.GetTemplates() {
+		parts = append(parts, []byte(t.GetName()), t.GetData())
+	}
+	for _, f := range ch.GetFiles() {
+		parts = append(parts, []byte(f.GetTypeUrl()), f.GetValue())
+	}
+	for _, dep := range ch.GetDependencies() {
+		parts = append(parts, []byte(crhash.Sum(chartParts(dep)...)))
+	}
+	return parts
+}
+
+// chartSchema returns the SchemaFile of the chart, nil if it has none
+func chartSchema(ch *chart.Chart) (*schema.Schema, error) {
+	for _, f := range ch.GetFiles() {
+		if f.GetTypeUrl() != SchemaFile {
+			continue
+		}
+		s, err := schema.Parse(f.GetValue())
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s: %s", SchemaFile, err)
+		}
+		return s, nil
+	}
+	return nil, nil
+}
@@ -15,30 +15,53 @@
 package helmctlr
 
 import (
-	"fmt"
+	"errors"
 	"time"
 
 	"github.com/ghodss/yaml"
 	"go.uber.org/zap"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/helm/pkg/chartutil"
 	"k8s.io/helm/pkg/helm"
+	"k8s.io/helm/pkg/proto/hapi/chart"
 	"k8s.io/helm/pkg/proto/hapi/release"
 
+	"github.com/lostromos/lostromos/crhash"
+	"github.com/lostromos/lostromos/crstatus"
 	"github.com/lostromos/lostromos/metrics"
+	"github.com/lostromos/lostromos/reload"
 )
 
-var defaultNS = "default"
+var (
+	defaultNS    = "default"
+	errUnchanged = errors.New("release values and chart are unchanged")
+)
+
+// rollbackHistory is how many revisions are searched for the last deployed
+// one when rolling back
+const rollbackHistory = 256
 
 // Controller is a crwatcher.ResourceController that works with Helm to deploy
 // helm charts into K8s providing a CustomResource as value data to the charts
 type Controller struct {
-	ChartPath   string         // path to dir where the Helm chart is located; for a helm chart archive, path of that archive file
-	Helm        helm.Interface // Helm for talking with helm
-	Namespace   string         // Default namespace to deploy into. If empty it will default to "default"
-	ReleaseName string         // Prefix for the helm release name. Will look like ReleaseName-CR_Name
-	Wait        bool           // Whether or not to wait for resources during Update and Install before marking a release successful
-	WaitTimeout int64          // time in seconds to wait for kubernetes resources to be created before marking a release successful
-	logger      *zap.SugaredLogger
+	ChartPath              string          // path to dir where the Helm chart is located; for a helm chart archive, path of that archive file
+	Helm                   helm.Interface  // Helm for talking with helm
+	Namespace              string          // Default namespace to deploy into. If empty it will default to "default"
+	ReleaseName            string          // Prefix for the helm release name. Will look like ReleaseName-CR_Name
+	NamespaceMode          string          // How the namespace of a release is picked, see NamespaceFixed. Empty is NamespaceFixed
+	AllowedNamespaces      []string        // Namespaces the resource and annotation modes may install into. If empty, annotation mode only allows the CR's namespace and Namespace
+	NamespacedReleaseNames bool            // Whether release names include the namespace of the CR, like ReleaseName-CR_Namespace-CR_Name-hash
+	Wait                   bool            // Whether or not to wait for resources during Update and Install before marking a release successful
+	WaitTimeout            int64           // time in seconds to wait for kubernetes resources to be created before marking a release successful
+	Reload                 *reload.Watcher // reloads the chart when it changes, nil disables reloading
+	Tillerless             *Tillerless     // installs releases without Tiller, nil uses Helm
+	Rollback               bool            // Whether a failed upgrade is rolled back to the last deployed revision
+	Values                 *ValuesMapping  // maps the CR to the release values, nil uses resource.name, resource.namespace and resource.spec
+	ChartRepos             *ChartRepos     // repositories of remote charts, nil uses the repositories of $HELM_HOME
+	logger                 *zap.SugaredLogger
+	status                 crstatus.Writer
+	applied                *crhash.Store
+	chart                  *chartCache
 }
 
 // NewController will return a configured Helm Controller
@@ -58,66 +81,141 @@ func NewController(chartDir, ns, rn, host string, wait bool, waitto int64, logge
 		Wait:        wait,
 		WaitTimeout: waitto,
 		logger:      logger,
+		status:      crstatus.NopWriter{},
+		applied:     crhash.NewStore(),
+		chart:       newChartCache(chartDir),
 	}
 	return c
 }
 
+// WatchReloads reloads the chart when it changes, see crwatcher.Reloader
+func (c *Controller) WatchReloads(resync func(), stopCh <-chan struct{}) {
+	if c.Reload != nil {
+		go c.Reload.Run(c.ReloadChart, resync, stopCh)
+	}
+}
+
+// ReloadChart loads the local chart again. If it fails to load the previous
+// chart is kept.
+func (c *Controller) ReloadChart() error {
+	return c.chart.reload()
+}
+
+// SetStatusWriter sets where the result of each reconcile is reported
+func (c *Controller) SetStatusWriter(w crstatus.Writer) {
+	c.status = w
+}
+
 // ResourceAdded is called when a custom resource is created and will kick off a
 // help install for the given charts and CR
-func (c Controller) ResourceAdded(r *unstructured.Unstructured) {
+func (c Controller) ResourceAdded(r *unstructured.Unstructured) error {
 	metrics.TotalEvents.Inc()
 	c.logger.Infow("resource added", "resource", r.GetName())
-	if err := c.installOrUpdate(r); err != nil {
+	rls, err := c.installOrUpdate(r, false)
+	c.writeStatus(r, rls, err)
+	if err != nil {
 		metrics.CreateFailures.Inc()
 		c.logger.Errorw("failed to create resource", "error", err, "resource", r.GetName())
-		return
+		return err
 	}
 	metrics.CreatedReleases.Inc()
 	metrics.ManagedReleases.Inc()
 	metrics.LastSuccessfulCreate.Set(float64(time.Now().UTC().UnixNano()) / 1000000000)
+	return nil
 }
 
 // ResourceDeleted is called when a custom resource is created and will use
 // Helm to delete the release. The release is also purged in case in the future
 // another CR with the same name is created.
-func (c Controller) ResourceDeleted(r *unstructured.Unstructured) {
+func (c Controller) ResourceDeleted(r *unstructured.Unstructured) error {
 	metrics.TotalEvents.Inc()
 	c.logger.Infow("resource deleted", "resource", r.GetName())
 	err := c.delete(r)
 	if err != nil {
 		metrics.DeleteFailures.Inc()
 		c.logger.Errorw("failed to delete resource", "error", err, "resource", r.GetName())
-		return
+		return err
 	}
 	metrics.DeletedReleases.Inc()
 	metrics.ManagedReleases.Dec()
 	metrics.LastSuccessfulDelete.Set(float64(time.Now().UTC().UnixNano()) / 1000000000)
+	return nil
 }
 
 // ResourceUpdated is called when a custom resource is updated or during a
 // resync and will kick off a helm update for the corresponding release
-func (c Controller) ResourceUpdated(oldR, newR *unstructured.Unstructured) {
+func (c Controller) ResourceUpdated(oldR, newR *unstructured.Unstructured) error {
 	metrics.TotalEvents.Inc()
 	c.logger.Infow("resource updated", "resource", newR.GetName())
-	if err := c.installOrUpdate(newR); err != nil {
+	rls, err := c.installOrUpdate(newR, !crhash.IsResync(oldR, newR))
+	if err == errUnchanged {
+		c.logger.Debugw("release unchanged, skipping upgrade", "resource", newR.GetName())
+		metrics.SkippedEvents.Inc()
+		if oldR.GetGeneration() != newR.GetGeneration() {
+			// The spec changed without changing the release, it is deployed all the same
+			c.writeStatus(newR, nil, nil)
+		}
+		return nil
+	}
+	c.writeStatus(newR, rls, err)
+	if err != nil {
 		metrics.UpdateFailures.Inc()
 		c.logger.Errorw("failed to update resource", "error", err, "resource", newR.GetName())
-		return
+		return err
 	}
 	metrics.UpdatedReleases.Inc()
 	metrics.LastSuccessfulUpdate.Set(float64(time.Now().UTC().UnixNano()) / 1000000000)
+	return nil
 }
 
 func (c Controller) delete(r *unstructured.Unstructured) error {
+	c.applied.Forget(crhash.Key(r))
 	rlsName := c.releaseName(r)
+	if c.Tillerless == nil {
+		return c.deleteRelease(rlsName, "")
+	}
+	ns := installedNamespace(r, rlsName)
+	if ns == "" {
+		var err error
+		if ns, err = c.releaseNamespace(r); err != nil {
+			return err
+		}
+	}
+	return c.deleteRelease(rlsName, ns)
+}
+
+// deleteRelease purges the release, ns is only used by the Tillerless backend
+func (c Controller) deleteRelease(rlsName, ns string) error {
+	if c.Tillerless != nil {
+		return c.Tillerless.Delete(rlsName, ns)
+	}
 	_, err := c.Helm.DeleteRelease(rlsName, helm.DeletePurge(true))
 	return err
 }
 
-func (c Controller) installOrUpdate(r *unstructured.Unstructured) error {
+// deleteMovedRelease deletes the release from the namespace it was installed
+// into if the custom resource now picks another namespace, e.g. because its
+// namespace annotation changed, so the release is installed again in ns.
+func (c Controller) deleteMovedRelease(r *unstructured.Unstructured, rlsName, ns string) error {
+	old := installedNamespace(r, rlsName)
+	if old == "" || old == ns {
+		return nil
+	}
+	if c.Tillerless == nil && !c.releaseExists(rlsName, old) {
+		return nil
+	}
+	c.logger.Infow("release namespace changed, deleting the release from its old namespace",
+		"release", rlsName, "from", old, "to", ns)
+	return c.deleteRelease(rlsName, old)
+}
+
+// installOrUpdate installs or upgrades the release for the custom resource.
+// With skipUnchanged nothing is done and errUnchanged is returned if the
+// values and chart version are the same as on the last successful upgrade.
+func (c Controller) installOrUpdate(r *unstructured.Unstructured, skipUnchanged bool) (*release.Release, error) {
 	cr, err := c.marshallCR(r)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	// If chart entry is present in CR, then download the chart from repo to local dir
@@ -126,41 +224,214 @@ func (c Controller) installOrUpdate(r *unstructured.Unstructured) error {
 		if chartPath, chartErr := c.GetRemoteChart(chartRef); chartErr == nil {
 			c.ChartPath = chartPath
 		} else {
-			return chartErr
+			return nil, chartErr
+		}
+	}
+
+	ns, err := c.releaseNamespace(r)
+	if err != nil {
+		return nil, err
+	}
+	ch, err := c.loadChart()
+	if err != nil && c.Tillerless != nil {
+		// Only Tiller can install charts that can't be loaded here
+		return nil, err
+	}
+	if ch != nil {
+		if err := c.validate(r, ch); err != nil {
+			return nil, err
 		}
 	}
 
+	key, sum := crhash.Key(r), c.releaseHash(ch, ns, cr)
+	if skipUnchanged && sum != "" && c.applied.Unchanged(key, sum) {
+		return nil, errUnchanged
+	}
+	// Whatever happens next, the release may not match the last upgrade anymore
+	c.applied.Forget(key)
+
 	rlsName := c.releaseName(r)
-	if c.releaseExists(rlsName) {
-		_, err = c.Helm.UpdateRelease(
+	if err := c.deleteMovedRelease(r, rlsName, ns); err != nil {
+		return nil, err
+	}
+	rls, err := c.installOrUpgradeRelease(rlsName, ns, ch, cr)
+	if err == nil && sum != "" {
+		c.applied.Set(key, sum)
+	}
+	return rls, err
+}
+
+func (c Controller) installOrUpgradeRelease(rlsName, ns string, ch *chart.Chart, values []byte) (*release.Release, error) {
+	if c.Tillerless != nil {
+		rls, err := c.Tillerless.InstallOrUpgrade(rlsName, ns, ch, values)
+		return c.rollbackFailedUpgrade(rlsName, ns, rls, err)
+	}
+	if ch := c.chart.get(c.ChartPath); ch != nil {
+		return c.installOrUpgradeChart(rlsName, ns, ch, values)
+	}
+	if c.releaseExists(rlsName, ns) {
+		res, err := c.Helm.UpdateRelease(
 			rlsName,
 			c.ChartPath,
-			helm.UpdateValueOverrides(cr),
+			helm.UpdateValueOverrides(values),
 			helm.UpgradeWait(c.Wait),
 			helm.UpgradeTimeout(c.WaitTimeout))
-		return err
+		return c.rollbackFailedUpgrade(rlsName, ns, res.GetRelease(), err)
 	}
-	_, err = c.Helm.InstallRelease(
+	res, err := c.Helm.InstallRelease(
 		c.ChartPath,
-		c.Namespace,
+		ns,
 		helm.ReleaseName(rlsName),
-		helm.ValueOverrides(cr),
+		helm.ValueOverrides(values),
 		helm.InstallWait(c.Wait),
 		helm.InstallTimeout(c.WaitTimeout))
-	return err
+	return res.GetRelease(), err
 }
 
-func (c Controller) marshallCR(r *unstructured.Unstructured) ([]byte, error) {
-	re := map[string]interface{}{
-		"resource": map[string]interface{}{
-			"name":      r.GetName(),
-			"namespace": r.GetNamespace(),
-			"spec":      r.Object["spec"]}}
+// installOrUpgradeChart is like installOrUpgradeRelease for the loaded local
+// chart
+func (c Controller) installOrUpgradeChart(rlsName, ns string, ch *chart.Chart, values []byte) (*release.Release, error) {
+	if c.releaseExists(rlsName, ns) {
+		res, err := c.Helm.UpdateReleaseFromChart(
+			rlsName,
+			ch,
+			helm.UpdateValueOverrides(values),
+			helm.UpgradeWait(c.Wait),
+			helm.UpgradeTimeout(c.WaitTimeout))
+		return c.rollbackFailedUpgrade(rlsName, ns, res.GetRelease(), err)
+	}
+	res, err := c.Helm.InstallReleaseFromChart(
+		ch,
+		ns,
+		helm.ReleaseName(rlsName),
+		helm.ValueOverrides(values),
+		helm.InstallWait(c.Wait),
+		helm.InstallTimeout(c.WaitTimeout))
+	return res.GetRelease(), err
+}
 
-	return yaml.Marshal(re)
+// rollbackFailedUpgrade rolls the release back to its last deployed revision
+// if the upgrade failed and Rollback is set. The upgrade still counts as
+// failed, so its result is returned either way.
+func (c Controller) rollbackFailedUpgrade(rlsName, ns string, rls *release.Release, err error) (*release.Release, error) {
+	if err == nil || !c.Rollback {
+		return rls, err
+	}
+	version, rerr := c.rollback(rlsName, ns)
+	if rerr != nil {
+		metrics.RollbackFailures.Inc()
+		c.logger.Errorw("failed to roll back release", "release", rlsName, "error", rerr, "upgradeError", err)
+		return rls, err
+	}
+	if version == 0 {
+		c.logger.Debugw("nothing to roll back", "release", rlsName)
+		return rls, err
+	}
+	metrics.RolledBackReleases.Inc()
+	c.logger.Warnw("rolled back failed upgrade", "release", rlsName, "revision", version, "error", err)
+	return rls, err
 }
 
-func (c Controller) releaseExists(rlsName string) bool {
+// rollback rolls the release back to its last deployed revision and returns
+// that revision, 0 if there is none
+func (c Controller) rollback(rlsName, ns string) (int32, error) {
+	if c.Tillerless != nil {
+		return c.Tillerless.Rollback(rlsName, ns)
+	}
+	res, err := c.Helm.ReleaseHistory(rlsName, helm.WithMaxHistory(rollbackHistory))
+	if err != nil {
+		return 0, err
+	}
+	version := lastGoodVersion(res.GetReleases())
+	if version == 0 {
+		return 0, nil
+	}
+	_, err = c.Helm.RollbackRelease(
+		rlsName,
+		helm.RollbackVersion(version),
+		helm.RollbackWait(c.Wait),
+		helm.RollbackTimeout(c.WaitTimeout))
+	return version, err
+}
+
+// lastGoodVersion returns the newest revision that was deployed successfully.
+// Tiller marks the deployed revision superseded before it upgrades, so after a
+// failed upgrade no revision is deployed anymore.
+func lastGoodVersion(history []*release.Release) int32 {
+	var version int32
+	for _, r := range history {
+		switch r.GetInfo().GetStatus().GetCode() {
+		case release.Status_DEPLOYED, release.Status_SUPERSEDED:
+			if r.GetVersion() > version {
+				version = r.GetVersion()
+			}
+		}
+	}
+	return version
+}
+
+// loadChart returns the chart at ChartPath
+func (c Controller) loadChart() (*chart.Chart, error) {
+	if ch := c.chart.get(c.ChartPath); ch != nil {
+		return ch, nil
+	}
+	return chartutil.Load(c.ChartPath)
+}
+
+// validate checks the spec of the custom resource against the schema of the
+// chart
+func (c Controller) validate(r *unstructured.Unstructured, ch *chart.Chart) error {
+	s, err := chartSchema(ch)
+	if err != nil || s == nil {
+		return err
+	}
+	spec, ok := r.Object["spec"]
+	if !ok {
+		spec = map[string]interface{}{}
+	}
+	if err := s.Validate("spec", spec); err != nil {
+		metrics.ValidationFailures.Inc()
+		c.logger.Warnw("spec does not match the schema", "resource", r.GetName(), "error", err)
+		return err
+	}
+	return nil
+}
+
+// releaseHash identifies the chart and values of a release. It is empty if the
+// chart can't be loaded, which disables skipping upgrades.
+func (c Controller) releaseHash(ch *chart.Chart, ns string, values []byte) string {
+	if ch == nil {
+		return ""
+	}
+	parts := append([][]byte{[]byte(c.ChartPath), []byte(ns), values}, chartParts(ch)...)
+	return crhash.Sum(parts...)
+}
+
+// writeStatus reports the result of a reconcile, including the state of the
+// release when helm returned one.
+func (c Controller) writeStatus(r *unstructured.Unstructured, rls *release.Release, err error) {
+	s := crstatus.New(r, err)
+	if rls != nil {
+		s.Release = &crstatus.Release{
+			Name:      rls.GetName(),
+			Namespace: rls.GetNamespace(),
+			Revision:  rls.GetVersion(),
+			Status:    rls.GetInfo().GetStatus().GetCode().String(),
+		}
+	}
+	if werr := c.status.WriteStatus(r, s); werr != nil {
+		c.logger.Warnw("failed to write status", "resource", r.GetName(), "error", werr)
+	}
+}
+
+func (c Controller) marshallCR(r *unstructured.Unstructured) ([]byte, error) {
+	if c.Values != nil {
+		return c.Values.Values(r)
+	}
+	return yaml.Marshal(resourceValues(r))
+}
+
+func (c Controller) releaseExists(rlsName, ns string) bool {
 	statuses := []release.Status_Code{
 		release.Status_UNKNOWN,
 		release.Status_DEPLOYED,
@@ -172,7 +443,7 @@ func (c Controller) releaseExists(rlsName string) bool {
 		release.Status_PENDING_ROLLBACK,
 	}
 	r, err := c.Helm.ListReleases(
-		helm.ReleaseListNamespace(c.Namespace),
+		helm.ReleaseListNamespace(ns),
 		helm.ReleaseListFilter(rlsName),
 		helm.ReleaseListStatuses(statuses),
 	)
@@ -186,7 +457,3 @@ func (c Controller) releaseExists(rlsName string) bool {
 	}
 	return false
 }
-
-func (c Controller) releaseName(r *unstructured.Unstructured) string {
-	return fmt.Sprintf("%s-%s", c.ReleaseName, r.GetName())
-}
@@ -16,6 +16,7 @@ package helmctlr_test
 
 import (
 	"errors"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 	"testing"
@@ -25,9 +26,12 @@ import (
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/stretchr/testify/assert"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/helm/pkg/helm"
+	"k8s.io/helm/pkg/proto/hapi/chart"
 	"k8s.io/helm/pkg/proto/hapi/release"
 	"k8s.io/helm/pkg/proto/hapi/services"
 
+	"github.com/lostromos/lostromos/crstatus"
 	"github.com/lostromos/lostromos/helmctlr"
 	"github.com/lostromos/lostromos/metrics"
 )
@@ -195,7 +199,7 @@ func TestResourceAddedHappyPath(t *testing.T) {
 	tsExpected := timestampTestMap()
 	tsExpected["releases_last_create_timestamp_utc_seconds"] = greaterThan
 
-	assertMetrics(t, ct, func() { testController.ResourceAdded(testResource) }, tsExpected)
+	assertMetrics(t, ct, func() { assert.Nil(t, testController.ResourceAdded(testResource)) }, tsExpected)
 }
 
 func TestResourceAddedNoPriorReleaseHappyPath(t *testing.T) {
@@ -216,7 +220,7 @@ func TestResourceAddedNoPriorReleaseHappyPath(t *testing.T) {
 	tsExpected := timestampTestMap()
 	tsExpected["releases_last_create_timestamp_utc_seconds"] = greaterThan
 
-	assertMetrics(t, ct, func() { testController.ResourceAdded(testResource) }, tsExpected)
+	assertMetrics(t, ct, func() { assert.Nil(t, testController.ResourceAdded(testResource)) }, tsExpected)
 }
 
 func TestResourceRemoteRepoAddedHappyPath(t *testing.T) {
@@ -243,7 +247,7 @@ func TestResourceRemoteRepoAddedHappyPath(t *testing.T) {
 	tsExpected := timestampTestMap()
 	tsExpected["releases_last_create_timestamp_utc_seconds"] = greaterThan
 
-	assertMetrics(t, ct, func() { testController.ResourceAdded(testRemoteRepoResource) }, tsExpected)
+	assertMetrics(t, ct, func() { assert.Nil(t, testController.ResourceAdded(testRemoteRepoResource)) }, tsExpected)
 }
 
 func TestResourceRemoteRepoAddedFailureCase(t *testing.T) {
@@ -258,7 +262,7 @@ func TestResourceRemoteRepoAddedFailureCase(t *testing.T) {
 		remoteRepoErr: 1,
 	}
 
-	assertMetrics(t, ct, func() { testController.ResourceAdded(testRemoteRepoResource) }, timestampTestMap())
+	assertMetrics(t, ct, func() { assert.NotNil(t, testController.ResourceAdded(testRemoteRepoResource)) }, timestampTestMap())
 }
 
 // Happy path when resource exists...happens on startup
@@ -286,7 +290,7 @@ func TestResourceAddedHappyPathExists(t *testing.T) {
 	tsExpected := timestampTestMap()
 	tsExpected["releases_last_create_timestamp_utc_seconds"] = greaterThan
 
-	assertMetrics(t, ct, func() { testController.ResourceAdded(testResource) }, tsExpected)
+	assertMetrics(t, ct, func() { assert.Nil(t, testController.ResourceAdded(testResource)) }, tsExpected)
 }
 
 // List returns an error but install still works
@@ -308,7 +312,7 @@ func TestResourceAddedListErrorStillSuccessful(t *testing.T) {
 	tsExpected := timestampTestMap()
 	tsExpected["releases_last_create_timestamp_utc_seconds"] = greaterThan
 
-	assertMetrics(t, ct, func() { testController.ResourceAdded(testResource) }, tsExpected)
+	assertMetrics(t, ct, func() { assert.Nil(t, testController.ResourceAdded(testResource)) }, tsExpected)
 }
 
 // helm Install returns an error
@@ -328,7 +332,7 @@ func TestResourceAddedInstallErrors(t *testing.T) {
 	}
 	tsExpected := timestampTestMap()
 
-	assertMetrics(t, ct, func() { testController.ResourceAdded(testResource) }, tsExpected)
+	assertMetrics(t, ct, func() { assert.NotNil(t, testController.ResourceAdded(testResource)) }, tsExpected)
 }
 
 // helm update returns an error
@@ -354,7 +358,7 @@ func TestResourceAddedUpdateErrors(t *testing.T) {
 	}
 	tsExpected := timestampTestMap()
 
-	assertMetrics(t, ct, func() { testController.ResourceAdded(testResource) }, tsExpected)
+	assertMetrics(t, ct, func() { assert.NotNil(t, testController.ResourceAdded(testResource)) }, tsExpected)
 }
 
 func TestResourceDeleted(t *testing.T) {
@@ -373,7 +377,7 @@ func TestResourceDeleted(t *testing.T) {
 	tsExpected := timestampTestMap()
 	tsExpected["releases_last_delete_timestamp_utc_seconds"] = greaterThan
 
-	assertMetrics(t, ct, func() { testController.ResourceDeleted(testResource) }, tsExpected)
+	assertMetrics(t, ct, func() { assert.Nil(t, testController.ResourceDeleted(testResource)) }, tsExpected)
 }
 
 func TestResourceDeletedWhenDeleteFails(t *testing.T) {
@@ -390,7 +394,7 @@ func TestResourceDeletedWhenDeleteFails(t *testing.T) {
 	}
 	tsExpected := timestampTestMap()
 
-	assertMetrics(t, ct, func() { testController.ResourceDeleted(testResource) }, tsExpected)
+	assertMetrics(t, ct, func() { assert.NotNil(t, testController.ResourceDeleted(testResource)) }, tsExpected)
 }
 
 func TestResourceUpdatedHappyPath(t *testing.T) {
@@ -410,7 +414,7 @@ func TestResourceUpdatedHappyPath(t *testing.T) {
 	tsExpected := timestampTestMap()
 	tsExpected["releases_last_update_timestamp_utc_seconds"] = greaterThan
 
-	assertMetrics(t, ct, func() { testController.ResourceUpdated(testResource, testResource) }, tsExpected)
+	assertMetrics(t, ct, func() { assert.Nil(t, testController.ResourceUpdated(testResource, testResource)) }, tsExpected)
 }
 
 // Happy path when resource exists...happens on startup
@@ -437,7 +441,7 @@ func TestResourceUpdatedHappyPathExists(t *testing.T) {
 	tsExpected := timestampTestMap()
 	tsExpected["releases_last_update_timestamp_utc_seconds"] = greaterThan
 
-	assertMetrics(t, ct, func() { testController.ResourceUpdated(testResource, testResource) }, tsExpected)
+	assertMetrics(t, ct, func() { assert.Nil(t, testController.ResourceUpdated(testResource, testResource)) }, tsExpected)
 }
 
 // List returns an error but install still works
@@ -458,7 +462,7 @@ func TestResourceUpdatedListErrorStillSuccessful(t *testing.T) {
 	tsExpected := timestampTestMap()
 	tsExpected["releases_last_update_timestamp_utc_seconds"] = greaterThan
 
-	assertMetrics(t, ct, func() { testController.ResourceUpdated(testResource, testResource) }, tsExpected)
+	assertMetrics(t, ct, func() { assert.Nil(t, testController.ResourceUpdated(testResource, testResource)) }, tsExpected)
 }
 
 // helm Install returns an error
@@ -478,7 +482,7 @@ func TestResourceUpdatedInstallErrors(t *testing.T) {
 	}
 	tsExpected := timestampTestMap()
 
-	assertMetrics(t, ct, func() { testController.ResourceUpdated(testResource, testResource) }, tsExpected)
+	assertMetrics(t, ct, func() { assert.NotNil(t, testController.ResourceUpdated(testResource, testResource)) }, tsExpected)
 }
 
 // helm update returns an error
@@ -504,5 +508,336 @@ func TestResourceUpdatedUpdateErrors(t *testing.T) {
 	}
 	tsExpected := timestampTestMap()
 
-	assertMetrics(t, ct, func() { testController.ResourceUpdated(testResource, testResource) }, tsExpected)
+	assertMetrics(t, ct, func() { assert.NotNil(t, testController.ResourceUpdated(testResource, testResource)) }, tsExpected)
+}
+
+func rollbackTestController(mockHelm helm.Interface) *helmctlr.Controller {
+	c := helmctlr.NewController("../test/data/chart", "lostromos-test", "lostromostest", "0", false, 30, nil)
+	c.Helm = mockHelm
+	c.Rollback = true
+	return c
+}
+
+func expectFailedUpgrade(mockHelm *MockInterface) {
+	res := &services.ListReleasesResponse{Releases: []*release.Release{{Name: testReleaseName}}}
+	mockHelm.EXPECT().ListReleases(gomock.Any(), gomock.Any(), gomock.Any()).Return(res, nil)
+	mockHelm.EXPECT().UpdateRelease(testReleaseName, "../test/data/chart", gomock.Any(), gomock.Any(), gomock.Any()).Return(nil, errors.New("upgrade failed"))
+}
+
+func testRevision(version int32, code release.Status_Code) *release.Release {
+	return &release.Release{
+		Name:    testReleaseName,
+		Version: version,
+		Info:    &release.Info{Status: &release.Status{Code: code}},
+	}
+}
+
+func TestResourceUpdatedRollsBackFailedUpgrade(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	mockHelm := NewMockInterface(mockCtrl)
+	c := rollbackTestController(mockHelm)
+	expectFailedUpgrade(mockHelm)
+	history := &services.GetHistoryResponse{Releases: []*release.Release{
+		testRevision(3, release.Status_FAILED),
+		testRevision(2, release.Status_SUPERSEDED),
+		testRevision(1, release.Status_SUPERSEDED),
+	}}
+	mockHelm.EXPECT().ReleaseHistory(testReleaseName, gomock.Any()).Return(history, nil)
+	mockHelm.EXPECT().RollbackRelease(testReleaseName, gomock.Any(), gomock.Any(), gomock.Any())
+
+	before := getPromCounterValue("releases_rollback_total")
+	err := c.ResourceUpdated(testResource, testResource)
+	assert.NotNil(t, err, "the upgrade still fails")
+	assert.Equal(t, float64(1), getPromCounterValue("releases_rollback_total")-before)
+}
+
+func TestResourceUpdatedWithoutRevisionToRollBackTo(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	mockHelm := NewMockInterface(mockCtrl)
+	c := rollbackTestController(mockHelm)
+	expectFailedUpgrade(mockHelm)
+	history := &services.GetHistoryResponse{Releases: []*release.Release{testRevision(1, release.Status_FAILED)}}
+	mockHelm.EXPECT().ReleaseHistory(testReleaseName, gomock.Any()).Return(history, nil)
+
+	before := getPromCounterValue("releases_rollback_total")
+	assert.NotNil(t, c.ResourceUpdated(testResource, testResource))
+	assert.Equal(t, float64(0), getPromCounterValue("releases_rollback_total")-before)
+}
+
+func TestResourceUpdatedRollbackErrors(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	mockHelm := NewMockInterface(mockCtrl)
+	c := rollbackTestController(mockHelm)
+	expectFailedUpgrade(mockHelm)
+	history := &services.GetHistoryResponse{Releases: []*release.Release{
+		testRevision(1, release.Status_SUPERSEDED),
+		testRevision(2, release.Status_FAILED),
+	}}
+	mockHelm.EXPECT().ReleaseHistory(testReleaseName, gomock.Any()).Return(history, nil)
+	mockHelm.EXPECT().RollbackRelease(testReleaseName, gomock.Any(), gomock.Any(), gomock.Any()).Return(nil, errors.New("rollback failed"))
+
+	before := getPromCounterValue("releases_rollback_error_total")
+	err := c.ResourceUpdated(testResource, testResource)
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "upgrade failed")
+	assert.Equal(t, float64(1), getPromCounterValue("releases_rollback_error_total")-before)
+}
+
+func TestResourceAddedInstallsIntoResourceNamespace(t *testing.T) {
+	c := helmctlr.NewController("../test/data/chart", "lostromos-test", "lostromostest", "0", false, 30, nil)
+	c.NamespaceMode = helmctlr.NamespaceResource
+	c.AllowedNamespaces = []string{"pixar"}
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	mockHelm := NewMockInterface(mockCtrl)
+	c.Helm = mockHelm
+	r := testResource.DeepCopy()
+	r.SetNamespace("pixar")
+	mockHelm.EXPECT().ListReleases(gomock.Any(), gomock.Any(), gomock.Any()).Return(&services.ListReleasesResponse{}, nil)
+	mockHelm.EXPECT().InstallRelease(c.ChartPath, "pixar", gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any())
+	assert.Nil(t, c.ResourceAdded(r))
+
+	// Nothing is installed into namespaces that are not allowed
+	r.SetNamespace("dreamworks")
+	err := c.ResourceAdded(r)
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "not allowed")
+}
+
+// A release whose custom resource picks another namespace is deleted from the
+// namespace recorded in the status before it is installed again
+func TestResourceUpdatedMovesReleaseToNewNamespace(t *testing.T) {
+	c := helmctlr.NewController("../test/data/chart", "lostromos-test", "lostromostest", "0", false, 30, nil)
+	c.NamespaceMode = helmctlr.NamespaceAnnotation
+	c.AllowedNamespaces = []string{"reef", "ocean"}
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	mockHelm := NewMockInterface(mockCtrl)
+	c.Helm = mockHelm
+	r := testResource.DeepCopy()
+	r.SetAnnotations(map[string]string{helmctlr.ReleaseNamespaceAnnotation: "ocean"})
+	r.Object["status"] = map[string]interface{}{
+		"release": map[string]interface{}{"name": testReleaseName, "namespace": "reef"},
+	}
+	installed := &services.ListReleasesResponse{Releases: []*release.Release{{Name: testReleaseName, Namespace: "reef"}}}
+
+	gomock.InOrder(
+		mockHelm.EXPECT().ListReleases(gomock.Any(), gomock.Any(), gomock.Any()).Return(installed, nil),
+		mockHelm.EXPECT().DeleteRelease(testReleaseName, gomock.Any()),
+		mockHelm.EXPECT().ListReleases(gomock.Any(), gomock.Any(), gomock.Any()).Return(&services.ListReleasesResponse{}, nil),
+		mockHelm.EXPECT().InstallRelease(c.ChartPath, "ocean", gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()),
+	)
+	assert.Nil(t, c.ResourceUpdated(r, r))
+}
+
+type testStatusWriter struct {
+	statuses []*crstatus.Status
+}
+
+func (w *testStatusWriter) WriteStatus(r *unstructured.Unstructured, s *crstatus.Status) error {
+	w.statuses = append(w.statuses, s)
+	return nil
+}
+
+func TestResourceAddedWritesReleaseStatus(t *testing.T) {
+	c := helmctlr.NewController("../test/data/chart", "lostromos-test", "lostromostest", "0", false, 30, nil)
+	sw := &testStatusWriter{}
+	c.SetStatusWriter(sw)
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	mockHelm := NewMockInterface(mockCtrl)
+	c.Helm = mockHelm
+	listOpts := []interface{}{gomock.Any(), gomock.Any(), gomock.Any()}
+	mockHelm.EXPECT().ListReleases(listOpts...).Return(&services.ListReleasesResponse{}, nil)
+	installOpts := []interface{}{gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()}
+	res := &services.InstallReleaseResponse{
+		Release: &release.Release{
+			Name:      testReleaseName,
+			Namespace: c.Namespace,
+			Version:   1,
+			Info: &release.Info{
+				Status: &release.Status{Code: release.Status_DEPLOYED},
+			},
+		},
+	}
+	mockHelm.EXPECT().InstallRelease(c.ChartPath, c.Namespace, installOpts...).Return(res, nil)
+
+	assert.Nil(t, c.ResourceAdded(testResource))
+	assert.Len(t, sw.statuses, 1)
+	assert.Equal(t, crstatus.PhaseApplied, sw.statuses[0].Phase)
+	assert.Equal(t, &crstatus.Release{Name: testReleaseName, Namespace: c.Namespace, Revision: 1, Status: "DEPLOYED"}, sw.statuses[0].Release)
+}
+
+func TestResourceAddedWritesFailedStatus(t *testing.T) {
+	c := helmctlr.NewController("../test/data/chart", "lostromos-test", "lostromostest", "0", false, 30, nil)
+	sw := &testStatusWriter{}
+	c.SetStatusWriter(sw)
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	mockHelm := NewMockInterface(mockCtrl)
+	c.Helm = mockHelm
+	listOpts := []interface{}{gomock.Any(), gomock.Any(), gomock.Any()}
+	mockHelm.EXPECT().ListReleases(listOpts...).Return(&services.ListReleasesResponse{}, nil)
+	installOpts := []interface{}{gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()}
+	mockHelm.EXPECT().InstallRelease(c.ChartPath, c.Namespace, installOpts...).Return(nil, errors.New("install failed"))
+
+	assert.NotNil(t, c.ResourceAdded(testResource))
+	assert.Len(t, sw.statuses, 1)
+	assert.Equal(t, crstatus.PhaseFailed, sw.statuses[0].Phase)
+	assert.Equal(t, "install failed", sw.statuses[0].Message)
+	assert.Nil(t, sw.statuses[0].Release)
+}
+
+func TestResourceUpdatedSkipsUnchangedRelease(t *testing.T) {
+	c := helmctlr.NewController("../test/data/helm/chart", "lostromos-test", "lostromostest", "0", false, 30, nil)
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	mockHelm := NewMockInterface(mockCtrl)
+	c.Helm = mockHelm
+	listOpts := []interface{}{gomock.Any(), gomock.Any(), gomock.Any()}
+	mockHelm.EXPECT().ListReleases(listOpts...).Return(&services.ListReleasesResponse{}, nil)
+	installOpts := []interface{}{gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()}
+	mockHelm.EXPECT().InstallReleaseFromChart(gomock.Any(), c.Namespace, installOpts...)
+	assert.Nil(t, c.ResourceAdded(testResource))
+
+	sw := &testStatusWriter{}
+	c.SetStatusWriter(sw)
+	updated := testResource.DeepCopy()
+	updated.SetResourceVersion("2")
+	skipped := getPromCounterValue("releases_event_skipped_total")
+	ct := counterTest{
+		events: 1,
+	}
+	assertMetrics(t, ct, func() { assert.Nil(t, c.ResourceUpdated(testResource, updated)) }, timestampTestMap())
+	assert.Equal(t, float64(1), getPromCounterValue("releases_event_skipped_total")-skipped)
+	assert.Empty(t, sw.statuses)
+
+	// A new generation with the same values is skipped, but its status written
+	respecced := updated.DeepCopy()
+	respecced.SetResourceVersion("3")
+	respecced.SetGeneration(updated.GetGeneration() + 1)
+	assert.Nil(t, c.ResourceUpdated(updated, respecced))
+	assert.Len(t, sw.statuses, 1)
+	assert.Equal(t, respecced.GetGeneration(), sw.statuses[0].Generation)
+
+	res := &services.ListReleasesResponse{Releases: []*release.Release{{Name: testReleaseName}}}
+	opts := []interface{}{gomock.Any(), gomock.Any(), gomock.Any()}
+	// Resyncs are upgraded all the same
+	mockHelm.EXPECT().ListReleases(listOpts...).Return(res, nil)
+	mockHelm.EXPECT().UpdateReleaseFromChart(testReleaseName, gomock.Any(), opts...)
+	assert.Nil(t, c.ResourceUpdated(respecced, respecced))
+
+	changed := respecced.DeepCopy()
+	changed.SetResourceVersion("4")
+	changed.Object["spec"] = map[string]interface{}{"Name": "Nemo"}
+	mockHelm.EXPECT().ListReleases(listOpts...).Return(res, nil)
+	mockHelm.EXPECT().UpdateReleaseFromChart(testReleaseName, gomock.Any(), opts...)
+	assert.Nil(t, c.ResourceUpdated(respecced, changed))
+}
+
+func TestResourceUpdatedUpgradesAgainAfterDelete(t *testing.T) {
+	c := helmctlr.NewController("../test/data/helm/chart", "lostromos-test", "lostromostest", "0", false, 30, nil)
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	mockHelm := NewMockInterface(mockCtrl)
+	c.Helm = mockHelm
+	listOpts := []interface{}{gomock.Any(), gomock.Any(), gomock.Any()}
+	mockHelm.EXPECT().ListReleases(listOpts...).Return(&services.ListReleasesResponse{}, nil).Times(2)
+	installOpts := []interface{}{gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()}
+	mockHelm.EXPECT().InstallReleaseFromChart(gomock.Any(), c.Namespace, installOpts...).Times(2)
+	mockHelm.EXPECT().DeleteRelease(testReleaseName, gomock.Any())
+
+	assert.Nil(t, c.ResourceAdded(testResource))
+	assert.Nil(t, c.ResourceDeleted(testResource))
+	assert.Nil(t, c.ResourceUpdated(testResource, testResource))
+}
+
+func copyChart(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "chart")
+	assert.Nil(t, err)
+	src := "../test/data/helm/chart"
+	err = filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(src, path)
+		if info.IsDir() {
+			return os.MkdirAll(filepath.Join(dir, rel), 0755)
+		}
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		return ioutil.WriteFile(filepath.Join(dir, rel), data, 0644)
+	})
+	assert.Nil(t, err)
+	return dir
+}
+
+func TestReloadChartKeepsPreviousChartOnFailure(t *testing.T) {
+	dir := copyChart(t)
+	defer os.RemoveAll(dir)
+	c := helmctlr.NewController(dir, "lostromos-test", "lostromostest", "0", false, 30, nil)
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	mockHelm := NewMockInterface(mockCtrl)
+	c.Helm = mockHelm
+	listOpts := []interface{}{gomock.Any(), gomock.Any(), gomock.Any()}
+	mockHelm.EXPECT().ListReleases(listOpts...).Return(&services.ListReleasesResponse{}, nil).AnyTimes()
+	installOpts := []interface{}{gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()}
+	var versions []string
+	mockHelm.EXPECT().InstallReleaseFromChart(gomock.Any(), c.Namespace, installOpts...).
+		Do(func(ch *chart.Chart, ns string, opts ...helm.InstallOption) {
+			versions = append(versions, ch.GetMetadata().GetVersion())
+		}).Times(3)
+	chartFile := filepath.Join(dir, "Chart.yaml")
+
+	assert.Nil(t, c.ResourceAdded(testResource))
+
+	assert.Nil(t, ioutil.WriteFile(chartFile, []byte("name: [broken"), 0644))
+	assert.NotNil(t, c.ReloadChart())
+	assert.Nil(t, c.ResourceAdded(testResource))
+
+	assert.Nil(t, ioutil.WriteFile(chartFile, []byte("apiVersion: v1\nname: helloworld\nversion: 9.9.9\n"), 0644))
+	assert.Nil(t, c.ReloadChart())
+	assert.Nil(t, c.ResourceAdded(testResource))
+
+	assert.Equal(t, versions[0], versions[1])
+	assert.Equal(t, "9.9.9", versions[2])
+}
+
+func TestResourceAddedValidatesSpec(t *testing.T) {
+	dir := copyChart(t)
+	defer os.RemoveAll(dir)
+	schemaFile := filepath.Join(dir, helmctlr.SchemaFile)
+	assert.Nil(t, ioutil.WriteFile(schemaFile, []byte(`{"type": "object", "required": ["Size"]}`), 0644))
+	c := helmctlr.NewController(dir, "lostromos-test", "lostromostest", "0", false, 30, nil)
+	sw := &testStatusWriter{}
+	c.SetStatusWriter(sw)
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	mockHelm := NewMockInterface(mockCtrl)
+	c.Helm = mockHelm
+
+	err := c.ResourceAdded(testResource)
+	assert.NotNil(t, err)
+	assert.Len(t, sw.statuses, 1)
+	assert.Equal(t, crstatus.PhaseFailed, sw.statuses[0].Phase)
+	assert.Equal(t, []string{"spec.Size: is required"}, sw.statuses[0].Violations)
+
+	assert.Nil(t, ioutil.WriteFile(schemaFile, []byte(`{"type": "object", "required": ["Name"]}`), 0644))
+	assert.Nil(t, c.ReloadChart())
+	listOpts := []interface{}{gomock.Any(), gomock.Any(), gomock.Any()}
+	mockHelm.EXPECT().ListReleases(listOpts...).Return(&services.ListReleasesResponse{}, nil)
+	installOpts := []interface{}{gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()}
+	mockHelm.EXPECT().InstallReleaseFromChart(gomock.Any(), c.Namespace, installOpts...)
+	assert.Nil(t, c.ResourceAdded(testResource))
+
+	assert.Nil(t, ioutil.WriteFile(schemaFile, []byte(`{"type": `), 0644))
+	err = c.ReloadChart()
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), helmctlr.SchemaFile)
 }
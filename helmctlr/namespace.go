@@ -0,0 +1,124 @@
+// Copyright 2017 the lostromos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package helmctlr
+
+import (
+	"fmt"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+
+	"github.com/lostromos/lostromos/crhash"
+)
+
+// Namespace modes pick the namespace the release of a custom resource is
+// installed into
+const (
+	NamespaceFixed      = "fixed"      // Namespace of the controller
+	NamespaceResource   = "resource"   // namespace of the custom resource
+	NamespaceAnnotation = "annotation" // namespace named by the ReleaseNamespaceAnnotation of the custom resource
+)
+
+// ReleaseNamespaceAnnotation names the namespace to install the release of a
+// custom resource into with the annotation namespace mode
+const ReleaseNamespaceAnnotation = "lostromos.io/namespace"
+
+// maxReleaseName is the longest release name Helm accepts
+const maxReleaseName = 53
+
+// releaseHashLength is how many characters of the hash of the custom resource
+// are added to release names that need one
+const releaseHashLength = 8
+
+// releaseNamespace returns the namespace the release of the custom resource is
+// installed into. Custom resources without a namespace use Namespace.
+func (c Controller) releaseNamespace(r *unstructured.Unstructured) (string, error) {
+	var ns string
+	switch c.NamespaceMode {
+	case "", NamespaceFixed:
+		return c.Namespace, nil
+	case NamespaceResource:
+		ns = r.GetNamespace()
+	case NamespaceAnnotation:
+		ns = r.GetAnnotations()[ReleaseNamespaceAnnotation]
+	default:
+		return "", fmt.Errorf("unknown namespace mode %q", c.NamespaceMode)
+	}
+	if ns == "" {
+		ns = c.Namespace
+	}
+	if !c.namespaceAllowed(r, ns) {
+		return "", fmt.Errorf("namespace %q is not allowed for releases", ns)
+	}
+	return ns, nil
+}
+
+// namespaceAllowed reports whether the release of the custom resource may be
+// installed into ns. Without AllowedNamespaces the annotation mode only allows
+// the namespace of the custom resource and Namespace, so the annotation can't
+// be used to install into any namespace.
+func (c Controller) namespaceAllowed(r *unstructured.Unstructured, ns string) bool {
+	if len(c.AllowedNamespaces) == 0 {
+		if c.NamespaceMode == NamespaceAnnotation {
+			return ns == r.GetNamespace() || ns == c.Namespace
+		}
+		return true
+	}
+	for _, allowed := range c.AllowedNamespaces {
+		if allowed == ns {
+			return true
+		}
+	}
+	return false
+}
+
+// installedNamespace returns the namespace the release of the custom resource
+// was installed into as recorded in its status, empty if it is not known
+func installedNamespace(r *unstructured.Unstructured, rlsName string) string {
+	status, _ := r.Object["status"].(map[string]interface{})
+	rls, _ := status["release"].(map[string]interface{})
+	if name, _ := rls["name"].(string); name != rlsName {
+		return ""
+	}
+	ns, _ := rls["namespace"].(string)
+	return ns
+}
+
+// releaseName returns the name of the release of the custom resource. With
+// NamespacedReleaseNames it includes the namespace of the custom resource and a
+// hash of its namespace/name key, so custom resources with the same name in
+// different namespaces, or names like a/b-c and a-b/c, don't collide. Names
+// longer than Helm allows are shortened and end in a hash of the full name.
+func (c Controller) releaseName(r *unstructured.Unstructured) string {
+	if c.NamespacedReleaseNames && r.GetNamespace() != "" {
+		name := fmt.Sprintf("%s-%s-%s", c.ReleaseName, r.GetNamespace(), r.GetName())
+		return withHash(name, crhash.Key(r))
+	}
+	name := fmt.Sprintf("%s-%s", c.ReleaseName, r.GetName())
+	if len(name) > maxReleaseName {
+		return withHash(name, name)
+	}
+	return name
+}
+
+// withHash appends a short hash of key to name, shortening name so the result
+// is a valid release name
+func withHash(name, key string) string {
+	hash := crhash.Sum([]byte(key))[:releaseHashLength]
+	if max := maxReleaseName - releaseHashLength - 1; len(name) > max {
+		name = strings.TrimRight(name[:max], "-.")
+	}
+	return name + "-" + hash
+}
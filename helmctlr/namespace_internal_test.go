@@ -0,0 +1,117 @@
+// Copyright 2017 the lostromos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package helmctlr
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+func namespacedResource(ns string, annotations map[string]string) *unstructured.Unstructured {
+	r := &unstructured.Unstructured{Object: map[string]interface{}{}}
+	r.SetName("dory")
+	r.SetNamespace(ns)
+	r.SetAnnotations(annotations)
+	return r
+}
+
+func TestReleaseNamespace(t *testing.T) {
+	annotated := map[string]string{ReleaseNamespaceAnnotation: "reef"}
+	tests := []struct {
+		mode     string
+		allowed  []string
+		resource *unstructured.Unstructured
+		ns       string
+		err      string
+	}{
+		{mode: "", resource: namespacedResource("pixar", annotated), ns: "lostromos"},
+		{mode: NamespaceFixed, allowed: []string{"pixar"}, resource: namespacedResource("pixar", nil), ns: "lostromos"},
+		{mode: NamespaceResource, resource: namespacedResource("pixar", annotated), ns: "pixar"},
+		{mode: NamespaceResource, resource: namespacedResource("", nil), ns: "lostromos"},
+		{mode: NamespaceAnnotation, allowed: []string{"reef"}, resource: namespacedResource("pixar", annotated), ns: "reef"},
+		{mode: NamespaceAnnotation, resource: namespacedResource("reef", annotated), ns: "reef"},
+		{mode: NamespaceAnnotation, resource: namespacedResource("pixar", annotated), err: `namespace "reef" is not allowed`},
+		{mode: NamespaceAnnotation, resource: namespacedResource("pixar", map[string]string{ReleaseNamespaceAnnotation: "lostromos"}), ns: "lostromos"},
+		{mode: NamespaceAnnotation, resource: namespacedResource("pixar", nil), ns: "lostromos"},
+		{mode: NamespaceResource, allowed: []string{"pixar", "reef"}, resource: namespacedResource("pixar", nil), ns: "pixar"},
+		{mode: NamespaceAnnotation, allowed: []string{"pixar"}, resource: namespacedResource("pixar", annotated), err: `namespace "reef" is not allowed`},
+		{mode: "cluster", resource: namespacedResource("pixar", nil), err: `unknown namespace mode "cluster"`},
+	}
+	for _, test := range tests {
+		c := Controller{Namespace: "lostromos", NamespaceMode: test.mode, AllowedNamespaces: test.allowed}
+		ns, err := c.releaseNamespace(test.resource)
+		if test.err != "" {
+			if assert.NotNil(t, err, test.mode) {
+				assert.Contains(t, err.Error(), test.err)
+			}
+			continue
+		}
+		assert.Nil(t, err, test.mode)
+		assert.Equal(t, test.ns, ns, test.mode)
+	}
+}
+
+func TestReleaseName(t *testing.T) {
+	c := Controller{ReleaseName: "lostromos"}
+	assert.Equal(t, "lostromos-dory", c.releaseName(namespacedResource("pixar", nil)))
+
+	c.NamespacedReleaseNames = true
+	name := c.releaseName(namespacedResource("pixar", nil))
+	assert.Regexp(t, "^lostromos-pixar-dory-[0-9a-f]{8}$", name)
+	assert.Equal(t, "lostromos-dory", c.releaseName(namespacedResource("", nil)))
+}
+
+func TestNamespacedReleaseNamesDontCollide(t *testing.T) {
+	c := Controller{ReleaseName: "lostromos", NamespacedReleaseNames: true}
+	a := namespacedResource("a", nil)
+	a.SetName("b-c")
+	b := namespacedResource("a-b", nil)
+	b.SetName("c")
+	assert.NotEqual(t, c.releaseName(a), c.releaseName(b))
+}
+
+func TestLongReleaseNamesAreShortened(t *testing.T) {
+	long := strings.Repeat("nemo-", 12)
+	c := Controller{ReleaseName: "lostromos"}
+	r := namespacedResource("pixar", nil)
+	r.SetName(long + "a")
+	other := namespacedResource("pixar", nil)
+	other.SetName(long + "b")
+
+	for _, namespaced := range []bool{false, true} {
+		c.NamespacedReleaseNames = namespaced
+		name := c.releaseName(r)
+		assert.True(t, len(name) <= maxReleaseName, name)
+		assert.Regexp(t, "^lostromos-.*[a-z0-9]-[0-9a-f]{8}$", name)
+		assert.NotEqual(t, name, c.releaseName(other))
+	}
+}
+
+func TestInstalledNamespace(t *testing.T) {
+	r := namespacedResource("pixar", nil)
+	assert.Equal(t, "", installedNamespace(r, "lostromos-dory"))
+
+	r.Object["status"] = map[string]interface{}{
+		"release": map[string]interface{}{
+			"name":      "lostromos-dory",
+			"namespace": "reef",
+		},
+	}
+	assert.Equal(t, "reef", installedNamespace(r, "lostromos-dory"))
+	assert.Equal(t, "", installedNamespace(r, "lostromos-pixar-dory"))
+}
@@ -7,6 +7,7 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
 
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/helm/pkg/downloader"
@@ -17,6 +18,10 @@ import (
 	"github.com/lostromos/lostromos/metrics"
 )
 
+// chartLock serializes chart downloads so that workers reconciling different
+// CRs never write the same chart cache directory at the same time.
+var chartLock sync.Mutex
+
 // GetChartRef reads the chart entry from CR spec and returns chart entry or empty string.
 func GetChartRef(r *unstructured.Unstructured) string {
 	if chart, ok := r.GetAnnotations()["chart"]; ok {
@@ -30,9 +35,11 @@ func GetChartRef(r *unstructured.Unstructured) string {
 // puts it into versioned folder, and returns that folder
 // Uses chart downloader to download the charts
 // 	- chart downloader uses the version passed, but if version is empty, pulls the latest version.
-// Prerequisite: Repo should have been initialized under HELM_HOME
+// Prerequisite: Repo should have been initialized under HELM_HOME, or be one of ChartRepos
 func (c *Controller) GetRemoteChart(chartRef string) (string, error) {
-	chartDir, err := getRemoteChart(chartRef)
+	chartLock.Lock()
+	chartDir, err := getRemoteChart(chartRef, c.ChartRepos)
+	chartLock.Unlock()
 	if err != nil {
 		metrics.RemoteRepoError.Inc()
 		c.logger.Errorw("failed to fetch chart from remote repo", "error", err, "chart", chartRef)
@@ -43,15 +50,21 @@ func (c *Controller) GetRemoteChart(chartRef string) (string, error) {
 	return chartDir, err
 }
 
-func getRemoteChart(chartRef string) (string, error) {
+func getRemoteChart(chartRef string, repos *ChartRepos) (string, error) {
 	chartName, chartVersion := SplitChartRef(chartRef)
 	if chartName == "" {
 		return "", errors.New("no chart name provided")
 	}
 
-	dl := getChartDownloader()
+	dl := getChartDownloader(repos)
 
 	url, _, err := dl.ResolveChartVersion(chartName, chartVersion)
+	if err != nil && repos != nil {
+		// The chart may have been published after the indexes were downloaded
+		if err = repos.Update(); err == nil {
+			url, _, err = dl.ResolveChartVersion(chartName, chartVersion)
+		}
+	}
 	if err != nil {
 		return "", fmt.Errorf("cannot resolve chart version: %s", err)
 	}
@@ -79,7 +92,15 @@ func getRemoteChart(chartRef string) (string, error) {
 	return chartPath, nil
 }
 
-func getChartDownloader() downloader.ChartDownloader {
+func getChartDownloader(repos *ChartRepos) downloader.ChartDownloader {
+	if repos != nil {
+		return downloader.ChartDownloader{
+			HelmHome: repos.Home,
+			Out:      os.Stdout,
+			Getters:  repos.getters(),
+			Verify:   downloader.VerifyIfPossible,
+		}
+	}
 	helmHome := helmpath.Home(os.Getenv("HELM_HOME"))
 	dl := downloader.ChartDownloader{
 		HelmHome: helmHome,
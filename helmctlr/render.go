@@ -0,0 +1,204 @@
+// Copyright 2017 the lostromos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package helmctlr
+
+import (
+	"bytes"
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/ghodss/yaml"
+	"k8s.io/helm/pkg/chartutil"
+	"k8s.io/helm/pkg/engine"
+	"k8s.io/helm/pkg/hooks"
+	"k8s.io/helm/pkg/proto/hapi/chart"
+	"k8s.io/helm/pkg/proto/hapi/release"
+	"k8s.io/helm/pkg/releaseutil"
+)
+
+var hookEvents = map[string]release.Hook_Event{
+	hooks.PreInstall:         release.Hook_PRE_INSTALL,
+	hooks.PostInstall:        release.Hook_POST_INSTALL,
+	hooks.PreDelete:          release.Hook_PRE_DELETE,
+	hooks.PostDelete:         release.Hook_POST_DELETE,
+	hooks.PreUpgrade:         release.Hook_PRE_UPGRADE,
+	hooks.PostUpgrade:        release.Hook_POST_UPGRADE,
+	hooks.PreRollback:        release.Hook_PRE_ROLLBACK,
+	hooks.PostRollback:       release.Hook_POST_ROLLBACK,
+	hooks.ReleaseTestSuccess: release.Hook_RELEASE_TEST_SUCCESS,
+	hooks.ReleaseTestFailure: release.Hook_RELEASE_TEST_FAILURE,
+}
+
+var hookDeletePolicies = map[string]release.Hook_DeletePolicy{
+	hooks.HookSucceeded:      release.Hook_SUCCEEDED,
+	hooks.HookFailed:         release.Hook_FAILED,
+	hooks.BeforeHookCreation: release.Hook_BEFORE_HOOK_CREATION,
+}
+
+// renderChart renders the chart and its dependencies with the Helm engine, the
+// way Tiller does. It returns the hooks of the chart and a manifest of all
+// other objects. Partials, whose names start with an underscore, and NOTES.txt
+// are not part of either.
+func renderChart(ch *chart.Chart, values []byte, opts chartutil.ReleaseOptions, caps *chartutil.Capabilities) ([]*release.Hook, []byte, error) {
+	config := &chart.Config{Raw: string(values)}
+	if err := chartutil.ProcessRequirementsEnabled(ch, config); err != nil {
+		return nil, nil, err
+	}
+	if err := chartutil.ProcessRequirementsImportValues(ch); err != nil {
+		return nil, nil, err
+	}
+	vals, err := chartutil.ToRenderValuesCaps(ch, config, opts, caps)
+	if err != nil {
+		return nil, nil, err
+	}
+	rendered, err := engine.New().Render(ch, vals)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	names := make([]string, 0, len(rendered))
+	for name := range rendered {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var hks []*release.Hook
+	var manifest bytes.Buffer
+	for _, name := range names {
+		base := path.Base(name)
+		if strings.HasPrefix(base, "_") || base == "NOTES.txt" || strings.TrimSpace(rendered[name]) == "" {
+			continue
+		}
+		fileHooks, generic, err := splitHooks(name, rendered[name])
+		if err != nil {
+			return nil, nil, err
+		}
+		hks = append(hks, fileHooks...)
+		for _, m := range generic {
+			fmt.Fprintf(&manifest, "---\n# Source: %s\n%s\n", name, m)
+		}
+	}
+	return hks, manifest.Bytes(), nil
+}
+
+// splitHooks splits the rendered template into its documents and separates the
+// ones annotated with helm.sh/hook from the others, like Tiller does. Documents
+// with unknown hook types are dropped.
+func splitHooks(name, content string) ([]*release.Hook, []string, error) {
+	entries := releaseutil.SplitManifests(content)
+	keys := make([]string, 0, len(entries))
+	for key := range entries {
+		keys = append(keys, key)
+	}
+	// SplitManifests names the documents manifest-0, manifest-1, ...
+	sort.Slice(keys, func(i, j int) bool {
+		return manifestIndex(keys[i]) < manifestIndex(keys[j])
+	})
+
+	var hks []*release.Hook
+	var generic []string
+	for _, key := range keys {
+		m := entries[key]
+		var head releaseutil.SimpleHead
+		if err := yaml.Unmarshal([]byte(m), &head); err != nil {
+			return nil, nil, fmt.Errorf("YAML parse error on %s: %s", name, err)
+		}
+		var annotations map[string]string
+		if head.Metadata != nil {
+			annotations = head.Metadata.Annotations
+		}
+		hookTypes, ok := annotations[hooks.HookAnno]
+		if !ok {
+			generic = append(generic, m)
+			continue
+		}
+		weight, _ := strconv.Atoi(annotations[hooks.HookWeightAnno])
+		h := &release.Hook{
+			Name:     head.Metadata.Name,
+			Kind:     head.Kind,
+			Path:     name,
+			Manifest: m,
+			Weight:   int32(weight),
+		}
+		if h.Events = parseHookEvents(hookTypes); h.Events == nil {
+			continue
+		}
+		for _, p := range splitAnnotation(annotations[hooks.HookDeleteAnno]) {
+			if policy, ok := hookDeletePolicies[p]; ok {
+				h.DeletePolicies = append(h.DeletePolicies, policy)
+			}
+		}
+		hks = append(hks, h)
+	}
+	return hks, generic, nil
+}
+
+// parseHookEvents returns the events of the helm.sh/hook annotation, or nil if
+// any of them is unknown
+func parseHookEvents(value string) []release.Hook_Event {
+	var events []release.Hook_Event
+	for _, t := range splitAnnotation(value) {
+		e, ok := hookEvents[t]
+		if !ok {
+			return nil
+		}
+		events = append(events, e)
+	}
+	return events
+}
+
+func splitAnnotation(value string) []string {
+	var values []string
+	for _, v := range strings.Split(value, ",") {
+		if v = strings.ToLower(strings.TrimSpace(v)); v != "" {
+			values = append(values, v)
+		}
+	}
+	return values
+}
+
+func manifestIndex(key string) int {
+	i, _ := strconv.Atoi(strings.TrimPrefix(key, "manifest-"))
+	return i
+}
+
+// hooksFor returns the hooks of rls that run on the event, ordered by weight
+// like Tiller runs them
+func hooksFor(rls *release.Release, event release.Hook_Event) []*release.Hook {
+	var hks []*release.Hook
+	for _, h := range rls.GetHooks() {
+		for _, e := range h.GetEvents() {
+			if e == event {
+				hks = append(hks, h)
+				break
+			}
+		}
+	}
+	sort.SliceStable(hks, func(i, j int) bool {
+		return hks[i].GetWeight() < hks[j].GetWeight()
+	})
+	return hks
+}
+
+func hasDeletePolicy(h *release.Hook, policy release.Hook_DeletePolicy) bool {
+	for _, p := range h.GetDeletePolicies() {
+		if p == policy {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,118 @@
+// Copyright 2017 the lostromos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package helmctlr
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"k8s.io/helm/pkg/chartutil"
+	"k8s.io/helm/pkg/proto/hapi/chart"
+	"k8s.io/helm/pkg/proto/hapi/release"
+)
+
+const hookTemplate = `apiVersion: batch/v1
+kind: Job
+metadata:
+  name: {{ .Release.Name }}-migrate
+  annotations:
+    "helm.sh/hook": pre-install,pre-upgrade
+    "helm.sh/hook-weight": "{{ .Values.weight }}"
+    "helm.sh/hook-delete-policy": before-hook-creation
+spec:
+  template:
+    spec:
+      restartPolicy: Never
+      containers:
+      - name: migrate
+        image: migrate
+---
+apiVersion: v1
+kind: Pod
+metadata:
+  name: {{ .Release.Name }}-unknown
+  annotations:
+    "helm.sh/hook": pre-everything
+`
+
+const sprigTemplate = `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: {{ .Release.Name }}-sprig
+data:
+  replicas: "{{ add (int .Values.replicas) 1 }}"
+  {{- if semverCompare ">=1.8" .Capabilities.KubeVersion.GitVersion }}
+  modern: "true"
+  {{- end }}
+`
+
+func renderTestChart(t *testing.T, templates map[string]string, values string) ([]*release.Hook, string) {
+	ch := &chart.Chart{Metadata: &chart.Metadata{Name: "render", Version: "0.1.0"}}
+	for name, data := range templates {
+		ch.Templates = append(ch.Templates, &chart.Template{Name: name, Data: []byte(data)})
+	}
+	caps := &chartutil.Capabilities{
+		APIVersions: chartutil.DefaultVersionSet,
+		KubeVersion: chartutil.DefaultKubeVersion,
+	}
+	hks, manifest, err := renderChart(ch, []byte(values), chartutil.ReleaseOptions{Name: "dory", Namespace: "lostromos", IsInstall: true}, caps)
+	assert.Nil(t, err)
+	return hks, string(manifest)
+}
+
+func TestRenderChartSupportsSprig(t *testing.T) {
+	_, manifest := renderTestChart(t, map[string]string{
+		"templates/configmap.yaml": sprigTemplate,
+		"templates/NOTES.txt":      "installed {{ .Release.Name }}",
+	}, "replicas: \"2\"")
+	assert.Contains(t, manifest, "# Source: render/templates/configmap.yaml")
+	assert.Contains(t, manifest, `replicas: "3"`)
+	assert.Contains(t, manifest, `modern: "true"`)
+	assert.NotContains(t, manifest, "installed dory")
+}
+
+func TestRenderChartSplitsHooks(t *testing.T) {
+	hks, manifest := renderTestChart(t, map[string]string{
+		"templates/configmap.yaml": sprigTemplate,
+		"templates/hooks.yaml":     hookTemplate,
+	}, "replicas: 1\nweight: 5")
+	assert.NotContains(t, manifest, "dory-migrate")
+	assert.NotContains(t, manifest, "dory-unknown")
+	assert.Contains(t, manifest, "name: dory-sprig")
+	if !assert.Len(t, hks, 1) {
+		return
+	}
+	h := hks[0]
+	assert.Equal(t, "dory-migrate", h.GetName())
+	assert.Equal(t, "Job", h.GetKind())
+	assert.Equal(t, "render/templates/hooks.yaml", h.GetPath())
+	assert.Equal(t, int32(5), h.GetWeight())
+	assert.Equal(t, []release.Hook_Event{release.Hook_PRE_INSTALL, release.Hook_PRE_UPGRADE}, h.GetEvents())
+	assert.Equal(t, []release.Hook_DeletePolicy{release.Hook_BEFORE_HOOK_CREATION}, h.GetDeletePolicies())
+	assert.Contains(t, h.GetManifest(), "name: dory-migrate")
+}
+
+func TestHooksForOrdersByWeight(t *testing.T) {
+	rls := &release.Release{Hooks: []*release.Hook{
+		{Name: "late", Weight: 10, Events: []release.Hook_Event{release.Hook_PRE_INSTALL}},
+		{Name: "post", Weight: -5, Events: []release.Hook_Event{release.Hook_POST_INSTALL}},
+		{Name: "early", Weight: -1, Events: []release.Hook_Event{release.Hook_PRE_UPGRADE, release.Hook_PRE_INSTALL}},
+	}}
+	var names []string
+	for _, h := range hooksFor(rls, release.Hook_PRE_INSTALL) {
+		names = append(names, h.GetName())
+	}
+	assert.Equal(t, []string{"early", "late"}, names)
+}
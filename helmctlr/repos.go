@@ -0,0 +1,250 @@
+// Copyright 2017 the lostromos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package helmctlr
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"k8s.io/helm/pkg/getter"
+	"k8s.io/helm/pkg/helm/helmpath"
+	"k8s.io/helm/pkg/repo"
+)
+
+// ChartRepo is a chart repository that remote charts are downloaded from.
+// Credentials are read from files, like mounted Secrets, every time the
+// repository is accessed, so they can be rotated without a restart.
+type ChartRepo struct {
+	Name         string // used in chart references, like <name>/<chart>:<version>
+	URL          string
+	UsernameFile string // file with the user name for basic auth
+	PasswordFile string // file with the password for basic auth
+	TokenFile    string // file with a bearer token, instead of basic auth
+	CAFile       string // PEM bundle of the CAs that verify the repository
+	CertFile     string // PEM client certificate
+	KeyFile      string // PEM key of the client certificate
+}
+
+// ChartRepos are the chart repositories that remote charts are downloaded
+// from, kept in a helm home directory
+type ChartRepos struct {
+	Home  helmpath.Home
+	Repos []ChartRepo
+}
+
+// Add adds the repositories to the repositories file of the helm home and
+// downloads their indexes, creating the helm home if needed. Repositories
+// already in the file are kept.
+func (r *ChartRepos) Add() error {
+	for _, dir := range []string{r.Home.Repository(), r.Home.Cache()} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+	}
+	file := repo.NewRepoFile()
+	if _, err := os.Stat(r.Home.RepositoryFile()); err == nil {
+		if file, err = repo.LoadRepositoriesFile(r.Home.RepositoryFile()); err != nil {
+			return err
+		}
+	}
+	for _, cr := range r.Repos {
+		if err := cr.validate(); err != nil {
+			return err
+		}
+		entry := r.entry(cr)
+		if err := r.downloadIndex(entry); err != nil {
+			return err
+		}
+		file.Update(entry)
+	}
+	return file.WriteFile(r.Home.RepositoryFile(), 0644)
+}
+
+// Update downloads the indexes of the repositories again, so charts that were
+// published after Add are found
+func (r *ChartRepos) Update() error {
+	for _, cr := range r.Repos {
+		if err := r.downloadIndex(r.entry(cr)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *ChartRepos) entry(cr ChartRepo) *repo.Entry {
+	return &repo.Entry{
+		Name:     cr.Name,
+		URL:      cr.URL,
+		Cache:    r.Home.CacheIndex(cr.Name),
+		CAFile:   cr.CAFile,
+		CertFile: cr.CertFile,
+		KeyFile:  cr.KeyFile,
+	}
+}
+
+func (r *ChartRepos) downloadIndex(entry *repo.Entry) error {
+	cr, err := repo.NewChartRepository(entry, r.getters())
+	if err == nil {
+		err = cr.DownloadIndexFile(r.Home.Cache())
+	}
+	if err != nil {
+		return fmt.Errorf("cannot download the index of chart repository %s: %s", entry.Name, err)
+	}
+	return nil
+}
+
+// getters returns the getters for http and https URLs, which authenticate to
+// the repository they are created for
+func (r *ChartRepos) getters() getter.Providers {
+	return getter.Providers{{
+		Schemes: []string{"http", "https"},
+		New: func(repoURL, certFile, keyFile, caFile string) (getter.Getter, error) {
+			for _, cr := range r.Repos {
+				if strings.TrimSuffix(cr.URL, "/") == strings.TrimSuffix(repoURL, "/") {
+					return cr.getter()
+				}
+			}
+			return ChartRepo{URL: repoURL, CAFile: caFile, CertFile: certFile, KeyFile: keyFile}.getter()
+		},
+	}}
+}
+
+func (cr ChartRepo) validate() error {
+	if cr.Name == "" || cr.URL == "" {
+		return errors.New("chart repositories need a name and a url")
+	}
+	if cr.TokenFile != "" && (cr.UsernameFile != "" || cr.PasswordFile != "") {
+		return fmt.Errorf("chart repository %s has both a token and a user name or password", cr.Name)
+	}
+	if (cr.CertFile == "") != (cr.KeyFile == "") {
+		return fmt.Errorf("chart repository %s needs both a client certificate and its key", cr.Name)
+	}
+	return nil
+}
+
+// getter returns a getter.Getter that verifies the repository with its CAs and
+// presents its client certificate
+func (cr ChartRepo) getter() (getter.Getter, error) {
+	cfg := &tls.Config{}
+	if cr.CAFile != "" {
+		pem, err := ioutil.ReadFile(cr.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.RootCAs = x509.NewCertPool()
+		if !cfg.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", cr.CAFile)
+		}
+	}
+	if cr.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(cr.CertFile, cr.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	base, err := url.Parse(cr.URL)
+	if err != nil {
+		return nil, err
+	}
+	return &repoGetter{
+		repo: cr,
+		base: base,
+		client: &http.Client{Transport: &http.Transport{
+			Proxy:           http.ProxyFromEnvironment,
+			TLSClientConfig: cfg,
+		}},
+	}, nil
+}
+
+// repoGetter is a getter.Getter for a chart repository
+type repoGetter struct {
+	repo   ChartRepo
+	base   *url.URL
+	client *http.Client
+}
+
+// Get downloads the URL. Credentials are only sent to the host of the
+// repository, not to charts the index links to elsewhere.
+func (g *repoGetter) Get(href string) (*bytes.Buffer, error) {
+	req, err := http.NewRequest("GET", href, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", "lostromos")
+	if req.URL.Scheme == g.base.Scheme && req.URL.Host == g.base.Host {
+		if err := g.repo.authorize(req); err != nil {
+			return nil, err
+		}
+	}
+	resp, err := g.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close() // nolint: errcheck
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to fetch %s: %s", href, resp.Status)
+	}
+	buf := &bytes.Buffer{}
+	_, err = io.Copy(buf, resp.Body)
+	return buf, err
+}
+
+// authorize adds the credentials of the repository to the request
+func (cr ChartRepo) authorize(req *http.Request) error {
+	if cr.TokenFile != "" {
+		token, err := readCredential(cr.TokenFile)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+		return nil
+	}
+	if cr.UsernameFile == "" && cr.PasswordFile == "" {
+		return nil
+	}
+	username, err := readCredential(cr.UsernameFile)
+	if err != nil {
+		return err
+	}
+	password, err := readCredential(cr.PasswordFile)
+	if err != nil {
+		return err
+	}
+	req.SetBasicAuth(username, password)
+	return nil
+}
+
+// readCredential reads a credential from a file, without the trailing newline
+// files often have. No file is an empty credential.
+func readCredential(file string) (string, error) {
+	if file == "" {
+		return "", nil
+	}
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return "", fmt.Errorf("cannot read credentials: %s", err)
+	}
+	return strings.TrimSpace(string(data)), nil
+}
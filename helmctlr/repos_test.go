@@ -0,0 +1,197 @@
+// Copyright 2017 the lostromos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package helmctlr_test
+
+import (
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"k8s.io/helm/pkg/helm/helmpath"
+	"k8s.io/helm/pkg/repo"
+
+	"github.com/lostromos/lostromos/helmctlr"
+)
+
+// chartServer is a chart repository that only serves authorized requests
+type chartServer struct {
+	*httptest.Server
+	dir string
+}
+
+func newChartServer(t *testing.T, secure bool, authorized func(*http.Request) bool) *chartServer {
+	dir, err := ioutil.TempDir("", "lostromos-charts-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := http.FileServer(http.Dir(dir))
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !authorized(r) {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		files.ServeHTTP(w, r)
+	})
+	s := &chartServer{dir: dir}
+	if secure {
+		s.Server = httptest.NewTLSServer(handler)
+	} else {
+		s.Server = httptest.NewServer(handler)
+	}
+	s.publish(t, "../test/data/helm/chart-0.1.0.tgz")
+	return s
+}
+
+// publish copies the charts into the repository and indexes it again
+func (s *chartServer) publish(t *testing.T, charts ...string) {
+	for _, chart := range charts {
+		data, err := ioutil.ReadFile(chart)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(s.dir, filepath.Base(chart)), data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	index, err := repo.IndexDirectory(s.dir, s.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := index.WriteFile(filepath.Join(s.dir, "index.yaml"), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func (s *chartServer) Close() {
+	s.Server.Close()
+	os.RemoveAll(s.dir)
+}
+
+// writeFile writes the content to a file in dir and returns its path
+func writeFile(t *testing.T, dir, name, content string) string {
+	file := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(file, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+func tempHelmHome(t *testing.T) helmpath.Home {
+	dir, err := ioutil.TempDir("", "lostromos-helm-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return helmpath.Home(dir)
+}
+
+// remoteChart downloads the chart through a controller using the repositories
+func remoteChart(repos *helmctlr.ChartRepos, chartRef string) (string, error) {
+	c := helmctlr.NewController("../test/data/chart", "lostromos-test", "lostromostest", "0", false, 30, nil)
+	c.ChartRepos = repos
+	return c.GetRemoteChart(chartRef)
+}
+
+func TestChartReposBasicAuth(t *testing.T) {
+	srv := newChartServer(t, false, func(r *http.Request) bool {
+		user, password, ok := r.BasicAuth()
+		return ok && user == "marlin" && password == "nemo"
+	})
+	defer srv.Close()
+	home := tempHelmHome(t)
+	defer os.RemoveAll(home.String())
+	defer os.RemoveAll(filepath.Join(os.TempDir(), "basic"))
+
+	repos := &helmctlr.ChartRepos{Home: home, Repos: []helmctlr.ChartRepo{{
+		Name:         "basic",
+		URL:          srv.URL,
+		UsernameFile: writeFile(t, home.String(), "username", "marlin\n"),
+		PasswordFile: writeFile(t, home.String(), "password", "nemo\n"),
+	}}}
+	assert.Nil(t, repos.Add())
+	file, err := repo.LoadRepositoriesFile(home.RepositoryFile())
+	assert.Nil(t, err)
+	assert.True(t, file.Has("basic"))
+
+	chart, err := remoteChart(repos, "basic/helloworld:0.1.0")
+	assert.Nil(t, err)
+	assert.Equal(t, "chart-0.1.0.tgz", filepath.Base(chart))
+
+	writeFile(t, home.String(), "password", "dory")
+	err = repos.Add()
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "401")
+}
+
+func TestChartReposTokenAndCA(t *testing.T) {
+	srv := newChartServer(t, true, func(r *http.Request) bool {
+		return r.Header.Get("Authorization") == "Bearer s3cr3t"
+	})
+	defer srv.Close()
+	home := tempHelmHome(t)
+	defer os.RemoveAll(home.String())
+	defer os.RemoveAll(filepath.Join(os.TempDir(), "token"))
+
+	tokenRepo := helmctlr.ChartRepo{
+		Name:      "token",
+		URL:       srv.URL,
+		TokenFile: writeFile(t, home.String(), "token", "s3cr3t\n"),
+	}
+	repos := &helmctlr.ChartRepos{Home: home, Repos: []helmctlr.ChartRepo{tokenRepo}}
+	err := repos.Add()
+	assert.NotNil(t, err, "the certificate of the server is not trusted")
+
+	ca := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.TLS.Certificates[0].Certificate[0]})
+	repos.Repos[0].CAFile = writeFile(t, home.String(), "ca.pem", string(ca))
+	assert.Nil(t, repos.Add())
+	_, err = remoteChart(repos, "token/helloworld:0.1.0")
+	assert.Nil(t, err)
+}
+
+func TestChartReposUpdateIndexForNewCharts(t *testing.T) {
+	srv := newChartServer(t, false, func(*http.Request) bool { return true })
+	defer srv.Close()
+	home := tempHelmHome(t)
+	defer os.RemoveAll(home.String())
+	defer os.RemoveAll(filepath.Join(os.TempDir(), "late"))
+
+	os.Remove(filepath.Join(srv.dir, "chart-0.1.0.tgz"))
+	srv.publish(t)
+	repos := &helmctlr.ChartRepos{Home: home, Repos: []helmctlr.ChartRepo{{Name: "late", URL: srv.URL}}}
+	assert.Nil(t, repos.Add())
+
+	srv.publish(t, "../test/data/helm/chart-0.1.0.tgz")
+	_, err := remoteChart(repos, "late/helloworld:0.1.0")
+	assert.Nil(t, err)
+}
+
+func TestChartReposValidation(t *testing.T) {
+	home := tempHelmHome(t)
+	defer os.RemoveAll(home.String())
+
+	invalid := []helmctlr.ChartRepo{
+		{URL: "http://127.0.0.1"},
+		{Name: "both", URL: "http://127.0.0.1", TokenFile: "token", PasswordFile: "password"},
+		{Name: "cert", URL: "http://127.0.0.1", CertFile: "cert.pem"},
+	}
+	for _, r := range invalid {
+		repos := &helmctlr.ChartRepos{Home: home, Repos: []helmctlr.ChartRepo{r}}
+		assert.NotNil(t, repos.Add(), r.Name)
+	}
+}
@@ -0,0 +1,481 @@
+// Copyright 2017 the lostromos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package helmctlr
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strconv"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes"
+	"go.uber.org/zap"
+	"k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	restclient "k8s.io/client-go/rest"
+	"k8s.io/helm/pkg/chartutil"
+	"k8s.io/helm/pkg/proto/hapi/chart"
+	"k8s.io/helm/pkg/proto/hapi/release"
+
+	"github.com/lostromos/lostromos/tmplctlr"
+)
+
+const (
+	// ReleaseSecretType is the type of the Secrets that store the revisions of
+	// releases installed without Tiller
+	ReleaseSecretType = "lostromos.io/release.v1"
+
+	releaseKey   = "release"
+	releaseOwner = "lostromos"
+)
+
+var gzipMagic = []byte{0x1f, 0x8b, 0x08}
+
+// Tillerless installs helm releases without Tiller, like Helm 3. It renders the
+// chart itself, applies the objects through the kubernetes API and stores every
+// revision of a release in a Secret in the namespace of the release.
+type Tillerless struct {
+	Client          kubernetes.Interface                       // stores the releases and discovers the capabilities of the cluster
+	Objects         func(namespace string) tmplctlr.KubeClient // applies and deletes the objects of a release in its namespace
+	TillerNamespace string                                     // namespace of the ConfigMaps of Tiller releases to migrate, empty disables migration
+	MaxHistory      int                                        // revisions kept per release, 0 keeps all of them
+	logger          *zap.SugaredLogger
+}
+
+// NewTillerless returns a Tillerless for the cluster described by cfg
+func NewTillerless(cfg *restclient.Config, tillerNamespace string, logger *zap.SugaredLogger) (*Tillerless, error) {
+	client, err := kubernetes.NewForConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+	objects, err := tmplctlr.NewDynamicClient(cfg, "")
+	if err != nil {
+		return nil, err
+	}
+	return &Tillerless{
+		Client:          client,
+		Objects:         func(ns string) tmplctlr.KubeClient { return objects.InNamespace(ns) },
+		TillerNamespace: tillerNamespace,
+		logger:          logger,
+	}, nil
+}
+
+// InstallOrUpgrade installs the chart as the release name in namespace, or
+// upgrades the release if it exists. Objects of the last deployed revision that
+// are not rendered anymore are deleted.
+func (t *Tillerless) InstallOrUpgrade(name, namespace string, ch *chart.Chart, values []byte) (*release.Release, error) {
+	history, err := t.history(name, namespace)
+	if err != nil {
+		return nil, err
+	}
+	deployed := lastDeployed(history)
+	now := ptypes.TimestampNow()
+	rls := &release.Release{
+		Name:      name,
+		Namespace: namespace,
+		Version:   1,
+		// The templates are left out to keep the Secret small
+		Chart:  &chart.Chart{Metadata: ch.GetMetadata(), Values: ch.GetValues()},
+		Config: &chart.Config{Raw: string(values)},
+		Info:   &release.Info{FirstDeployed: now, LastDeployed: now},
+	}
+	if len(history) > 0 {
+		rls.Version = history[len(history)-1].GetVersion() + 1
+		rls.Info.FirstDeployed = history[0].GetInfo().GetFirstDeployed()
+	}
+	setStatus(rls, release.Status_PENDING_INSTALL, "")
+	if deployed != nil {
+		setStatus(rls, release.Status_PENDING_UPGRADE, "")
+	}
+
+	caps, err := t.capabilities()
+	if err != nil {
+		return nil, err
+	}
+	hks, manifest, err := renderChart(ch, values, chartutil.ReleaseOptions{
+		Name:      name,
+		Namespace: namespace,
+		Time:      now,
+		Revision:  int(rls.GetVersion()),
+		IsInstall: deployed == nil,
+		IsUpgrade: deployed != nil,
+	}, caps)
+	if err != nil {
+		return nil, err
+	}
+	rls.Hooks = hks
+	rls.Manifest = string(manifest)
+	if err := t.save(rls, false); err != nil {
+		return nil, err
+	}
+	if deployed != nil {
+		return rls, t.deploy(rls, deployed, deployed.GetManifest(), "Upgrade complete", release.Hook_PRE_UPGRADE, release.Hook_POST_UPGRADE)
+	}
+	return rls, t.deploy(rls, nil, "", "Install complete", release.Hook_PRE_INSTALL, release.Hook_POST_INSTALL)
+}
+
+// Rollback deploys the last deployed revision of the release again if a newer
+// revision failed, and returns the version of that revision. It returns 0 if
+// there is nothing to roll back.
+func (t *Tillerless) Rollback(name, namespace string) (int32, error) {
+	history, err := t.history(name, namespace)
+	if err != nil {
+		return 0, err
+	}
+	deployed := lastDeployed(history)
+	if deployed == nil || deployed == history[len(history)-1] {
+		return 0, nil
+	}
+	failed := history[len(history)-1]
+	rls := proto.Clone(deployed).(*release.Release)
+	rls.Version = failed.GetVersion() + 1
+	rls.Info = &release.Info{
+		FirstDeployed: deployed.GetInfo().GetFirstDeployed(),
+		LastDeployed:  ptypes.TimestampNow(),
+	}
+	setStatus(rls, release.Status_PENDING_ROLLBACK, "")
+	if err := t.save(rls, false); err != nil {
+		return 0, err
+	}
+	description := fmt.Sprintf("Rollback to %d", deployed.GetVersion())
+	if err := t.deploy(rls, deployed, failed.GetManifest(), description, release.Hook_PRE_ROLLBACK, release.Hook_POST_ROLLBACK); err != nil {
+		return 0, err
+	}
+	return deployed.GetVersion(), nil
+}
+
+// deploy runs the pre hooks, applies the objects of the pending revision rls
+// and runs the post hooks. It then marks rls deployed and the previous revision
+// superseded. Objects of the stale manifest that rls doesn't contain are
+// deleted.
+func (t *Tillerless) deploy(rls, previous *release.Release, stale, description string, pre, post release.Hook_Event) error {
+	client := t.Objects(rls.GetNamespace())
+	manifest := []byte(rls.GetManifest())
+	if err := t.runHooks(client, rls, pre); err != nil {
+		return t.fail(rls, err)
+	}
+	if out, err := tmplctlr.ApplyManifest(client, manifest); err != nil {
+		t.log().Debugw("failed to apply release", "release", rls.GetName(), "output", out)
+		return t.fail(rls, err)
+	}
+	if err := t.runHooks(client, rls, post); err != nil {
+		return t.fail(rls, err)
+	}
+	if previous != nil {
+		if out, err := tmplctlr.DeleteStale(client, []byte(stale), manifest); err != nil {
+			t.log().Warnw("failed to delete objects that are not rendered anymore", "release", rls.GetName(), "error", err, "output", out)
+		}
+		setStatus(previous, release.Status_SUPERSEDED, previous.GetInfo().GetDescription())
+		if err := t.save(previous, true); err != nil {
+			return err
+		}
+	}
+	setStatus(rls, release.Status_DEPLOYED, description)
+	if err := t.save(rls, true); err != nil {
+		return err
+	}
+	t.prune(rls.GetName(), rls.GetNamespace())
+	return nil
+}
+
+// fail marks the pending revision rls failed and returns err
+func (t *Tillerless) fail(rls *release.Release, err error) error {
+	setStatus(rls, release.Status_FAILED, fmt.Sprintf("Release failed: %s", err))
+	if serr := t.save(rls, true); serr != nil {
+		t.log().Warnw("failed to save release", "release", rls.GetName(), "error", serr)
+	}
+	return err
+}
+
+// runHooks applies the hooks of rls for the event in the order of their
+// weight. Hooks with the before-hook-creation delete policy are deleted first.
+// Unlike Tiller, it doesn't wait for the hooks to complete.
+func (t *Tillerless) runHooks(client tmplctlr.KubeClient, rls *release.Release, event release.Hook_Event) error {
+	for _, h := range hooksFor(rls, event) {
+		manifest := []byte(h.GetManifest())
+		if hasDeletePolicy(h, release.Hook_BEFORE_HOOK_CREATION) {
+			if out, err := tmplctlr.DeleteManifest(client, manifest); err != nil {
+				t.log().Debugw("failed to delete hook", "release", rls.GetName(), "hook", h.GetName(), "output", out)
+				return fmt.Errorf("%s hook %s failed: %s", event, h.GetPath(), err)
+			}
+		}
+		if out, err := tmplctlr.ApplyManifest(client, manifest); err != nil {
+			t.log().Debugw("failed to apply hook", "release", rls.GetName(), "hook", h.GetName(), "output", out)
+			return fmt.Errorf("%s hook %s failed: %s", event, h.GetPath(), err)
+		}
+		h.LastRun = ptypes.TimestampNow()
+	}
+	return nil
+}
+
+// prune deletes the Secrets of the oldest revisions of the release that exceed
+// MaxHistory. Failing to prune doesn't fail the release.
+func (t *Tillerless) prune(name, namespace string) {
+	if t.MaxHistory <= 0 {
+		return
+	}
+	history, err := t.history(name, namespace)
+	if err != nil {
+		t.log().Warnw("failed to prune release history", "release", name, "error", err)
+		return
+	}
+	secrets := t.Client.CoreV1().Secrets(namespace)
+	for i := 0; i < len(history)-t.MaxHistory; i++ {
+		if history[i].GetInfo().GetStatus().GetCode() == release.Status_DEPLOYED {
+			continue
+		}
+		err := secrets.Delete(secretName(name, history[i].GetVersion()), &metav1.DeleteOptions{})
+		if err != nil && !apierrors.IsNotFound(err) {
+			t.log().Warnw("failed to prune release history", "release", name, "revision", history[i].GetVersion(), "error", err)
+		}
+	}
+}
+
+// Delete deletes the objects of the last deployed revision of the release,
+// between its pre-delete and post-delete hooks, and the Secrets of all its
+// revisions
+func (t *Tillerless) Delete(name, namespace string) error {
+	history, err := t.history(name, namespace)
+	if err != nil || len(history) == 0 {
+		return err
+	}
+	rls := lastDeployed(history)
+	if rls == nil {
+		rls = history[len(history)-1]
+	}
+	client := t.Objects(namespace)
+	if err := t.runHooks(client, rls, release.Hook_PRE_DELETE); err != nil {
+		return err
+	}
+	if out, err := tmplctlr.DeleteManifest(client, []byte(rls.GetManifest())); err != nil {
+		t.log().Debugw("failed to delete release", "release", name, "output", out)
+		return err
+	}
+	if err := t.runHooks(client, rls, release.Hook_POST_DELETE); err != nil {
+		return err
+	}
+	secrets := t.Client.CoreV1().Secrets(namespace)
+	for _, r := range history {
+		err := secrets.Delete(secretName(r.GetName(), r.GetVersion()), &metav1.DeleteOptions{})
+		if err != nil && !apierrors.IsNotFound(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// history returns the revisions of the release, oldest first. A release that
+// is only known to Tiller is migrated first.
+func (t *Tillerless) history(name, namespace string) ([]*release.Release, error) {
+	list, err := t.Client.CoreV1().Secrets(namespace).List(metav1.ListOptions{
+		LabelSelector: fmt.Sprintf("owner=%s,name=%s", releaseOwner, name),
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(list.Items) == 0 {
+		return t.migrate(name, namespace)
+	}
+	history := make([]*release.Release, 0, len(list.Items))
+	for _, s := range list.Items {
+		rls, err := decodeRelease(s.Data[releaseKey])
+		if err != nil {
+			return nil, fmt.Errorf("invalid release in secret %s: %s", s.GetName(), err)
+		}
+		history = append(history, rls)
+	}
+	sortByVersion(history)
+	return history, nil
+}
+
+// migrate copies the last deployed revision of a release managed by Tiller into
+// a Secret and removes the release from Tiller, so Tiller doesn't manage its
+// objects anymore. It returns the migrated revision, if any.
+func (t *Tillerless) migrate(name, namespace string) ([]*release.Release, error) {
+	if t.TillerNamespace == "" {
+		return nil, nil
+	}
+	configMaps := t.Client.CoreV1().ConfigMaps(t.TillerNamespace)
+	list, err := configMaps.List(metav1.ListOptions{
+		LabelSelector: fmt.Sprintf("OWNER=TILLER,NAME=%s", name),
+	})
+	if err != nil {
+		return nil, err
+	}
+	tillerHistory := make([]*release.Release, 0, len(list.Items))
+	for _, cm := range list.Items {
+		rls, err := decodeTillerRelease(cm.Data[releaseKey])
+		if err != nil {
+			return nil, fmt.Errorf("invalid tiller release in configmap %s: %s", cm.GetName(), err)
+		}
+		tillerHistory = append(tillerHistory, rls)
+	}
+	rls := lastDeployed(tillerHistory)
+	if rls == nil {
+		return nil, nil
+	}
+	if rls.GetNamespace() != namespace {
+		t.log().Warnw("not migrating tiller release deployed to another namespace", "release", name, "namespace", rls.GetNamespace())
+		return nil, nil
+	}
+	if err := t.save(rls, false); err != nil {
+		return nil, err
+	}
+	for _, cm := range list.Items {
+		err := configMaps.Delete(cm.GetName(), &metav1.DeleteOptions{})
+		if err != nil && !apierrors.IsNotFound(err) {
+			return nil, err
+		}
+	}
+	t.log().Infow("migrated release from tiller", "release", name, "revision", rls.GetVersion())
+	return []*release.Release{rls}, nil
+}
+
+// save creates or, with update, updates the Secret of the release revision
+func (t *Tillerless) save(rls *release.Release, update bool) error {
+	data, err := encodeRelease(rls)
+	if err != nil {
+		return err
+	}
+	s := &v1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      secretName(rls.GetName(), rls.GetVersion()),
+			Namespace: rls.GetNamespace(),
+			Labels: map[string]string{
+				"owner":   releaseOwner,
+				"name":    rls.GetName(),
+				"status":  rls.GetInfo().GetStatus().GetCode().String(),
+				"version": strconv.Itoa(int(rls.GetVersion())),
+			},
+		},
+		Type: ReleaseSecretType,
+		Data: map[string][]byte{releaseKey: data},
+	}
+	secrets := t.Client.CoreV1().Secrets(rls.GetNamespace())
+	if update {
+		_, err = secrets.Update(s)
+	} else {
+		_, err = secrets.Create(s)
+	}
+	return err
+}
+
+// capabilities describes the cluster to the chart templates
+func (t *Tillerless) capabilities() (*chartutil.Capabilities, error) {
+	discovery := t.Client.Discovery()
+	kubeVersion, err := discovery.ServerVersion()
+	if err != nil {
+		return nil, err
+	}
+	groups, err := discovery.ServerGroups()
+	if err != nil {
+		return nil, err
+	}
+	var versions []string
+	if groups != nil {
+		versions = metav1.ExtractGroupVersions(groups)
+	}
+	return &chartutil.Capabilities{
+		APIVersions: chartutil.NewVersionSet(versions...),
+		KubeVersion: kubeVersion,
+	}, nil
+}
+
+func (t *Tillerless) log() *zap.SugaredLogger {
+	if t.logger == nil {
+		return zap.NewNop().Sugar()
+	}
+	return t.logger
+}
+
+func secretName(name string, version int32) string {
+	return fmt.Sprintf("lostromos.release.v1.%s.v%d", name, version)
+}
+
+func setStatus(rls *release.Release, code release.Status_Code, description string) {
+	if rls.Info == nil {
+		rls.Info = &release.Info{}
+	}
+	rls.Info.Status = &release.Status{Code: code}
+	rls.Info.Description = description
+}
+
+// lastDeployed returns the newest deployed revision of the history, if any
+func lastDeployed(history []*release.Release) *release.Release {
+	sortByVersion(history)
+	for i := len(history) - 1; i >= 0; i-- {
+		if history[i].GetInfo().GetStatus().GetCode() == release.Status_DEPLOYED {
+			return history[i]
+		}
+	}
+	return nil
+}
+
+func sortByVersion(history []*release.Release) {
+	sort.Slice(history, func(i, j int) bool {
+		return history[i].GetVersion() < history[j].GetVersion()
+	})
+}
+
+// encodeRelease serializes the release for a Secret
+func encodeRelease(rls *release.Release) ([]byte, error) {
+	data, err := proto.Marshal(rls)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func decodeRelease(data []byte) (*release.Release, error) {
+	r, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close() // nolint: errcheck
+	raw, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	rls := &release.Release{}
+	return rls, proto.Unmarshal(raw, rls)
+}
+
+// decodeTillerRelease decodes a release stored by Tiller in a ConfigMap, the
+// base64 encoded release, gzipped by all but the oldest versions of Tiller
+func decodeTillerRelease(data string) (*release.Release, error) {
+	raw, err := base64.StdEncoding.DecodeString(data)
+	if err != nil {
+		return nil, err
+	}
+	if bytes.HasPrefix(raw, gzipMagic) {
+		return decodeRelease(raw)
+	}
+	rls := &release.Release{}
+	return rls, proto.Unmarshal(raw, rls)
+}
@@ -0,0 +1,294 @@
+// Copyright 2017 the lostromos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package helmctlr
+
+import (
+	"encoding/base64"
+	"errors"
+	"io/ioutil"
+	"testing"
+
+	"github.com/ghodss/yaml"
+	"github.com/stretchr/testify/assert"
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/helm/pkg/chartutil"
+	"k8s.io/helm/pkg/proto/hapi/chart"
+	"k8s.io/helm/pkg/proto/hapi/release"
+
+	"github.com/lostromos/lostromos/tmplctlr"
+)
+
+// manifestClient is a KubeClient that records the manifests it is handed
+type manifestClient struct {
+	applied []string
+	deleted []string
+	err     error
+}
+
+func (c *manifestClient) Apply(file string) (string, error) {
+	return "", c.record(file, &c.applied)
+}
+
+func (c *manifestClient) Delete(file string) (string, error) {
+	return "", c.record(file, &c.deleted)
+}
+
+func (c *manifestClient) record(file string, to *[]string) error {
+	if c.err != nil {
+		return c.err
+	}
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	*to = append(*to, string(data))
+	return nil
+}
+
+func newTestTillerless(objects ...runtime.Object) (*Tillerless, *manifestClient) {
+	client := &manifestClient{}
+	return &Tillerless{
+		Client:          fake.NewSimpleClientset(objects...),
+		Objects:         func(string) tmplctlr.KubeClient { return client },
+		TillerNamespace: "kube-system",
+	}, client
+}
+
+func testChart(t *testing.T) *chart.Chart {
+	ch, err := chartutil.Load("../test/data/helm/chart")
+	assert.Nil(t, err)
+	return ch
+}
+
+func testValues(t *testing.T, name string) []byte {
+	values, err := yaml.Marshal(map[string]interface{}{
+		"resource": map[string]interface{}{
+			"name": name,
+			"spec": map[string]interface{}{"By": "Disney"},
+		},
+	})
+	assert.Nil(t, err)
+	return values
+}
+
+func storedRelease(t *testing.T, tl *Tillerless, version int32) (*v1.Secret, *release.Release) {
+	s, err := tl.Client.CoreV1().Secrets("lostromos").Get(secretName("lostromos-dory", version), metav1.GetOptions{})
+	if !assert.Nil(t, err) {
+		return nil, nil
+	}
+	rls, err := decodeRelease(s.Data[releaseKey])
+	assert.Nil(t, err)
+	return s, rls
+}
+
+func TestTillerlessInstallAndUpgrade(t *testing.T) {
+	tl, client := newTestTillerless()
+	ch := testChart(t)
+
+	rls, err := tl.InstallOrUpgrade("lostromos-dory", "lostromos", ch, testValues(t, "dory"))
+	assert.Nil(t, err)
+	assert.Equal(t, int32(1), rls.GetVersion())
+	assert.Equal(t, release.Status_DEPLOYED, rls.GetInfo().GetStatus().GetCode())
+	assert.Len(t, client.applied, 1)
+	assert.Contains(t, client.applied[0], "name: dory-hello")
+	assert.Contains(t, client.applied[0], "release: lostromos-dory")
+	assert.Contains(t, rls.GetManifest(), "# Source: helloworld/templates/deployment.yaml")
+
+	s, stored := storedRelease(t, tl, 1)
+	assert.Equal(t, ReleaseSecretType, string(s.Type))
+	assert.Equal(t, map[string]string{"owner": "lostromos", "name": "lostromos-dory", "status": "DEPLOYED", "version": "1"}, s.Labels)
+	assert.Equal(t, rls.GetManifest(), stored.GetManifest())
+	assert.Empty(t, stored.GetChart().GetTemplates())
+
+	rls, err = tl.InstallOrUpgrade("lostromos-dory", "lostromos", ch, testValues(t, "nemo"))
+	assert.Nil(t, err)
+	assert.Equal(t, int32(2), rls.GetVersion())
+	assert.Equal(t, "Upgrade complete", rls.GetInfo().GetDescription())
+	assert.Contains(t, client.applied[1], "name: nemo-hello")
+	assert.Len(t, client.deleted, 1)
+	assert.Contains(t, client.deleted[0], "name: dory-hello")
+
+	s, _ = storedRelease(t, tl, 1)
+	assert.Equal(t, "SUPERSEDED", s.Labels["status"])
+	s, _ = storedRelease(t, tl, 2)
+	assert.Equal(t, "DEPLOYED", s.Labels["status"])
+}
+
+func TestTillerlessRunsHooks(t *testing.T) {
+	tl, client := newTestTillerless()
+	ch := testChart(t)
+	ch.Templates = append(ch.Templates, &chart.Template{Name: "templates/hooks.yaml", Data: []byte(`apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: {{ .Release.Name }}-pre
+  annotations:
+    helm.sh/hook: pre-install
+    helm.sh/hook-delete-policy: before-hook-creation
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: {{ .Release.Name }}-post
+  annotations:
+    helm.sh/hook: post-install,pre-delete
+`)})
+
+	rls, err := tl.InstallOrUpgrade("lostromos-dory", "lostromos", ch, testValues(t, "dory"))
+	assert.Nil(t, err)
+	assert.NotContains(t, rls.GetManifest(), "helm.sh/hook")
+	assert.Len(t, rls.GetHooks(), 2)
+	if assert.Len(t, client.applied, 3) {
+		assert.Contains(t, client.applied[0], "name: lostromos-dory-pre")
+		assert.Contains(t, client.applied[1], "name: dory-hello")
+		assert.Contains(t, client.applied[2], "name: lostromos-dory-post")
+	}
+	if assert.Len(t, client.deleted, 1) {
+		assert.Contains(t, client.deleted[0], "name: lostromos-dory-pre")
+	}
+	_, stored := storedRelease(t, tl, 1)
+	assert.Len(t, stored.GetHooks(), 2)
+
+	client.applied = nil
+	assert.Nil(t, tl.Delete("lostromos-dory", "lostromos"))
+	if assert.Len(t, client.applied, 1) {
+		assert.Contains(t, client.applied[0], "name: lostromos-dory-post")
+	}
+}
+
+func TestTillerlessInstallFailure(t *testing.T) {
+	tl, client := newTestTillerless()
+	client.err = errors.New("forbidden")
+
+	rls, err := tl.InstallOrUpgrade("lostromos-dory", "lostromos", testChart(t), testValues(t, "dory"))
+	assert.NotNil(t, err)
+	assert.Equal(t, release.Status_FAILED, rls.GetInfo().GetStatus().GetCode())
+	s, _ := storedRelease(t, tl, 1)
+	assert.Equal(t, "FAILED", s.Labels["status"])
+}
+
+func TestTillerlessDelete(t *testing.T) {
+	tl, client := newTestTillerless()
+	ch := testChart(t)
+	_, err := tl.InstallOrUpgrade("lostromos-dory", "lostromos", ch, testValues(t, "dory"))
+	assert.Nil(t, err)
+	_, err = tl.InstallOrUpgrade("lostromos-dory", "lostromos", ch, testValues(t, "dory"))
+	assert.Nil(t, err)
+
+	assert.Nil(t, tl.Delete("lostromos-dory", "lostromos"))
+	assert.Len(t, client.deleted, 1)
+	assert.Contains(t, client.deleted[0], "name: dory-hello")
+	secrets, err := tl.Client.CoreV1().Secrets("lostromos").List(metav1.ListOptions{})
+	assert.Nil(t, err)
+	assert.Empty(t, secrets.Items)
+
+	// Deleting a release that doesn't exist is not an error
+	assert.Nil(t, tl.Delete("lostromos-dory", "lostromos"))
+}
+
+func tillerConfigMap(t *testing.T, rls *release.Release) *v1.ConfigMap {
+	data, err := encodeRelease(rls)
+	assert.Nil(t, err)
+	return &v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      secretName(rls.GetName(), rls.GetVersion()),
+			Namespace: "kube-system",
+			Labels:    map[string]string{"OWNER": "TILLER", "NAME": rls.GetName()},
+		},
+		Data: map[string]string{releaseKey: base64.StdEncoding.EncodeToString(data)},
+	}
+}
+
+func TestTillerlessMigratesTillerReleases(t *testing.T) {
+	old := &release.Release{Name: "lostromos-dory", Namespace: "lostromos", Version: 3, Manifest: "---\nkind: ConfigMap\nmetadata:\n  name: dory-fish\n"}
+	setStatus(old, release.Status_SUPERSEDED, "")
+	deployed := &release.Release{Name: "lostromos-dory", Namespace: "lostromos", Version: 4, Manifest: old.Manifest}
+	setStatus(deployed, release.Status_DEPLOYED, "")
+	tl, client := newTestTillerless(tillerConfigMap(t, old), tillerConfigMap(t, deployed))
+
+	rls, err := tl.InstallOrUpgrade("lostromos-dory", "lostromos", testChart(t), testValues(t, "dory"))
+	assert.Nil(t, err)
+	assert.Equal(t, int32(5), rls.GetVersion())
+	assert.Len(t, client.deleted, 1)
+	assert.Contains(t, client.deleted[0], "name: dory-fish")
+
+	s, _ := storedRelease(t, tl, 4)
+	assert.Equal(t, "SUPERSEDED", s.Labels["status"])
+	configMaps, err := tl.Client.CoreV1().ConfigMaps("kube-system").List(metav1.ListOptions{})
+	assert.Nil(t, err)
+	assert.Empty(t, configMaps.Items)
+}
+
+func TestTillerlessSkipsTillerReleasesOfOtherNamespaces(t *testing.T) {
+	deployed := &release.Release{Name: "lostromos-dory", Namespace: "default", Version: 1}
+	setStatus(deployed, release.Status_DEPLOYED, "")
+	tl, _ := newTestTillerless(tillerConfigMap(t, deployed))
+
+	rls, err := tl.InstallOrUpgrade("lostromos-dory", "lostromos", testChart(t), testValues(t, "dory"))
+	assert.Nil(t, err)
+	assert.Equal(t, int32(1), rls.GetVersion())
+	configMaps, err := tl.Client.CoreV1().ConfigMaps("kube-system").List(metav1.ListOptions{})
+	assert.Nil(t, err)
+	assert.Len(t, configMaps.Items, 1)
+}
+
+func TestTillerlessRollback(t *testing.T) {
+	tl, client := newTestTillerless()
+	ch := testChart(t)
+	_, err := tl.InstallOrUpgrade("lostromos-dory", "lostromos", ch, testValues(t, "dory"))
+	assert.Nil(t, err)
+	version, err := tl.Rollback("lostromos-dory", "lostromos")
+	assert.Nil(t, err)
+	assert.Equal(t, int32(0), version, "nothing to roll back")
+
+	client.err = errors.New("forbidden")
+	_, err = tl.InstallOrUpgrade("lostromos-dory", "lostromos", ch, testValues(t, "nemo"))
+	assert.NotNil(t, err)
+	client.err = nil
+
+	version, err = tl.Rollback("lostromos-dory", "lostromos")
+	assert.Nil(t, err)
+	assert.Equal(t, int32(1), version)
+	assert.Len(t, client.applied, 2)
+	assert.Contains(t, client.applied[1], "name: dory-hello")
+	assert.Len(t, client.deleted, 1)
+	assert.Contains(t, client.deleted[0], "name: nemo-hello")
+
+	s, rls := storedRelease(t, tl, 3)
+	assert.Equal(t, "DEPLOYED", s.Labels["status"])
+	assert.Equal(t, "Rollback to 1", rls.GetInfo().GetDescription())
+	s, _ = storedRelease(t, tl, 2)
+	assert.Equal(t, "FAILED", s.Labels["status"])
+	s, _ = storedRelease(t, tl, 1)
+	assert.Equal(t, "SUPERSEDED", s.Labels["status"])
+}
+
+func TestTillerlessMaxHistory(t *testing.T) {
+	tl, _ := newTestTillerless()
+	tl.MaxHistory = 2
+	ch := testChart(t)
+	for i := 0; i < 3; i++ {
+		_, err := tl.InstallOrUpgrade("lostromos-dory", "lostromos", ch, testValues(t, "dory"))
+		assert.Nil(t, err)
+	}
+	history, err := tl.history("lostromos-dory", "lostromos")
+	assert.Nil(t, err)
+	if assert.Len(t, history, 2) {
+		assert.Equal(t, int32(2), history[0].GetVersion())
+		assert.Equal(t, int32(3), history[1].GetVersion())
+	}
+}
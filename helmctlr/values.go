@@ -0,0 +1,166 @@
+// Copyright 2017 the lostromos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package helmctlr
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/ghodss/yaml"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+
+	"github.com/lostromos/lostromos/tmpl"
+)
+
+// FieldRule copies a field of the custom resource into the release values
+type FieldRule struct {
+	Value string // dot separated path of the value, like image.tag
+	Field string // dot separated path of the field, like spec.version. A simple JSONPath like {.spec.version} works too
+}
+
+// ValuesMapping turns a custom resource into the values of its release, so
+// charts don't have to be written for Lostrómos. The values are made of, each
+// overriding the previous:
+//
+//   - the values files, later files overriding earlier ones
+//   - the output of the values template, or the resource values without one
+//   - the fields copied by the field rules
+type ValuesMapping struct {
+	files    map[string]interface{}
+	template *tmpl.Template
+	fields   []FieldRule
+}
+
+// NewValuesMapping reads the values files and parses the values template, if
+// any, so errors in them are found before any custom resource is handled.
+func NewValuesMapping(files []string, template string, fields []FieldRule) (*ValuesMapping, error) {
+	m := &ValuesMapping{files: map[string]interface{}{}, fields: fields}
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		vals := map[string]interface{}{}
+		if err := yaml.Unmarshal(data, &vals); err != nil {
+			return nil, fmt.Errorf("invalid values file %s: %s", file, err)
+		}
+		mergeValues(m.files, vals)
+	}
+	if template != "" {
+		t, err := tmpl.ParseFiles(template)
+		if err != nil {
+			return nil, err
+		}
+		m.template = t
+	}
+	for _, f := range fields {
+		if f.Value == "" || fieldPath(f.Field) == nil {
+			return nil, fmt.Errorf("invalid field rule %s: %s, both the value and the field are required", f.Value, f.Field)
+		}
+	}
+	return m, nil
+}
+
+// Values returns the values of the release of the custom resource as YAML
+func (m *ValuesMapping) Values(r *unstructured.Unstructured) ([]byte, error) {
+	vals := mergeValues(map[string]interface{}{}, m.files)
+	resource, err := m.resourceValues(r)
+	if err != nil {
+		return nil, err
+	}
+	mergeValues(vals, resource)
+	cr := tmpl.CustomResource{Resource: r}
+	for _, f := range m.fields {
+		// Missing fields keep the default of the chart
+		if v := cr.GetValue(fieldPath(f.Field)...); v != nil {
+			setValue(vals, strings.Split(f.Value, "."), v)
+		}
+	}
+	return yaml.Marshal(vals)
+}
+
+// resourceValues renders the values template for the custom resource, or
+// returns the resource values without one
+func (m *ValuesMapping) resourceValues(r *unstructured.Unstructured) (map[string]interface{}, error) {
+	if m.template == nil {
+		return resourceValues(r), nil
+	}
+	var buf bytes.Buffer
+	if err := m.template.Execute(&tmpl.CustomResource{Resource: r}, &buf, nil); err != nil {
+		return nil, err
+	}
+	vals := map[string]interface{}{}
+	if err := yaml.Unmarshal(buf.Bytes(), &vals); err != nil {
+		return nil, fmt.Errorf("values template did not render valid YAML: %s", err)
+	}
+	return vals, nil
+}
+
+// resourceValues returns the name, namespace and spec of the custom resource
+// under the resource key
+func resourceValues(r *unstructured.Unstructured) map[string]interface{} {
+	return map[string]interface{}{
+		"resource": map[string]interface{}{
+			"name":      r.GetName(),
+			"namespace": r.GetNamespace(),
+			"spec":      r.Object["spec"]}}
+}
+
+// mergeValues merges src into dest, merging maps both contain. Maps of src are
+// copied, so changing dest later doesn't change src.
+func mergeValues(dest, src map[string]interface{}) map[string]interface{} {
+	for k, v := range src {
+		next, ok := v.(map[string]interface{})
+		if !ok {
+			dest[k] = v
+			continue
+		}
+		d, ok := dest[k].(map[string]interface{})
+		if !ok {
+			d = map[string]interface{}{}
+		}
+		dest[k] = mergeValues(d, next)
+	}
+	return dest
+}
+
+// setValue sets the value at the path, replacing anything on the way that is
+// not a map
+func setValue(vals map[string]interface{}, path []string, v interface{}) {
+	for _, key := range path[:len(path)-1] {
+		next, ok := vals[key].(map[string]interface{})
+		if !ok {
+			next = map[string]interface{}{}
+			vals[key] = next
+		}
+		vals = next
+	}
+	if m, ok := v.(map[string]interface{}); ok {
+		v = mergeValues(map[string]interface{}{}, m)
+	}
+	vals[path[len(path)-1]] = v
+}
+
+// fieldPath splits the field path of a field rule, nil if it is empty
+func fieldPath(field string) []string {
+	field = strings.TrimSuffix(strings.TrimPrefix(field, "{"), "}")
+	field = strings.TrimPrefix(field, ".")
+	if field == "" {
+		return nil
+	}
+	return strings.Split(field, ".")
+}
@@ -0,0 +1,107 @@
+// Copyright 2017 the lostromos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package helmctlr_test
+
+import (
+	"testing"
+
+	"github.com/ghodss/yaml"
+	"github.com/stretchr/testify/assert"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+
+	"github.com/lostromos/lostromos/helmctlr"
+)
+
+var valuesResource = &unstructured.Unstructured{
+	Object: map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"name":      "nemo",
+			"namespace": "pixar",
+		},
+		"spec": map[string]interface{}{
+			"Name":     "Nemo",
+			"replicas": int64(3),
+			"version":  "1.2.3",
+			"resources": map[string]interface{}{
+				"limits": map[string]interface{}{"cpu": "100m"},
+			},
+		},
+	},
+}
+
+func mappedValues(t *testing.T, m *helmctlr.ValuesMapping) map[string]interface{} {
+	data, err := m.Values(valuesResource)
+	assert.Nil(t, err)
+	vals := map[string]interface{}{}
+	assert.Nil(t, yaml.Unmarshal(data, &vals))
+	return vals
+}
+
+func TestValuesMappingDefaultsToResourceValues(t *testing.T) {
+	m, err := helmctlr.NewValuesMapping(nil, "", nil)
+	assert.Nil(t, err)
+	vals := mappedValues(t, m)
+	resource := vals["resource"].(map[string]interface{})
+	assert.Equal(t, "nemo", resource["name"])
+	assert.Equal(t, "pixar", resource["namespace"])
+	assert.Equal(t, "Nemo", resource["spec"].(map[string]interface{})["Name"])
+}
+
+func TestValuesMappingMergesFilesTemplateAndFields(t *testing.T) {
+	files := []string{"../test/data/helm/values/base.yaml", "../test/data/helm/values/override.yaml"}
+	fields := []helmctlr.FieldRule{
+		{Value: "image.tag", Field: "spec.version"},
+		{Value: "resources", Field: "{.spec.resources}"},
+		{Value: "image.digest", Field: ".spec.digest"},
+	}
+	m, err := helmctlr.NewValuesMapping(files, "../test/data/helm/values/values.tmpl", fields)
+	assert.Nil(t, err)
+	vals := mappedValues(t, m)
+
+	assert.Equal(t, map[string]interface{}{
+		"repository": "dockercloud/hello-world",
+		"tag":        "1.2.3",
+		"pullPolicy": "IfNotPresent",
+	}, vals["image"], "missing fields keep the values of the files")
+	assert.Equal(t, map[string]interface{}{"type": "ClusterIP"}, vals["service"])
+	assert.Equal(t, float64(3), vals["replicaCount"])
+	assert.Equal(t, "nemo", vals["nameOverride"])
+	assert.Equal(t, map[string]interface{}{"character": "Nemo"}, vals["podLabels"])
+	assert.Equal(t, map[string]interface{}{"limits": map[string]interface{}{"cpu": "100m"}}, vals["resources"])
+	assert.Nil(t, vals["resource"], "the template replaces the resource values")
+
+	// The values files are not changed by a custom resource
+	vals = mappedValues(t, m)
+	assert.Equal(t, "1.2.3", vals["image"].(map[string]interface{})["tag"])
+	m, err = helmctlr.NewValuesMapping(files, "", nil)
+	assert.Nil(t, err)
+	assert.Equal(t, "latest", mappedValues(t, m)["image"].(map[string]interface{})["tag"])
+}
+
+func TestNewValuesMappingErrors(t *testing.T) {
+	_, err := helmctlr.NewValuesMapping([]string{"../test/data/helm/values/missing.yaml"}, "", nil)
+	assert.NotNil(t, err)
+
+	_, err = helmctlr.NewValuesMapping([]string{"../test/data/helm/values/invalid.yaml"}, "", nil)
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "invalid values file")
+
+	_, err = helmctlr.NewValuesMapping(nil, "../test/data/helm/values/missing.tmpl", nil)
+	assert.NotNil(t, err)
+
+	_, err = helmctlr.NewValuesMapping(nil, "", []helmctlr.FieldRule{{Value: "image.tag"}})
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "invalid field rule")
+}
@@ -0,0 +1,157 @@
+// Copyright 2017 the lostromos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package leader
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"go.uber.org/zap"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes"
+	restclient "k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+
+	"github.com/lostromos/lostromos/metrics"
+	"github.com/lostromos/lostromos/status"
+)
+
+// ErrLostLeadership is returned by Run when this instance stops being the leader
+var ErrLostLeadership = errors.New("lost leadership")
+
+// Config provides config for leader election
+type Config struct {
+	Namespace     string        // namespace of the ConfigMap used as lock
+	Name          string        // name of the ConfigMap used as lock
+	Identity      string        // unique identity of this instance, usually the pod name
+	LeaseDuration time.Duration // how long standbys wait before taking over from a leader that stopped renewing
+	RenewDeadline time.Duration // how long the leader keeps retrying to renew before giving up leadership
+	RetryPeriod   time.Duration // how often to try to acquire or renew the lock
+}
+
+// RunFunc is the work done while holding leadership. It must return once the
+// stop channel is closed.
+type RunFunc func(stop <-chan struct{}) error
+
+// Run blocks until this instance is elected leader and then calls run. It
+// returns the error of run, or ErrLostLeadership if leadership was lost, after
+// which the process should exit so it can rejoin as a standby.
+func Run(cfg *Config, kubeCfg *restclient.Config, logger *zap.SugaredLogger, run RunFunc) error {
+	client, err := kubernetes.NewForConfig(kubeCfg)
+	if err != nil {
+		return err
+	}
+	e := newElector(cfg.Identity, run, logger)
+	lock := &resourcelock.ConfigMapLock{
+		ConfigMapMeta: metav1.ObjectMeta{
+			Namespace: cfg.Namespace,
+			Name:      cfg.Name,
+		},
+		Client: client.CoreV1(),
+		LockConfig: resourcelock.ResourceLockConfig{
+			Identity:      cfg.Identity,
+			EventRecorder: eventLogger{logger: logger},
+		},
+	}
+	le, err := leaderelection.NewLeaderElector(leaderelection.LeaderElectionConfig{
+		Lock:          lock,
+		LeaseDuration: cfg.LeaseDuration,
+		RenewDeadline: cfg.RenewDeadline,
+		RetryPeriod:   cfg.RetryPeriod,
+		Callbacks: leaderelection.LeaderCallbacks{
+			OnStartedLeading: e.startedLeading,
+			OnStoppedLeading: e.stoppedLeading,
+			OnNewLeader:      e.newLeader,
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	e.newLeader("")
+	logger.Infow("waiting for leadership", "identity", cfg.Identity, "lock", cfg.Namespace+"/"+cfg.Name)
+	go le.Run()
+	return <-e.done
+}
+
+// elector tracks the leader election state and reports it on the status
+// endpoint and in metrics.
+type elector struct {
+	identity string
+	run      RunFunc
+	logger   *zap.SugaredLogger
+	done     chan error
+}
+
+func newElector(identity string, run RunFunc, logger *zap.SugaredLogger) *elector {
+	return &elector{
+		identity: identity,
+		run:      run,
+		logger:   logger,
+		done:     make(chan error, 1),
+	}
+}
+
+func (e *elector) startedLeading(stop <-chan struct{}) {
+	e.logger.Infow("started leading", "identity", e.identity)
+	metrics.Leader.Set(1)
+	status.SetLeadership(status.Leadership{Identity: e.identity, Leader: e.identity, IsLeader: true})
+
+	err := e.run(stop)
+	select {
+	case <-stop:
+		err = ErrLostLeadership
+	default:
+	}
+	e.done <- err
+}
+
+func (e *elector) stoppedLeading() {
+	e.logger.Infow("stopped leading", "identity", e.identity)
+	metrics.Leader.Set(0)
+	status.SetLeadership(status.Leadership{Identity: e.identity, IsLeader: false})
+}
+
+func (e *elector) newLeader(identity string) {
+	if identity == e.identity {
+		// Reported by startedLeading
+		return
+	}
+	if identity != "" {
+		e.logger.Infow("new leader elected", "leader", identity)
+	}
+	metrics.Leader.Set(0)
+	status.SetLeadership(status.Leadership{Identity: e.identity, Leader: identity, IsLeader: false})
+}
+
+// eventLogger logs the events the lock records on leadership changes
+type eventLogger struct {
+	logger *zap.SugaredLogger
+}
+
+func (l eventLogger) Event(obj runtime.Object, eventType, reason, message string) {
+	l.logger.Infow(message, "reason", reason, "type", eventType)
+}
+
+func (l eventLogger) Eventf(obj runtime.Object, eventType, reason, message string, args ...interface{}) {
+	l.Event(obj, eventType, reason, fmt.Sprintf(message, args...))
+}
+
+func (l eventLogger) PastEventf(obj runtime.Object, timestamp metav1.Time, eventType, reason, message string, args ...interface{}) {
+	l.Event(obj, eventType, reason, fmt.Sprintf(message, args...))
+}
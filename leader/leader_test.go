@@ -0,0 +1,81 @@
+// Copyright 2017 the lostromos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package leader
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/http"
+	"go.uber.org/zap"
+
+	"github.com/lostromos/lostromos/status"
+)
+
+func getPromGaugeValue(metric string) float64 {
+	mf, _ := prometheus.DefaultGatherer.Gather()
+	for _, s := range mf {
+		if s.GetName() == metric {
+			return s.GetMetric()[0].GetGauge().GetValue()
+		}
+	}
+	return 0
+}
+
+func statusOutput() string {
+	writer := new(http.TestResponseWriter)
+	status.Handler(writer, nil)
+	return writer.Output
+}
+
+func TestStandbyReportsLeader(t *testing.T) {
+	e := newElector("lostromos-1", nil, zap.NewNop().Sugar())
+	e.newLeader("lostromos-2")
+
+	assert.Equal(t, float64(0), getPromGaugeValue("lostromos_leader"))
+	assert.Equal(t, `{"success":true,"leaderElection":{"identity":"lostromos-1","leader":"lostromos-2","isLeader":false}}`, statusOutput())
+}
+
+func TestStartedLeadingRunsUntilStopped(t *testing.T) {
+	stop := make(chan struct{})
+	running := make(chan struct{})
+	run := func(stop <-chan struct{}) error {
+		close(running)
+		<-stop
+		return nil
+	}
+	e := newElector("lostromos-1", run, zap.NewNop().Sugar())
+
+	go e.startedLeading(stop)
+	<-running
+	assert.Equal(t, float64(1), getPromGaugeValue("lostromos_leader"))
+	assert.Equal(t, `{"success":true,"leaderElection":{"identity":"lostromos-1","leader":"lostromos-1","isLeader":true}}`, statusOutput())
+
+	close(stop)
+	assert.Equal(t, ErrLostLeadership, <-e.done)
+	e.stoppedLeading()
+	assert.Equal(t, float64(0), getPromGaugeValue("lostromos_leader"))
+}
+
+func TestStartedLeadingReturnsRunError(t *testing.T) {
+	e := newElector("lostromos-1", func(stop <-chan struct{}) error {
+		return errors.New("cache failed to sync")
+	}, zap.NewNop().Sugar())
+
+	e.startedLeading(make(chan struct{}))
+	assert.EqualError(t, <-e.done, "cache failed to sync")
+}
@@ -104,6 +104,55 @@ var (
 		Namespace: "releases",
 	})
 
+	// RolledBackReleases is a metric for the number of failed upgrades rolled back to the last deployed revision
+	RolledBackReleases = prometheus.NewCounter(prometheus.CounterOpts{
+		Help:      "The number of failed upgrades that were rolled back to the last deployed revision",
+		Name:      "rollback_total",
+		Namespace: "releases",
+	})
+
+	// RollbackFailures is a metric for the number of failed upgrades that could not be rolled back
+	RollbackFailures = prometheus.NewCounter(prometheus.CounterOpts{
+		Help:      "The number of failed upgrades whose rollback failed",
+		Name:      "rollback_error_total",
+		Namespace: "releases",
+	})
+
+	// EventRetries is a metric for the number of times a failed event was requeued to be retried
+	EventRetries = prometheus.NewCounter(prometheus.CounterOpts{
+		Help:      "The number of failed events that were requeued to be retried",
+		Name:      "event_retry_total",
+		Namespace: "releases",
+	})
+
+	// DroppedEvents is a metric for the number of events dropped after reaching the maximum number of retries
+	DroppedEvents = prometheus.NewCounter(prometheus.CounterOpts{
+		Help:      "The number of failed events that were dropped after reaching the maximum number of retries",
+		Name:      "event_dropped_total",
+		Namespace: "releases",
+	})
+
+	// SkippedEvents is a metric for the number of updates that were not applied because nothing changed
+	SkippedEvents = prometheus.NewCounter(prometheus.CounterOpts{
+		Help:      "The number of update events skipped because the rendered output matched the last successful apply",
+		Name:      "event_skipped_total",
+		Namespace: "releases",
+	})
+
+	// ValidationFailures is a metric for the number of custom resources whose spec did not match the schema
+	ValidationFailures = prometheus.NewCounter(prometheus.CounterOpts{
+		Help:      "The number of events failed because the spec of the custom resource did not match the schema",
+		Name:      "validation_error_total",
+		Namespace: "releases",
+	})
+
+	// Leader is 1 while this instance holds the leader election lock and 0 otherwise
+	Leader = prometheus.NewGauge(prometheus.GaugeOpts{
+		Help:      "Whether this instance is the elected leader (1) or a standby (0)",
+		Name:      "leader",
+		Namespace: "lostromos",
+	})
+
 	// TotalEvents is a metric for the number of events that have been handled by this operator
 	TotalEvents = prometheus.NewCounter(prometheus.CounterOpts{
 		Help:      "The number of events (create/delete/updates) processed by this operator",
@@ -125,5 +174,12 @@ func init() {
 	prometheus.MustRegister(UpdatedReleases)
 	prometheus.MustRegister(UpdateFailures)
 	prometheus.MustRegister(LastSuccessfulUpdate)
+	prometheus.MustRegister(RolledBackReleases)
+	prometheus.MustRegister(RollbackFailures)
 	prometheus.MustRegister(TotalEvents)
+	prometheus.MustRegister(EventRetries)
+	prometheus.MustRegister(DroppedEvents)
+	prometheus.MustRegister(SkippedEvents)
+	prometheus.MustRegister(ValidationFailures)
+	prometheus.MustRegister(Leader)
 }
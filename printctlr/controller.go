@@ -31,29 +31,32 @@ type Controller struct{}
 
 // ResourceAdded will receive a custom resource when it is created and
 // print that the CR was added
-func (c Controller) ResourceAdded(r *unstructured.Unstructured) {
+func (c Controller) ResourceAdded(r *unstructured.Unstructured) error {
 	fmt.Printf("CR added: %s\n", r.GetName())
 	metrics.CreatedReleases.Inc()
 	metrics.ManagedReleases.Inc()
 	metrics.TotalEvents.Inc()
 	metrics.LastSuccessfulCreate.Set(float64(time.Now().UTC().UnixNano()) / 1000000000)
+	return nil
 }
 
 // ResourceUpdated receives both an the old version and current version of a
 // custom resource and will print out the the custom resource was changed
-func (c Controller) ResourceUpdated(oldR, newR *unstructured.Unstructured) {
+func (c Controller) ResourceUpdated(oldR, newR *unstructured.Unstructured) error {
 	fmt.Printf("CR changed: %s\n", newR.GetName())
 	metrics.UpdatedReleases.Inc()
 	metrics.TotalEvents.Inc()
 	metrics.LastSuccessfulUpdate.Set(float64(time.Now().UTC().UnixNano()) / 1000000000)
+	return nil
 }
 
 // ResourceDeleted will receive a custom resource when it is deleted and
 // print that the CR was deleted
-func (c Controller) ResourceDeleted(r *unstructured.Unstructured) {
+func (c Controller) ResourceDeleted(r *unstructured.Unstructured) error {
 	fmt.Printf("CR deleted: %s\n", r.GetName())
 	metrics.DeletedReleases.Inc()
 	metrics.ManagedReleases.Dec()
 	metrics.TotalEvents.Inc()
 	metrics.LastSuccessfulDelete.Set(float64(time.Now().UTC().UnixNano()) / 1000000000)
+	return nil
 }
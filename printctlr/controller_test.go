@@ -25,7 +25,7 @@ func ExampleController_ResourceAdded() {
 		},
 	}
 
-	Controller{}.ResourceAdded(r)
+	_ = Controller{}.ResourceAdded(r)
 	// Output:
 	// CR added: Thing1
 }
@@ -46,7 +46,7 @@ func ExampleController_ResourceUpdated() {
 		},
 	}
 
-	Controller{}.ResourceUpdated(oldR, newR)
+	_ = Controller{}.ResourceUpdated(oldR, newR)
 	// Output:
 	// CR changed: Thing2
 }
@@ -60,7 +60,7 @@ func ExampleController_ResourceDeleted() {
 		},
 	}
 
-	Controller{}.ResourceDeleted(r)
+	_ = Controller{}.ResourceDeleted(r)
 	// Output:
 	// CR deleted: Thing1
 }
@@ -0,0 +1,120 @@
+// Copyright 2017 the lostromos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package reload watches template directories and charts for changes, so
+// controllers can pick them up without a restart.
+package reload
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"go.uber.org/zap"
+	"k8s.io/apimachinery/pkg/util/wait"
+
+	"github.com/lostromos/lostromos/crhash"
+	"github.com/lostromos/lostromos/status"
+)
+
+// Watcher polls a file or directory and reloads it when its contents change
+type Watcher struct {
+	Path     string        // file or directory to watch
+	Interval time.Duration // how often Path is checked for changes
+	logger   *zap.SugaredLogger
+	last     string // fingerprint of the last loaded contents
+}
+
+// NewWatcher builds a Watcher for path
+func NewWatcher(path string, interval time.Duration, logger *zap.SugaredLogger) *Watcher {
+	if logger == nil {
+		logger = zap.NewNop().Sugar()
+	}
+	return &Watcher{
+		Path:     path,
+		Interval: interval,
+		logger:   logger,
+	}
+}
+
+// Run checks Path for changes every Interval until stopCh is closed. On a
+// change load is called to validate and load the new contents, if it succeeds
+// resync is called so everything is reconciled with them. Failures are
+// reported on the status endpoint until a later load succeeds, the previous
+// contents stay in use meanwhile.
+func (w *Watcher) Run(load func() error, resync func(), stopCh <-chan struct{}) {
+	last, err := Fingerprint(w.Path)
+	if err != nil {
+		w.logger.Warnw("failed to read files to watch for changes", "path", w.Path, "error", err)
+	}
+	w.last = last
+	wait.Until(func() { w.check(load, resync) }, w.Interval, stopCh)
+}
+
+// check reloads Path if it changed since the last check
+func (w *Watcher) check(load func() error, resync func()) {
+	current, err := Fingerprint(w.Path)
+	if err != nil {
+		w.logger.Warnw("failed to read files to watch for changes", "path", w.Path, "error", err)
+		return
+	}
+	if current == w.last {
+		return
+	}
+	// Broken contents are not loaded again until they change
+	w.last = current
+	if err := load(); err != nil {
+		w.logger.Errorw("failed to reload, keeping the previous version", "path", w.Path, "error", err)
+		status.SetReloadError(w.Path, err)
+		return
+	}
+	w.logger.Infow("reloaded, reconciling all custom resources", "path", w.Path)
+	status.SetReloadError(w.Path, nil)
+	resync()
+}
+
+// Fingerprint returns a hash of the names and contents of all files under path.
+// Symlinks to directories, like the ..data link of a mounted ConfigMap, are not
+// followed; the directories they point to are hashed where they are.
+func Fingerprint(path string) (string, error) {
+	var parts [][]byte
+	err := filepath.Walk(path, func(file string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			target, err := os.Stat(file)
+			if err != nil {
+				return err
+			}
+			if target.IsDir() {
+				return nil
+			}
+		}
+		data, err := ioutil.ReadFile(file) // nolint: gosec
+		if err != nil {
+			return err
+		}
+		parts = append(parts, []byte(file), data)
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return crhash.Sum(parts...), nil
+}
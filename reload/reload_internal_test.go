@@ -0,0 +1,127 @@
+// Copyright 2017 the lostromos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package reload
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/http"
+
+	"github.com/lostromos/lostromos/status"
+)
+
+func reloadErrors(t *testing.T) map[string]string {
+	writer := new(http.TestResponseWriter)
+	status.Handler(writer, nil)
+	var res status.Response
+	assert.Nil(t, json.Unmarshal([]byte(writer.Output), &res))
+	return res.ReloadErrors
+}
+
+func writeTestFile(t *testing.T, dir, name, contents string) {
+	assert.Nil(t, os.MkdirAll(filepath.Join(dir, filepath.Dir(name)), 0755))
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, name), []byte(contents), 0644))
+}
+
+func TestFingerprint(t *testing.T) {
+	dir, err := ioutil.TempDir("", "reload")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	writeTestFile(t, dir, "a.tmpl", "nemo")
+
+	first, err := Fingerprint(dir)
+	assert.Nil(t, err)
+	same, err := Fingerprint(dir)
+	assert.Nil(t, err)
+	assert.Equal(t, first, same)
+
+	writeTestFile(t, dir, "a.tmpl", "dory")
+	changed, err := Fingerprint(dir)
+	assert.Nil(t, err)
+	assert.NotEqual(t, first, changed)
+
+	writeTestFile(t, dir, "large/b.tmpl", "marlin")
+	added, err := Fingerprint(dir)
+	assert.Nil(t, err)
+	assert.NotEqual(t, changed, added)
+
+	_, err = Fingerprint(filepath.Join(dir, "missing"))
+	assert.NotNil(t, err)
+}
+
+func TestFingerprintConfigMapMount(t *testing.T) {
+	dir, err := ioutil.TempDir("", "reload")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	// Kubernetes mounts a ConfigMap as files linked through the ..data link to a
+	// timestamped directory, and swaps the link on updates
+	writeTestFile(t, dir, "..2018_06_01/a.tmpl", "nemo")
+	assert.Nil(t, os.Symlink("..2018_06_01", filepath.Join(dir, "..data")))
+	assert.Nil(t, os.Symlink("..data/a.tmpl", filepath.Join(dir, "a.tmpl")))
+
+	first, err := Fingerprint(dir)
+	assert.Nil(t, err)
+
+	writeTestFile(t, dir, "..2018_06_02/a.tmpl", "dory")
+	assert.Nil(t, os.Symlink("..2018_06_02", filepath.Join(dir, "..data_tmp")))
+	assert.Nil(t, os.Rename(filepath.Join(dir, "..data_tmp"), filepath.Join(dir, "..data")))
+	assert.Nil(t, os.RemoveAll(filepath.Join(dir, "..2018_06_01")))
+
+	changed, err := Fingerprint(dir)
+	assert.Nil(t, err)
+	assert.NotEqual(t, first, changed)
+}
+
+func TestCheckReloadsChanges(t *testing.T) {
+	dir, err := ioutil.TempDir("", "reload")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	writeTestFile(t, dir, "a.tmpl", "nemo")
+	w := NewWatcher(dir, time.Second, nil)
+	w.last, _ = Fingerprint(dir)
+
+	loads, resyncs := 0, 0
+	var loadErr error
+	load := func() error { loads++; return loadErr }
+	resync := func() { resyncs++ }
+
+	w.check(load, resync)
+	assert.Equal(t, 0, loads)
+
+	writeTestFile(t, dir, "a.tmpl", "{{ broken")
+	loadErr = errors.New("unexpected EOF")
+	w.check(load, resync)
+	assert.Equal(t, 1, loads)
+	assert.Equal(t, 0, resyncs)
+	assert.Equal(t, "unexpected EOF", reloadErrors(t)[dir])
+
+	// Broken files are not loaded again until they change
+	w.check(load, resync)
+	assert.Equal(t, 1, loads)
+
+	writeTestFile(t, dir, "a.tmpl", "dory")
+	loadErr = nil
+	w.check(load, resync)
+	assert.Equal(t, 2, loads)
+	assert.Equal(t, 1, resyncs)
+	assert.Empty(t, reloadErrors(t))
+}
@@ -0,0 +1,243 @@
+// Copyright 2017 the lostromos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package schema validates custom resources against a JSON Schema. It supports
+// the keywords used to describe the spec of a custom resource: type, enum,
+// properties, required, additionalProperties, items, minItems, maxItems,
+// uniqueItems, minimum, maximum, exclusiveMinimum, exclusiveMaximum,
+// minLength, maxLength, pattern, allOf, anyOf, oneOf, not and $ref to local
+// definitions, plus annotations like title and description. Schemas using
+// other keywords are rejected, so nothing the author meant to check is
+// silently skipped.
+package schema
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"regexp"
+	"strings"
+)
+
+// Schema is a parsed JSON Schema
+type Schema struct {
+	root *node
+}
+
+// ValidationError lists every way a value does not match a Schema
+type ValidationError struct {
+	Name       string   // name of the validated value, the root of the paths in Violations
+	Violations []string // the path of the offending value and what is wrong with it
+}
+
+func (e *ValidationError) Error() string {
+	return fmt.Sprintf("%s does not match the schema: %s", e.Name, strings.Join(e.Violations, "; "))
+}
+
+// Parse parses a JSON Schema
+func Parse(data []byte) (*Schema, error) {
+	root := &node{}
+	if err := json.Unmarshal(data, root); err != nil {
+		return nil, err
+	}
+	if err := root.compile(root); err != nil {
+		return nil, err
+	}
+	return &Schema{root: root}, nil
+}
+
+// Load reads the JSON Schema in the file. It returns nil without an error if
+// the file does not exist.
+func Load(file string) (*Schema, error) {
+	data, err := ioutil.ReadFile(file) // nolint: gosec
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	s, err := Parse(data)
+	if err != nil {
+		return nil, fmt.Errorf("invalid schema %s: %s", file, err)
+	}
+	return s, nil
+}
+
+// Validate checks v, a value decoded from JSON or YAML, against the schema. It
+// returns a *ValidationError if it does not match.
+func (s *Schema) Validate(name string, v interface{}) error {
+	var violations []string
+	s.root.validate(name, v, &violations)
+	if len(violations) > 0 {
+		return &ValidationError{Name: name, Violations: violations}
+	}
+	return nil
+}
+
+// node is a schema or subschema
+type node struct {
+	Type                 types            `json:"type"`
+	Enum                 []interface{}    `json:"enum"`
+	Properties           map[string]*node `json:"properties"`
+	Required             []string         `json:"required"`
+	AdditionalProperties *node            `json:"additionalProperties"`
+	Items                *node            `json:"items"`
+	MinItems             *int             `json:"minItems"`
+	MaxItems             *int             `json:"maxItems"`
+	UniqueItems          bool             `json:"uniqueItems"`
+	Minimum              *float64         `json:"minimum"`
+	Maximum              *float64         `json:"maximum"`
+	ExclusiveMinimum     *bound           `json:"exclusiveMinimum"`
+	ExclusiveMaximum     *bound           `json:"exclusiveMaximum"`
+	MinLength            *int             `json:"minLength"`
+	MaxLength            *int             `json:"maxLength"`
+	Pattern              string           `json:"pattern"`
+	AllOf                []*node          `json:"allOf"`
+	AnyOf                []*node          `json:"anyOf"`
+	OneOf                []*node          `json:"oneOf"`
+	Not                  *node            `json:"not"`
+	Ref                  string           `json:"$ref"`
+	Definitions          map[string]*node `json:"definitions"`
+	Defs                 map[string]*node `json:"$defs"`
+
+	always  *bool // set for the boolean schemas true and false
+	pattern *regexp.Regexp
+	ref     *node
+}
+
+// annotations are keywords that don't constrain values
+var annotations = []string{"$schema", "$id", "id", "$comment", "title", "description", "default", "examples"}
+
+// keywords are the supported keywords, the JSON names of the fields of node
+// and the annotations
+var keywords = func() map[string]bool {
+	k := map[string]bool{}
+	t := reflect.TypeOf(node{})
+	for i := 0; i < t.NumField(); i++ {
+		if tag := t.Field(i).Tag.Get("json"); tag != "" {
+			k[tag] = true
+		}
+	}
+	for _, a := range annotations {
+		k[a] = true
+	}
+	return k
+}()
+
+func (n *node) UnmarshalJSON(data []byte) error {
+	var b bool
+	if err := json.Unmarshal(data, &b); err == nil {
+		n.always = &b
+		return nil
+	}
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	for k := range raw {
+		if !keywords[k] {
+			return fmt.Errorf("unsupported keyword %q", k)
+		}
+	}
+	type plain node
+	return json.Unmarshal(data, (*plain)(n))
+}
+
+// types is the type keyword, a single type or a list of them
+type types []string
+
+func (t *types) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err == nil {
+		*t = types{s}
+		return nil
+	}
+	return json.Unmarshal(data, (*[]string)(t))
+}
+
+// bound is exclusiveMinimum or exclusiveMaximum, a number since draft 6 and a
+// boolean modifying minimum or maximum in draft 4
+type bound struct {
+	value *float64
+	flag  bool
+}
+
+func (b *bound) UnmarshalJSON(data []byte) error {
+	if err := json.Unmarshal(data, &b.flag); err == nil {
+		return nil
+	}
+	return json.Unmarshal(data, &b.value)
+}
+
+// compile resolves references and compiles patterns of the node and its
+// subschemas
+func (n *node) compile(root *node) error {
+	if n == nil {
+		return nil
+	}
+	if n.Pattern != "" {
+		re, err := regexp.Compile(n.Pattern)
+		if err != nil {
+			return fmt.Errorf("invalid pattern %q: %s", n.Pattern, err)
+		}
+		n.pattern = re
+	}
+	if n.Ref != "" {
+		ref, err := root.resolve(n.Ref)
+		if err != nil {
+			return err
+		}
+		n.ref = ref
+	}
+	var children []*node
+	for _, m := range []map[string]*node{n.Properties, n.Definitions, n.Defs} {
+		for _, child := range m {
+			children = append(children, child)
+		}
+	}
+	children = append(children, n.AdditionalProperties, n.Items, n.Not)
+	children = append(children, n.AllOf...)
+	children = append(children, n.AnyOf...)
+	children = append(children, n.OneOf...)
+	for _, child := range children {
+		if err := child.compile(root); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// resolve finds the definition a $ref points to
+func (n *node) resolve(ref string) (*node, error) {
+	if ref == "#" {
+		return n, nil
+	}
+	var defs map[string]*node
+	var name string
+	switch {
+	case strings.HasPrefix(ref, "#/definitions/"):
+		defs, name = n.Definitions, strings.TrimPrefix(ref, "#/definitions/")
+	case strings.HasPrefix(ref, "#/$defs/"):
+		defs, name = n.Defs, strings.TrimPrefix(ref, "#/$defs/")
+	default:
+		return nil, fmt.Errorf("unsupported $ref %q, only local definitions are supported", ref)
+	}
+	def, ok := defs[name]
+	if !ok {
+		return nil, fmt.Errorf("$ref %q not found", ref)
+	}
+	return def, nil
+}
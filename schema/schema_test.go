@@ -0,0 +1,174 @@
+// Copyright 2017 the lostromos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package schema_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/lostromos/lostromos/schema"
+)
+
+const testSchema = `{
+  "$schema": "http://json-schema.org/draft-07/schema#",
+  "type": "object",
+  "required": ["size", "image"],
+  "additionalProperties": false,
+  "properties": {
+    "size": {"type": "string", "enum": ["small", "large"]},
+    "image": {"type": "string", "pattern": "^[a-z/]+:[0-9.]+$", "maxLength": 20},
+    "replicas": {"type": "integer", "minimum": 1, "exclusiveMaximum": 10},
+    "ratio": {"type": "number", "exclusiveMinimum": 0},
+    "ports": {"type": "array", "minItems": 1, "uniqueItems": true, "items": {"$ref": "#/definitions/port"}},
+    "labels": {"type": "object", "additionalProperties": {"type": "string"}},
+    "storage": {"oneOf": [{"type": "string"}, {"type": "object", "required": ["size"]}]},
+    "debug": {"type": ["boolean", "null"]}
+  },
+  "definitions": {
+    "port": {"type": "integer", "minimum": 1, "maximum": 65535}
+  }
+}`
+
+func TestValidate(t *testing.T) {
+	s, err := schema.Parse([]byte(testSchema))
+	assert.Nil(t, err)
+
+	var testCases = []struct {
+		name       string
+		spec       interface{}
+		violations []string
+	}{
+		{"Test valid spec", map[string]interface{}{
+			"size":     "small",
+			"image":    "nginx:1.13",
+			"replicas": int64(3),
+			"ratio":    0.5,
+			"ports":    []interface{}{float64(80), int64(443)},
+			"labels":   map[string]interface{}{"app": "nginx"},
+			"storage":  map[string]interface{}{"size": "1Gi"},
+			"debug":    nil,
+		}, nil},
+		{"Test missing spec", nil, []string{"spec: must be of type object, not null"}},
+		{"Test missing fields", map[string]interface{}{}, []string{"spec.size: is required", "spec.image: is required"}},
+		{"Test wrong types", map[string]interface{}{
+			"size":     float64(1),
+			"image":    "nginx:1.13",
+			"replicas": 1.5,
+			"debug":    "yes",
+		}, []string{
+			"spec.debug: must be of type boolean or null, not string",
+			"spec.replicas: must be of type integer, not number",
+			"spec.size: must be of type string, not integer",
+		}},
+		{"Test values out of range", map[string]interface{}{
+			"size":     "medium",
+			"image":    "Nginx:latest-and-greatest",
+			"replicas": int64(10),
+			"ratio":    float64(0),
+			"ports":    []interface{}{int64(80), float64(80), int64(70000)},
+			"labels":   map[string]interface{}{"app": true},
+			"storage":  map[string]interface{}{},
+			"extra":    "field",
+		}, []string{
+			"spec.extra: is not allowed",
+			`spec.image: must be at most 20 characters long`,
+			`spec.image: must match the pattern "^[a-z/]+:[0-9.]+$"`,
+			"spec.labels.app: must be of type string, not boolean",
+			"spec.ports: must not contain duplicate items",
+			"spec.ports[2]: must be at most 65535",
+			"spec.ratio: must be greater than 0",
+			"spec.replicas: must be less than 10",
+			`spec.size: must be one of ["small","large"]`,
+			"spec.storage: must match exactly one schema of oneOf",
+		}},
+	}
+	for _, tt := range testCases {
+		err := s.Validate("spec", tt.spec)
+		if tt.violations == nil {
+			assert.Nil(t, err, tt.name)
+			continue
+		}
+		if assert.IsType(t, &schema.ValidationError{}, err, tt.name) {
+			assert.Equal(t, tt.violations, err.(*schema.ValidationError).Violations, tt.name)
+		}
+	}
+}
+
+func TestValidationErrorMessage(t *testing.T) {
+	err := &schema.ValidationError{Name: "spec", Violations: []string{"spec.size: is required", "spec.image: is required"}}
+	assert.Equal(t, "spec does not match the schema: spec.size: is required; spec.image: is required", err.Error())
+}
+
+func TestParseFailsOnInvalidSchemas(t *testing.T) {
+	for _, data := range []string{
+		`{"type": `,
+		`{"type": 1}`,
+		`{"pattern": "("}`,
+		`{"$ref": "https://example.com/schema.json"}`,
+		`{"$ref": "#/definitions/missing"}`,
+	} {
+		_, err := schema.Parse([]byte(data))
+		assert.NotNil(t, err, data)
+	}
+}
+
+func TestParseRejectsUnsupportedKeywords(t *testing.T) {
+	for _, keyword := range []string{
+		`"const": 1`,
+		`"format": "email"`,
+		`"patternProperties": {"^a": {"type": "string"}}`,
+		`"if": {"type": "string"}, "then": {"maxLength": 3}`,
+		`"minProperties": 1`,
+		`"dependencies": {"a": ["b"]}`,
+	} {
+		_, err := schema.Parse([]byte(`{"type": "object", "properties": {"a": {` + keyword + `}}}`))
+		assert.NotNil(t, err, keyword)
+		assert.Contains(t, err.Error(), "unsupported keyword", keyword)
+	}
+
+	_, err := schema.Parse([]byte(`{"title": "Spec", "description": "The spec", "properties": {"a": {"default": 1, "examples": [1]}}}`))
+	assert.Nil(t, err)
+}
+
+func TestParseDraft4ExclusiveBounds(t *testing.T) {
+	s, err := schema.Parse([]byte(`{"minimum": 0, "exclusiveMinimum": true, "maximum": 1, "exclusiveMaximum": false}`))
+	assert.Nil(t, err)
+	assert.NotNil(t, s.Validate("spec", float64(0)))
+	assert.Nil(t, s.Validate("spec", float64(1)))
+}
+
+func TestLoad(t *testing.T) {
+	dir, err := ioutil.TempDir("", "schema")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	s, err := schema.Load(filepath.Join(dir, "schema.json"))
+	assert.Nil(t, err)
+	assert.Nil(t, s, "a missing file is no schema")
+
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, "schema.json"), []byte(`{"type": "object"}`), 0644))
+	s, err = schema.Load(filepath.Join(dir, "schema.json"))
+	assert.Nil(t, err)
+	assert.NotNil(t, s)
+
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, "schema.json"), []byte(`{"type": }`), 0644))
+	_, err = schema.Load(filepath.Join(dir, "schema.json"))
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "invalid schema")
+}
@@ -0,0 +1,249 @@
+// Copyright 2017 the lostromos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package schema
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// validate appends the violations of v at path to violations
+func (n *node) validate(path string, v interface{}, violations *[]string) {
+	report := func(format string, args ...interface{}) {
+		*violations = append(*violations, path+": "+fmt.Sprintf(format, args...))
+	}
+	if n.always != nil {
+		if !*n.always {
+			report("is not allowed")
+		}
+		return
+	}
+	if n.ref != nil {
+		n.ref.validate(path, v, violations)
+	}
+	if len(n.Type) > 0 && !n.Type.match(v) {
+		report("must be of type %s, not %s", strings.Join(n.Type, " or "), typeOf(v))
+		// The other keywords only make sense for the right type
+		return
+	}
+	if len(n.Enum) > 0 && !contains(n.Enum, v) {
+		report("must be one of %s", list(n.Enum))
+	}
+
+	switch val := v.(type) {
+	case map[string]interface{}:
+		n.validateObject(path, val, violations)
+	case []interface{}:
+		n.validateArray(path, val, violations)
+	case string:
+		n.validateString(path, val, report)
+	default:
+		if f, ok := number(v); ok {
+			n.validateNumber(f, report)
+		}
+	}
+
+	for _, sub := range n.AllOf {
+		sub.validate(path, v, violations)
+	}
+	if len(n.AnyOf) > 0 && n.matches(n.AnyOf, path, v) == 0 {
+		report("must match at least one schema of anyOf")
+	}
+	if len(n.OneOf) > 0 && n.matches(n.OneOf, path, v) != 1 {
+		report("must match exactly one schema of oneOf")
+	}
+	if n.Not != nil && n.matches([]*node{n.Not}, path, v) == 1 {
+		report("must not match the schema of not")
+	}
+}
+
+// matches returns the number of schemas that v matches
+func (n *node) matches(schemas []*node, path string, v interface{}) int {
+	count := 0
+	for _, sub := range schemas {
+		var violations []string
+		sub.validate(path, v, &violations)
+		if len(violations) == 0 {
+			count++
+		}
+	}
+	return count
+}
+
+func (n *node) validateObject(path string, obj map[string]interface{}, violations *[]string) {
+	for _, name := range n.Required {
+		if _, ok := obj[name]; !ok {
+			*violations = append(*violations, path+"."+name+": is required")
+		}
+	}
+	names := make([]string, 0, len(obj))
+	for name := range obj {
+		names = append(names, name)
+	}
+	// Report violations in a stable order
+	sort.Strings(names)
+	for _, name := range names {
+		if prop, ok := n.Properties[name]; ok {
+			prop.validate(path+"."+name, obj[name], violations)
+		} else if n.AdditionalProperties != nil {
+			n.AdditionalProperties.validate(path+"."+name, obj[name], violations)
+		}
+	}
+}
+
+func (n *node) validateArray(path string, items []interface{}, violations *[]string) {
+	report := func(format string, args ...interface{}) {
+		*violations = append(*violations, path+": "+fmt.Sprintf(format, args...))
+	}
+	if n.MinItems != nil && len(items) < *n.MinItems {
+		report("must have at least %d items", *n.MinItems)
+	}
+	if n.MaxItems != nil && len(items) > *n.MaxItems {
+		report("must have at most %d items", *n.MaxItems)
+	}
+	if n.UniqueItems {
+		for i := range items {
+			if contains(items[:i], items[i]) {
+				report("must not contain duplicate items")
+				break
+			}
+		}
+	}
+	if n.Items != nil {
+		for i, item := range items {
+			n.Items.validate(fmt.Sprintf("%s[%d]", path, i), item, violations)
+		}
+	}
+}
+
+func (n *node) validateString(path string, s string, report func(string, ...interface{})) {
+	length := utf8.RuneCountInString(s)
+	if n.MinLength != nil && length < *n.MinLength {
+		report("must be at least %d characters long", *n.MinLength)
+	}
+	if n.MaxLength != nil && length > *n.MaxLength {
+		report("must be at most %d characters long", *n.MaxLength)
+	}
+	if n.pattern != nil && !n.pattern.MatchString(s) {
+		report("must match the pattern %q", n.Pattern)
+	}
+}
+
+func (n *node) validateNumber(f float64, report func(string, ...interface{})) {
+	if n.Minimum != nil {
+		if n.ExclusiveMinimum != nil && n.ExclusiveMinimum.flag {
+			if f <= *n.Minimum {
+				report("must be greater than %v", *n.Minimum)
+			}
+		} else if f < *n.Minimum {
+			report("must be at least %v", *n.Minimum)
+		}
+	}
+	if n.Maximum != nil {
+		if n.ExclusiveMaximum != nil && n.ExclusiveMaximum.flag {
+			if f >= *n.Maximum {
+				report("must be less than %v", *n.Maximum)
+			}
+		} else if f > *n.Maximum {
+			report("must be at most %v", *n.Maximum)
+		}
+	}
+	if n.ExclusiveMinimum != nil && n.ExclusiveMinimum.value != nil && f <= *n.ExclusiveMinimum.value {
+		report("must be greater than %v", *n.ExclusiveMinimum.value)
+	}
+	if n.ExclusiveMaximum != nil && n.ExclusiveMaximum.value != nil && f >= *n.ExclusiveMaximum.value {
+		report("must be less than %v", *n.ExclusiveMaximum.value)
+	}
+}
+
+// match reports whether v has one of the types
+func (t types) match(v interface{}) bool {
+	actual := typeOf(v)
+	for _, name := range t {
+		if name == actual || name == "number" && actual == "integer" {
+			return true
+		}
+	}
+	return false
+}
+
+// typeOf returns the JSON Schema type of v
+func typeOf(v interface{}) string {
+	switch v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case string:
+		return "string"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	}
+	if f, ok := number(v); ok {
+		if f == math.Trunc(f) {
+			return "integer"
+		}
+		return "number"
+	}
+	return fmt.Sprintf("%T", v)
+}
+
+// number converts the numbers found in decoded JSON and YAML to a float64
+func number(v interface{}) (float64, bool) {
+	switch val := v.(type) {
+	case float64:
+		return val, true
+	case int64:
+		return float64(val), true
+	case int:
+		return float64(val), true
+	case json.Number:
+		f, err := val.Float64()
+		return f, err == nil
+	}
+	return 0, false
+}
+
+// contains reports whether v equals one of values, comparing numbers by value
+func contains(values []interface{}, v interface{}) bool {
+	for _, val := range values {
+		if f, ok := number(val); ok {
+			if g, ok := number(v); ok && f == g {
+				return true
+			}
+			continue
+		}
+		if reflect.DeepEqual(val, v) {
+			return true
+		}
+	}
+	return false
+}
+
+// list formats values as a JSON list
+func list(values []interface{}) string {
+	data, err := json.Marshal(values)
+	if err != nil {
+		return fmt.Sprint(values)
+	}
+	return string(data)
+}
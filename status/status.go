@@ -15,20 +15,77 @@
 package status
 
 import (
-	"fmt"
+	"encoding/json"
 	"net/http"
+	"sync"
 )
 
 // Response used to define the status response for Lostromos
 type Response struct {
-	Success bool
-	Info    string
+	Success      bool              `json:"success"`
+	Info         string            `json:"info,omitempty"`
+	Leader       *Leadership       `json:"leaderElection,omitempty"`
+	ReloadErrors map[string]string `json:"reloadErrors,omitempty"`
+}
+
+// Leadership describes the leader election state of this Lostromos instance
+type Leadership struct {
+	Identity string `json:"identity"` // identity of this instance
+	Leader   string `json:"leader"`   // identity of the current leader
+	IsLeader bool   `json:"isLeader"` // whether this instance is the leader
+}
+
+var (
+	mu           sync.RWMutex
+	leadership   *Leadership
+	reloadErrors = map[string]string{}
+)
+
+// SetLeadership records the leader election state reported by the status endpoint
+func SetLeadership(l Leadership) {
+	mu.Lock()
+	defer mu.Unlock()
+	leadership = &l
+}
+
+// SetReloadError records why the templates or chart at path failed to reload,
+// a nil err clears it
+func SetReloadError(path string, err error) {
+	mu.Lock()
+	defer mu.Unlock()
+	if err == nil {
+		delete(reloadErrors, path)
+		return
+	}
+	reloadErrors[path] = err.Error()
+}
+
+func current() Response {
+	mu.RLock()
+	defer mu.RUnlock()
+	res := Response{Success: true}
+	if leadership != nil {
+		l := *leadership
+		res.Leader = &l
+	}
+	if len(reloadErrors) > 0 {
+		res.ReloadErrors = make(map[string]string, len(reloadErrors))
+		for path, err := range reloadErrors {
+			res.ReloadErrors[path] = err
+		}
+	}
+	return res
 }
 
 // Handler is used for managing calls to /status to inform of the current status of Lostromos.
 func Handler(w http.ResponseWriter, r *http.Request) {
+	body, err := json.Marshal(current())
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
 	w.Header().Set("Content-Type", "application/json")
-	_, err := fmt.Fprint(w, "{\"success\": true}")
+	_, err = w.Write(body)
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		return
@@ -15,6 +15,7 @@
 package status
 
 import (
+	"errors"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -24,5 +25,27 @@ import (
 func TestStatusHandler(t *testing.T) {
 	writer := new(http.TestResponseWriter)
 	Handler(writer, nil)
-	assert.Equal(t, "{\"success\": true}", writer.Output)
+	assert.Equal(t, "{\"success\":true}", writer.Output)
+}
+
+func TestStatusHandlerReportsLeadership(t *testing.T) {
+	defer func() { leadership = nil }()
+	SetLeadership(Leadership{Identity: "lostromos-1", Leader: "lostromos-2", IsLeader: false})
+
+	writer := new(http.TestResponseWriter)
+	Handler(writer, nil)
+	assert.Equal(t, `{"success":true,"leaderElection":{"identity":"lostromos-1","leader":"lostromos-2","isLeader":false}}`, writer.Output)
+}
+
+func TestStatusHandlerReportsReloadErrors(t *testing.T) {
+	SetReloadError("/templates", errors.New("template: bad.tmpl:1: unexpected EOF"))
+
+	writer := new(http.TestResponseWriter)
+	Handler(writer, nil)
+	assert.Equal(t, `{"success":true,"reloadErrors":{"/templates":"template: bad.tmpl:1: unexpected EOF"}}`, writer.Output)
+
+	SetReloadError("/templates", nil)
+	writer = new(http.TestResponseWriter)
+	Handler(writer, nil)
+	assert.Equal(t, "{\"success\":true}", writer.Output)
 }
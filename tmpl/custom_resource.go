@@ -22,6 +22,12 @@ type CustomResource struct {
 	Resource *unstructured.Unstructured // represents the resource from kubernetes
 }
 
+// copy returns a deep copy of the custom resource, the resource usually belongs
+// to the informer cache and must not be modified by templates
+func (cr *CustomResource) copy() *CustomResource {
+	return &CustomResource{Resource: cr.Resource.DeepCopy()}
+}
+
 // Name will return the Name from the custom resource
 func (cr CustomResource) Name() string {
 	return cr.Resource.GetName()
@@ -36,6 +42,88 @@ func (cr CustomResource) GetField(fields ...string) string {
 	return ""
 }
 
+// GetValue will traverse all the fields to return the raw value of the
+// requested field, so templates can range over lists and maps. If the field is
+// not found it will return nil
+func (cr CustomResource) GetValue(fields ...string) interface{} {
+	return getNestedField(cr.Resource.Object, fields...)
+}
+
+// GetValueOr returns the value of the requested field, or def if the field is
+// not found
+func (cr CustomResource) GetValueOr(def interface{}, fields ...string) interface{} {
+	if val := getNestedField(cr.Resource.Object, fields...); val != nil {
+		return val
+	}
+	return def
+}
+
+// GetInt returns the integer value of the requested field, or 0 if it is not
+// found or not a number
+func (cr CustomResource) GetInt(fields ...string) int64 {
+	i, _ := toInt64(getNestedField(cr.Resource.Object, fields...))
+	return i
+}
+
+// GetBool returns the boolean value of the requested field, or false if it is
+// not found or not a boolean
+func (cr CustomResource) GetBool(fields ...string) bool {
+	b, _ := getNestedField(cr.Resource.Object, fields...).(bool)
+	return b
+}
+
+// GetSlice returns the list value of the requested field, or nil if it is not
+// found or not a list
+func (cr CustomResource) GetSlice(fields ...string) []interface{} {
+	l, _ := getNestedField(cr.Resource.Object, fields...).([]interface{})
+	return l
+}
+
+// GetMap returns the map value of the requested field, or nil if it is not
+// found or not a map
+func (cr CustomResource) GetMap(fields ...string) map[string]interface{} {
+	m, _ := getNestedField(cr.Resource.Object, fields...).(map[string]interface{})
+	return m
+}
+
+// Namespace will return the Namespace from the custom resource
+func (cr CustomResource) Namespace() string {
+	return cr.Resource.GetNamespace()
+}
+
+// Labels will return the labels of the custom resource
+func (cr CustomResource) Labels() map[string]string {
+	return cr.Resource.GetLabels()
+}
+
+// Annotations will return the annotations of the custom resource
+func (cr CustomResource) Annotations() map[string]string {
+	return cr.Resource.GetAnnotations()
+}
+
+// UID will return the UID of the custom resource
+func (cr CustomResource) UID() string {
+	return string(cr.Resource.GetUID())
+}
+
+// Generation will return the metadata.generation of the custom resource
+func (cr CustomResource) Generation() int64 {
+	return cr.Resource.GetGeneration()
+}
+
+// toInt64 converts the numbers found in unstructured objects to an int64
+func toInt64(v interface{}) (int64, bool) {
+	switch val := v.(type) {
+	case int64:
+		return val, true
+	case int:
+		return int64(val), true
+	case float64:
+		return int64(val), true
+	}
+	return 0, false
+}
+
 // copied from https://github.com/kubernetes/apimachinery/blob/master/pkg/apis/meta/v1/unstructured/unstructured.go
 func getNestedField(obj map[string]interface{}, fields ...string) interface{} {
 	var val interface{} = obj
@@ -15,11 +15,37 @@
 package tmpl_test
 
 import (
+	"bytes"
+	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+
+	"github.com/lostromos/lostromos/tmpl"
 )
 
+var typedCR = &tmpl.CustomResource{Resource: &unstructured.Unstructured{
+	Object: map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"name":        "dory",
+			"namespace":   "ocean",
+			"uid":         "1234",
+			"generation":  int64(2),
+			"labels":      map[string]interface{}{"app": "nemo"},
+			"annotations": map[string]interface{}{"note": "keep swimming"},
+		},
+		"spec": map[string]interface{}{
+			"replicas": int64(3),
+			"scale":    float64(1.5),
+			"enabled":  true,
+			"ports":    []interface{}{int64(80), int64(443)},
+			"config":   map[string]interface{}{"level": "debug"},
+		},
+	},
+}}
+
 func TestName(t *testing.T) {
 	r := testCR.Name()
 	assert.Equal(t, "dory", r)
@@ -34,3 +60,59 @@ func TestGetFieldReturnsEmptyIfNotFound(t *testing.T) {
 	r := testCR.GetField("Something", "made", "up")
 	assert.Empty(t, r)
 }
+
+func TestGetValue(t *testing.T) {
+	assert.Equal(t, int64(3), typedCR.GetValue("spec", "replicas"))
+	assert.Equal(t, []interface{}{int64(80), int64(443)}, typedCR.GetValue("spec", "ports"))
+	assert.Nil(t, typedCR.GetValue("spec", "missing"))
+}
+
+func TestGetValueOr(t *testing.T) {
+	assert.Equal(t, int64(3), typedCR.GetValueOr(1, "spec", "replicas"))
+	assert.Equal(t, 1, typedCR.GetValueOr(1, "spec", "missing"))
+}
+
+func TestGetInt(t *testing.T) {
+	assert.Equal(t, int64(3), typedCR.GetInt("spec", "replicas"))
+	assert.Equal(t, int64(1), typedCR.GetInt("spec", "scale"))
+	assert.Equal(t, int64(0), typedCR.GetInt("spec", "enabled"))
+	assert.Equal(t, int64(0), typedCR.GetInt("spec", "missing"))
+}
+
+func TestGetBool(t *testing.T) {
+	assert.True(t, typedCR.GetBool("spec", "enabled"))
+	assert.False(t, typedCR.GetBool("spec", "replicas"))
+	assert.False(t, typedCR.GetBool("spec", "missing"))
+}
+
+func TestGetSlice(t *testing.T) {
+	assert.Equal(t, []interface{}{int64(80), int64(443)}, typedCR.GetSlice("spec", "ports"))
+	assert.Nil(t, typedCR.GetSlice("spec", "config"))
+}
+
+func TestGetMap(t *testing.T) {
+	assert.Equal(t, map[string]interface{}{"level": "debug"}, typedCR.GetMap("spec", "config"))
+	assert.Nil(t, typedCR.GetMap("spec", "ports"))
+}
+
+func TestMetadataAccessors(t *testing.T) {
+	assert.Equal(t, "ocean", typedCR.Namespace())
+	assert.Equal(t, map[string]string{"app": "nemo"}, typedCR.Labels())
+	assert.Equal(t, map[string]string{"note": "keep swimming"}, typedCR.Annotations())
+	assert.Equal(t, "1234", typedCR.UID())
+	assert.Equal(t, int64(2), typedCR.Generation())
+}
+
+func TestTemplateRangesOverSlice(t *testing.T) {
+	dir := createTestDir([]templateFile{
+		{"service.tmpl", `replicas: {{ .GetInt "spec" "replicas" }}
+ports:{{ range .GetSlice "spec" "ports" }}
+- {{ . }}{{ end }}`},
+	})
+	defer os.RemoveAll(dir)
+
+	buf := bytes.NewBufferString("")
+	err := tmpl.Parse(typedCR, filepath.Join(dir, "*.tmpl"), buf)
+	assert.Nil(t, err)
+	assert.Equal(t, "replicas: 3\nports:\n- 80\n- 443", buf.String())
+}
@@ -0,0 +1,397 @@
+// Copyright 2017 the lostromos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tmpl
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"text/template"
+
+	"github.com/ghodss/yaml"
+)
+
+// FuncMap returns the functions available to templates. They follow the
+// names and argument order of the Sprig functions used by Helm charts, so the
+// piped value is always the last argument.
+func FuncMap() template.FuncMap {
+	return template.FuncMap{
+		// Defaults and checks
+		"default":  defaultValue,
+		"empty":    empty,
+		"required": required,
+		"coalesce": coalesce,
+		"ternary":  ternary,
+
+		// Strings
+		"quote":      quote,
+		"squote":     squote,
+		"toString":   toString,
+		"upper":      strings.ToUpper,
+		"lower":      strings.ToLower,
+		"title":      strings.Title,
+		"trim":       strings.TrimSpace,
+		"trimAll":    func(cutset, s string) string { return strings.Trim(s, cutset) },
+		"trimPrefix": func(prefix, s string) string { return strings.TrimPrefix(s, prefix) },
+		"trimSuffix": func(suffix, s string) string { return strings.TrimSuffix(s, suffix) },
+		"contains":   func(substr, s string) bool { return strings.Contains(s, substr) },
+		"hasPrefix":  func(prefix, s string) bool { return strings.HasPrefix(s, prefix) },
+		"hasSuffix":  func(suffix, s string) bool { return strings.HasSuffix(s, suffix) },
+		"replace":    func(old, repl, s string) string { return strings.Replace(s, old, repl, -1) },
+		"repeat":     func(count int, s string) string { return strings.Repeat(s, count) },
+		"trunc":      trunc,
+		"splitList":  func(sep, s string) []string { return strings.Split(s, sep) },
+		"join":       join,
+		"indent":     indent,
+		"nindent":    func(spaces int, s string) string { return "\n" + indent(spaces, s) },
+
+		// Encoding
+		"toYaml":    toYaml,
+		"toJson":    toJSON,
+		"fromJson":  fromJSON,
+		"b64enc":    func(s string) string { return base64.StdEncoding.EncodeToString([]byte(s)) },
+		"b64dec":    b64dec,
+		"sha256sum": sha256sum,
+
+		// Lists
+		"list":    func(v ...interface{}) []interface{} { return v },
+		"first":   first,
+		"last":    last,
+		"rest":    rest,
+		"append":  appendList,
+		"prepend": prependList,
+		"has":     has,
+		"uniq":    uniq,
+
+		// Dicts
+		"dict":   dict,
+		"get":    func(d map[string]interface{}, key string) interface{} { return d[key] },
+		"set":    func(d map[string]interface{}, key string, v interface{}) map[string]interface{} { d[key] = v; return d },
+		"unset":  func(d map[string]interface{}, key string) map[string]interface{} { delete(d, key); return d },
+		"hasKey": func(d map[string]interface{}, key string) bool { _, ok := d[key]; return ok },
+		"keys":   keys,
+		"values": values,
+		"merge":  merge,
+
+		// Cluster
+		"lookup": lookupFunc(nil),
+	}
+}
+
+// empty returns true for nil and the zero value of v's type, including empty
+// strings, slices and maps
+func empty(v interface{}) bool {
+	rv := reflect.ValueOf(v)
+	if !rv.IsValid() {
+		return true
+	}
+	switch rv.Kind() {
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return rv.Len() == 0
+	case reflect.Bool:
+		return !rv.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return rv.Int() == 0
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return rv.Uint() == 0
+	case reflect.Float32, reflect.Float64:
+		return rv.Float() == 0
+	case reflect.Interface, reflect.Ptr:
+		return rv.IsNil()
+	}
+	return false
+}
+
+// defaultValue returns d if the given value is missing or empty
+func defaultValue(d interface{}, given ...interface{}) interface{} {
+	if len(given) == 0 || empty(given[0]) {
+		return d
+	}
+	return given[0]
+}
+
+// required fails the template with msg if v is missing or an empty string
+func required(msg string, v interface{}) (interface{}, error) {
+	if v == nil {
+		return nil, errors.New(msg)
+	}
+	if s, ok := v.(string); ok && s == "" {
+		return nil, errors.New(msg)
+	}
+	return v, nil
+}
+
+func coalesce(v ...interface{}) interface{} {
+	for _, val := range v {
+		if !empty(val) {
+			return val
+		}
+	}
+	return nil
+}
+
+func ternary(vt, vf interface{}, cond bool) interface{} {
+	if cond {
+		return vt
+	}
+	return vf
+}
+
+func toString(v interface{}) string {
+	switch s := v.(type) {
+	case string:
+		return s
+	case []byte:
+		return string(s)
+	case error:
+		return s.Error()
+	case fmt.Stringer:
+		return s.String()
+	case nil:
+		return ""
+	}
+	return fmt.Sprint(v)
+}
+
+func quote(v ...interface{}) string {
+	out := make([]string, 0, len(v))
+	for _, s := range v {
+		if s != nil {
+			out = append(out, fmt.Sprintf("%q", toString(s)))
+		}
+	}
+	return strings.Join(out, " ")
+}
+
+func squote(v ...interface{}) string {
+	out := make([]string, 0, len(v))
+	for _, s := range v {
+		if s != nil {
+			out = append(out, "'"+toString(s)+"'")
+		}
+	}
+	return strings.Join(out, " ")
+}
+
+func trunc(c int, s string) string {
+	if c >= 0 && len(s) > c {
+		return s[:c]
+	}
+	if c < 0 && len(s)+c > 0 {
+		return s[len(s)+c:]
+	}
+	return s
+}
+
+func join(sep string, v interface{}) (string, error) {
+	l, err := toList(v)
+	if err != nil {
+		return "", err
+	}
+	out := make([]string, 0, len(l))
+	for _, s := range l {
+		out = append(out, toString(s))
+	}
+	return strings.Join(out, sep), nil
+}
+
+// indent prefixes every line of s with the number of spaces
+func indent(spaces int, s string) string {
+	pad := strings.Repeat(" ", spaces)
+	return pad + strings.Replace(s, "\n", "\n"+pad, -1)
+}
+
+func toYaml(v interface{}) (string, error) {
+	data, err := yaml.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(string(data), "\n"), nil
+}
+
+func toJSON(v interface{}) (string, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+func fromJSON(s string) (interface{}, error) {
+	var v interface{}
+	err := json.Unmarshal([]byte(s), &v)
+	return v, err
+}
+
+func sha256sum(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+func b64dec(s string) (string, error) {
+	data, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+// toList converts any slice or array, like the []interface{} of a custom
+// resource field, to a []interface{}
+func toList(v interface{}) ([]interface{}, error) {
+	if v == nil {
+		return nil, nil
+	}
+	if l, ok := v.([]interface{}); ok {
+		return l, nil
+	}
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Slice && rv.Kind() != reflect.Array {
+		return nil, fmt.Errorf("expected a list, got %T", v)
+	}
+	l := make([]interface{}, rv.Len())
+	for i := range l {
+		l[i] = rv.Index(i).Interface()
+	}
+	return l, nil
+}
+
+func first(v interface{}) (interface{}, error) {
+	l, err := toList(v)
+	if err != nil || len(l) == 0 {
+		return nil, err
+	}
+	return l[0], nil
+}
+
+func last(v interface{}) (interface{}, error) {
+	l, err := toList(v)
+	if err != nil || len(l) == 0 {
+		return nil, err
+	}
+	return l[len(l)-1], nil
+}
+
+func rest(v interface{}) ([]interface{}, error) {
+	l, err := toList(v)
+	if err != nil || len(l) == 0 {
+		return nil, err
+	}
+	return l[1:], nil
+}
+
+func appendList(v interface{}, item interface{}) ([]interface{}, error) {
+	l, err := toList(v)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]interface{}, 0, len(l)+1)
+	return append(append(out, l...), item), nil
+}
+
+func prependList(v interface{}, item interface{}) ([]interface{}, error) {
+	l, err := toList(v)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]interface{}, 0, len(l)+1)
+	return append(append(out, item), l...), nil
+}
+
+func has(needle interface{}, haystack interface{}) (bool, error) {
+	l, err := toList(haystack)
+	if err != nil {
+		return false, err
+	}
+	for _, v := range l {
+		if reflect.DeepEqual(v, needle) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func uniq(v interface{}) ([]interface{}, error) {
+	l, err := toList(v)
+	if err != nil {
+		return nil, err
+	}
+	out := []interface{}{}
+	for _, item := range l {
+		if found, _ := has(item, out); !found {
+			out = append(out, item)
+		}
+	}
+	return out, nil
+}
+
+// dict builds a map from alternating keys and values
+func dict(v ...interface{}) (map[string]interface{}, error) {
+	if len(v)%2 != 0 {
+		return nil, errors.New("dict expects an even number of arguments")
+	}
+	d := make(map[string]interface{}, len(v)/2)
+	for i := 0; i < len(v); i += 2 {
+		d[toString(v[i])] = v[i+1]
+	}
+	return d, nil
+}
+
+// keys returns the sorted keys of all the dicts
+func keys(dicts ...map[string]interface{}) []string {
+	var out []string
+	for _, d := range dicts {
+		for k := range d {
+			out = append(out, k)
+		}
+	}
+	sort.Strings(out)
+	return out
+}
+
+// values returns the values of the dict, ordered by key
+func values(d map[string]interface{}) []interface{} {
+	out := make([]interface{}, 0, len(d))
+	for _, k := range keys(d) {
+		out = append(out, d[k])
+	}
+	return out
+}
+
+// merge copies the keys of the sources that are missing from dst into dst,
+// nested dicts are merged the same way
+func merge(dst map[string]interface{}, srcs ...map[string]interface{}) map[string]interface{} {
+	for _, src := range srcs {
+		for k, v := range src {
+			existing, ok := dst[k]
+			if !ok {
+				dst[k] = v
+				continue
+			}
+			dm, dok := existing.(map[string]interface{})
+			sm, sok := v.(map[string]interface{})
+			if dok && sok {
+				dst[k] = merge(dm, sm)
+			}
+		}
+	}
+	return dst
+}
@@ -0,0 +1,121 @@
+// Copyright 2017 the lostromos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tmpl_test
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"text/template"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/lostromos/lostromos/tmpl"
+)
+
+func execute(text string, data interface{}) (string, error) {
+	t, err := template.New("test").Funcs(tmpl.FuncMap()).Parse(text)
+	if err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	err = t.Execute(&buf, data)
+	return buf.String(), err
+}
+
+func TestFuncMap(t *testing.T) {
+	data := map[string]interface{}{
+		"name":     "dory",
+		"empty":    "",
+		"replicas": int64(3),
+		"ports":    []interface{}{int64(80), int64(443), int64(80)},
+		"labels":   map[string]interface{}{"app": "nemo", "tier": "fish"},
+	}
+	var testCases = []struct {
+		name     string
+		template string
+		expected string
+	}{
+		{"default with value", `{{ .name | default "nemo" }}`, "dory"},
+		{"default when empty", `{{ .empty | default "nemo" }}`, "nemo"},
+		{"default when missing", `{{ .missing | default "nemo" }}`, "nemo"},
+		{"empty", `{{ empty .empty }} {{ empty .name }}`, "true false"},
+		{"coalesce", `{{ coalesce .missing .empty .name }}`, "dory"},
+		{"ternary", `{{ ternary "yes" "no" true }} {{ ternary "yes" "no" false }}`, "yes no"},
+		{"quote", `{{ .name | quote }} {{ .replicas | quote }}`, `"dory" "3"`},
+		{"squote", `{{ .name | squote }}`, `'dory'`},
+		{"upper and lower", `{{ .name | upper }} {{ "NEMO" | lower }}`, "DORY nemo"},
+		{"title", `{{ "finding nemo" | title }}`, "Finding Nemo"},
+		{"trim", `{{ "  dory " | trim }}{{ "--dory--" | trimAll "-" }}`, "dorydory"},
+		{"trimPrefix and trimSuffix", `{{ "dory-fish" | trimPrefix "dory-" }} {{ "dory-fish" | trimSuffix "-fish" }}`, "fish dory"},
+		{"contains", `{{ contains "or" .name }} {{ hasPrefix "do" .name }} {{ hasSuffix "do" .name }}`, "true true false"},
+		{"replace", `{{ "a.b.c" | replace "." "-" }}`, "a-b-c"},
+		{"repeat", `{{ "na" | repeat 3 }}`, "nanana"},
+		{"trunc", `{{ .name | trunc 2 }} {{ .name | trunc -2 }} {{ .name | trunc 10 }}`, "do ry dory"},
+		{"splitList and join", `{{ "a,b,c" | splitList "," | join "-" }} {{ .ports | join "," }}`, "a-b-c 80,443,80"},
+		{"indent", `{{ "a: 1\nb: 2" | indent 2 }}`, "  a: 1\n  b: 2"},
+		{"nindent", `x:{{ "a: 1" | nindent 2 }}`, "x:\n  a: 1"},
+		{"toYaml", `{{ .labels | toYaml }}`, "app: nemo\ntier: fish"},
+		{"toJson", `{{ .labels | toJson }}`, `{"app":"nemo","tier":"fish"}`},
+		{"fromJson", `{{ (fromJson "{\"a\": \"b\"}").a }}`, "b"},
+		{"b64enc and b64dec", `{{ .name | b64enc }} {{ "ZG9yeQ==" | b64dec }}`, "ZG9yeQ== dory"},
+		{"sha256sum", `{{ .name | sha256sum }}`, "5cb8ad155351b80ef8385b3beabce3be352abb773ba9f4e44854c814188a0936"},
+		{"list functions", `{{ first .ports }} {{ last .ports }} {{ rest .ports }} {{ uniq .ports }}`, "80 80 [443 80] [80 443]"},
+		{"append and prepend", `{{ append .ports 8080 }} {{ prepend (list "a") "b" }}`, "[80 443 80 8080] [b a]"},
+		{"has", `{{ has "b" (list "a" "b") }} {{ has "c" (list "a" "b") }}`, "true false"},
+		{"dict", `{{ $d := dict "a" 1 "b" 2 }}{{ get $d "a" }} {{ hasKey $d "b" }} {{ keys $d }} {{ values $d }}`, "1 true [a b] [1 2]"},
+		{"set and unset", `{{ $d := dict "a" 1 }}{{ $_ := set $d "b" 2 }}{{ $_ := unset $d "a" }}{{ keys $d }}`, "[b]"},
+		{"merge", `{{ $d := merge (dict "app" "dory") .labels }}{{ $d.app }} {{ $d.tier }}`, "dory fish"},
+		{"toString", `{{ .replicas | toString | quote }}`, `"3"`},
+	}
+	for _, tt := range testCases {
+		out, err := execute(tt.template, data)
+		assert.Nil(t, err, tt.name)
+		assert.Equal(t, tt.expected, out, tt.name)
+	}
+}
+
+func TestFuncMapErrors(t *testing.T) {
+	var testCases = []struct {
+		name     string
+		template string
+	}{
+		{"required when missing", `{{ required "name is required" .missing }}`},
+		{"required when empty", `{{ required "name is required" "" }}`},
+		{"dict with odd arguments", `{{ dict "a" }}`},
+		{"join of a string", `{{ join "," "abc" }}`},
+		{"b64dec of invalid input", `{{ b64dec "%%%" }}`},
+	}
+	for _, tt := range testCases {
+		_, err := execute(tt.template, map[string]interface{}{})
+		assert.NotNil(t, err, tt.name)
+	}
+
+	_, err := execute(`{{ required "name is required" .missing }}`, map[string]interface{}{})
+	assert.Contains(t, err.Error(), "name is required")
+}
+
+func TestParseProvidesFuncMap(t *testing.T) {
+	dir := createTestDir([]templateFile{
+		{"configmap.tmpl", `name: {{ .GetField "metadata" "name" | upper | quote }}`},
+	})
+	defer os.RemoveAll(dir)
+
+	buf := bytes.NewBufferString("")
+	err := tmpl.Parse(testCR, filepath.Join(dir, "*.tmpl"), buf)
+	assert.Nil(t, err)
+	assert.Equal(t, `name: "DORY"`, buf.String())
+}
@@ -0,0 +1,86 @@
+// Copyright 2017 the lostromos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tmpl
+
+import (
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+// Lookup reads objects from the cluster for the lookup template function. An
+// empty name lists all objects of the kind, an empty namespace looks in all
+// namespaces. Objects that don't exist are returned as an empty map, not as an
+// error.
+type Lookup interface {
+	Lookup(apiVersion, kind, namespace, name string) (map[string]interface{}, error)
+}
+
+// lookupFunc returns the lookup template function backed by l. Without a
+// Lookup every object is missing, like with `helm template`.
+func lookupFunc(l Lookup) func(apiVersion, kind, namespace, name string) (map[string]interface{}, error) {
+	return func(apiVersion, kind, namespace, name string) (map[string]interface{}, error) {
+		if l == nil {
+			return map[string]interface{}{}, nil
+		}
+		obj, err := l.Lookup(apiVersion, kind, namespace, name)
+		if err != nil || obj == nil {
+			return map[string]interface{}{}, err
+		}
+		// the object may come from a cache, templates must not modify it
+		return (&unstructured.Unstructured{Object: obj}).DeepCopy().Object, nil
+	}
+}
+
+// FakeLookup is a Lookup that serves a fixed set of objects, for the check
+// command and tests.
+type FakeLookup struct {
+	Objects []*unstructured.Unstructured
+}
+
+// Lookup returns the matching object, or a list of the matching objects if
+// name is empty
+func (f *FakeLookup) Lookup(apiVersion, kind, namespace, name string) (map[string]interface{}, error) {
+	var items []interface{}
+	for _, obj := range f.Objects {
+		if obj.GetAPIVersion() != apiVersion || obj.GetKind() != kind {
+			continue
+		}
+		if namespace != "" && obj.GetNamespace() != namespace {
+			continue
+		}
+		if name == "" {
+			items = append(items, obj.Object)
+			continue
+		}
+		if obj.GetName() == name {
+			return obj.Object, nil
+		}
+	}
+	if name != "" {
+		return map[string]interface{}{}, nil
+	}
+	return listObject(items), nil
+}
+
+// listObject wraps objects the way the API server returns a list
+func listObject(items []interface{}) map[string]interface{} {
+	if items == nil {
+		items = []interface{}{}
+	}
+	return map[string]interface{}{
+		"apiVersion": "v1",
+		"kind":       "List",
+		"items":      items,
+	}
+}
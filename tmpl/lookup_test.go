@@ -0,0 +1,127 @@
+// Copyright 2017 the lostromos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tmpl_test
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+
+	"github.com/lostromos/lostromos/tmpl"
+)
+
+var lookupObjects = []*unstructured.Unstructured{
+	{Object: map[string]interface{}{
+		"apiVersion": "v1",
+		"kind":       "Service",
+		"metadata":   map[string]interface{}{"name": "reef", "namespace": "ocean"},
+		"spec":       map[string]interface{}{"clusterIP": "10.0.0.1"},
+	}},
+	{Object: map[string]interface{}{
+		"apiVersion": "v1",
+		"kind":       "Service",
+		"metadata":   map[string]interface{}{"name": "tank", "namespace": "dentist"},
+	}},
+	{Object: map[string]interface{}{
+		"apiVersion": "v1",
+		"kind":       "ConfigMap",
+		"metadata":   map[string]interface{}{"name": "reef", "namespace": "ocean"},
+	}},
+}
+
+type failingLookup struct{}
+
+func (failingLookup) Lookup(apiVersion, kind, namespace, name string) (map[string]interface{}, error) {
+	return nil, errors.New("forbidden")
+}
+
+func TestFakeLookup(t *testing.T) {
+	l := &tmpl.FakeLookup{Objects: lookupObjects}
+
+	obj, err := l.Lookup("v1", "Service", "ocean", "reef")
+	assert.Nil(t, err)
+	assert.Equal(t, lookupObjects[0].Object, obj)
+
+	obj, err = l.Lookup("v1", "Service", "dentist", "reef")
+	assert.Nil(t, err)
+	assert.Empty(t, obj)
+
+	obj, err = l.Lookup("v1", "Service", "", "")
+	assert.Nil(t, err)
+	assert.Len(t, obj["items"], 2)
+
+	obj, err = l.Lookup("v1", "Service", "ocean", "")
+	assert.Nil(t, err)
+	assert.Len(t, obj["items"], 1)
+
+	obj, err = l.Lookup("apps/v1", "Deployment", "", "")
+	assert.Nil(t, err)
+	assert.Equal(t, []interface{}{}, obj["items"])
+}
+
+func TestParseWithLookup(t *testing.T) {
+	dir := createTestDir([]templateFile{
+		{"service.tmpl", `ip: {{ (lookup "v1" "Service" "ocean" "reef").spec.clusterIP }}
+services: {{ len (lookup "v1" "Service" "" "").items }}
+missing: {{ (lookup "v1" "Service" "ocean" "deep").spec | default "none" }}`},
+	})
+	defer os.RemoveAll(dir)
+
+	buf := bytes.NewBufferString("")
+	err := tmpl.ParseWithLookup(testCR, filepath.Join(dir, "*.tmpl"), buf, &tmpl.FakeLookup{Objects: lookupObjects})
+	assert.Nil(t, err)
+	assert.Equal(t, "ip: 10.0.0.1\nservices: 2\nmissing: none", buf.String())
+}
+
+func TestParseWithoutLookupFindsNothing(t *testing.T) {
+	dir := createTestDir([]templateFile{
+		{"service.tmpl", `missing: {{ len (lookup "v1" "Service" "ocean" "reef") }}`},
+	})
+	defer os.RemoveAll(dir)
+
+	buf := bytes.NewBufferString("")
+	err := tmpl.Parse(testCR, filepath.Join(dir, "*.tmpl"), buf)
+	assert.Nil(t, err)
+	assert.Equal(t, "missing: 0", buf.String())
+}
+
+func TestParseWithLookupReturnsErrors(t *testing.T) {
+	dir := createTestDir([]templateFile{
+		{"service.tmpl", `{{ lookup "v1" "Service" "ocean" "reef" }}`},
+	})
+	defer os.RemoveAll(dir)
+
+	buf := bytes.NewBufferString("")
+	err := tmpl.ParseWithLookup(testCR, filepath.Join(dir, "*.tmpl"), buf, failingLookup{})
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "forbidden")
+}
+
+func TestParseWithLookupLeavesObjectsUnchanged(t *testing.T) {
+	dir := createTestDir([]templateFile{
+		{"service.tmpl", `{{ $_ := set (lookup "v1" "Service" "ocean" "reef") "kind" "Fish" }}`},
+	})
+	defer os.RemoveAll(dir)
+
+	obj := lookupObjects[0].DeepCopy()
+	err := tmpl.ParseWithLookup(testCR, filepath.Join(dir, "*.tmpl"), bytes.NewBufferString(""), &tmpl.FakeLookup{Objects: lookupObjects})
+	assert.Nil(t, err)
+	assert.Equal(t, obj, lookupObjects[0])
+}
@@ -15,17 +15,70 @@
 package tmpl
 
 import (
+	"fmt"
 	"io"
+	"path/filepath"
 	"text/template"
 )
 
+// Template is a parsed set of template files. It can be executed for any
+// number of custom resources, also concurrently.
+type Template struct {
+	tmpl *template.Template
+}
+
+// ParseFiles parses the template files matching the pattern. Like
+// template.ParseGlob, the first file is the template that is executed.
+func ParseFiles(pattern string) (*Template, error) {
+	files, err := filepath.Glob(pattern)
+	if err != nil {
+		return nil, err
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("template: pattern matches no files: %#q", pattern)
+	}
+	tmpl, err := template.New(filepath.Base(files[0])).Funcs(FuncMap()).ParseFiles(files...)
+	if err != nil {
+		return nil, err
+	}
+	return &Template{tmpl: tmpl}, nil
+}
+
+// Execute prints the templates for the CustomResource to the io.Writer. The
+// lookup template function reads objects from l, without it it finds none.
+// The templates work on a copy, so functions like set leave cr unchanged.
+func (t *Template) Execute(cr *CustomResource, w io.Writer, l Lookup) error {
+	return t.execute(cr.copy(), w, l)
+}
+
+// ExecuteStrict is like Execute, but fails on missing map keys and on fields
+// of the CustomResource that are missing or have the wrong type, instead of
+// printing empty values.
+func (t *Template) ExecuteStrict(cr *CustomResource, w io.Writer, l Lookup) error {
+	return t.execute(strictResource{cr.copy()}, w, l, "missingkey=error")
+}
+
+func (t *Template) execute(data interface{}, w io.Writer, l Lookup, opts ...string) error {
+	tmpl, err := t.tmpl.Clone()
+	if err != nil {
+		return err
+	}
+	return tmpl.Option(opts...).Funcs(template.FuncMap{"lookup": lookupFunc(l)}).Execute(w, data)
+}
+
 // Parse will take a CustomResource, template directory and an io.Writer and
-// print the resulting templates to the io.Writer
+// print the resulting templates to the io.Writer. The functions of FuncMap are
+// available to the templates, lookup finds no objects.
 func Parse(cr *CustomResource, dir string, w io.Writer) error {
-	tmpl, err := template.ParseGlob(dir)
+	return ParseWithLookup(cr, dir, w, nil)
+}
+
+// ParseWithLookup is like Parse, but the lookup template function reads objects
+// from l.
+func ParseWithLookup(cr *CustomResource, dir string, w io.Writer, l Lookup) error {
+	tmpl, err := ParseFiles(dir)
 	if err != nil {
 		return err
 	}
-
-	return tmpl.Execute(w, cr)
+	return tmpl.Execute(cr, w, l)
 }
@@ -102,3 +102,92 @@ func TestGenerateTemplateNoTemplatePath(t *testing.T) {
 	assert.NotNil(t, err)
 	assert.Empty(t, buf.String(), "If an error occurs nothing should be written")
 }
+
+func TestParseFilesExecutesForEveryResource(t *testing.T) {
+	dir := createTestDir(testTemplates)
+	defer os.RemoveAll(dir)
+
+	parsed, err := tmpl.ParseFiles(filepath.Join(dir, "*.tmpl"))
+	assert.Nil(t, err)
+
+	nemo := &tmpl.CustomResource{Resource: testResource.DeepCopy()}
+	nemo.Resource.SetName("nemo")
+	for _, cr := range []*tmpl.CustomResource{testCR, nemo} {
+		buf := bytes.NewBufferString("")
+		assert.Nil(t, parsed.Execute(cr, buf, nil))
+		assert.Equal(t, "--- name: "+cr.Name()+"-configmap", buf.String())
+	}
+}
+
+func TestParseFilesFailsOnInvalidTemplates(t *testing.T) {
+	dir := createTestDir([]templateFile{{"bad.tmpl", `{{ .GetField "metadata"`}})
+	defer os.RemoveAll(dir)
+
+	_, err := tmpl.ParseFiles(filepath.Join(dir, "*.tmpl"))
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "bad.tmpl:1")
+}
+
+func TestExecuteStrict(t *testing.T) {
+	var testCases = []struct {
+		name     string
+		text     string
+		expected string
+		err      string
+	}{
+		{"Test existing field", `{{ .GetField "spec" "Name" }}`, "Dory", ""},
+		{"Test missing field", `{{ .GetField "spec" "nmae" }}`, "", "missing field spec.nmae"},
+		{"Test wrong type", `{{ .GetInt "spec" "Name" }}`, "", "field spec.Name is not a number"},
+		{"Test missing value", `{{ .GetValue "status" }}`, "", "missing field status"},
+		{"Test missing map key", `{{ .Labels.app }}`, "", `map has no entry for key "app"`},
+		{"Test default still allowed", `{{ .GetValueOr "small" "spec" "size" }}`, "small", ""},
+		{"Test required", `{{ required "spec.By is required" (.GetValueOr nil "spec" "By") }}`, "Disney", ""},
+		{"Test other methods", `{{ .Name }} {{ .Resource.GetName }}`, "dory dory", ""},
+	}
+	for _, tt := range testCases {
+		dir := createTestDir([]templateFile{{"strict.tmpl", tt.text}})
+		parsed, err := tmpl.ParseFiles(filepath.Join(dir, "*.tmpl"))
+		assert.Nil(t, err, tt.name)
+
+		buf := bytes.NewBufferString("")
+		err = parsed.ExecuteStrict(testCR, buf, nil)
+		if tt.err == "" {
+			assert.Nil(t, err, tt.name)
+			assert.Equal(t, tt.expected, buf.String(), tt.name)
+		} else {
+			assert.NotNil(t, err, tt.name)
+			assert.Contains(t, err.Error(), tt.err, tt.name)
+			assert.Contains(t, err.Error(), "strict.tmpl:1", tt.name)
+		}
+		os.RemoveAll(dir)
+	}
+}
+
+func TestExecuteIgnoresMissingFields(t *testing.T) {
+	dir := createTestDir([]templateFile{{"loose.tmpl", `[{{ .GetField "spec" "nmae" }}]`}})
+	defer os.RemoveAll(dir)
+
+	parsed, err := tmpl.ParseFiles(filepath.Join(dir, "*.tmpl"))
+	assert.Nil(t, err)
+	buf := bytes.NewBufferString("")
+	assert.Nil(t, parsed.Execute(testCR, buf, nil))
+	assert.Equal(t, "[]", buf.String())
+}
+
+func TestExecuteLeavesResourceUnchanged(t *testing.T) {
+	dir := createTestDir([]templateFile{{"mutate.tmpl", `{{ $_ := set .Resource.Object "kind" "Fish" }}
+{{- $_ := unset (index .Resource.Object "spec") "Name" }}
+{{- $_ := merge (index .Resource.Object "metadata") (dict "labels" (dict "app" "nemo")) }}
+{{- .Resource.GetKind }} {{ hasKey (index .Resource.Object "spec") "Name" }} {{ .Resource.GetLabels }}`}})
+	defer os.RemoveAll(dir)
+
+	parsed, err := tmpl.ParseFiles(filepath.Join(dir, "*.tmpl"))
+	assert.Nil(t, err)
+	resource := testResource.DeepCopy()
+	for _, execute := range []func(*tmpl.CustomResource, io.Writer, tmpl.Lookup) error{parsed.Execute, parsed.ExecuteStrict} {
+		buf := bytes.NewBufferString("")
+		assert.Nil(t, execute(testCR, buf, nil))
+		assert.Equal(t, "Fish false map[app:nemo]", buf.String())
+		assert.Equal(t, resource, testCR.Resource)
+	}
+}
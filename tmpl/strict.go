@@ -0,0 +1,109 @@
+// Copyright 2017 the lostromos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tmpl
+
+import (
+	"fmt"
+	"strings"
+)
+
+// strictResource is the CustomResource seen by templates executed with
+// ExecuteStrict. Its field accessors return an error for a missing field or a
+// field of the wrong type, which fails the template.
+type strictResource struct {
+	*CustomResource
+}
+
+// GetField returns the string value of the requested field
+func (cr strictResource) GetField(fields ...string) (string, error) {
+	val, err := cr.field(fields)
+	if err != nil {
+		return "", err
+	}
+	str, ok := val.(string)
+	if !ok {
+		return "", fmt.Errorf("field %s is not a string", fieldPath(fields))
+	}
+	return str, nil
+}
+
+// GetValue returns the raw value of the requested field
+func (cr strictResource) GetValue(fields ...string) (interface{}, error) {
+	return cr.field(fields)
+}
+
+// GetInt returns the integer value of the requested field
+func (cr strictResource) GetInt(fields ...string) (int64, error) {
+	val, err := cr.field(fields)
+	if err != nil {
+		return 0, err
+	}
+	i, ok := toInt64(val)
+	if !ok {
+		return 0, fmt.Errorf("field %s is not a number", fieldPath(fields))
+	}
+	return i, nil
+}
+
+// GetBool returns the boolean value of the requested field
+func (cr strictResource) GetBool(fields ...string) (bool, error) {
+	val, err := cr.field(fields)
+	if err != nil {
+		return false, err
+	}
+	b, ok := val.(bool)
+	if !ok {
+		return false, fmt.Errorf("field %s is not a boolean", fieldPath(fields))
+	}
+	return b, nil
+}
+
+// GetSlice returns the list value of the requested field
+func (cr strictResource) GetSlice(fields ...string) ([]interface{}, error) {
+	val, err := cr.field(fields)
+	if err != nil {
+		return nil, err
+	}
+	l, ok := val.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("field %s is not a list", fieldPath(fields))
+	}
+	return l, nil
+}
+
+// GetMap returns the map value of the requested field
+func (cr strictResource) GetMap(fields ...string) (map[string]interface{}, error) {
+	val, err := cr.field(fields)
+	if err != nil {
+		return nil, err
+	}
+	m, ok := val.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("field %s is not a map", fieldPath(fields))
+	}
+	return m, nil
+}
+
+func (cr strictResource) field(fields []string) (interface{}, error) {
+	val := getNestedField(cr.Resource.Object, fields...)
+	if val == nil {
+		return nil, fmt.Errorf("missing field %s", fieldPath(fields))
+	}
+	return val, nil
+}
+
+func fieldPath(fields []string) string {
+	return strings.Join(fields, ".")
+}
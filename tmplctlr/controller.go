@@ -15,111 +15,309 @@
 package tmplctlr
 
 import (
+	"bytes"
+	"errors"
+	"fmt"
 	"io/ioutil"
-	"os"
-	"path/filepath"
 	"time"
 
 	"go.uber.org/zap"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 
+	"github.com/lostromos/lostromos/crhash"
+	"github.com/lostromos/lostromos/crstatus"
 	"github.com/lostromos/lostromos/metrics"
+	"github.com/lostromos/lostromos/reload"
+	"github.com/lostromos/lostromos/schema"
 	"github.com/lostromos/lostromos/tmpl"
 )
 
 // Controller implements a valid crwatcher.ResourceController that will manage
 // resources in kubernetes based on the provided template files.
 type Controller struct {
-	templatePath string     //path to dir where templates are located
-	Client       KubeClient //client for talking with kubernetes
-	logger       *zap.SugaredLogger
+	templateDir        string          //path to dir where templates are located
+	TemplateSet        string          //subdirectory of templateDir used when a custom resource doesn't pick one, empty uses templateDir itself
+	Strict             bool            //execute all template sets in strict mode
+	StrictTemplateSets []string        //template sets executed in strict mode
+	Client             KubeClient      //client for talking with kubernetes
+	Inventory          Inventory       //records the rendered objects for pruning, nil disables pruning
+	OwnerReferences    bool            //make the custom resource the owner of the rendered objects
+	Drift              *DriftWatcher   //requeues custom resources whose objects changed, nil disables drift detection
+	Lookup             tmpl.Lookup     //reads cluster objects for the lookup template function, nil finds none
+	Reload             *reload.Watcher //reloads the templates when they change, nil disables reloading
+	logger             *zap.SugaredLogger
+	templates          *templateCache
+	status             crstatus.Writer
+	applied            *crhash.Store
 }
 
-// NewController will return a configured Controller
-func NewController(tmplDir string, kubeCfg string, logger *zap.SugaredLogger) *Controller {
+var errUnchanged = errors.New("rendered templates are unchanged")
+
+// NewController will return a configured Controller. The templates in tmplDir
+// and its template sets are parsed once here, an error names the file and line
+// of the first template that fails to parse.
+func NewController(tmplDir string, kubeCfg string, logger *zap.SugaredLogger) (*Controller, error) {
 	if logger == nil {
 		// If you don't give us a logger, set logger to a nop logger
 		logger = zap.NewNop().Sugar()
 	}
 	c := &Controller{
-		Client:       &Kubectl{ConfigFile: kubeCfg},
-		templatePath: filepath.Join(tmplDir, "*.tmpl"),
-		logger:       logger,
+		Client:      &Kubectl{ConfigFile: kubeCfg},
+		templateDir: tmplDir,
+		logger:      logger,
+		status:      crstatus.NopWriter{},
+		applied:     crhash.NewStore(),
+		templates:   newTemplateCache(),
+	}
+	if err := c.templates.load(tmplDir); err != nil {
+		return nil, err
 	}
-	return c
+	return c, nil
+}
+
+// WatchDependents starts the drift detection, see crwatcher.DependentWatcher
+func (c *Controller) WatchDependents(requeue func(key string), stopCh <-chan struct{}) {
+	if c.Drift != nil {
+		c.Drift.Start(func(key string) {
+			// The objects don't match the last apply anymore
+			c.applied.Forget(key)
+			requeue(key)
+		}, stopCh)
+	}
+}
+
+// WatchReloads reloads the templates when they change, see crwatcher.Reloader
+func (c *Controller) WatchReloads(resync func(), stopCh <-chan struct{}) {
+	if c.Reload != nil {
+		go c.Reload.Run(c.ReloadTemplates, resync, stopCh)
+	}
+}
+
+// ReloadTemplates parses the templates again. If any template set fails to
+// parse the previous templates are kept.
+func (c *Controller) ReloadTemplates() error {
+	return c.templates.load(c.templateDir)
+}
+
+// SetStatusWriter sets where the result of each reconcile is reported
+func (c *Controller) SetStatusWriter(w crstatus.Writer) {
+	c.status = w
 }
 
 // ResourceAdded is called when a custom resource is created and will generate
 // the template files and apply them to Kubernetes
-func (c Controller) ResourceAdded(r *unstructured.Unstructured) {
+func (c Controller) ResourceAdded(r *unstructured.Unstructured) error {
 	metrics.TotalEvents.Inc()
 	c.logger.Infow("resource added", "resource", r.GetName())
-	out, err := c.apply(r)
+	out, err := c.apply(r, false)
+	c.writeStatus(r, err)
 	if err != nil {
 		c.logger.Errorw("failed to add resource", "resource", r.GetName(), "error", err, "cmdOutput", out)
 		metrics.CreateFailures.Inc()
-		return
+		return err
 	}
 	metrics.CreatedReleases.Inc()
 	metrics.ManagedReleases.Inc()
 	metrics.LastSuccessfulCreate.Set(float64(time.Now().UTC().UnixNano()) / 1000000000)
+	return nil
 }
 
 // ResourceUpdated is called when a custom resource is updated or during a
 // resync and will generate the template files and apply them to Kubernetes
-func (c Controller) ResourceUpdated(oldR, newR *unstructured.Unstructured) {
+func (c Controller) ResourceUpdated(oldR, newR *unstructured.Unstructured) error {
 	metrics.TotalEvents.Inc()
 	c.logger.Infow("resource updated", "resource", newR.GetName())
-	out, err := c.apply(newR)
+	out, err := c.apply(newR, !crhash.IsResync(oldR, newR))
+	if err == errUnchanged {
+		c.logger.Debugw("rendered templates unchanged, skipping apply", "resource", newR.GetName())
+		metrics.SkippedEvents.Inc()
+		if oldR.GetGeneration() != newR.GetGeneration() {
+			// The spec changed without changing the output, it is applied all the same
+			c.writeStatus(newR, nil)
+		}
+		return nil
+	}
+	c.writeStatus(newR, err)
 	if err != nil {
 		c.logger.Errorw("failed to update resource", "resource", newR.GetName(), "error", err, "cmdOutput", out)
 		metrics.UpdateFailures.Inc()
-		return
+		return err
 	}
 	metrics.UpdatedReleases.Inc()
 	metrics.LastSuccessfulUpdate.Set(float64(time.Now().UTC().UnixNano()) / 1000000000)
+	return nil
 }
 
 // ResourceDeleted is called when a custom resource is created and will generate
 // the template files and delete them from Kubernetes
-func (c Controller) ResourceDeleted(r *unstructured.Unstructured) {
+func (c Controller) ResourceDeleted(r *unstructured.Unstructured) error {
 	metrics.TotalEvents.Inc()
 	c.logger.Infow("resource deleted", "resource", r.GetName())
 	out, err := c.delete(r)
 	if err != nil {
 		c.logger.Errorw("failed to delete resource", "resource", r.GetName(), "error", err, "cmdOutput", out)
 		metrics.DeleteFailures.Inc()
-		return
+		return err
 	}
 	metrics.DeletedReleases.Inc()
 	metrics.ManagedReleases.Dec()
 	metrics.LastSuccessfulDelete.Set(float64(time.Now().UTC().UnixNano()) / 1000000000)
+	return nil
 }
 
-func (c Controller) apply(r *unstructured.Unstructured) (output string, err error) {
-	tmpFile, err := c.buildTemplate(r)
+func (c Controller) writeStatus(r *unstructured.Unstructured, err error) {
+	if werr := c.status.WriteStatus(r, crstatus.New(r, err)); werr != nil {
+		c.logger.Warnw("failed to write status", "resource", r.GetName(), "error", werr)
+	}
+}
+
+// apply renders the templates and applies them. With skipUnchanged nothing is
+// applied and errUnchanged is returned if the rendered templates are the same
+// as on the last successful apply.
+func (c Controller) apply(r *unstructured.Unstructured, skipUnchanged bool) (output string, err error) {
+	manifest, err := c.render(r, true)
 	if err != nil {
 		return "", err
 	}
-	return c.Client.Apply(tmpFile.Name())
+	key, sum := crhash.Key(r), crhash.Sum(manifest)
+	if skipUnchanged && c.applied.Unchanged(key, sum) {
+		return "", errUnchanged
+	}
+	// Whatever happens next, the objects may not match the last apply anymore
+	c.applied.Forget(key)
+	output, err = ApplyManifest(c.Client, manifest)
+	if err != nil {
+		return output, err
+	}
+	if c.Inventory == nil && c.Drift == nil {
+		c.applied.Set(key, sum)
+		return output, nil
+	}
+	refs, err := manifestRefs(manifest)
+	if err != nil {
+		c.logger.Warnw("failed to read rendered objects", "resource", r.GetName(), "error", err)
+		c.applied.Set(key, sum)
+		return output, nil
+	}
+	if c.Drift != nil {
+		c.Drift.Track(r.GroupVersionKind().GroupKind(), refs)
+	}
+	if c.Inventory != nil {
+		if err := c.prune(r, refs); err != nil {
+			// Don't remember the apply, so the prune is retried on the next reconcile
+			return output, fmt.Errorf("failed to prune objects: %s", err)
+		}
+	}
+	c.applied.Set(key, sum)
+	return output, nil
 }
 
 func (c Controller) delete(r *unstructured.Unstructured) (output string, err error) {
-	tmpFile, err := c.buildTemplate(r)
+	c.applied.Forget(crhash.Key(r))
+	// A custom resource that does not match the schema can still be deleted
+	manifest, err := c.render(r, false)
 	if err != nil {
 		return "", err
 	}
-	return c.Client.Delete(tmpFile.Name())
+	output, err = DeleteManifest(c.Client, manifest)
+	if err != nil || c.Inventory == nil {
+		return output, err
+	}
+	refs, err := manifestRefs(manifest)
+	if err != nil {
+		c.logger.Warnw("failed to read rendered objects, skipping prune", "resource", r.GetName(), "error", err)
+		return output, nil
+	}
+	// Objects that were rendered in the past but not anymore still need to go.
+	// Failures are returned, so the finalizer is kept and the delete retried.
+	if err := c.prune(r, refs); err != nil {
+		return output, fmt.Errorf("failed to prune objects: %s", err)
+	}
+	if err := c.Inventory.Delete(r); err != nil {
+		return output, fmt.Errorf("failed to delete inventory: %s", err)
+	}
+	return output, nil
 }
 
-func (c Controller) buildTemplate(r *unstructured.Unstructured) (tmpFile *os.File, err error) {
+// prune deletes the objects recorded for the resource that are not in refs
+// anymore and records refs as the current objects. Objects that fail to be
+// deleted are kept in the inventory so they are pruned on the next reconcile.
+func (c Controller) prune(r *unstructured.Unstructured, refs []ObjectRef) error {
+	old, err := c.Inventory.Get(r)
+	if err != nil {
+		return err
+	}
+	stale := staleRefs(old, refs)
+	if len(stale) > 0 {
+		out, err := deleteRefs(c.Client, stale)
+		if err != nil {
+			if serr := c.Inventory.Set(r, append(refs, stale...)); serr != nil {
+				c.logger.Warnw("failed to update inventory", "resource", r.GetName(), "error", serr)
+			}
+			return fmt.Errorf("%s: %s", err, out)
+		}
+		c.logger.Infow("pruned objects", "resource", r.GetName(), "objects", stale)
+	}
+	return c.Inventory.Set(r, refs)
+}
+
+// render executes the templates for the custom resource. With validate the
+// spec is checked against the schema of the template set first.
+func (c Controller) render(r *unstructured.Unstructured, validate bool) ([]byte, error) {
 	cr := &tmpl.CustomResource{
 		Resource: r,
 	}
-	tmpFile, err = ioutil.TempFile("", "lostromos")
+	set := c.templateSet(r)
+	path, err := c.templatePath(set)
+	if err != nil {
+		return nil, err
+	}
+	parsed, err := c.templates.get(path)
 	if err != nil {
-		return tmpFile, err
+		return nil, err
+	}
+	if validate && parsed.schema != nil {
+		if err := c.validate(r, parsed.schema); err != nil {
+			return nil, err
+		}
+	}
+	execute := parsed.templates.Execute
+	if c.strict(set) {
+		execute = parsed.templates.ExecuteStrict
+	}
+	var buf bytes.Buffer
+	if err := execute(cr, &buf, c.Lookup); err != nil {
+		return nil, err
+	}
+	if !c.OwnerReferences && c.Drift == nil {
+		return buf.Bytes(), nil
+	}
+	return setOwner(buf.Bytes(), r, c.OwnerReferences)
+}
+
+// validate checks the spec of the custom resource against the schema
+func (c Controller) validate(r *unstructured.Unstructured, s *schema.Schema) error {
+	spec, ok := r.Object["spec"]
+	if !ok {
+		spec = map[string]interface{}{}
+	}
+	if err := s.Validate("spec", spec); err != nil {
+		metrics.ValidationFailures.Inc()
+		c.logger.Warnw("spec does not match the schema", "resource", r.GetName(), "error", err)
+		return err
+	}
+	return nil
+}
+
+// writeManifest writes the manifest to a temporary file and returns its name
+func writeManifest(manifest []byte) (string, error) {
+	tmpFile, err := ioutil.TempFile("", "lostromos")
+	if err != nil {
+		return "", err
+	}
+	_, err = tmpFile.Write(manifest)
+	if cerr := tmpFile.Close(); err == nil {
+		err = cerr
 	}
-	err = tmpl.Parse(cr, c.templatePath, tmpFile)
-	return tmpFile, err
+	return tmpFile.Name(), err
 }
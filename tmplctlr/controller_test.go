@@ -28,8 +28,11 @@ import (
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/stretchr/testify/assert"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	restclient "k8s.io/client-go/rest"
 
+	"github.com/lostromos/lostromos/crstatus"
 	"github.com/lostromos/lostromos/metrics"
+	"github.com/lostromos/lostromos/schema"
 	"github.com/lostromos/lostromos/tmplctlr"
 )
 
@@ -49,13 +52,13 @@ var (
 
 	testTemplates = []testFile{
 		// T0.tmpl is a plain template file that just invokes T1.
-		{"0_base.tmpl", `--- {{template "file1.tmpl" . }}`},
+		{"0_base.tmpl", "---\n{{template \"file1.tmpl\" . }}"},
 		// T1.tmpl defines a template, T1 that invokes T2.
-		{"file1.tmpl", `name: {{ .GetField "metadata" "name"  }}-configmap`},
+		{"file1.tmpl", "kind: ConfigMap\nmetadata:\n  name: {{ .GetField \"metadata\" \"name\"  }}-configmap\n"},
 	}
 
 	testBadTemplates = []testFile{
-		{"base", `--- {{template "not there.tmpl" . }}`},
+		{"base.tmpl", `--- {{template "not there.tmpl" . }}`},
 	}
 )
 
@@ -71,6 +74,9 @@ func createTestDir(files []testFile) string {
 		log.Fatal(err)
 	}
 	for _, file := range files {
+		if err := os.MkdirAll(filepath.Dir(filepath.Join(dir, file.name)), 0755); err != nil {
+			log.Fatal(err)
+		}
 		f, err := os.Create(filepath.Join(dir, file.name))
 		if err != nil {
 			log.Fatal(err)
@@ -84,6 +90,14 @@ func createTestDir(files []testFile) string {
 	return dir
 }
 
+func newTestController(t *testing.T, dir string) *tmplctlr.Controller {
+	c, err := tmplctlr.NewController(dir, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
 func getPromCounterValue(metric string) float64 {
 	mf, _ := prometheus.DefaultGatherer.Gather()
 	for _, s := range mf {
@@ -186,7 +200,7 @@ func TestResourceAddedHappyPath(t *testing.T) {
 	dir := createTestDir(testTemplates)
 	// Clean up after the test; another quirk of running as an example.
 	defer os.RemoveAll(dir)
-	c := tmplctlr.NewController(dir, "", nil)
+	c := newTestController(t, dir)
 	mockCtrl := gomock.NewController(t)
 	defer mockCtrl.Finish()
 	mockKube := NewMockKubeClient(mockCtrl)
@@ -202,14 +216,14 @@ func TestResourceAddedHappyPath(t *testing.T) {
 	tsExpected := timestampTestMap()
 	tsExpected["releases_last_create_timestamp_utc_seconds"] = greaterThan
 
-	assertMetrics(t, ct, func() { c.ResourceAdded(testResource) }, tsExpected)
+	assertMetrics(t, ct, func() { assert.Nil(t, c.ResourceAdded(testResource)) }, tsExpected)
 }
 
 func TestResourceAddedApplyFails(t *testing.T) {
 	dir := createTestDir(testTemplates)
 	// Clean up after the test; another quirk of running as an example.
 	defer os.RemoveAll(dir)
-	c := tmplctlr.NewController(dir, "", nil)
+	c := newTestController(t, dir)
 	mockCtrl := gomock.NewController(t)
 	defer mockCtrl.Finish()
 	mockKube := NewMockKubeClient(mockCtrl)
@@ -223,14 +237,14 @@ func TestResourceAddedApplyFails(t *testing.T) {
 	}
 	tsExpected := timestampTestMap()
 
-	assertMetrics(t, ct, func() { c.ResourceAdded(testResource) }, tsExpected)
+	assertMetrics(t, ct, func() { assert.NotNil(t, c.ResourceAdded(testResource)) }, tsExpected)
 }
 
 func TestResourceAddedTemplatingFails(t *testing.T) {
 	dir := createTestDir(testBadTemplates)
 	// Clean up after the test; another quirk of running as an example.
 	defer os.RemoveAll(dir)
-	c := tmplctlr.NewController(dir, "", nil)
+	c := newTestController(t, dir)
 	mockCtrl := gomock.NewController(t)
 	defer mockCtrl.Finish()
 	mockKube := NewMockKubeClient(mockCtrl)
@@ -242,14 +256,14 @@ func TestResourceAddedTemplatingFails(t *testing.T) {
 	}
 	tsExpected := timestampTestMap()
 
-	assertMetrics(t, ct, func() { c.ResourceAdded(testResource) }, tsExpected)
+	assertMetrics(t, ct, func() { assert.NotNil(t, c.ResourceAdded(testResource)) }, tsExpected)
 }
 
 func TestResourceDeletedHappyPath(t *testing.T) {
 	dir := createTestDir(testTemplates)
 	// Clean up after the test; another quirk of running as an example.
 	defer os.RemoveAll(dir)
-	c := tmplctlr.NewController(dir, "", nil)
+	c := newTestController(t, dir)
 	mockCtrl := gomock.NewController(t)
 	defer mockCtrl.Finish()
 	mockKube := NewMockKubeClient(mockCtrl)
@@ -265,14 +279,14 @@ func TestResourceDeletedHappyPath(t *testing.T) {
 	tsExpected := timestampTestMap()
 	tsExpected["releases_last_delete_timestamp_utc_seconds"] = greaterThan
 
-	assertMetrics(t, ct, func() { c.ResourceDeleted(testResource) }, tsExpected)
+	assertMetrics(t, ct, func() { assert.Nil(t, c.ResourceDeleted(testResource)) }, tsExpected)
 }
 
 func TestResourceDeletedApplyFails(t *testing.T) {
 	dir := createTestDir(testTemplates)
 	// Clean up after the test; another quirk of running as an example.
 	defer os.RemoveAll(dir)
-	c := tmplctlr.NewController(dir, "", nil)
+	c := newTestController(t, dir)
 	mockCtrl := gomock.NewController(t)
 	defer mockCtrl.Finish()
 	mockKube := NewMockKubeClient(mockCtrl)
@@ -286,14 +300,14 @@ func TestResourceDeletedApplyFails(t *testing.T) {
 	}
 	tsExpected := timestampTestMap()
 
-	assertMetrics(t, ct, func() { c.ResourceDeleted(testResource) }, tsExpected)
+	assertMetrics(t, ct, func() { assert.NotNil(t, c.ResourceDeleted(testResource)) }, tsExpected)
 }
 
 func TestResourceDeletedTemplatingFails(t *testing.T) {
 	dir := createTestDir(testBadTemplates)
 	// Clean up after the test; another quirk of running as an example.
 	defer os.RemoveAll(dir)
-	c := tmplctlr.NewController(dir, "", nil)
+	c := newTestController(t, dir)
 	mockCtrl := gomock.NewController(t)
 	defer mockCtrl.Finish()
 	mockKube := NewMockKubeClient(mockCtrl)
@@ -305,14 +319,14 @@ func TestResourceDeletedTemplatingFails(t *testing.T) {
 	}
 	tsExpected := timestampTestMap()
 
-	assertMetrics(t, ct, func() { c.ResourceDeleted(testResource) }, tsExpected)
+	assertMetrics(t, ct, func() { assert.NotNil(t, c.ResourceDeleted(testResource)) }, tsExpected)
 }
 
 func TestResourceUpdatedHappyPath(t *testing.T) {
 	dir := createTestDir(testTemplates)
 	// Clean up after the test; another quirk of running as an example.
 	defer os.RemoveAll(dir)
-	c := tmplctlr.NewController(dir, "", nil)
+	c := newTestController(t, dir)
 	mockCtrl := gomock.NewController(t)
 	defer mockCtrl.Finish()
 	mockKube := NewMockKubeClient(mockCtrl)
@@ -327,14 +341,14 @@ func TestResourceUpdatedHappyPath(t *testing.T) {
 	tsExpected := timestampTestMap()
 	tsExpected["releases_last_update_timestamp_utc_seconds"] = greaterThan
 
-	assertMetrics(t, ct, func() { c.ResourceUpdated(testResource, testResource) }, tsExpected)
+	assertMetrics(t, ct, func() { assert.Nil(t, c.ResourceUpdated(testResource, testResource)) }, tsExpected)
 }
 
 func TestResourceUpdatedApplyFails(t *testing.T) {
 	dir := createTestDir(testTemplates)
 	// Clean up after the test; another quirk of running as an example.
 	defer os.RemoveAll(dir)
-	c := tmplctlr.NewController(dir, "", nil)
+	c := newTestController(t, dir)
 	mockCtrl := gomock.NewController(t)
 	defer mockCtrl.Finish()
 	mockKube := NewMockKubeClient(mockCtrl)
@@ -348,5 +362,658 @@ func TestResourceUpdatedApplyFails(t *testing.T) {
 	}
 	tsExpected := timestampTestMap()
 
-	assertMetrics(t, ct, func() { c.ResourceUpdated(testResource, testResource) }, tsExpected)
+	assertMetrics(t, ct, func() { assert.NotNil(t, c.ResourceUpdated(testResource, testResource)) }, tsExpected)
+}
+
+type testStatusWriter struct {
+	statuses []*crstatus.Status
+}
+
+func (w *testStatusWriter) WriteStatus(r *unstructured.Unstructured, s *crstatus.Status) error {
+	w.statuses = append(w.statuses, s)
+	return nil
+}
+
+func TestResourceAddedWritesStatus(t *testing.T) {
+	dir := createTestDir(testTemplates)
+	defer os.RemoveAll(dir)
+	c := newTestController(t, dir)
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	mockKube := NewMockKubeClient(mockCtrl)
+	c.Client = mockKube
+	sw := &testStatusWriter{}
+	c.SetStatusWriter(sw)
+
+	mockKube.EXPECT().Apply(gomock.Any())
+	mockKube.EXPECT().Apply(gomock.Any()).Return("", errors.New("apply failed"))
+
+	assert.Nil(t, c.ResourceAdded(testResource))
+	assert.NotNil(t, c.ResourceAdded(testResource))
+
+	assert.Len(t, sw.statuses, 2)
+	assert.Equal(t, crstatus.PhaseApplied, sw.statuses[0].Phase)
+	assert.Equal(t, crstatus.PhaseFailed, sw.statuses[1].Phase)
+	assert.Equal(t, "ConfigMap dory-configmap: apply failed", sw.statuses[1].Message)
+}
+
+var testPruneTemplates = []testFile{
+	{"configmap.yaml.tmpl", `---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: {{ .GetField "metadata" "name" }}-configmap
+`},
+}
+
+type testInventory struct {
+	refs      map[string][]tmplctlr.ObjectRef
+	deleteErr error
+}
+
+func (i *testInventory) Get(r *unstructured.Unstructured) ([]tmplctlr.ObjectRef, error) {
+	return i.refs[r.GetName()], nil
+}
+
+func (i *testInventory) Set(r *unstructured.Unstructured, refs []tmplctlr.ObjectRef) error {
+	i.refs[r.GetName()] = refs
+	return nil
+}
+
+func (i *testInventory) Delete(r *unstructured.Unstructured) error {
+	if i.deleteErr != nil {
+		return i.deleteErr
+	}
+	delete(i.refs, r.GetName())
+	return nil
+}
+
+func configMapRef(name string) tmplctlr.ObjectRef {
+	return tmplctlr.ObjectRef{APIVersion: "v1", Kind: "ConfigMap", Name: name}
+}
+
+func readFile(t *testing.T, dst *string) func(string) {
+	return func(file string) {
+		b, err := ioutil.ReadFile(file)
+		assert.Nil(t, err)
+		*dst = string(b)
+	}
+}
+
+func TestResourceUpdatedPrunesObjects(t *testing.T) {
+	dir := createTestDir(testPruneTemplates)
+	defer os.RemoveAll(dir)
+	c := newTestController(t, dir)
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	mockKube := NewMockKubeClient(mockCtrl)
+	c.Client = mockKube
+	inv := &testInventory{refs: map[string][]tmplctlr.ObjectRef{
+		"dory": {configMapRef("dory-configmap"), configMapRef("dory-secret")},
+	}}
+	c.Inventory = inv
+
+	var pruned string
+	mockKube.EXPECT().Apply(gomock.Any())
+	mockKube.EXPECT().Delete(gomock.Any()).Do(readFile(t, &pruned))
+
+	assert.Nil(t, c.ResourceUpdated(testResource, testResource))
+	assert.Contains(t, pruned, "name: dory-secret")
+	assert.NotContains(t, pruned, "dory-configmap")
+	assert.Equal(t, []tmplctlr.ObjectRef{configMapRef("dory-configmap")}, inv.refs["dory"])
+}
+
+func TestResourceUpdatedKeepsObjectsThatFailToPrune(t *testing.T) {
+	dir := createTestDir(testPruneTemplates)
+	defer os.RemoveAll(dir)
+	c := newTestController(t, dir)
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	mockKube := NewMockKubeClient(mockCtrl)
+	c.Client = mockKube
+	inv := &testInventory{refs: map[string][]tmplctlr.ObjectRef{
+		"dory": {configMapRef("dory-secret")},
+	}}
+	c.Inventory = inv
+
+	mockKube.EXPECT().Apply(gomock.Any())
+	mockKube.EXPECT().Delete(gomock.Any()).Return("", errors.New("delete failed"))
+
+	err := c.ResourceUpdated(testResource, testResource)
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "failed to prune objects")
+	assert.Equal(t, []tmplctlr.ObjectRef{configMapRef("dory-configmap"), configMapRef("dory-secret")}, inv.refs["dory"])
+}
+
+func TestResourceAddedRecordsObjects(t *testing.T) {
+	dir := createTestDir(testPruneTemplates)
+	defer os.RemoveAll(dir)
+	c := newTestController(t, dir)
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	mockKube := NewMockKubeClient(mockCtrl)
+	c.Client = mockKube
+	inv := &testInventory{refs: map[string][]tmplctlr.ObjectRef{}}
+	c.Inventory = inv
+
+	mockKube.EXPECT().Apply(gomock.Any())
+
+	assert.Nil(t, c.ResourceAdded(testResource))
+	assert.Equal(t, []tmplctlr.ObjectRef{configMapRef("dory-configmap")}, inv.refs["dory"])
+}
+
+func TestResourceDeletedPrunesAndForgetsObjects(t *testing.T) {
+	dir := createTestDir(testPruneTemplates)
+	defer os.RemoveAll(dir)
+	c := newTestController(t, dir)
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	mockKube := NewMockKubeClient(mockCtrl)
+	c.Client = mockKube
+	inv := &testInventory{refs: map[string][]tmplctlr.ObjectRef{
+		"dory": {configMapRef("dory-configmap"), configMapRef("dory-secret")},
+	}}
+	c.Inventory = inv
+
+	var deleted, pruned string
+	gomock.InOrder(
+		mockKube.EXPECT().Delete(gomock.Any()).Do(readFile(t, &deleted)),
+		mockKube.EXPECT().Delete(gomock.Any()).Do(readFile(t, &pruned)),
+	)
+
+	assert.Nil(t, c.ResourceDeleted(testResource))
+	assert.Contains(t, deleted, "name: dory-configmap")
+	assert.Contains(t, pruned, "name: dory-secret")
+	assert.Empty(t, inv.refs)
+}
+
+func TestResourceDeletedReturnsPruneErrors(t *testing.T) {
+	dir := createTestDir(testPruneTemplates)
+	defer os.RemoveAll(dir)
+	c := newTestController(t, dir)
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	mockKube := NewMockKubeClient(mockCtrl)
+	c.Client = mockKube
+	inv := &testInventory{refs: map[string][]tmplctlr.ObjectRef{
+		"dory": {configMapRef("dory-configmap"), configMapRef("dory-secret")},
+	}}
+	c.Inventory = inv
+
+	gomock.InOrder(
+		mockKube.EXPECT().Delete(gomock.Any()),
+		mockKube.EXPECT().Delete(gomock.Any()).Return("", errors.New("delete failed")),
+	)
+	err := c.ResourceDeleted(testResource)
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "failed to prune objects")
+	assert.NotEmpty(t, inv.refs["dory"])
+
+	// Once the objects are gone the inventory still has to be deleted
+	inv.deleteErr = errors.New("forbidden")
+	gomock.InOrder(
+		mockKube.EXPECT().Delete(gomock.Any()),
+		mockKube.EXPECT().Delete(gomock.Any()),
+	)
+	err = c.ResourceDeleted(testResource)
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "failed to delete inventory")
+}
+
+func TestResourceAddedSetsOwner(t *testing.T) {
+	dir := createTestDir(testPruneTemplates)
+	defer os.RemoveAll(dir)
+	c := newTestController(t, dir)
+	c.OwnerReferences = true
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	mockKube := NewMockKubeClient(mockCtrl)
+	c.Client = mockKube
+
+	r := testResource.DeepCopy()
+	r.SetAPIVersion("stable.lostromos/v1")
+	r.SetKind("Character")
+	r.SetUID("1234")
+
+	var applied string
+	mockKube.EXPECT().Apply(gomock.Any()).Do(readFile(t, &applied))
+
+	assert.Nil(t, c.ResourceAdded(r))
+	assert.Contains(t, applied, "app.kubernetes.io/managed-by: lostromos")
+	assert.Contains(t, applied, "uid: \"1234\"")
+}
+
+func TestResourceAddedAnnotatesOwnerForDriftDetection(t *testing.T) {
+	dir := createTestDir(testPruneTemplates)
+	defer os.RemoveAll(dir)
+	c := newTestController(t, dir)
+	drift, err := tmplctlr.NewDriftWatcher(&restclient.Config{Host: "http://127.0.0.1:8001"}, nil)
+	assert.Nil(t, err)
+	c.Drift = drift
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	mockKube := NewMockKubeClient(mockCtrl)
+	c.Client = mockKube
+
+	var applied string
+	mockKube.EXPECT().Apply(gomock.Any()).Do(readFile(t, &applied))
+
+	assert.Nil(t, c.ResourceAdded(testResource))
+	assert.Contains(t, applied, "lostromos.io/owner: dory")
+	assert.Contains(t, applied, "app.kubernetes.io/managed-by: lostromos")
+	assert.NotContains(t, applied, "ownerReferences")
+}
+
+func TestResourceUpdatedSkipsUnchangedTemplates(t *testing.T) {
+	dir := createTestDir(testTemplates)
+	defer os.RemoveAll(dir)
+	c := newTestController(t, dir)
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	mockKube := NewMockKubeClient(mockCtrl)
+	c.Client = mockKube
+	sw := &testStatusWriter{}
+	c.SetStatusWriter(sw)
+
+	mockKube.EXPECT().Apply(gomock.Any())
+	assert.Nil(t, c.ResourceAdded(testResource))
+
+	updated := testResource.DeepCopy()
+	updated.SetResourceVersion("2")
+	skipped := getPromCounterValue("releases_event_skipped_total")
+	ct := counterTest{
+		events: 1,
+	}
+	assertMetrics(t, ct, func() { assert.Nil(t, c.ResourceUpdated(testResource, updated)) }, timestampTestMap())
+	assert.Equal(t, float64(1), getPromCounterValue("releases_event_skipped_total")-skipped)
+	assert.Len(t, sw.statuses, 1)
+
+	// A new generation that renders the same is skipped, but its status written
+	respecced := updated.DeepCopy()
+	respecced.SetResourceVersion("3")
+	respecced.SetGeneration(updated.GetGeneration() + 1)
+	assert.Nil(t, c.ResourceUpdated(updated, respecced))
+	assert.Len(t, sw.statuses, 2)
+	assert.Equal(t, respecced.GetGeneration(), sw.statuses[1].Generation)
+
+	// Resyncs are applied all the same
+	mockKube.EXPECT().Apply(gomock.Any())
+	assert.Nil(t, c.ResourceUpdated(respecced, respecced))
+
+	renamed := respecced.DeepCopy()
+	renamed.SetName("nemo")
+	renamed.SetResourceVersion("4")
+	mockKube.EXPECT().Apply(gomock.Any())
+	assert.Nil(t, c.ResourceUpdated(respecced, renamed))
+}
+
+func TestResourceUpdatedAppliesAgainAfterFailure(t *testing.T) {
+	dir := createTestDir(testTemplates)
+	defer os.RemoveAll(dir)
+	c := newTestController(t, dir)
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	mockKube := NewMockKubeClient(mockCtrl)
+	c.Client = mockKube
+
+	gomock.InOrder(
+		mockKube.EXPECT().Apply(gomock.Any()),
+		mockKube.EXPECT().Apply(gomock.Any()).Return("", errors.New("apply failed")),
+		mockKube.EXPECT().Apply(gomock.Any()),
+	)
+
+	assert.Nil(t, c.ResourceAdded(testResource))
+	assert.NotNil(t, c.ResourceAdded(testResource))
+	assert.Nil(t, c.ResourceUpdated(testResource, testResource))
+}
+
+func TestResourceDeletedForgetsLastApply(t *testing.T) {
+	dir := createTestDir(testTemplates)
+	defer os.RemoveAll(dir)
+	c := newTestController(t, dir)
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	mockKube := NewMockKubeClient(mockCtrl)
+	c.Client = mockKube
+
+	mockKube.EXPECT().Apply(gomock.Any()).Times(2)
+	mockKube.EXPECT().Delete(gomock.Any())
+
+	assert.Nil(t, c.ResourceAdded(testResource))
+	assert.Nil(t, c.ResourceDeleted(testResource))
+	assert.Nil(t, c.ResourceUpdated(testResource, testResource))
+}
+
+var testTemplateSets = []testFile{
+	{"default.tmpl", `kind: ConfigMap
+name: {{ .GetField "metadata" "name" }}-default`},
+	{"small/configmap.tmpl", `kind: ConfigMap
+name: {{ .GetField "metadata" "name" }}-small`},
+	{"large/configmap.tmpl", `kind: ConfigMap
+name: {{ .GetField "metadata" "name" }}-large`},
+}
+
+func TestResourceAddedUsesTemplateSet(t *testing.T) {
+	var testCases = []struct {
+		name       string
+		defaultSet string
+		annotation string
+		expected   string
+	}{
+		{"Test uses the templates directory without a set", "", "", "kind: ConfigMap\nname: dory-default\n"},
+		{"Test uses the default set", "small", "", "kind: ConfigMap\nname: dory-small\n"},
+		{"Test uses the set of the annotation", "", "large", "kind: ConfigMap\nname: dory-large\n"},
+		{"Test prefers the annotation over the default set", "small", "large", "kind: ConfigMap\nname: dory-large\n"},
+	}
+	dir := createTestDir(testTemplateSets)
+	defer os.RemoveAll(dir)
+	for _, tt := range testCases {
+		c := newTestController(t, dir)
+		c.TemplateSet = tt.defaultSet
+		mockCtrl := gomock.NewController(t)
+		mockKube := NewMockKubeClient(mockCtrl)
+		c.Client = mockKube
+
+		r := testResource.DeepCopy()
+		if tt.annotation != "" {
+			r.SetAnnotations(map[string]string{tmplctlr.TemplateAnnotation: tt.annotation})
+		}
+		var applied string
+		mockKube.EXPECT().Apply(gomock.Any()).Do(readFile(t, &applied))
+
+		assert.Nil(t, c.ResourceAdded(r), tt.name)
+		assert.Equal(t, tt.expected, applied, tt.name)
+		mockCtrl.Finish()
+	}
+}
+
+func TestResourceAddedReportsMissingTemplateSet(t *testing.T) {
+	dir := createTestDir(testTemplateSets)
+	defer os.RemoveAll(dir)
+	for _, set := range []string{"medium", "../small", ".."} {
+		c := newTestController(t, dir)
+		sw := &testStatusWriter{}
+		c.SetStatusWriter(sw)
+
+		r := testResource.DeepCopy()
+		r.SetAnnotations(map[string]string{tmplctlr.TemplateAnnotation: set})
+
+		err := c.ResourceAdded(r)
+		assert.NotNil(t, err, set)
+		assert.Len(t, sw.statuses, 1, set)
+		assert.Equal(t, crstatus.PhaseFailed, sw.statuses[0].Phase, set)
+		assert.Contains(t, sw.statuses[0].Message, set, set)
+	}
+}
+
+var testStrictTemplates = []testFile{
+	{"default.tmpl", `kind: ConfigMap
+name: {{ .GetField "metadata" "name" }}-{{ .GetField "spec" "nmae" }}`},
+	{"large/configmap.tmpl", `kind: ConfigMap
+name: {{ .GetField "metadata" "name" }}-{{ .GetField "spec" "nmae" }}`},
+}
+
+func TestResourceAddedInStrictMode(t *testing.T) {
+	var testCases = []struct {
+		name       string
+		strict     bool
+		strictSets []string
+		annotation string
+		err        bool
+	}{
+		{"Test renders missing fields as empty strings", false, nil, "", false},
+		{"Test fails on missing fields", true, nil, "", true},
+		{"Test fails on missing fields in a strict template set", false, []string{"large"}, "large", true},
+		{"Test renders other template sets as before", false, []string{"large"}, "", false},
+	}
+	dir := createTestDir(testStrictTemplates)
+	defer os.RemoveAll(dir)
+	for _, tt := range testCases {
+		c := newTestController(t, dir)
+		c.Strict = tt.strict
+		c.StrictTemplateSets = tt.strictSets
+		sw := &testStatusWriter{}
+		c.SetStatusWriter(sw)
+		mockCtrl := gomock.NewController(t)
+		mockKube := NewMockKubeClient(mockCtrl)
+		c.Client = mockKube
+
+		r := testResource.DeepCopy()
+		if tt.annotation != "" {
+			r.SetAnnotations(map[string]string{tmplctlr.TemplateAnnotation: tt.annotation})
+		}
+		if tt.err {
+			err := c.ResourceAdded(r)
+			assert.NotNil(t, err, tt.name)
+			assert.Contains(t, err.Error(), "missing field spec.nmae", tt.name)
+			assert.Equal(t, crstatus.PhaseFailed, sw.statuses[0].Phase, tt.name)
+		} else {
+			mockKube.EXPECT().Apply(gomock.Any())
+			assert.Nil(t, c.ResourceAdded(r), tt.name)
+		}
+		mockCtrl.Finish()
+	}
+}
+
+var testSchemaTemplates = []testFile{
+	{"configmap.tmpl", `kind: ConfigMap
+name: {{ .GetField "metadata" "name" }}-configmap`},
+	{"schema.json", `{"type": "object", "required": ["Name", "Size"], "properties": {"By": {"enum": ["Pixar"]}}}`},
+	{"large/configmap.tmpl", `kind: ConfigMap
+name: {{ .GetField "metadata" "name" }}-large`},
+}
+
+func TestResourceAddedValidatesSpec(t *testing.T) {
+	dir := createTestDir(testSchemaTemplates)
+	defer os.RemoveAll(dir)
+	c := newTestController(t, dir)
+	sw := &testStatusWriter{}
+	c.SetStatusWriter(sw)
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	mockKube := NewMockKubeClient(mockCtrl)
+	c.Client = mockKube
+
+	before := getPromCounterValue("releases_validation_error_total")
+	err := c.ResourceAdded(testResource)
+	assert.IsType(t, &schema.ValidationError{}, err)
+	assert.Equal(t, float64(1), getPromCounterValue("releases_validation_error_total")-before)
+	assert.Len(t, sw.statuses, 1)
+	assert.Equal(t, crstatus.PhaseFailed, sw.statuses[0].Phase)
+	assert.Equal(t, []string{"spec.Size: is required", `spec.By: must be one of ["Pixar"]`}, sw.statuses[0].Violations)
+
+	// Deleting doesn't validate, and template sets without a schema don't either
+	mockKube.EXPECT().Delete(gomock.Any())
+	assert.Nil(t, c.ResourceDeleted(testResource))
+	r := testResource.DeepCopy()
+	r.SetAnnotations(map[string]string{tmplctlr.TemplateAnnotation: "large"})
+	mockKube.EXPECT().Apply(gomock.Any())
+	assert.Nil(t, c.ResourceAdded(r))
+}
+
+func TestNewControllerFailsOnInvalidSchema(t *testing.T) {
+	dir := createTestDir([]testFile{
+		{"configmap.tmpl", `name: {{ .GetField "metadata" "name" }}`},
+		{"large/configmap.tmpl", `name: {{ .GetField "metadata" "name" }}`},
+		{"large/schema.json", `{"type": "object",}`},
+	})
+	defer os.RemoveAll(dir)
+
+	_, err := tmplctlr.NewController(dir, "", nil)
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), filepath.Join("large", "schema.json"))
+}
+
+var testOrderedTemplates = []testFile{
+	{"all.yaml.tmpl", `---
+apiVersion: apps/v1beta1
+kind: Deployment
+metadata:
+  name: {{ .GetField "metadata" "name" }}-nginx
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: {{ .GetField "metadata" "name" }}-configmap
+---
+# only a comment
+---
+apiVersion: v1
+kind: Namespace
+metadata:
+  name: {{ .GetField "metadata" "name" }}
+`},
+}
+
+func TestResourceAddedAppliesDocumentsInInstallOrder(t *testing.T) {
+	dir := createTestDir(testOrderedTemplates)
+	defer os.RemoveAll(dir)
+	c := newTestController(t, dir)
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	mockKube := NewMockKubeClient(mockCtrl)
+	c.Client = mockKube
+
+	var ns, cm, deploy string
+	gomock.InOrder(
+		mockKube.EXPECT().Apply(gomock.Any()).Do(readFile(t, &ns)),
+		mockKube.EXPECT().Apply(gomock.Any()).Do(readFile(t, &cm)),
+		mockKube.EXPECT().Apply(gomock.Any()).Do(readFile(t, &deploy)),
+	)
+
+	assert.Nil(t, c.ResourceAdded(testResource))
+	assert.Contains(t, ns, "kind: Namespace")
+	assert.Contains(t, cm, "kind: ConfigMap")
+	assert.Contains(t, deploy, "kind: Deployment")
+	assert.NotContains(t, deploy, "kind: ConfigMap")
+}
+
+func TestResourceDeletedDeletesDocumentsInUninstallOrder(t *testing.T) {
+	dir := createTestDir(testOrderedTemplates)
+	defer os.RemoveAll(dir)
+	c := newTestController(t, dir)
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	mockKube := NewMockKubeClient(mockCtrl)
+	c.Client = mockKube
+
+	var deploy, cm, ns string
+	gomock.InOrder(
+		mockKube.EXPECT().Delete(gomock.Any()).Do(readFile(t, &deploy)),
+		mockKube.EXPECT().Delete(gomock.Any()).Do(readFile(t, &cm)),
+		mockKube.EXPECT().Delete(gomock.Any()).Do(readFile(t, &ns)),
+	)
+
+	assert.Nil(t, c.ResourceDeleted(testResource))
+	assert.Contains(t, deploy, "kind: Deployment")
+	assert.Contains(t, cm, "kind: ConfigMap")
+	assert.Contains(t, ns, "kind: Namespace")
+}
+
+func TestResourceAddedReportsFailedDocuments(t *testing.T) {
+	dir := createTestDir(testOrderedTemplates)
+	defer os.RemoveAll(dir)
+	c := newTestController(t, dir)
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	mockKube := NewMockKubeClient(mockCtrl)
+	c.Client = mockKube
+	sw := &testStatusWriter{}
+	c.SetStatusWriter(sw)
+
+	gomock.InOrder(
+		mockKube.EXPECT().Apply(gomock.Any()).Return("namespace \"dory\" created", nil),
+		mockKube.EXPECT().Apply(gomock.Any()).Return("", errors.New("forbidden")),
+		mockKube.EXPECT().Apply(gomock.Any()).Return("deployment \"dory-nginx\" created", nil),
+	)
+
+	err := c.ResourceAdded(testResource)
+	assert.NotNil(t, err)
+	assert.Equal(t, "ConfigMap dory-configmap: forbidden", err.Error())
+	assert.Equal(t, "ConfigMap dory-configmap: forbidden", sw.statuses[0].Message)
+}
+
+func TestReloadTemplatesKeepsPreviousTemplatesOnFailure(t *testing.T) {
+	dir := createTestDir([]testFile{{"configmap.tmpl", `kind: ConfigMap
+name: {{ .GetField "metadata" "name" }}-v1`}})
+	defer os.RemoveAll(dir)
+	c := newTestController(t, dir)
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	mockKube := NewMockKubeClient(mockCtrl)
+	c.Client = mockKube
+	var applied string
+	mockKube.EXPECT().Apply(gomock.Any()).Do(readFile(t, &applied)).Times(4)
+	write := func(contents string) {
+		assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, "configmap.tmpl"), []byte(contents), 0644))
+	}
+
+	assert.Nil(t, c.ResourceAdded(testResource))
+	assert.Equal(t, "kind: ConfigMap\nname: dory-v1\n", applied)
+
+	// Changes are only picked up on reload
+	write(`kind: ConfigMap
+name: {{ .GetField "metadata" "name" }}-v2`)
+	assert.Nil(t, c.ResourceAdded(testResource))
+	assert.Equal(t, "kind: ConfigMap\nname: dory-v1\n", applied)
+
+	write(`name: {{ .GetField "metadata" "name" `)
+	err := c.ReloadTemplates()
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "configmap.tmpl:1")
+	assert.Nil(t, c.ResourceAdded(testResource))
+	assert.Equal(t, "kind: ConfigMap\nname: dory-v1\n", applied)
+
+	write(`kind: ConfigMap
+name: {{ .GetField "metadata" "name" }}-v3`)
+	assert.Nil(t, c.ReloadTemplates())
+	assert.Nil(t, c.ResourceAdded(testResource))
+	assert.Equal(t, "kind: ConfigMap\nname: dory-v3\n", applied)
+}
+
+func TestNewControllerFailsOnInvalidTemplates(t *testing.T) {
+	var testCases = []struct {
+		name     string
+		files    []testFile
+		expected []string
+	}{
+		{"Test fails on a syntax error", []testFile{
+			{"configmap.tmpl", "name: {{ .Name }}\ndata: {{ .GetField \"spec\" "},
+		}, []string{"configmap.tmpl:2"}},
+		{"Test fails on an unknown function", []testFile{
+			{"configmap.tmpl", "name: {{ .Name | shout }}"},
+		}, []string{"configmap.tmpl:1", `"shout" not defined`}},
+		{"Test fails on a broken template set", []testFile{
+			{"default.tmpl", "name: {{ .Name }}"},
+			{"large/configmap.tmpl", "name: {{ .Name "},
+		}, []string{"large", "configmap.tmpl:1"}},
+		{"Test fails without templates", []testFile{
+			{"README.md", "no templates here"},
+		}, []string{"no *.tmpl files"}},
+	}
+	for _, tt := range testCases {
+		dir := createTestDir(tt.files)
+		c, err := tmplctlr.NewController(dir, "", nil)
+		assert.Nil(t, c, tt.name)
+		assert.NotNil(t, err, tt.name)
+		for _, e := range tt.expected {
+			assert.Contains(t, err.Error(), e, tt.name)
+		}
+		os.RemoveAll(dir)
+	}
+
+	_, err := tmplctlr.NewController("/path/not/found", "", nil)
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "does not exist")
+}
+
+func TestNewControllerAcceptsTemplateSetsOnly(t *testing.T) {
+	dir := createTestDir([]testFile{
+		{"small/configmap.tmpl", "name: {{ .Name }}"},
+		{"large/configmap.tmpl", "name: {{ .Name }}"},
+	})
+	defer os.RemoveAll(dir)
+
+	_, err := tmplctlr.NewController(dir, "", nil)
+	assert.Nil(t, err)
 }
@@ -0,0 +1,206 @@
+// Copyright 2017 the lostromos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tmplctlr
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/ghodss/yaml"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+)
+
+// InstallOrder is the order in which kinds are applied, the same as Helm's.
+// Kinds that are not listed are applied last.
+var InstallOrder = []string{
+	"Namespace",
+	"ResourceQuota",
+	"LimitRange",
+	"PodSecurityPolicy",
+	"Secret",
+	"ConfigMap",
+	"StorageClass",
+	"PersistentVolume",
+	"PersistentVolumeClaim",
+	"ServiceAccount",
+	"CustomResourceDefinition",
+	"ClusterRole",
+	"ClusterRoleBinding",
+	"Role",
+	"RoleBinding",
+	"Service",
+	"DaemonSet",
+	"Pod",
+	"ReplicationController",
+	"ReplicaSet",
+	"Deployment",
+	"StatefulSet",
+	"Job",
+	"CronJob",
+	"Ingress",
+	"APIService",
+}
+
+// document is a single object of a rendered manifest
+type document struct {
+	Index int // position in the manifest, starting at 1
+	Kind  string
+	Name  string
+	Data  []byte
+}
+
+func (d document) String() string {
+	if d.Kind == "" || d.Name == "" {
+		return fmt.Sprintf("document %d", d.Index)
+	}
+	return fmt.Sprintf("%s %s", d.Kind, d.Name)
+}
+
+// splitManifest splits a rendered manifest into its documents with
+// ParseManifest, so empty documents are skipped and the items of a List become
+// documents of their own.
+func splitManifest(manifest []byte) ([]document, error) {
+	objs, err := ParseManifest(bytes.NewReader(manifest))
+	if err != nil {
+		return nil, err
+	}
+	docs := make([]document, 0, len(objs))
+	for i, obj := range objs {
+		data, err := yaml.Marshal(obj.Object)
+		if err != nil {
+			return nil, err
+		}
+		docs = append(docs, document{Index: i + 1, Kind: obj.GetKind(), Name: obj.GetName(), Data: data})
+	}
+	return docs, nil
+}
+
+// refDocuments turns object references into documents
+func refDocuments(refs []ObjectRef) ([]document, error) {
+	docs := make([]document, 0, len(refs))
+	for i, ref := range refs {
+		var buf bytes.Buffer
+		if err := writeRefs(&buf, []ObjectRef{ref}); err != nil {
+			return nil, err
+		}
+		docs = append(docs, document{Index: i + 1, Kind: ref.Kind, Name: ref.Name, Data: buf.Bytes()})
+	}
+	return docs, nil
+}
+
+// sortForInstall orders the documents by InstallOrder, keeping the rendered
+// order within a kind
+func sortForInstall(docs []document) {
+	sort.SliceStable(docs, func(i, j int) bool {
+		return kindPriority(docs[i].Kind) < kindPriority(docs[j].Kind)
+	})
+}
+
+// sortForUninstall orders the documents by the reverse of InstallOrder, so
+// kinds that are not listed, like custom resources, are deleted first
+func sortForUninstall(docs []document) {
+	sort.SliceStable(docs, func(i, j int) bool {
+		return kindPriority(docs[i].Kind) > kindPriority(docs[j].Kind)
+	})
+}
+
+func kindPriority(kind string) int {
+	for i, k := range InstallOrder {
+		if k == kind {
+			return i
+		}
+	}
+	return len(InstallOrder)
+}
+
+// ApplyManifest applies the objects of the manifest one by one in InstallOrder.
+// All objects are applied even if some fail, the failures are returned
+// together.
+func ApplyManifest(client KubeClient, manifest []byte) (string, error) {
+	docs, err := splitManifest(manifest)
+	if err != nil {
+		return "", err
+	}
+	sortForInstall(docs)
+	return eachDocument(docs, client.Apply)
+}
+
+// DeleteManifest deletes the objects of the manifest one by one in the reverse
+// of InstallOrder
+func DeleteManifest(client KubeClient, manifest []byte) (string, error) {
+	docs, err := splitManifest(manifest)
+	if err != nil {
+		return "", err
+	}
+	sortForUninstall(docs)
+	return eachDocument(docs, client.Delete)
+}
+
+// DeleteStale deletes the objects of the old manifest that are not in the
+// current one
+func DeleteStale(client KubeClient, old, current []byte) (string, error) {
+	oldRefs, err := manifestRefs(old)
+	if err != nil {
+		return "", err
+	}
+	refs, err := manifestRefs(current)
+	if err != nil {
+		return "", err
+	}
+	stale := staleRefs(oldRefs, refs)
+	if len(stale) == 0 {
+		return "", nil
+	}
+	return deleteRefs(client, stale)
+}
+
+// deleteRefs deletes the objects in the reverse of InstallOrder
+func deleteRefs(client KubeClient, refs []ObjectRef) (string, error) {
+	docs, err := refDocuments(refs)
+	if err != nil {
+		return "", err
+	}
+	sortForUninstall(docs)
+	return eachDocument(docs, client.Delete)
+}
+
+// eachDocument hands every document to f in its own file. All documents are
+// handed over even if some fail, the failures are returned together.
+func eachDocument(docs []document, f func(file string) (string, error)) (string, error) {
+	var out []string
+	var errs []error
+	for _, d := range docs {
+		output, err := runDocument(d, f)
+		if output != "" {
+			out = append(out, strings.TrimSpace(output))
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %s", d, err))
+		}
+	}
+	return strings.Join(out, "\n"), utilerrors.NewAggregate(errs)
+}
+
+func runDocument(d document, f func(file string) (string, error)) (string, error) {
+	file, err := writeManifest(d.Data)
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(file) // nolint: errcheck
+	return f(file)
+}
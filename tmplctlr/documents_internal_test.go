@@ -0,0 +1,232 @@
+// Copyright 2017 the lostromos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tmplctlr
+
+import (
+	"errors"
+	"io/ioutil"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func docKinds(docs []document) []string {
+	kinds := make([]string, 0, len(docs))
+	for _, d := range docs {
+		kinds = append(kinds, d.Kind)
+	}
+	return kinds
+}
+
+func TestSplitManifest(t *testing.T) {
+	manifest := `---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: nemo
+---
+# only a comment
+---
+
+---
+apiVersion: v1
+kind: List
+items:
+- apiVersion: v1
+  kind: Secret
+  metadata:
+    name: marlin
+- apiVersion: v1
+  kind: Service
+  metadata:
+    name: reef
+`
+	docs, err := splitManifest([]byte(manifest))
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"ConfigMap", "Secret", "Service"}, docKinds(docs))
+	assert.Equal(t, "apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: nemo\n", string(docs[0].Data))
+	assert.Equal(t, "ConfigMap nemo", docs[0].String())
+	assert.Equal(t, "Secret marlin", docs[1].String())
+	assert.Contains(t, string(docs[2].Data), "name: reef")
+	assert.NotContains(t, string(docs[2].Data), "marlin")
+}
+
+func TestSplitManifestRequiresKind(t *testing.T) {
+	_, err := splitManifest([]byte("---\nkind: ConfigMap\n---\nmetadata:\n  name: dory\n"))
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "dory")
+}
+
+func TestSplitManifestFailsOnInvalidYAML(t *testing.T) {
+	_, err := splitManifest([]byte("---\nkind: ConfigMap\n---\nkind: [\n"))
+	assert.NotNil(t, err)
+}
+
+func TestDocumentString(t *testing.T) {
+	assert.Equal(t, "document 2", document{Index: 2, Kind: "ConfigMap"}.String())
+	assert.Equal(t, "ConfigMap nemo", document{Index: 2, Kind: "ConfigMap", Name: "nemo"}.String())
+}
+
+func TestSortDocuments(t *testing.T) {
+	docs := []document{
+		{Kind: "Deployment", Name: "a"},
+		{Kind: "Character"},
+		{Kind: "Service"},
+		{Kind: "Deployment", Name: "b"},
+		{Kind: "CustomResourceDefinition"},
+		{Kind: "Namespace"},
+	}
+
+	sortForInstall(docs)
+	assert.Equal(t, []string{"Namespace", "CustomResourceDefinition", "Service", "Deployment", "Deployment", "Character"}, docKinds(docs))
+	assert.Equal(t, "a", docs[3].Name)
+	assert.Equal(t, "b", docs[4].Name)
+
+	sortForUninstall(docs)
+	assert.Equal(t, []string{"Character", "Deployment", "Deployment", "Service", "CustomResourceDefinition", "Namespace"}, docKinds(docs))
+	assert.Equal(t, "a", docs[1].Name)
+}
+
+func TestRefDocuments(t *testing.T) {
+	docs, err := refDocuments([]ObjectRef{
+		{APIVersion: "v1", Kind: "ConfigMap", Namespace: "ocean", Name: "nemo"},
+		{APIVersion: "v1", Kind: "Namespace", Name: "ocean"},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"ConfigMap", "Namespace"}, docKinds(docs))
+	assert.Contains(t, string(docs[0].Data), "name: nemo")
+	assert.NotContains(t, string(docs[0].Data), "kind: Namespace")
+}
+
+func TestEachDocumentRunsAllDocuments(t *testing.T) {
+	docs := []document{
+		{Index: 1, Kind: "ConfigMap", Name: "nemo", Data: []byte("kind: ConfigMap\n")},
+		{Index: 2, Kind: "Secret", Name: "marlin", Data: []byte("kind: Secret\n")},
+		{Index: 3, Kind: "Service", Name: "reef", Data: []byte("kind: Service\n")},
+	}
+	var seen []string
+	out, err := eachDocument(docs, func(file string) (string, error) {
+		b, rerr := ioutil.ReadFile(file)
+		assert.Nil(t, rerr)
+		seen = append(seen, string(b))
+		if string(b) == "kind: Secret\n" {
+			return "", errors.New("forbidden")
+		}
+		return string(b), nil
+	})
+	assert.Equal(t, []string{"kind: ConfigMap\n", "kind: Secret\n", "kind: Service\n"}, seen)
+	assert.Equal(t, "kind: ConfigMap\nkind: Service", out)
+	assert.NotNil(t, err)
+	assert.Equal(t, "Secret marlin: forbidden", err.Error())
+}
+
+// recordingClient is a KubeClient that records the kinds and names of the
+// objects it is handed
+type recordingClient struct {
+	applied []string
+	deleted []string
+}
+
+func (c *recordingClient) Apply(file string) (string, error) {
+	return "", c.record(file, &c.applied)
+}
+
+func (c *recordingClient) Delete(file string) (string, error) {
+	return "", c.record(file, &c.deleted)
+}
+
+func (c *recordingClient) record(file string, to *[]string) error {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	docs, err := splitManifest(data)
+	if err != nil {
+		return err
+	}
+	for _, d := range docs {
+		*to = append(*to, d.String())
+	}
+	return nil
+}
+
+func TestApplyAndDeleteManifest(t *testing.T) {
+	manifest := []byte(`---
+apiVersion: apps/v1beta1
+kind: Deployment
+metadata:
+  name: nemo
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: nemo
+`)
+	client := &recordingClient{}
+	_, err := ApplyManifest(client, manifest)
+	assert.Nil(t, err)
+	_, err = DeleteManifest(client, manifest)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"ConfigMap nemo", "Deployment nemo"}, client.applied)
+	assert.Equal(t, []string{"Deployment nemo", "ConfigMap nemo"}, client.deleted)
+}
+
+func TestDeleteStale(t *testing.T) {
+	old := []byte(`---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: nemo
+---
+apiVersion: v1
+kind: Service
+metadata:
+  name: reef
+`)
+	current := []byte(`---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: nemo
+`)
+	client := &recordingClient{}
+	_, err := DeleteStale(client, old, current)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"Service reef"}, client.deleted)
+
+	client = &recordingClient{}
+	_, err = DeleteStale(client, current, current)
+	assert.Nil(t, err)
+	assert.Empty(t, client.deleted)
+}
+
+func TestDeleteStaleKeepsObjectsMovedToANewAPIVersion(t *testing.T) {
+	old := []byte(`---
+apiVersion: extensions/v1beta1
+kind: Deployment
+metadata:
+  name: nemo
+`)
+	current := []byte(`---
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: nemo
+`)
+	client := &recordingClient{}
+	_, err := DeleteStale(client, old, current)
+	assert.Nil(t, err)
+	assert.Empty(t, client.deleted)
+}
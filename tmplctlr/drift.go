@@ -0,0 +1,189 @@
+// Copyright 2017 the lostromos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tmplctlr
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+
+	"go.uber.org/zap"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/dynamic"
+	restclient "k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/cache"
+)
+
+// OwnerAnnotation records the namespace/name key of the custom resource an
+// object was rendered for
+const OwnerAnnotation = "lostromos.io/owner"
+
+// OwnerKindAnnotation records the kind and group of the custom resource an
+// object was rendered for, formatted as Kind.group
+const OwnerKindAnnotation = "lostromos.io/owner-kind"
+
+// DriftWatcher watches the kinds of objects rendered from the templates and
+// requeues the custom resource that owns an object whenever the object is
+// changed or deleted, so the desired state gets applied again. Only objects
+// labelled as managed by Lostromos are watched, and only objects rendered for
+// the kinds of custom resources passed to Track requeue their owner.
+type DriftWatcher struct {
+	logger    *zap.SugaredLogger
+	resources func(obj *unstructured.Unstructured) (dynamic.ResourceInterface, error)
+
+	mu      sync.Mutex
+	kinds   map[schema.GroupVersionKind]bool
+	owners  map[string]bool
+	requeue func(key string)
+	stopCh  <-chan struct{}
+}
+
+// NewDriftWatcher builds a DriftWatcher for the cluster described by cfg
+func NewDriftWatcher(cfg *restclient.Config, logger *zap.SugaredLogger) (*DriftWatcher, error) {
+	r, err := newResourceClients(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return newDriftWatcher(r.forObject, logger), nil
+}
+
+func newDriftWatcher(resources func(*unstructured.Unstructured) (dynamic.ResourceInterface, error), logger *zap.SugaredLogger) *DriftWatcher {
+	if logger == nil {
+		logger = zap.NewNop().Sugar()
+	}
+	return &DriftWatcher{
+		logger:    logger,
+		resources: resources,
+		kinds:     map[schema.GroupVersionKind]bool{},
+		owners:    map[string]bool{},
+	}
+}
+
+// Start watches all kinds tracked so far and any kind tracked later until
+// stopCh is closed. requeue is called with the owner of a changed object.
+func (d *DriftWatcher) Start(requeue func(key string), stopCh <-chan struct{}) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.requeue = requeue
+	d.stopCh = stopCh
+	for gvk := range d.kinds {
+		d.watch(gvk)
+	}
+}
+
+// Track makes sure the kinds of the objects rendered for a custom resource of
+// the owner kind are watched
+func (d *DriftWatcher) Track(owner schema.GroupKind, refs []ObjectRef) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.owners[owner.String()] = true
+	for _, ref := range refs {
+		gvk := schema.FromAPIVersionAndKind(ref.APIVersion, ref.Kind)
+		if d.kinds[gvk] {
+			continue
+		}
+		d.kinds[gvk] = true
+		if d.stopCh != nil {
+			d.watch(gvk)
+		}
+	}
+}
+
+// watch starts an informer for the kind, d.mu must be held
+func (d *DriftWatcher) watch(gvk schema.GroupVersionKind) {
+	obj := &unstructured.Unstructured{}
+	obj.SetGroupVersionKind(gvk)
+	ri, err := d.resources(obj)
+	if err != nil {
+		d.logger.Warnw("failed to watch rendered kind for drift", "kind", gvk.String(), "error", err)
+		// Try again the next time an object of this kind is applied
+		delete(d.kinds, gvk)
+		return
+	}
+	selector := fmt.Sprintf("%s=%s", ManagedByLabel, ManagedByValue)
+	lw := &cache.ListWatch{
+		ListFunc: func(opts metav1.ListOptions) (runtime.Object, error) {
+			opts.LabelSelector = selector
+			return ri.List(opts)
+		},
+		WatchFunc: func(opts metav1.ListOptions) (watch.Interface, error) {
+			opts.LabelSelector = selector
+			return ri.Watch(opts)
+		},
+	}
+	_, controller := cache.NewInformer(lw, &unstructured.Unstructured{}, 0, cache.ResourceEventHandlerFuncs{
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			if drifted(oldObj, newObj) {
+				d.changed(newObj)
+			}
+		},
+		DeleteFunc: d.changed,
+	})
+	d.logger.Infow("watching rendered kind for drift", "kind", gvk.String())
+	go controller.Run(d.stopCh)
+}
+
+func (d *DriftWatcher) changed(obj interface{}) {
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = tombstone.Obj
+	}
+	r, ok := obj.(*unstructured.Unstructured)
+	if !ok {
+		return
+	}
+	key := r.GetAnnotations()[OwnerAnnotation]
+	if key == "" {
+		return
+	}
+	d.mu.Lock()
+	requeue := d.requeue
+	// Objects of another watch may belong to a custom resource with the same name
+	owned := d.owners[r.GetAnnotations()[OwnerKindAnnotation]]
+	d.mu.Unlock()
+	if !owned {
+		return
+	}
+	d.logger.Debugw("managed object changed, requeueing owner", "object", r.GetName(), "owner", key)
+	requeue(key)
+}
+
+// drifted reports whether an update changed more than the fields the cluster
+// keeps up to date itself, like the status of a Deployment during a rollout.
+func drifted(oldObj, newObj interface{}) bool {
+	oldR, ok := oldObj.(*unstructured.Unstructured)
+	if !ok {
+		return true
+	}
+	newR, ok := newObj.(*unstructured.Unstructured)
+	if !ok {
+		return true
+	}
+	return !reflect.DeepEqual(withoutServerFields(oldR), withoutServerFields(newR))
+}
+
+func withoutServerFields(r *unstructured.Unstructured) map[string]interface{} {
+	c := r.DeepCopy()
+	delete(c.Object, "status")
+	if metadata, ok := c.Object["metadata"].(map[string]interface{}); ok {
+		delete(metadata, "resourceVersion")
+		delete(metadata, "generation")
+		delete(metadata, "managedFields")
+	}
+	return c.Object
+}
@@ -0,0 +1,171 @@
+// Copyright 2017 the lostromos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tmplctlr
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/dynamic"
+)
+
+// watchResource lists nothing and hands out a fake watch
+type watchResource struct {
+	dynamic.ResourceInterface
+	watcher *watch.FakeWatcher
+}
+
+func (w *watchResource) List(opts metav1.ListOptions) (runtime.Object, error) {
+	return &unstructured.UnstructuredList{}, nil
+}
+
+func (w *watchResource) Watch(opts metav1.ListOptions) (watch.Interface, error) {
+	return w.watcher, nil
+}
+
+var testOwnerKind = schema.GroupKind{Group: "stable.lostromos", Kind: "Character"}
+
+func managedObject(name, owner, version string) *unstructured.Unstructured {
+	obj := &unstructured.Unstructured{}
+	obj.SetAPIVersion("v1")
+	obj.SetKind("ConfigMap")
+	obj.SetNamespace("ocean")
+	obj.SetName(name)
+	obj.SetResourceVersion(version)
+	obj.Object["data"] = map[string]interface{}{"version": version}
+	if owner != "" {
+		obj.SetAnnotations(map[string]string{
+			OwnerAnnotation:     owner,
+			OwnerKindAnnotation: testOwnerKind.String(),
+		})
+	}
+	return obj
+}
+
+func startDriftWatcher(fw *watch.FakeWatcher) (chan string, chan struct{}) {
+	d := newDriftWatcher(func(obj *unstructured.Unstructured) (dynamic.ResourceInterface, error) {
+		return &watchResource{watcher: fw}, nil
+	}, nil)
+	requeued := make(chan string, 10)
+	stopCh := make(chan struct{})
+	d.Track(testOwnerKind, []ObjectRef{{APIVersion: "v1", Kind: "ConfigMap", Name: "nemo"}})
+	d.Start(func(key string) { requeued <- key }, stopCh)
+	return requeued, stopCh
+}
+
+func expectRequeue(t *testing.T, requeued chan string, key string) {
+	select {
+	case got := <-requeued:
+		assert.Equal(t, key, got)
+	case <-time.After(5 * time.Second):
+		t.Fatalf("%s was not requeued", key)
+	}
+}
+
+func TestDriftWatcherRequeuesOwner(t *testing.T) {
+	fw := watch.NewFake()
+	requeued, stopCh := startDriftWatcher(fw)
+	defer close(stopCh)
+
+	fw.Add(managedObject("nemo", "ocean/nemo", "1"))
+	fw.Add(managedObject("unowned", "", "1"))
+	fw.Modify(managedObject("unowned", "", "2"))
+	fw.Modify(managedObject("nemo", "ocean/nemo", "2"))
+	expectRequeue(t, requeued, "ocean/nemo")
+
+	fw.Delete(managedObject("nemo", "ocean/nemo", "3"))
+	expectRequeue(t, requeued, "ocean/nemo")
+	assert.Empty(t, requeued)
+}
+
+func TestDriftWatcherIgnoresStatusChanges(t *testing.T) {
+	fw := watch.NewFake()
+	requeued, stopCh := startDriftWatcher(fw)
+	defer close(stopCh)
+
+	obj := managedObject("nemo", "ocean/nemo", "1")
+	fw.Add(obj)
+	rollout := obj.DeepCopy()
+	rollout.SetResourceVersion("2")
+	rollout.SetGeneration(2)
+	rollout.Object["status"] = map[string]interface{}{"replicas": int64(3)}
+	fw.Modify(rollout)
+
+	// Events are handled in order, a requeue of nemo would show up first
+	fw.Add(managedObject("dory", "ocean/dory", "1"))
+	fw.Modify(managedObject("dory", "ocean/dory", "2"))
+	expectRequeue(t, requeued, "ocean/dory")
+	assert.Empty(t, requeued)
+}
+
+// Watches of different CRDs only requeue objects rendered for their own kind
+func TestDriftWatcherIgnoresObjectsOfOtherOwnerKinds(t *testing.T) {
+	fw := watch.NewFake()
+	requeued, stopCh := startDriftWatcher(fw)
+	defer close(stopCh)
+
+	other := managedObject("nemo", "ocean/nemo", "1")
+	other.SetAnnotations(map[string]string{
+		OwnerAnnotation:     "ocean/nemo",
+		OwnerKindAnnotation: "Fish.example.com",
+	})
+	fw.Add(other)
+	fw.Delete(other)
+
+	fw.Add(managedObject("dory", "ocean/dory", "1"))
+	fw.Delete(managedObject("dory", "ocean/dory", "1"))
+	expectRequeue(t, requeued, "ocean/dory")
+	assert.Empty(t, requeued)
+}
+
+func TestDriftWatcherWatchesEveryKindOnce(t *testing.T) {
+	var watched []string
+	d := newDriftWatcher(func(obj *unstructured.Unstructured) (dynamic.ResourceInterface, error) {
+		watched = append(watched, obj.GetKind())
+		return &watchResource{watcher: watch.NewFake()}, nil
+	}, nil)
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+
+	d.Track(testOwnerKind, []ObjectRef{{APIVersion: "v1", Kind: "ConfigMap", Name: "a"}, {APIVersion: "v1", Kind: "ConfigMap", Name: "b"}})
+	assert.Empty(t, watched, "nothing is watched before the start")
+
+	d.Start(func(string) {}, stopCh)
+	d.Track(testOwnerKind, []ObjectRef{{APIVersion: "v1", Kind: "ConfigMap", Name: "c"}, {APIVersion: "apps/v1", Kind: "Deployment", Name: "d"}})
+	assert.Equal(t, []string{"ConfigMap", "Deployment"}, watched)
+}
+
+func TestDriftWatcherRetriesUnknownKinds(t *testing.T) {
+	calls := 0
+	d := newDriftWatcher(func(obj *unstructured.Unstructured) (dynamic.ResourceInterface, error) {
+		calls++
+		return nil, errors.New("no matches for kind")
+	}, nil)
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	d.Start(func(string) {}, stopCh)
+
+	refs := []ObjectRef{{APIVersion: "example.com/v1", Kind: "Widget", Name: "a"}}
+	d.Track(testOwnerKind, refs)
+	d.Track(testOwnerKind, refs)
+	assert.Equal(t, 2, calls)
+}
@@ -0,0 +1,405 @@
+// Copyright 2017 the lostromos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tmplctlr
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	"k8s.io/apimachinery/pkg/util/jsonmergepatch"
+	"k8s.io/apimachinery/pkg/util/strategicpatch"
+	"k8s.io/apimachinery/pkg/util/yaml"
+	"k8s.io/client-go/discovery"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes/scheme"
+	restclient "k8s.io/client-go/rest"
+)
+
+// LastAppliedAnnotation holds the configuration an object was last applied
+// with. It is shared with kubectl apply so both can manage the same objects.
+const LastAppliedAnnotation = "kubectl.kubernetes.io/last-applied-configuration"
+
+// Actions reported in a Result
+const (
+	ActionCreated    = "created"
+	ActionConfigured = "configured"
+	ActionUnchanged  = "unchanged"
+	ActionDeleted    = "deleted"
+	ActionNotFound   = "not found"
+	ActionFailed     = "failed"
+)
+
+// Result describes what happened to a single object of a rendered template
+type Result struct {
+	Kind      string
+	Namespace string
+	Name      string
+	Action    string
+	Err       error
+}
+
+// String formats the result the way kubectl reports it
+func (r Result) String() string {
+	s := fmt.Sprintf("%s/%s %s", strings.ToLower(r.Kind), r.Name, r.Action)
+	if r.Err != nil {
+		s = fmt.Sprintf("%s: %s", s, r.Err)
+	}
+	return s
+}
+
+// DynamicClient is a KubeClient that applies every object of the rendered
+// templates through the kubernetes API, without needing a kubectl binary.
+// Objects are created if they don't exist and patched otherwise, like kubectl
+// apply does.
+type DynamicClient struct {
+	Namespace string // namespace for namespaced objects that don't specify one
+
+	resources func(obj *unstructured.Unstructured) (dynamic.ResourceInterface, error)
+}
+
+// NewDynamicClient builds a DynamicClient that discovers the available
+// resources from the cluster described by cfg.
+func NewDynamicClient(cfg *restclient.Config, ns string) (*DynamicClient, error) {
+	if ns == "" {
+		ns = metav1.NamespaceDefault
+	}
+	r, err := newResourceClients(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return &DynamicClient{
+		Namespace: ns,
+		resources: r.forObject,
+	}, nil
+}
+
+// InNamespace returns a DynamicClient that puts namespaced objects without a
+// namespace into ns
+func (d *DynamicClient) InNamespace(ns string) *DynamicClient {
+	c := *d
+	c.Namespace = ns
+	return &c
+}
+
+// Apply will create or update every object in the file
+func (d *DynamicClient) Apply(file string) (string, error) {
+	return d.run(file, d.ApplyManifest)
+}
+
+// Delete will delete every object in the file
+func (d *DynamicClient) Delete(file string) (string, error) {
+	return d.run(file, d.DeleteManifest)
+}
+
+func (d *DynamicClient) run(file string, f func(io.Reader) ([]Result, error)) (string, error) {
+	in, err := os.Open(file) // nolint: gosec
+	if err != nil {
+		return "", err
+	}
+	defer in.Close() // nolint: errcheck
+	res, err := f(in)
+	return formatResults(res), err
+}
+
+func formatResults(res []Result) string {
+	var out bytes.Buffer
+	for _, r := range res {
+		fmt.Fprintln(&out, r.String())
+	}
+	return out.String()
+}
+
+// ApplyManifest creates or updates every object in the multi document YAML
+// manifest and reports the result for each of them.
+func (d *DynamicClient) ApplyManifest(manifest io.Reader) ([]Result, error) {
+	objs, err := ParseManifest(manifest)
+	if err != nil {
+		return nil, err
+	}
+	return d.each(objs, d.applyObject)
+}
+
+// DeleteManifest deletes every object in the multi document YAML manifest and
+// reports the result for each of them. Objects that don't exist are skipped.
+func (d *DynamicClient) DeleteManifest(manifest io.Reader) ([]Result, error) {
+	objs, err := ParseManifest(manifest)
+	if err != nil {
+		return nil, err
+	}
+	return d.each(objs, d.deleteObject)
+}
+
+func (d *DynamicClient) each(objs []*unstructured.Unstructured, f func(*unstructured.Unstructured) (string, error)) ([]Result, error) {
+	res := make([]Result, 0, len(objs))
+	var errs []error
+	for _, obj := range objs {
+		action, err := f(obj)
+		if err != nil {
+			action = ActionFailed
+			errs = append(errs, fmt.Errorf("%s/%s: %s", strings.ToLower(obj.GetKind()), obj.GetName(), err))
+		}
+		res = append(res, Result{
+			Kind:      obj.GetKind(),
+			Namespace: obj.GetNamespace(),
+			Name:      obj.GetName(),
+			Action:    action,
+			Err:       err,
+		})
+	}
+	return res, utilerrors.NewAggregate(errs)
+}
+
+func (d *DynamicClient) applyObject(obj *unstructured.Unstructured) (string, error) {
+	ri, err := d.resourceFor(obj)
+	if err != nil {
+		return "", err
+	}
+	modified, err := setLastApplied(obj)
+	if err != nil {
+		return "", err
+	}
+	live, err := ri.Get(obj.GetName(), metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		_, err = ri.Create(obj)
+		return ActionCreated, err
+	}
+	if err != nil {
+		return "", err
+	}
+	current, err := json.Marshal(live.Object)
+	if err != nil {
+		return "", err
+	}
+	original := []byte(live.GetAnnotations()[LastAppliedAnnotation])
+	pt, patch, err := threeWayPatch(obj.GroupVersionKind(), original, modified, current)
+	if err != nil {
+		return "", err
+	}
+	if string(patch) == "{}" {
+		return ActionUnchanged, nil
+	}
+	_, err = ri.Patch(obj.GetName(), pt, patch)
+	return ActionConfigured, err
+}
+
+// setLastApplied stores the configuration of obj in its LastAppliedAnnotation
+// and returns the resulting object as JSON
+func setLastApplied(obj *unstructured.Unstructured) ([]byte, error) {
+	annotations := map[string]string{}
+	for k, v := range obj.GetAnnotations() {
+		if k != LastAppliedAnnotation {
+			annotations[k] = v
+		}
+	}
+	if metadata, ok := obj.Object["metadata"].(map[string]interface{}); ok && len(annotations) == 0 {
+		delete(metadata, "annotations")
+	} else {
+		obj.SetAnnotations(annotations)
+	}
+	applied, err := json.Marshal(obj.Object)
+	if err != nil {
+		return nil, err
+	}
+	annotations[LastAppliedAnnotation] = string(applied)
+	obj.SetAnnotations(annotations)
+	return json.Marshal(obj.Object)
+}
+
+// threeWayPatch computes the patch from the last applied configuration to the
+// modified one, keeping changes made by others on the current object. Built in
+// kinds get a strategic merge patch, other kinds, e.g. custom resources, a JSON
+// merge patch.
+func threeWayPatch(gvk schema.GroupVersionKind, original, modified, current []byte) (types.PatchType, []byte, error) {
+	versioned, err := scheme.Scheme.New(gvk)
+	if runtime.IsNotRegisteredError(err) {
+		patch, err := jsonmergepatch.CreateThreeWayJSONMergePatch(original, modified, current)
+		return types.MergePatchType, patch, err
+	}
+	if err != nil {
+		return "", nil, err
+	}
+	patch, err := strategicpatch.CreateThreeWayMergePatch(original, modified, current, versioned, true)
+	return types.StrategicMergePatchType, patch, err
+}
+
+func (d *DynamicClient) deleteObject(obj *unstructured.Unstructured) (string, error) {
+	ri, err := d.resourceFor(obj)
+	if err != nil {
+		return "", err
+	}
+	err = ri.Delete(obj.GetName(), &metav1.DeleteOptions{})
+	if apierrors.IsNotFound(err) {
+		return ActionNotFound, nil
+	}
+	return ActionDeleted, err
+}
+
+func (d *DynamicClient) resourceFor(obj *unstructured.Unstructured) (dynamic.ResourceInterface, error) {
+	if obj.GetName() == "" {
+		return nil, fmt.Errorf("%s object has no name", obj.GetKind())
+	}
+	if obj.GetNamespace() == "" {
+		obj.SetNamespace(d.Namespace)
+	}
+	return d.resources(obj)
+}
+
+// ParseManifest splits a multi document YAML manifest into its objects. Empty
+// documents are skipped and the items of a List are returned individually.
+func ParseManifest(manifest io.Reader) ([]*unstructured.Unstructured, error) {
+	decoder := yaml.NewYAMLOrJSONDecoder(manifest, 4096)
+	var objs []*unstructured.Unstructured
+	for {
+		doc := map[string]interface{}{}
+		if err := decoder.Decode(&doc); err == io.EOF {
+			return objs, nil
+		} else if err != nil {
+			return nil, err
+		}
+		if len(doc) == 0 {
+			continue
+		}
+		obj := &unstructured.Unstructured{Object: doc}
+		if obj.GetKind() == "" {
+			return nil, fmt.Errorf("object %q has no kind", obj.GetName())
+		}
+		if obj.IsList() {
+			err := obj.EachListItem(func(item runtime.Object) error {
+				objs = append(objs, item.(*unstructured.Unstructured))
+				return nil
+			})
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+		objs = append(objs, obj)
+	}
+}
+
+// unknownKindTTL is how long a kind discovery didn't find is reported unknown
+// before discovery is asked again
+const unknownKindTTL = 30 * time.Second
+
+// resourceClients finds the resource for the kind of an object using discovery
+// and keeps a dynamic client for every group version.
+type resourceClients struct {
+	cfg       *restclient.Config
+	discovery discovery.DiscoveryInterface
+	now       func() time.Time
+
+	mu      sync.Mutex
+	mapper  meta.RESTMapper
+	unknown map[schema.GroupVersionKind]time.Time
+	clients map[schema.GroupVersion]*dynamic.Client
+}
+
+func newResourceClients(cfg *restclient.Config) (*resourceClients, error) {
+	dc, err := discovery.NewDiscoveryClientForConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return &resourceClients{
+		cfg:       cfg,
+		discovery: dc,
+		now:       time.Now,
+		unknown:   map[schema.GroupVersionKind]time.Time{},
+		clients:   map[schema.GroupVersion]*dynamic.Client{},
+	}, nil
+}
+
+func (r *resourceClients) forObject(obj *unstructured.Unstructured) (dynamic.ResourceInterface, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	gvk := obj.GroupVersionKind()
+	mapping, err := r.mapping(gvk)
+	if err != nil {
+		return nil, err
+	}
+	client, err := r.client(gvk.GroupVersion())
+	if err != nil {
+		return nil, err
+	}
+	namespaced := mapping.Scope.Name() == meta.RESTScopeNameNamespace
+	apiResource := &metav1.APIResource{
+		Name:       mapping.Resource,
+		Namespaced: namespaced,
+	}
+	ns := obj.GetNamespace()
+	if !namespaced {
+		ns = metav1.NamespaceNone
+	}
+	return client.Resource(apiResource, ns), nil
+}
+
+// mapping looks up the resource of a kind, refreshing the discovery
+// information if the kind is unknown, e.g. for a freshly created CRD. A kind
+// that is still unknown afterwards doesn't refresh again for unknownKindTTL.
+func (r *resourceClients) mapping(gvk schema.GroupVersionKind) (*meta.RESTMapping, error) {
+	if r.mapper != nil {
+		m, err := r.mapper.RESTMapping(gvk.GroupKind(), gvk.Version)
+		if err == nil {
+			return m, nil
+		}
+		if since, ok := r.unknown[gvk]; ok && r.now().Sub(since) < unknownKindTTL {
+			return nil, err
+		}
+	}
+	groupResources, err := discovery.GetAPIGroupResources(r.discovery)
+	if err != nil {
+		return nil, err
+	}
+	r.mapper = discovery.NewRESTMapper(groupResources, dynamic.VersionInterfaces)
+	m, err := r.mapper.RESTMapping(gvk.GroupKind(), gvk.Version)
+	if err != nil {
+		r.unknown[gvk] = r.now()
+		return nil, err
+	}
+	delete(r.unknown, gvk)
+	return m, nil
+}
+
+func (r *resourceClients) client(gv schema.GroupVersion) (*dynamic.Client, error) {
+	if c, ok := r.clients[gv]; ok {
+		return c, nil
+	}
+	cfg := *r.cfg
+	cfg.ContentConfig.GroupVersion = &gv
+	cfg.APIPath = "/apis"
+	if gv.Group == "" {
+		cfg.APIPath = "/api"
+	}
+	c, err := dynamic.NewClient(&cfg)
+	if err != nil {
+		return nil, err
+	}
+	r.clients[gv] = c
+	return c, nil
+}
@@ -0,0 +1,332 @@
+// Copyright 2017 the lostromos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tmplctlr
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	discoveryfake "k8s.io/client-go/discovery/fake"
+	"k8s.io/client-go/dynamic"
+	clienttesting "k8s.io/client-go/testing"
+)
+
+const testManifest = `
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: nemo
+data:
+  species: clownfish
+---
+# an empty document
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: dory
+  namespace: ocean
+data:
+  species: blue-tang
+`
+
+// fakeResource stores objects by name and implements the parts of
+// dynamic.ResourceInterface used by the DynamicClient
+type fakeResource struct {
+	dynamic.ResourceInterface
+	objects    map[string]*unstructured.Unstructured
+	patches    map[string]map[string]interface{}
+	patchTypes map[string]types.PatchType
+	err        error
+}
+
+func newFakeResource(objs ...string) *fakeResource {
+	f := &fakeResource{
+		objects:    map[string]*unstructured.Unstructured{},
+		patches:    map[string]map[string]interface{}{},
+		patchTypes: map[string]types.PatchType{},
+	}
+	for _, name := range objs {
+		obj := &unstructured.Unstructured{}
+		obj.SetName(name)
+		f.objects[name] = obj
+	}
+	return f
+}
+
+func (f *fakeResource) notFound(name string) error {
+	return apierrors.NewNotFound(schema.GroupResource{Resource: "configmaps"}, name)
+}
+
+func (f *fakeResource) Get(name string, opts metav1.GetOptions) (*unstructured.Unstructured, error) {
+	if f.err != nil {
+		return nil, f.err
+	}
+	obj, ok := f.objects[name]
+	if !ok {
+		return nil, f.notFound(name)
+	}
+	return obj, nil
+}
+
+func (f *fakeResource) Create(obj *unstructured.Unstructured) (*unstructured.Unstructured, error) {
+	f.objects[obj.GetName()] = obj
+	return obj, nil
+}
+
+func (f *fakeResource) Patch(name string, pt types.PatchType, data []byte) (*unstructured.Unstructured, error) {
+	patch := map[string]interface{}{}
+	if err := json.Unmarshal(data, &patch); err != nil {
+		return nil, err
+	}
+	f.patches[name] = patch
+	f.patchTypes[name] = pt
+	return f.objects[name], nil
+}
+
+func (f *fakeResource) Delete(name string, opts *metav1.DeleteOptions) error {
+	if _, ok := f.objects[name]; !ok {
+		return f.notFound(name)
+	}
+	delete(f.objects, name)
+	return nil
+}
+
+func newTestDynamicClient(f *fakeResource) *DynamicClient {
+	return &DynamicClient{
+		Namespace: "default",
+		resources: func(obj *unstructured.Unstructured) (dynamic.ResourceInterface, error) {
+			return f, nil
+		},
+	}
+}
+
+func TestParseManifest(t *testing.T) {
+	objs, err := ParseManifest(strings.NewReader(testManifest))
+	assert.Nil(t, err)
+	assert.Len(t, objs, 2)
+	assert.Equal(t, "nemo", objs[0].GetName())
+	assert.Equal(t, "ConfigMap", objs[0].GetKind())
+	assert.Equal(t, "dory", objs[1].GetName())
+	assert.Equal(t, "ocean", objs[1].GetNamespace())
+}
+
+func TestParseManifestExpandsLists(t *testing.T) {
+	list := `
+apiVersion: v1
+kind: List
+items:
+- apiVersion: v1
+  kind: ConfigMap
+  metadata:
+    name: nemo
+- apiVersion: v1
+  kind: Secret
+  metadata:
+    name: marlin
+`
+	objs, err := ParseManifest(strings.NewReader(list))
+	assert.Nil(t, err)
+	assert.Len(t, objs, 2)
+	assert.Equal(t, "ConfigMap", objs[0].GetKind())
+	assert.Equal(t, "Secret", objs[1].GetKind())
+}
+
+func TestParseManifestRequiresKind(t *testing.T) {
+	_, err := ParseManifest(strings.NewReader("metadata:\n  name: nemo\n"))
+	assert.NotNil(t, err)
+}
+
+func TestDynamicClientApplyManifest(t *testing.T) {
+	f := newFakeResource("dory")
+	d := newTestDynamicClient(f)
+
+	res, err := d.ApplyManifest(strings.NewReader(testManifest))
+	assert.Nil(t, err)
+	assert.Equal(t, []Result{
+		{Kind: "ConfigMap", Namespace: "default", Name: "nemo", Action: ActionCreated},
+		{Kind: "ConfigMap", Namespace: "ocean", Name: "dory", Action: ActionConfigured},
+	}, res)
+	assert.Equal(t, "default", f.objects["nemo"].GetNamespace())
+	assert.Equal(t, map[string]interface{}{"species": "blue-tang"}, f.patches["dory"]["data"])
+	assert.Contains(t, f.objects["nemo"].GetAnnotations(), LastAppliedAnnotation)
+}
+
+func TestDynamicClientApplyRemovesFieldsDroppedFromTheTemplate(t *testing.T) {
+	f := newFakeResource()
+	d := newTestDynamicClient(f)
+	_, err := d.ApplyManifest(strings.NewReader(`
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: nemo
+data:
+  species: clownfish
+  home: anemone
+`))
+	assert.Nil(t, err)
+
+	res, err := d.ApplyManifest(strings.NewReader(`
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: nemo
+data:
+  species: clownfish
+`))
+	assert.Nil(t, err)
+	assert.Equal(t, ActionConfigured, res[0].Action)
+	assert.Equal(t, types.StrategicMergePatchType, f.patchTypes["nemo"])
+	assert.Equal(t, map[string]interface{}{"home": nil}, f.patches["nemo"]["data"])
+}
+
+func TestDynamicClientApplyKeepsFieldsSetByOthers(t *testing.T) {
+	f := newFakeResource()
+	d := newTestDynamicClient(f)
+	_, err := d.ApplyManifest(strings.NewReader(testManifest))
+	assert.Nil(t, err)
+	f.objects["nemo"].Object["data"].(map[string]interface{})["home"] = "reef"
+
+	res, err := d.ApplyManifest(strings.NewReader(testManifest))
+	assert.Nil(t, err)
+	assert.Equal(t, ActionUnchanged, res[0].Action)
+	assert.Empty(t, f.patches)
+}
+
+func TestDynamicClientApplyMergePatchesCustomResources(t *testing.T) {
+	f := newFakeResource()
+	d := newTestDynamicClient(f)
+	cr := `
+apiVersion: stable.lostromos/v1
+kind: Character
+metadata:
+  name: nemo
+spec:
+  fins: %d
+`
+	_, err := d.ApplyManifest(strings.NewReader(fmt.Sprintf(cr, 1)))
+	assert.Nil(t, err)
+
+	res, err := d.ApplyManifest(strings.NewReader(fmt.Sprintf(cr, 2)))
+	assert.Nil(t, err)
+	assert.Equal(t, ActionConfigured, res[0].Action)
+	assert.Equal(t, types.MergePatchType, f.patchTypes["nemo"])
+	assert.Equal(t, map[string]interface{}{"fins": float64(2)}, f.patches["nemo"]["spec"])
+}
+
+func TestDynamicClientApplyManifestReportsFailures(t *testing.T) {
+	f := newFakeResource()
+	f.err = errors.New("connection refused")
+	d := newTestDynamicClient(f)
+
+	res, err := d.ApplyManifest(strings.NewReader(testManifest))
+	assert.NotNil(t, err)
+	assert.Len(t, res, 2)
+	for _, r := range res {
+		assert.Equal(t, ActionFailed, r.Action)
+		assert.Equal(t, f.err, r.Err)
+	}
+}
+
+func TestDynamicClientDeleteManifest(t *testing.T) {
+	f := newFakeResource("nemo")
+	d := newTestDynamicClient(f)
+
+	res, err := d.DeleteManifest(strings.NewReader(testManifest))
+	assert.Nil(t, err)
+	assert.Equal(t, ActionDeleted, res[0].Action)
+	assert.Equal(t, ActionNotFound, res[1].Action)
+	assert.Empty(t, f.objects)
+}
+
+func TestDynamicClientApplyFile(t *testing.T) {
+	file, err := ioutil.TempFile("", "lostromos")
+	assert.Nil(t, err)
+	defer os.Remove(file.Name()) // nolint: errcheck
+	_, err = file.WriteString(testManifest)
+	assert.Nil(t, err)
+	assert.Nil(t, file.Close())
+
+	d := newTestDynamicClient(newFakeResource("dory"))
+	out, err := d.Apply(file.Name())
+	assert.Nil(t, err)
+	assert.Equal(t, "configmap/nemo created\nconfigmap/dory configured\n", out)
+}
+
+func TestDynamicClientApplyMissingFile(t *testing.T) {
+	d := newTestDynamicClient(newFakeResource())
+	_, err := d.Apply("/i-dont-exist/manifest.yaml")
+	assert.NotNil(t, err)
+}
+
+// Objects of a deleted custom resource that are already gone, e.g. removed by
+// hand or by the garbage collector, must not fail the delete, otherwise the
+// finalizer of the custom resource is never removed.
+func TestResourceDeletedSucceedsWhenObjectsAreGone(t *testing.T) {
+	dir, err := ioutil.TempDir("", "template")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir) // nolint: errcheck
+	contents := `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: {{ .GetField "metadata" "name" }}
+`
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, "cm.tmpl"), []byte(contents), 0644))
+
+	c, err := NewController(dir, "", nil)
+	assert.Nil(t, err)
+	c.Client = newTestDynamicClient(newFakeResource())
+
+	r := &unstructured.Unstructured{}
+	r.SetName("nemo")
+	assert.Nil(t, c.ResourceDeleted(r))
+}
+
+func TestResourceClientsCachesUnknownKinds(t *testing.T) {
+	fake := &discoveryfake.FakeDiscovery{Fake: &clienttesting.Fake{}}
+	now := time.Now()
+	r := &resourceClients{
+		discovery: fake,
+		now:       func() time.Time { return now },
+		unknown:   map[schema.GroupVersionKind]time.Time{},
+	}
+	gvk := schema.GroupVersionKind{Group: "stable.lostromos", Version: "v1", Kind: "Character"}
+
+	_, err := r.mapping(gvk)
+	assert.NotNil(t, err)
+	lookups := len(fake.Actions())
+	_, err = r.mapping(gvk)
+	assert.NotNil(t, err)
+	assert.Equal(t, lookups, len(fake.Actions()), "discovery ran again for an unknown kind")
+
+	now = now.Add(unknownKindTTL)
+	_, err = r.mapping(gvk)
+	assert.NotNil(t, err)
+	assert.True(t, len(fake.Actions()) > lookups, "discovery didn't run after the unknown kind expired")
+}
@@ -0,0 +1,222 @@
+// Copyright 2017 the lostromos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tmplctlr
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/ghodss/yaml"
+	"k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/kubernetes"
+)
+
+const inventoryKey = "objects"
+
+// ObjectRef identifies an object rendered from the templates
+type ObjectRef struct {
+	APIVersion string `json:"apiVersion"`
+	Kind       string `json:"kind"`
+	Namespace  string `json:"namespace,omitempty"`
+	Name       string `json:"name"`
+}
+
+func (o ObjectRef) String() string {
+	return fmt.Sprintf("%s/%s", strings.ToLower(o.Kind), o.Name)
+}
+
+// Inventory keeps track of the objects rendered for each custom resource, so
+// objects that stop being rendered can be deleted
+type Inventory interface {
+	Get(r *unstructured.Unstructured) ([]ObjectRef, error)
+	Set(r *unstructured.Unstructured, refs []ObjectRef) error
+	Delete(r *unstructured.Unstructured) error
+}
+
+// ConfigMapInventory stores the objects rendered for a custom resource in a
+// ConfigMap next to it. The ConfigMaps of cluster scoped custom resources are
+// stored in Namespace.
+type ConfigMapInventory struct {
+	Client    kubernetes.Interface
+	Namespace string
+}
+
+// Get returns the objects recorded for the custom resource
+func (i *ConfigMapInventory) Get(r *unstructured.Unstructured) ([]ObjectRef, error) {
+	ns, name := i.configMapFor(r)
+	cm, err := i.Client.CoreV1().ConfigMaps(ns).Get(name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var refs []ObjectRef
+	if data, ok := cm.Data[inventoryKey]; ok {
+		if err := json.Unmarshal([]byte(data), &refs); err != nil {
+			return nil, err
+		}
+	}
+	return refs, nil
+}
+
+// Set records the objects for the custom resource
+func (i *ConfigMapInventory) Set(r *unstructured.Unstructured, refs []ObjectRef) error {
+	data, err := json.Marshal(refs)
+	if err != nil {
+		return err
+	}
+	ns, name := i.configMapFor(r)
+	cms := i.Client.CoreV1().ConfigMaps(ns)
+	cm, err := cms.Get(name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		_, err = cms.Create(&v1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      name,
+				Namespace: ns,
+				Labels: map[string]string{
+					ManagedByLabel: ManagedByValue,
+				},
+			},
+			Data: map[string]string{inventoryKey: string(data)},
+		})
+		return err
+	}
+	if err != nil {
+		return err
+	}
+	if cm.Data == nil {
+		cm.Data = map[string]string{}
+	}
+	cm.Data[inventoryKey] = string(data)
+	_, err = cms.Update(cm)
+	return err
+}
+
+// Delete removes the record for the custom resource
+func (i *ConfigMapInventory) Delete(r *unstructured.Unstructured) error {
+	ns, name := i.configMapFor(r)
+	err := i.Client.CoreV1().ConfigMaps(ns).Delete(name, &metav1.DeleteOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil
+	}
+	return err
+}
+
+func (i *ConfigMapInventory) configMapFor(r *unstructured.Unstructured) (string, string) {
+	ns := r.GetNamespace()
+	if ns == "" {
+		ns = i.Namespace
+	}
+	// The group keeps kinds of the same name in different groups apart
+	kind := r.GroupVersionKind().GroupKind()
+	return ns, fmt.Sprintf("lostromos-%s-%s", strings.ToLower(kind.String()), r.GetName())
+}
+
+// manifestRefs returns the objects in a rendered manifest
+func manifestRefs(manifest []byte) ([]ObjectRef, error) {
+	objs, err := ParseManifest(bytes.NewReader(manifest))
+	if err != nil {
+		return nil, err
+	}
+	refs := make([]ObjectRef, 0, len(objs))
+	for _, obj := range objs {
+		refs = append(refs, ObjectRef{
+			APIVersion: obj.GetAPIVersion(),
+			Kind:       obj.GetKind(),
+			Namespace:  obj.GetNamespace(),
+			Name:       obj.GetName(),
+		})
+	}
+	return refs, nil
+}
+
+// staleRefs returns the objects in old that are not in current. Objects are
+// compared without the version of their API, so a template moving a kind to a
+// new apiVersion does not delete the object it just applied.
+func staleRefs(old, current []ObjectRef) []ObjectRef {
+	keep := make(map[objectKey]bool, len(current))
+	for _, ref := range current {
+		keep[ref.key()] = true
+	}
+	var stale []ObjectRef
+	for _, ref := range old {
+		if !keep[ref.key()] {
+			stale = append(stale, ref)
+		}
+	}
+	return stale
+}
+
+// objectKey identifies an object independent of the API version it is read with
+type objectKey struct {
+	Group     string
+	Kind      string
+	Namespace string
+	Name      string
+}
+
+// movedKinds are the kinds of the extensions group that are served by their
+// own group as well, the same object can be read from either of them
+var movedKinds = map[string]string{
+	"DaemonSet":         "apps",
+	"Deployment":        "apps",
+	"ReplicaSet":        "apps",
+	"NetworkPolicy":     "networking.k8s.io",
+	"Ingress":           "networking.k8s.io",
+	"PodSecurityPolicy": "policy",
+}
+
+func (o ObjectRef) key() objectKey {
+	group := schema.FromAPIVersionAndKind(o.APIVersion, o.Kind).Group
+	if moved, ok := movedKinds[o.Kind]; ok && group == "extensions" {
+		group = moved
+	}
+	return objectKey{
+		Group:     group,
+		Kind:      o.Kind,
+		Namespace: o.Namespace,
+		Name:      o.Name,
+	}
+}
+
+// writeRefs writes a manifest with just enough of every object to delete it
+func writeRefs(w io.Writer, refs []ObjectRef) error {
+	var out bytes.Buffer
+	for _, ref := range refs {
+		obj := &unstructured.Unstructured{}
+		obj.SetAPIVersion(ref.APIVersion)
+		obj.SetKind(ref.Kind)
+		if ref.Namespace != "" {
+			obj.SetNamespace(ref.Namespace)
+		}
+		obj.SetName(ref.Name)
+		doc, err := yaml.Marshal(obj.Object)
+		if err != nil {
+			return err
+		}
+		out.WriteString("---\n")
+		out.Write(doc)
+	}
+	_, err := w.Write(out.Bytes())
+	return err
+}
@@ -0,0 +1,128 @@
+// Copyright 2017 the lostromos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tmplctlr
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func testCR(ns, name string) *unstructured.Unstructured {
+	r := &unstructured.Unstructured{}
+	r.SetAPIVersion("stable.lostromos/v1")
+	r.SetKind("Character")
+	r.SetNamespace(ns)
+	r.SetName(name)
+	return r
+}
+
+func TestConfigMapInventory(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	inv := &ConfigMapInventory{Client: client, Namespace: "lostromos"}
+	r := testCR("ocean", "dory")
+	refs := []ObjectRef{
+		{APIVersion: "v1", Kind: "ConfigMap", Name: "dory-configmap"},
+		{APIVersion: "apps/v1", Kind: "Deployment", Namespace: "ocean", Name: "dory"},
+	}
+
+	got, err := inv.Get(r)
+	assert.Nil(t, err)
+	assert.Empty(t, got)
+
+	assert.Nil(t, inv.Set(r, refs))
+	cm, err := client.CoreV1().ConfigMaps("ocean").Get("lostromos-character.stable.lostromos-dory", metav1.GetOptions{})
+	assert.Nil(t, err)
+	assert.Equal(t, "lostromos", cm.Labels["app.kubernetes.io/managed-by"])
+
+	got, err = inv.Get(r)
+	assert.Nil(t, err)
+	assert.Equal(t, refs, got)
+
+	assert.Nil(t, inv.Set(r, refs[:1]))
+	got, err = inv.Get(r)
+	assert.Nil(t, err)
+	assert.Equal(t, refs[:1], got)
+
+	assert.Nil(t, inv.Delete(r))
+	assert.Nil(t, inv.Delete(r))
+	got, err = inv.Get(r)
+	assert.Nil(t, err)
+	assert.Empty(t, got)
+}
+
+func TestConfigMapInventoryClusterScoped(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	inv := &ConfigMapInventory{Client: client, Namespace: "lostromos"}
+
+	assert.Nil(t, inv.Set(testCR("", "nemo"), nil))
+	_, err := client.CoreV1().ConfigMaps("lostromos").Get("lostromos-character.stable.lostromos-nemo", metav1.GetOptions{})
+	assert.Nil(t, err)
+}
+
+func TestConfigMapInventoryNamesIncludeGroup(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	inv := &ConfigMapInventory{Client: client, Namespace: "lostromos"}
+	other := testCR("ocean", "dory")
+	other.SetAPIVersion("pixar.lostromos/v1")
+
+	assert.Nil(t, inv.Set(testCR("ocean", "dory"), []ObjectRef{{APIVersion: "v1", Kind: "ConfigMap", Name: "a"}}))
+	assert.Nil(t, inv.Set(other, []ObjectRef{{APIVersion: "v1", Kind: "ConfigMap", Name: "b"}}))
+	got, err := inv.Get(testCR("ocean", "dory"))
+	assert.Nil(t, err)
+	assert.Equal(t, []ObjectRef{{APIVersion: "v1", Kind: "ConfigMap", Name: "a"}}, got)
+}
+
+func TestStaleRefs(t *testing.T) {
+	a := ObjectRef{APIVersion: "v1", Kind: "ConfigMap", Name: "a"}
+	b := ObjectRef{APIVersion: "v1", Kind: "ConfigMap", Name: "b"}
+	c := ObjectRef{APIVersion: "v1", Kind: "Secret", Name: "a"}
+
+	assert.Equal(t, []ObjectRef{b, c}, staleRefs([]ObjectRef{a, b, c}, []ObjectRef{a}))
+	assert.Empty(t, staleRefs([]ObjectRef{a}, []ObjectRef{a, b}))
+	assert.Empty(t, staleRefs(nil, []ObjectRef{a}))
+}
+
+func TestStaleRefsIgnoresAPIVersion(t *testing.T) {
+	extensions := ObjectRef{APIVersion: "extensions/v1beta1", Kind: "Deployment", Namespace: "ocean", Name: "a"}
+	beta := ObjectRef{APIVersion: "apps/v1beta2", Kind: "Deployment", Namespace: "ocean", Name: "a"}
+	apps := ObjectRef{APIVersion: "apps/v1", Kind: "Deployment", Namespace: "ocean", Name: "a"}
+	other := ObjectRef{APIVersion: "example.com/v1", Kind: "Deployment", Namespace: "ocean", Name: "a"}
+
+	assert.Empty(t, staleRefs([]ObjectRef{extensions}, []ObjectRef{apps}))
+	assert.Empty(t, staleRefs([]ObjectRef{beta}, []ObjectRef{apps}))
+	assert.Equal(t, []ObjectRef{other}, staleRefs([]ObjectRef{other}, []ObjectRef{apps}))
+}
+
+func TestWriteRefs(t *testing.T) {
+	refs := []ObjectRef{
+		{APIVersion: "v1", Kind: "ConfigMap", Name: "a"},
+		{APIVersion: "apps/v1", Kind: "Deployment", Namespace: "ocean", Name: "b"},
+	}
+	var buf bytes.Buffer
+	assert.Nil(t, writeRefs(&buf, refs))
+
+	objs, err := ParseManifest(&buf)
+	assert.Nil(t, err)
+	assert.Len(t, objs, 2)
+	assert.Equal(t, "ConfigMap", objs[0].GetKind())
+	assert.Equal(t, "", objs[0].GetNamespace())
+	assert.Equal(t, "ocean", objs[1].GetNamespace())
+	assert.Equal(t, "apps/v1", objs[1].GetAPIVersion())
+}
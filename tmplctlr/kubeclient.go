@@ -39,18 +39,19 @@ func (k Kubectl) Apply(file string) (string, error) {
 	return k.kubectlExec(file, "apply")
 }
 
-// Delete will execute kubectl delete -f file with the correct config
+// Delete will execute kubectl delete -f file with the correct config. Objects
+// that are already gone are skipped, so deleting them again succeeds.
 func (k Kubectl) Delete(file string) (string, error) {
-	return k.kubectlExec(file, "delete")
+	return k.kubectlExec(file, "delete", "--ignore-not-found")
 }
 
-// Delete will execute kubectl delete -f file with the correct config
-func (k Kubectl) kubectlExec(file, cmd string) (string, error) {
+func (k Kubectl) kubectlExec(file, cmd string, flags ...string) (string, error) {
 	if k.ConfigFile != "" {
 		if err := os.Setenv("KUBECONFIG", k.ConfigFile); err != nil {
 			return "", err
 		}
 	}
-	out, err := execCommand("kubectl", cmd, "-f", file).CombinedOutput()
+	args := append(append([]string{cmd}, flags...), "-f", file)
+	out, err := execCommand("kubectl", args...).CombinedOutput()
 	return string(out[:]), err
 }
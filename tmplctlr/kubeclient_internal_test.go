@@ -80,7 +80,7 @@ func TestKubectlDelete(t *testing.T) {
 	k := &Kubectl{}
 	out, err := k.Delete("path")
 	assert.Nil(t, err)
-	assert.Equal(t, "[kubectl delete -f path]", out)
+	assert.Equal(t, "[kubectl delete --ignore-not-found -f path]", out)
 }
 
 func TestKubectlDeleteConfigFile(t *testing.T) {
@@ -91,7 +91,7 @@ func TestKubectlDeleteConfigFile(t *testing.T) {
 	out, err := k.Delete("path")
 	assert.Nil(t, err)
 	assert.Equal(t, "some_file", os.Getenv("KUBECONFIG"))
-	assert.Equal(t, "[kubectl delete -f path]", out)
+	assert.Equal(t, "[kubectl delete --ignore-not-found -f path]", out)
 }
 
 func TestKubectlDeleteCmdError(t *testing.T) {
@@ -101,5 +101,5 @@ func TestKubectlDeleteCmdError(t *testing.T) {
 	k := &Kubectl{}
 	out, err := k.Delete("ERROR")
 	assert.NotNil(t, err)
-	assert.Equal(t, "[kubectl delete -f ERROR]", out)
+	assert.Equal(t, "[kubectl delete --ignore-not-found -f ERROR]", out)
 }
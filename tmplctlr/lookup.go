@@ -0,0 +1,82 @@
+// Copyright 2017 the lostromos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tmplctlr
+
+import (
+	"fmt"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/client-go/dynamic"
+	restclient "k8s.io/client-go/rest"
+)
+
+// DynamicLookup is a tmpl.Lookup that reads objects through the kubernetes
+// API. It only ever gets and lists objects.
+type DynamicLookup struct {
+	resources func(obj *unstructured.Unstructured) (dynamic.ResourceInterface, error)
+}
+
+// NewDynamicLookup builds a DynamicLookup that discovers the available
+// resources from the cluster described by cfg.
+func NewDynamicLookup(cfg *restclient.Config) (*DynamicLookup, error) {
+	r, err := newResourceClients(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return &DynamicLookup{resources: r.forObject}, nil
+}
+
+// Lookup gets the named object, or lists the objects of the kind if name is
+// empty. Missing objects are returned as an empty map.
+func (d *DynamicLookup) Lookup(apiVersion, kind, namespace, name string) (map[string]interface{}, error) {
+	obj := &unstructured.Unstructured{}
+	obj.SetAPIVersion(apiVersion)
+	obj.SetKind(kind)
+	obj.SetNamespace(namespace)
+	ri, err := d.resources(obj)
+	if err != nil {
+		return nil, err
+	}
+	if name != "" {
+		found, err := ri.Get(name, metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			return map[string]interface{}{}, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		return found.Object, nil
+	}
+	res, err := ri.List(metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	list, ok := res.(*unstructured.UnstructuredList)
+	if !ok {
+		return nil, fmt.Errorf("unexpected list type %T", res)
+	}
+	items := make([]interface{}, 0, len(list.Items))
+	for _, item := range list.Items {
+		items = append(items, item.Object)
+	}
+	out := map[string]interface{}{}
+	for k, v := range list.Object {
+		out[k] = v
+	}
+	out["items"] = items
+	return out, nil
+}
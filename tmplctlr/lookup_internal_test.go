@@ -0,0 +1,96 @@
+// Copyright 2017 the lostromos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tmplctlr
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/dynamic"
+)
+
+// listResource adds listing to the fakeResource
+type listResource struct {
+	*fakeResource
+}
+
+func (l listResource) List(opts metav1.ListOptions) (runtime.Object, error) {
+	if l.err != nil {
+		return nil, l.err
+	}
+	list := &unstructured.UnstructuredList{Object: map[string]interface{}{"kind": "ConfigMapList"}}
+	for _, obj := range l.objects {
+		list.Items = append(list.Items, *obj)
+	}
+	return list, nil
+}
+
+func newTestLookup(f *fakeResource) (*DynamicLookup, *unstructured.Unstructured) {
+	var requested unstructured.Unstructured
+	return &DynamicLookup{
+		resources: func(obj *unstructured.Unstructured) (dynamic.ResourceInterface, error) {
+			requested = *obj
+			return listResource{f}, nil
+		},
+	}, &requested
+}
+
+func TestDynamicLookupGetsObject(t *testing.T) {
+	f := newFakeResource()
+	f.objects["nemo"] = &unstructured.Unstructured{Object: map[string]interface{}{
+		"data": map[string]interface{}{"species": "clownfish"},
+	}}
+	l, requested := newTestLookup(f)
+
+	obj, err := l.Lookup("v1", "ConfigMap", "ocean", "nemo")
+	assert.Nil(t, err)
+	assert.Equal(t, f.objects["nemo"].Object, obj)
+	assert.Equal(t, "ConfigMap", requested.GetKind())
+	assert.Equal(t, "v1", requested.GetAPIVersion())
+	assert.Equal(t, "ocean", requested.GetNamespace())
+}
+
+func TestDynamicLookupReturnsEmptyMapIfNotFound(t *testing.T) {
+	l, _ := newTestLookup(newFakeResource())
+
+	obj, err := l.Lookup("v1", "ConfigMap", "ocean", "nemo")
+	assert.Nil(t, err)
+	assert.Empty(t, obj)
+	assert.NotNil(t, obj)
+}
+
+func TestDynamicLookupListsObjects(t *testing.T) {
+	l, _ := newTestLookup(newFakeResource("nemo"))
+
+	obj, err := l.Lookup("v1", "ConfigMap", "", "")
+	assert.Nil(t, err)
+	assert.Equal(t, "ConfigMapList", obj["kind"])
+	assert.Len(t, obj["items"], 1)
+}
+
+func TestDynamicLookupReturnsErrors(t *testing.T) {
+	f := newFakeResource()
+	f.err = errors.New("forbidden")
+	l, _ := newTestLookup(f)
+
+	_, err := l.Lookup("v1", "ConfigMap", "ocean", "nemo")
+	assert.NotNil(t, err)
+	_, err = l.Lookup("v1", "ConfigMap", "ocean", "")
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,102 @@
+// Copyright 2017 the lostromos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tmplctlr
+
+import (
+	"bytes"
+
+	"github.com/ghodss/yaml"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+
+	"github.com/lostromos/lostromos/crhash"
+)
+
+// Standard labels set on the objects managed by Lostromos
+const (
+	ManagedByLabel = "app.kubernetes.io/managed-by"
+	ManagedByValue = "lostromos"
+)
+
+// setOwner labels every object in the manifest as managed by Lostromos and
+// annotates it with the key and kind of the custom resource. With ownerRefs
+// the custom resource also becomes the owner of the objects, so kubernetes
+// garbage collects them when the custom resource is deleted. Owner references can't
+// cross namespaces, so objects in a different namespace than a namespaced
+// custom resource don't get one.
+func setOwner(manifest []byte, r *unstructured.Unstructured, ownerRefs bool) ([]byte, error) {
+	objs, err := ParseManifest(bytes.NewReader(manifest))
+	if err != nil {
+		return nil, err
+	}
+	ownerKind := r.GroupVersionKind().GroupKind()
+	var out bytes.Buffer
+	for _, obj := range objs {
+		labels := obj.GetLabels()
+		if labels == nil {
+			labels = map[string]string{}
+		}
+		labels[ManagedByLabel] = ManagedByValue
+		obj.SetLabels(labels)
+
+		annotations := obj.GetAnnotations()
+		if annotations == nil {
+			annotations = map[string]string{}
+		}
+		annotations[OwnerAnnotation] = crhash.Key(r)
+		annotations[OwnerKindAnnotation] = ownerKind.String()
+		obj.SetAnnotations(annotations)
+
+		if ownerRefs && ownedBy(obj, r) {
+			obj.SetOwnerReferences(withOwner(obj.GetOwnerReferences(), ownerReference(r)))
+		}
+		doc, err := yaml.Marshal(obj.Object)
+		if err != nil {
+			return nil, err
+		}
+		out.WriteString("---\n")
+		out.Write(doc)
+	}
+	return out.Bytes(), nil
+}
+
+func ownedBy(obj, r *unstructured.Unstructured) bool {
+	if r.GetUID() == "" {
+		return false
+	}
+	return r.GetNamespace() == "" || obj.GetNamespace() == r.GetNamespace()
+}
+
+func ownerReference(r *unstructured.Unstructured) metav1.OwnerReference {
+	controller := true
+	return metav1.OwnerReference{
+		APIVersion: r.GetAPIVersion(),
+		Kind:       r.GetKind(),
+		Name:       r.GetName(),
+		UID:        r.GetUID(),
+		Controller: &controller,
+	}
+}
+
+// withOwner adds the owner to refs, replacing an existing reference to it
+func withOwner(refs []metav1.OwnerReference, owner metav1.OwnerReference) []metav1.OwnerReference {
+	for i, ref := range refs {
+		if ref.UID == owner.UID {
+			refs[i] = owner
+			return refs
+		}
+	}
+	return append(refs, owner)
+}
@@ -0,0 +1,115 @@
+// Copyright 2017 the lostromos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tmplctlr
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+const ownerTestManifest = `---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: same-namespace
+  namespace: ocean
+  labels:
+    app: nemo
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: other-namespace
+  namespace: reef
+`
+
+func ownerTestCR(ns string) *unstructured.Unstructured {
+	r := &unstructured.Unstructured{}
+	r.SetAPIVersion("stable.lostromos/v1")
+	r.SetKind("Character")
+	r.SetNamespace(ns)
+	r.SetName("nemo")
+	r.SetUID("1234")
+	return r
+}
+
+func TestSetOwner(t *testing.T) {
+	out, err := setOwner([]byte(ownerTestManifest), ownerTestCR("ocean"), true)
+	assert.Nil(t, err)
+	objs, err := ParseManifest(bytes.NewReader(out))
+	assert.Nil(t, err)
+	assert.Len(t, objs, 2)
+
+	assert.Equal(t, map[string]string{"app": "nemo", ManagedByLabel: ManagedByValue}, objs[0].GetLabels())
+	refs := objs[0].GetOwnerReferences()
+	assert.Len(t, refs, 1)
+	assert.Equal(t, "stable.lostromos/v1", refs[0].APIVersion)
+	assert.Equal(t, "Character", refs[0].Kind)
+	assert.Equal(t, "nemo", refs[0].Name)
+	assert.Equal(t, "1234", string(refs[0].UID))
+	assert.True(t, *refs[0].Controller)
+
+	assert.Equal(t, map[string]string{ManagedByLabel: ManagedByValue}, objs[1].GetLabels())
+	assert.Empty(t, objs[1].GetOwnerReferences())
+
+	for _, obj := range objs {
+		assert.Equal(t, "ocean/nemo", obj.GetAnnotations()[OwnerAnnotation])
+		assert.Equal(t, "Character.stable.lostromos", obj.GetAnnotations()[OwnerKindAnnotation])
+	}
+}
+
+func TestSetOwnerWithoutOwnerReferences(t *testing.T) {
+	out, err := setOwner([]byte(ownerTestManifest), ownerTestCR(""), false)
+	assert.Nil(t, err)
+	objs, err := ParseManifest(bytes.NewReader(out))
+	assert.Nil(t, err)
+	for _, obj := range objs {
+		assert.Empty(t, obj.GetOwnerReferences())
+		assert.Equal(t, ManagedByValue, obj.GetLabels()[ManagedByLabel])
+		assert.Equal(t, "nemo", obj.GetAnnotations()[OwnerAnnotation])
+	}
+}
+
+func TestSetOwnerClusterScoped(t *testing.T) {
+	out, err := setOwner([]byte(ownerTestManifest), ownerTestCR(""), true)
+	assert.Nil(t, err)
+	objs, err := ParseManifest(bytes.NewReader(out))
+	assert.Nil(t, err)
+	for _, obj := range objs {
+		assert.Len(t, obj.GetOwnerReferences(), 1)
+	}
+}
+
+func TestSetOwnerWithoutUID(t *testing.T) {
+	r := ownerTestCR("ocean")
+	r.SetUID("")
+	out, err := setOwner([]byte(ownerTestManifest), r, true)
+	assert.Nil(t, err)
+	objs, err := ParseManifest(bytes.NewReader(out))
+	assert.Nil(t, err)
+	assert.Empty(t, objs[0].GetOwnerReferences())
+	assert.Equal(t, ManagedByValue, objs[0].GetLabels()[ManagedByLabel])
+}
+
+func TestWithOwnerReplacesExistingReference(t *testing.T) {
+	other := metav1.OwnerReference{Name: "other", UID: "1"}
+	owner := metav1.OwnerReference{Name: "nemo", UID: "2"}
+	refs := withOwner([]metav1.OwnerReference{other, {Name: "old", UID: "2"}}, owner)
+	assert.Equal(t, []metav1.OwnerReference{other, owner}, refs)
+}
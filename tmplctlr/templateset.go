@@ -0,0 +1,177 @@
+// Copyright 2017 the lostromos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tmplctlr
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+
+	"github.com/lostromos/lostromos/schema"
+	"github.com/lostromos/lostromos/tmpl"
+)
+
+// TemplateAnnotation picks the template set of a custom resource, the name of
+// a subdirectory of the templates directory
+const TemplateAnnotation = "lostromos.io/template"
+
+// templateSet returns the name of the template set for the custom resource
+func (c Controller) templateSet(r *unstructured.Unstructured) string {
+	if name, ok := r.GetAnnotations()[TemplateAnnotation]; ok {
+		return name
+	}
+	return c.TemplateSet
+}
+
+// strict reports whether the template set is executed in strict mode, see
+// tmpl.Template.ExecuteStrict
+func (c Controller) strict(set string) bool {
+	if c.Strict {
+		return true
+	}
+	for _, name := range c.StrictTemplateSets {
+		if name == set {
+			return true
+		}
+	}
+	return false
+}
+
+// templatePath returns the glob of the templates of the template set
+func (c Controller) templatePath(set string) (string, error) {
+	if set == "" {
+		return filepath.Join(c.templateDir, "*.tmpl"), nil
+	}
+	if set != filepath.Base(set) || set == "." || set == ".." {
+		return "", fmt.Errorf("invalid template set %q", set)
+	}
+	dir := filepath.Join(c.templateDir, set)
+	if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+		return "", fmt.Errorf("template set %q does not exist", set)
+	}
+	return filepath.Join(dir, "*.tmpl"), nil
+}
+
+// SchemaFile is the name of the JSON Schema the spec of custom resources is
+// validated against before the templates next to it are rendered
+const SchemaFile = "schema.json"
+
+// parsedSet is a parsed template set
+type parsedSet struct {
+	templates *tmpl.Template
+	schema    *schema.Schema // nil without a SchemaFile
+}
+
+// parseSet parses the templates matching pattern and the schema next to them
+func parseSet(pattern string) (*parsedSet, error) {
+	dir := filepath.Dir(pattern)
+	t, err := tmpl.ParseFiles(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("invalid templates in %s: %s", dir, err)
+	}
+	s, err := schema.Load(filepath.Join(dir, SchemaFile))
+	if err != nil {
+		return nil, err
+	}
+	return &parsedSet{templates: t, schema: s}, nil
+}
+
+// templateCache holds every parsed template set, so they are only parsed again
+// when they are reloaded. Template sets created after the last load are parsed
+// when they are first used.
+type templateCache struct {
+	mu   sync.RWMutex
+	sets map[string]*parsedSet // by glob pattern
+}
+
+func newTemplateCache() *templateCache {
+	return &templateCache{sets: map[string]*parsedSet{}}
+}
+
+// get returns the parsed template set of the templates matching pattern
+func (c *templateCache) get(pattern string) (*parsedSet, error) {
+	c.mu.RLock()
+	set, ok := c.sets[pattern]
+	c.mu.RUnlock()
+	if ok {
+		return set, nil
+	}
+	set, err := parseSet(pattern)
+	if err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.sets[pattern] = set
+	return set, nil
+}
+
+// load parses the templates in dir and in each of its template sets. The cache
+// is only updated if all of them parse.
+func (c *templateCache) load(dir string) error {
+	patterns, err := templatePatterns(dir)
+	if err != nil {
+		return err
+	}
+	sets := make(map[string]*parsedSet, len(patterns))
+	for _, pattern := range patterns {
+		set, err := parseSet(pattern)
+		if err != nil {
+			return err
+		}
+		sets[pattern] = set
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.sets = sets
+	return nil
+}
+
+// templatePatterns returns the glob patterns of the templates in dir and in
+// the template sets below it
+func templatePatterns(dir string) ([]string, error) {
+	info, err := os.Stat(dir)
+	if err != nil {
+		return nil, fmt.Errorf("templates directory %s does not exist", dir)
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("templates directory %s is not a directory", dir)
+	}
+	dirs := []string{dir}
+	subdirs, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, sub := range subdirs {
+		if sub.IsDir() {
+			dirs = append(dirs, filepath.Join(dir, sub.Name()))
+		}
+	}
+	var patterns []string
+	for _, d := range dirs {
+		pattern := filepath.Join(d, "*.tmpl")
+		if files, _ := filepath.Glob(pattern); len(files) > 0 {
+			patterns = append(patterns, pattern)
+		}
+	}
+	if len(patterns) == 0 {
+		return nil, fmt.Errorf("no *.tmpl files in templates directory %s", dir)
+	}
+	return patterns, nil
+}